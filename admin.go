@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// Posts checked per page of /admin/consistency (default and max).
+	CONSISTENCY_PAGE_SIZE     = 500
+	CONSISTENCY_MAX_PAGE_SIZE = 5000
+	// Ids listed per kind of problem in one report, the counts are always complete.
+	CONSISTENCY_MAX_IDS = 100
+
+	// Rows of /admin/export written between two flushes to the client.
+	EXPORT_FLUSH_ROWS = 500
+
+	AUDIT_EXPORT_POSTS = "export_posts"
+)
+
+// adminOnly wraps an (already JWT-checked) handler to reject non-admins with 403.
+func adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "Admin only", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//***************  CONSISTENCY CHECK (ES vs BigTable) ***************************
+// ConsistencyReport is one page of the comparison between ES and BigTable.
+type ConsistencyReport struct {
+	Source        string   `json:"source"`
+	Checked       int      `json:"checked"`
+	Missing       int      `json:"missing"`    // in BigTable, not in ES
+	Mismatched    int      `json:"mismatched"` // in both, with different fields
+	Extra         int      `json:"extra"`      // in ES, not in BigTable
+	Repaired      int      `json:"repaired"`
+	MissingIds    []string `json:"missing_ids,omitempty"`
+	MismatchedIds []string `json:"mismatched_ids,omitempty"`
+	ExtraIds      []string `json:"extra_ids,omitempty"`
+	// Pass it back as "cursor" to check the next page, empty when done.
+	Next string `json:"next"`
+}
+
+// GET /admin/consistency?source=bigtable|es&cursor=&limit=&repair=true
+//
+// source=bigtable (default) walks the BigTable rows and looks each post up in
+// ES, finding missing and mismatched docs. With repair=true they are indexed
+// again from BigTable, the source of truth.
+// source=es walks the ES docs and finds the ones without a BigTable row (extra),
+// these are only reported.
+//
+// It checks one page per call, follow "next" to scan everything.
+func consistencyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one consistency check request")
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	limit := CONSISTENCY_PAGE_SIZE
+	if val := query.Get("limit"); val != "" {
+		v, err := strconv.Atoi(val)
+		if err != nil || v <= 0 || v > CONSISTENCY_MAX_PAGE_SIZE {
+			http.Error(w, fmt.Sprintf("Invalid limit, it must be 1 to %d", CONSISTENCY_MAX_PAGE_SIZE), http.StatusBadRequest)
+			return
+		}
+		limit = v
+	}
+
+	ctx := context.Background()
+	var report *ConsistencyReport
+	var err error
+	switch query.Get("source") {
+	case "", "bigtable":
+		report, err = checkBigTablePage(ctx, query.Get("cursor"), limit, query.Get("repair") == "true")
+	case "es":
+		report, err = checkESPage(ctx, query.Get("cursor"), limit)
+	default:
+		http.Error(w, `Invalid source, use "bigtable" or "es"`, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Consistency check failed %v\n", err)
+		http.Error(w, "Consistency check failed", http.StatusInternalServerError)
+		return
+	}
+
+	if report.Repaired > 0 {
+		audit(r, AUDIT_REPAIR, "posts", fmt.Sprintf("reindexed %d posts from BigTable", report.Repaired))
+	}
+
+	js, err := json.Marshal(report)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(js)
+}
+
+// checkBigTablePage compares up to limit BigTable posts from the row key
+// cursor on, with their docs in ES.
+func checkBigTablePage(ctx context.Context, cursor string, limit int, repair bool) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{Source: "bigtable"}
+
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	// read one more row than needed, its key is where the next page starts
+	var posts []Post
+	err = bt_client.Open("post").ReadRows(ctx, bigtable.NewRange(cursor, ""), func(row bigtable.Row) bool {
+		if len(posts) == limit {
+			report.Next = row.Key()
+			return false
+		}
+		posts = append(posts, postFromRow(row))
+		return true
+	}, bigtable.LimitRows(int64(limit+1)), bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil || len(posts) == 0 {
+		return report, err
+	}
+	report.Checked = len(posts)
+
+	es_client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+	mget := es_client.MultiGet()
+	for _, p := range posts {
+		mget = mget.Add(elastic.NewMultiGetItem().Index(config.ESIndex).Type(config.ESType).Id(p.Id))
+	}
+	res, err := mget.Do()
+	if err != nil {
+		return nil, err
+	}
+	indexed := map[string]*Post{}
+	for _, doc := range res.Docs {
+		if !doc.Found || doc.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(*doc.Source, &p); err == nil {
+			indexed[doc.Id] = &p
+		}
+	}
+
+	for _, p := range posts {
+		doc, found := indexed[p.Id]
+		switch {
+		case !found:
+			report.Missing++
+			report.MissingIds = appendID(report.MissingIds, p.Id)
+		case !samePost(p, *doc):
+			report.Mismatched++
+			report.MismatchedIds = appendID(report.MismatchedIds, p.Id)
+			// rows written before the url was stored in BigTable, keep the indexed one
+			if p.Url == "" {
+				p.Url = doc.Url
+			}
+		default:
+			continue
+		}
+
+		if repair {
+			post := p
+			if err := searchIndex.Index(&post, p.Id); err != nil {
+				fmt.Printf("Failed to repair post %s %v\n", p.Id, err)
+				continue
+			}
+			report.Repaired++
+		}
+	}
+	return report, nil
+}
+
+// checkESPage finds the ES docs of one scroll page without a BigTable row.
+// The cursor is the ES scroll id, it expires after a minute without use.
+func checkESPage(ctx context.Context, cursor string, limit int) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{Source: "es"}
+
+	es_client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+	scroll := es_client.Scroll(config.ESIndex).Type(config.ESType).Size(limit).Scroll("1m")
+	if cursor != "" {
+		scroll = scroll.ScrollId(cursor)
+	}
+	res, err := scroll.Do()
+	if err == io.EOF {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Next = res.ScrollId
+
+	var ids []string
+	for _, hit := range res.Hits.Hits {
+		ids = append(ids, hit.Id)
+	}
+	report.Checked = len(ids)
+	if len(ids) == 0 {
+		report.Next = ""
+		return report, nil
+	}
+
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	stored := map[string]bool{}
+	err = bt_client.Open("post").ReadRows(ctx, bigtable.RowList(ids), func(row bigtable.Row) bool {
+		stored[row.Key()] = true
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !stored[id] {
+			report.Extra++
+			report.ExtraIds = appendID(report.ExtraIds, id)
+		}
+	}
+	return report, nil
+}
+
+// samePost compares what both stores keep of a post. BigTable rows written
+// before the url was stored have no url, it isn't compared then.
+func samePost(stored, indexed Post) bool {
+	return stored.User == indexed.User &&
+		stored.Message == indexed.Message &&
+		stored.Location == indexed.Location &&
+		stored.Created == indexed.Created &&
+		(stored.Url == "" || stored.Url == indexed.Url)
+}
+
+func appendID(ids []string, id string) []string {
+	if len(ids) < CONSISTENCY_MAX_IDS {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+//***************  ADMIN EXPORT (CSV) ***************************
+// exportPostsHandler streams every post of BigTable as CSV, for offline analysis:
+//
+//	GET /admin/export?format=csv&from=2024-01-01&to=2024-01-31
+//
+// from / to (optional, a date or RFC3339 time, to is inclusive) keep the posts
+// created in between. Posts older than the created field are only in an
+// export without range. Rows are written as they are read, nothing is held.
+func exportPostsHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one admin export request")
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "csv" {
+		http.Error(w, "Invalid format, only csv is supported", http.StatusBadRequest)
+		return
+	}
+	from, err := parseExportTime(query.Get("from"), false)
+	if err != nil {
+		http.Error(w, "Invalid from, use YYYY-MM-DD or RFC3339", http.StatusBadRequest)
+		return
+	}
+	to, err := parseExportTime(query.Get("to"), true)
+	if err != nil {
+		http.Error(w, "Invalid to, use YYYY-MM-DD or RFC3339", http.StatusBadRequest)
+		return
+	}
+	ranged := !from.IsZero() || !to.IsZero()
+
+	ctx := r.Context()
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		panic(err)
+	}
+	defer bt_client.Close()
+
+	audit(r, AUDIT_EXPORT_POSTS, "posts", r.URL.RawQuery)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="posts.csv"`)
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "user", "message", "lat", "lon", "created", "url"})
+
+	n := 0
+	err = bt_client.Open("post").ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		p := postFromRow(row)
+		created := time.Unix(p.Created, 0)
+		if ranged && (p.Created == 0 || (!from.IsZero() && created.Before(from)) || (!to.IsZero() && !created.Before(to))) {
+			return true
+		}
+		createdStr := ""
+		if p.Created != 0 {
+			createdStr = created.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			p.Id, p.User, p.Message,
+			strconv.FormatFloat(p.Location.Lat, 'f', -1, 64),
+			strconv.FormatFloat(p.Location.Lon, 'f', -1, 64),
+			createdStr, p.Url,
+		})
+		// push a chunk to the client now and then, not only at the end
+		if n++; n%EXPORT_FLUSH_ROWS == 0 {
+			cw.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return cw.Error() == nil
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	cw.Flush()
+	if err != nil || cw.Error() != nil {
+		// the status is sent already, the client sees a cut CSV
+		fmt.Printf("Admin export stopped after %d posts %v %v\n", n, err, cw.Error())
+		return
+	}
+	fmt.Printf("Admin export of %d posts done\n", n)
+}
+
+// parseExportTime reads a date (2024-01-31) or an RFC3339 time. A date as
+// the end of the range means the end of that day.
+func parseExportTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil && end {
+		t = t.Add(time.Second)
+	}
+	return t, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// Longest time range of one /admin/posts request.
+	MAX_ADMIN_POSTS_SPAN = 7 * 24 * time.Hour
+	// Posts read from ES per scroll page.
+	ADMIN_POSTS_PAGE_SIZE = 500
+)
+
+//***************  POSTS BY TIME (ADMIN) ***************************
+// adminPostsHandler streams every post created in [since, until) (unix
+// seconds), oldest first, as NDJSON: one {"id": ..., "user": ...} per line.
+// For analytics and backfills, e.g. a day of activity. ES 2.x has no
+// search_after, the posts are scrolled. A failure in the middle (headers
+// already sent) ends the stream with a {"error": "..."} line.
+//
+//	GET /admin/posts?since=1700000000&until=1700086400
+func adminPostsHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one admin posts request")
+	since, until, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to ES %v\n", err)
+		http.Error(w, "Failed to read posts", http.StatusInternalServerError)
+		return
+	}
+	scroll := es_client.Scroll(config.ESIndex).
+		Type(config.ESType).
+		Query(elastic.NewRangeQuery("created").Gte(since).Lt(until)).
+		Sort("created", true).
+		Size(ADMIN_POSTS_PAGE_SIZE).
+		Scroll("1m")
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	count := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("Failed to scroll posts %v\n", err)
+			enc.Encode(map[string]string{"error": "Failed to read posts: " + err.Error()})
+			return
+		}
+		if len(res.Hits.Hits) == 0 {
+			break
+		}
+		for _, hit := range res.Hits.Hits {
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				continue
+			}
+			p.Id = hit.Id
+			if err := enc.Encode(p); err != nil {
+				// the client went away
+				return
+			}
+			count++
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	fmt.Printf("Streamed %d posts from %d to %d\n", count, since, until)
+}
+
+// parseTimeRange reads since (required) and until (default now), unix
+// seconds, at most MAX_ADMIN_POSTS_SPAN apart.
+func parseTimeRange(r *http.Request) (since, until int64, err error) {
+	query := r.URL.Query()
+	if since, err = strconv.ParseInt(query.Get("since"), 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("Invalid since, it must be a unix time in seconds")
+	}
+	until = time.Now().Unix()
+	if val := query.Get("until"); val != "" {
+		if until, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid until, it must be a unix time in seconds")
+		}
+	}
+	if until <= since {
+		return 0, 0, fmt.Errorf("until must be after since")
+	}
+	if time.Duration(until-since)*time.Second > MAX_ADMIN_POSTS_SPAN {
+		return 0, 0, fmt.Errorf("The range can be at most %d days, split it", int(MAX_ADMIN_POSTS_SPAN.Hours()/24))
+	}
+	return since, until, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	// Handles of anonymized users: ANON_PREFIX + ANON_HASH_BYTES bytes of hash, in hex.
+	ANON_PREFIX     = "anon-"
+	ANON_HASH_BYTES = 6
+)
+
+//***************  ANONYMIZED SEARCH ***************************
+// With ANONYMIZE_USERS, /search shows every author but the caller as a
+// pseudonymous handle: the same user gets the same handle in every search
+// (their posts still read as one person's), but it doesn't tell who they
+// are. Admins see the real users. Storage keeps the real user.
+//
+// The handle is an HMAC with ANONYMIZE_USERS_SALT: a plain hash of the
+// username could be reversed by hashing every known username.
+
+// anonymizeResults replaces the authors of the results (and their profile,
+// which would give them away) for viewer, unless admin.
+func anonymizeResults(results []PostResult, viewer string, admin bool) {
+	if !config.AnonymizeUsers || admin {
+		return
+	}
+	for i := range results {
+		res := &results[i]
+		if res.User == viewer {
+			continue
+		}
+		res.User = anonymousHandle(res.User)
+		res.DisplayName = res.User
+		res.AvatarURL = ""
+	}
+}
+
+// anonymousHandle is the stable pseudonym of username.
+func anonymousHandle(username string) string {
+	mac := hmac.New(sha256.New, []byte(config.AnonymizeSalt))
+	mac.Write([]byte(username))
+	return ANON_PREFIX + hex.EncodeToString(mac.Sum(nil)[:ANON_HASH_BYTES])
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// BigTable table of the API keys, row key: <key id>
+	// columns: apikey:name, apikey:hash (sha256 of the secret, hex),
+	// apikey:created, apikey:revoked (unix seconds, missing if active)
+	// Revoked keys stay, so the audit log and posts still make sense.
+	API_KEY_TABLE = "apikey"
+
+	API_KEY_HEADER = "X-API-Key"
+
+	// The key a service sends is <id>.<secret>
+	API_KEY_ID_LENGTH     = 10
+	API_KEY_SECRET_LENGTH = 40
+
+	// A service acts as the user "svc-<name>". checkUsername and
+	// checkExistingUsername refuse it, whatever USERNAME_PATTERN allows, so
+	// no real user can be mistaken for a service.
+	SERVICE_USER_PREFIX = "svc-"
+
+	AUDIT_CREATE_API_KEY = "create_api_key"
+	AUDIT_REVOKE_API_KEY = "revoke_api_key"
+)
+
+type APIKey struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// only returned when the key is created, it can't be read again
+	Key     string `json:"key,omitempty"`
+	Created int64  `json:"created"`
+	Revoked int64  `json:"revoked,omitempty"`
+	hash    string
+}
+
+//***************  API KEY MIDDLEWARE ***************************
+// apiKeyOrJWT lets a request in with a valid X-API-Key, as the service the
+// key belongs to, and falls back to jwtAuth otherwise. It is only used on the
+// routes services need, end-user clients keep using JWT.
+func apiKeyOrJWT(jwtAuth func(http.Handler) http.Handler, h http.Handler) http.Handler {
+	withJWT := jwtAuth(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(API_KEY_HEADER)
+		if key == "" {
+			withJWT.ServeHTTP(w, r)
+			return
+		}
+		k, err := checkAPIKey(r.Context(), key)
+		if err != nil {
+			fmt.Printf("Failed to check API key %v\n", err)
+			http.Error(w, "Failed to check API key", http.StatusInternalServerError)
+			return
+		}
+		if k == nil {
+			http.Error(w, "Invalid or revoked API key", http.StatusUnauthorized)
+			return
+		}
+		// the same shape as a checked JWT, so usernameFromToken just works
+		token := &jwt.Token{Claims: jwt.MapClaims{
+			"username": SERVICE_USER_PREFIX + k.Name,
+			"api_key":  k.Id,
+		}, Valid: true}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", token)))
+	})
+}
+
+// isService tells whether the caller came in with an API key.
+func isService(r *http.Request) bool {
+	return apiKeyID(r) != ""
+}
+
+// apiKeyID returns the id of the API key the caller came in with, "" for a JWT.
+func apiKeyID(r *http.Request) string {
+	user := r.Context().Value("user")
+	claims := user.(*jwt.Token).Claims
+	id, _ := claims.(jwt.MapClaims)["api_key"].(string)
+	return id
+}
+
+// adminOrService wraps a handler for admins and services only.
+func adminOrService(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) && !isService(r) {
+			http.Error(w, "Admin or API key only", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkAPIKey returns the key if it exists and is not revoked, nil otherwise.
+func checkAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, nil
+	}
+	k, err := getAPIKey(ctx, parts[0])
+	if err != nil || k == nil || k.Revoked != 0 {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(parts[1])), []byte(k.hash)) != 1 {
+		return nil, nil
+	}
+	return k, nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//***************  API KEY HANDLERS ***************************
+// createAPIKeyHandler makes a key for a service, {"name": "partner_x"}.
+// The key is in the response only, keep it then.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one create API key request")
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	// services act as svc-<name>, a user of sorts
+	var errs ValidationErrors
+	config.Policy.checkUsername(&errs, "name", body.Name)
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	id, err := randomBase62(API_KEY_ID_LENGTH)
+	if err != nil {
+		panic(err)
+	}
+	secret, err := randomBase62(API_KEY_SECRET_LENGTH)
+	if err != nil {
+		panic(err)
+	}
+	k := &APIKey{
+		Id:      id,
+		Name:    body.Name,
+		Key:     id + "." + secret,
+		Created: time.Now().Unix(),
+		hash:    hashAPIKeySecret(secret),
+	}
+	if err := saveAPIKey(context.Background(), k); err != nil {
+		fmt.Printf("Failed to save API key %v\n", err)
+		http.Error(w, "Failed to save API key", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_CREATE_API_KEY, k.Id, k.Name)
+
+	js, err := json.Marshal(k)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// listAPIKeysHandler lists the keys, revoked ones included (never the secrets).
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := listAPIKeys(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to read API keys %v\n", err)
+		http.Error(w, "Failed to read API keys", http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(keys)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// revokeAPIKeyHandler revokes a key, it is rejected from the next request on.
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	fmt.Printf("Received one revoke API key request %s\n", id)
+
+	ctx := context.Background()
+	k, err := getAPIKey(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read API key %s %v\n", id, err)
+		http.Error(w, "Failed to read API key", http.StatusInternalServerError)
+		return
+	}
+	if k == nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if k.Revoked == 0 {
+		if err := revokeAPIKey(ctx, id); err != nil {
+			fmt.Printf("Failed to revoke API key %s %v\n", id, err)
+			http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+			return
+		}
+		audit(r, AUDIT_REVOKE_API_KEY, id, k.Name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//***************  API KEY STORE ***************************
+func saveAPIKey(ctx context.Context, k *APIKey) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("apikey", "name", t, []byte(k.Name))
+	mut.Set("apikey", "hash", t, []byte(k.hash))
+	mut.Set("apikey", "created", t, []byte(strconv.FormatInt(k.Created, 10)))
+	return bt_client.Open(API_KEY_TABLE).Apply(ctx, k.Id, mut)
+}
+
+// getAPIKey returns the key with this id, or nil if there is none.
+func getAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	row, err := bt_client.Open(API_KEY_TABLE).ReadRow(ctx, id, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil || len(row) == 0 {
+		return nil, err
+	}
+	return apiKeyFromRow(row), nil
+}
+
+func listAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	keys := []*APIKey{}
+	err = bt_client.Open(API_KEY_TABLE).ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		keys = append(keys, apiKeyFromRow(row))
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return keys, err
+}
+
+func apiKeyFromRow(row bigtable.Row) *APIKey {
+	k := &APIKey{Id: row.Key()}
+	for _, item := range row["apikey"] {
+		val := string(item.Value)
+		switch item.Column {
+		case "apikey:name":
+			k.Name = val
+		case "apikey:hash":
+			k.hash = val
+		case "apikey:created":
+			k.Created, _ = strconv.ParseInt(val, 10, 64)
+		case "apikey:revoked":
+			k.Revoked, _ = strconv.ParseInt(val, 10, 64)
+		}
+	}
+	return k
+}
+
+func revokeAPIKey(ctx context.Context, id string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.Set("apikey", "revoked", bigtable.Now(), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	return bt_client.Open(API_KEY_TABLE).Apply(ctx, id, mut)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	DEFAULT_AREA_USERS = 50
+	MAX_AREA_USERS     = 500
+
+	AREA_USERS_SORT_POSTS    = "posts"
+	AREA_USERS_SORT_USERNAME = "username"
+)
+
+// AreaUser is one user of /area/users, with how many posts they made in the area.
+type AreaUser struct {
+	Username string `json:"username"`
+	Posts    int64  `json:"posts"`
+}
+
+//***************  AREA USERS ***************************
+// areaUsersHandler lists the distinct users who posted in an area (terms
+// aggregation on user), for community analytics. Same area params as /search,
+// since= limits it to the recent posts. Banned users and private users the
+// caller doesn't follow are left out.
+//
+//	GET /area/users?lat=37.7&lon=-122.4&range=5&since=1700000000&limit=50&sort=posts|username
+func areaUsersHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one area users request")
+	sp, err := parseSearchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := DEFAULT_AREA_USERS
+	if val := r.URL.Query().Get("limit"); val != "" {
+		v, err := strconv.Atoi(val)
+		if err != nil || v <= 0 || v > MAX_AREA_USERS {
+			http.Error(w, fmt.Sprintf("Invalid limit, it must be 1 to %d", MAX_AREA_USERS), http.StatusBadRequest)
+			return
+		}
+		limit = v
+	}
+	// twice the limit: some of them may be dropped below
+	agg := elastic.NewTermsAggregation().Field("user").Size(2 * limit)
+	// the busiest posters first by default
+	switch r.URL.Query().Get("sort") {
+	case "", AREA_USERS_SORT_POSTS:
+		agg = agg.OrderByCountDesc()
+	case AREA_USERS_SORT_USERNAME:
+		agg = agg.OrderByTermAsc()
+	default:
+		http.Error(w, "Invalid sort, it must be posts or username", http.StatusBadRequest)
+		return
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to ES %v\n", err)
+		http.Error(w, "Failed to read area users", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := esContext(ES_OP_SEARCH)
+	defer cancel()
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(buildFilterQuery(sp)).
+		Aggregation("users", agg).
+		Size(0).
+		DoC(ctx)
+	if err != nil {
+		if writeESTimeout(w, esError(ctx, ES_OP_SEARCH, err)) {
+			return
+		}
+		fmt.Printf("Failed to aggregate area users %v\n", err)
+		http.Error(w, "Failed to read area users", http.StatusInternalServerError)
+		return
+	}
+
+	var users []AreaUser
+	var names []string
+	if buckets, found := searchResult.Aggregations.Terms("users"); found {
+		for _, b := range buckets.Buckets {
+			if name, ok := b.Key.(string); ok {
+				users = append(users, AreaUser{Username: name, Posts: b.DocCount})
+				names = append(names, name)
+			}
+		}
+	}
+
+	users, err = visibleAreaUsers(context.Background(), usernameFromToken(r), users, names)
+	if err != nil {
+		fmt.Printf("Failed to filter area users %v\n", err)
+		http.Error(w, "Failed to read area users", http.StatusInternalServerError)
+		return
+	}
+	if len(users) > limit {
+		users = users[:limit]
+	}
+
+	js, err := marshalResponse(users, sp.Pretty)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// visibleAreaUsers drops the banned users and the private ones viewer can't
+// see, in order. Without the bans or profiles nobody can be told apart, so
+// it fails rather than list them all.
+func visibleAreaUsers(ctx context.Context, viewer string, users []AreaUser, names []string) ([]AreaUser, error) {
+	kept := []AreaUser{}
+	if len(users) == 0 {
+		return kept, nil
+	}
+	bans, err := getBans(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := getProfiles(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := visibleAuthors(ctx, viewer, profiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if bans[u.Username] == nil && visible[u.Username] {
+			kept = append(kept, u)
+		}
+	}
+	return kept, nil
+}
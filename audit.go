@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// BigTable table of the admin / moderation actions, newest first.
+	// row key: <reversed timestamp %019d>#<uuid>
+	// columns: audit:actor, audit:action, audit:target, audit:detail, audit:request_id
+	// Rows are only ever added, nothing in the service updates or deletes them.
+	AUDIT_TABLE = "audit"
+
+	AUDIT_DELETE_POST = "delete_post"
+	AUDIT_VERIFY_USER = "verify_user"
+	AUDIT_REPAIR      = "repair_consistency"
+
+	DEFAULT_AUDIT_PAGE_SIZE = 50
+	MAX_AUDIT_PAGE_SIZE     = 500
+)
+
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Detail    string    `json:"detail,omitempty"`
+	RequestId string    `json:"request_id"`
+}
+
+//***************  AUDIT LOG ***************************
+// audit records an admin action done by the caller of r. A failure is only
+// logged, the action itself is already done.
+func audit(r *http.Request, action, target, detail string) {
+	e := AuditEntry{
+		Time:      time.Now(),
+		Actor:     usernameFromToken(r),
+		Action:    action,
+		Target:    target,
+		Detail:    detail,
+		RequestId: requestID(r),
+	}
+	if err := appendAudit(context.Background(), &e); err != nil {
+		fmt.Printf("Failed to write audit log %+v %v\n", e, err)
+	}
+}
+
+func appendAudit(ctx context.Context, e *AuditEntry) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	key := fmt.Sprintf("%019d#%s", math.MaxInt64-e.Time.UnixNano(), uuid.New())
+	mut := bigtable.NewMutation()
+	t := bigtable.Time(e.Time)
+	mut.Set("audit", "actor", t, []byte(e.Actor))
+	mut.Set("audit", "action", t, []byte(e.Action))
+	mut.Set("audit", "target", t, []byte(e.Target))
+	mut.Set("audit", "detail", t, []byte(e.Detail))
+	mut.Set("audit", "request_id", t, []byte(e.RequestId))
+	return bt_client.Open(AUDIT_TABLE).Apply(ctx, key, mut)
+}
+
+// auditHandler lists the audit log, newest first, one page per call.
+//
+//	GET /admin/audit?limit=50&cursor=<next of the previous page>
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one audit log request")
+	query := r.URL.Query()
+	limit := DEFAULT_AUDIT_PAGE_SIZE
+	if val := query.Get("limit"); val != "" {
+		v, err := strconv.Atoi(val)
+		if err != nil || v <= 0 || v > MAX_AUDIT_PAGE_SIZE {
+			http.Error(w, fmt.Sprintf("Invalid limit, it must be 1 to %d", MAX_AUDIT_PAGE_SIZE), http.StatusBadRequest)
+			return
+		}
+		limit = v
+	}
+
+	ctx := context.Background()
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		panic(err)
+	}
+	defer bt_client.Close()
+
+	// the cursor is the last row key returned, start right after it
+	rr := bigtable.InfiniteRange("")
+	if cursor := query.Get("cursor"); cursor != "" {
+		rr = bigtable.InfiniteRange(cursor + "\x00")
+	}
+	entries := []AuditEntry{}
+	next := ""
+	err = bt_client.Open(AUDIT_TABLE).ReadRows(ctx, rr, func(row bigtable.Row) bool {
+		entries = append(entries, auditFromRow(row))
+		next = row.Key()
+		return true
+	}, bigtable.LimitRows(int64(limit)), bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		fmt.Printf("Failed to read audit log %v\n", err)
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	if len(entries) < limit {
+		next = ""
+	}
+
+	js, err := json.Marshal(map[string]interface{}{"entries": entries, "next": next})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func auditFromRow(row bigtable.Row) AuditEntry {
+	var e AuditEntry
+	for _, item := range row["audit"] {
+		val := string(item.Value)
+		e.Time = item.Timestamp.Time()
+		switch strings.TrimPrefix(item.Column, "audit:") {
+		case "actor":
+			e.Actor = val
+		case "action":
+			e.Action = val
+		case "target":
+			e.Target = val
+		case "detail":
+			e.Detail = val
+		case "request_id":
+			e.RequestId = val
+		}
+	}
+	return e
+}
+
+//***************  ADMIN DELETE POST ***************************
+// adminDeletePostHandler deletes any post (moderation), and audits it.
+func adminDeletePostHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	fmt.Printf("Received one admin delete post request %s\n", id)
+
+	ctx := context.Background()
+	p, err := postStore.Read(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to read post", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err := deletePost(ctx, id); err != nil {
+		if writeESTimeout(w, err) {
+			return
+		}
+		fmt.Printf("Failed to delete post %s %v\n", id, err)
+		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_DELETE_POST, id, "author: "+p.User)
+	w.WriteHeader(http.StatusNoContent)
+}
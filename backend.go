@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//***************  POST BACKENDS ***************************
+// The handlers save, read, delete and search posts through these, never
+// through the BigTable / ES clients directly, so a handler can run against
+// the in-memory ones below (handler tests, a quick local run) instead of live
+// GCP and ES. That covers what creating and searching posts needs: the posts,
+// their ids, counters and idempotency keys, and the profiles and bans of
+// their authors. Follows, comments, reactions ... still go to BigTable / ES.
+
+// PostStore is the source of truth of the posts (BigTable).
+type PostStore interface {
+	// Save writes the post under id, writing it again stores the same thing.
+	Save(p *Post, id string) error
+	// Read returns the post, or nil if there is no such post.
+	Read(ctx context.Context, id string) (*Post, error)
+	// Delete removes the post, a missing one is no error.
+	Delete(ctx context.Context, id string) error
+	// ReserveID claims id for a new post, in one atomic step: false if a
+	// post (or another reservation) has it already. See newPostID.
+	ReserveID(ctx context.Context, id string) (bool, error)
+	// Stats returns the counters of the posts, none for a post without any.
+	Stats(ctx context.Context, ids []string) (map[string]PostStats, error)
+	// CountView counts a view of viewer on the post, unless viewer already
+	// viewed it within config.ViewDedupWindow. It tells whether it counted.
+	CountView(ctx context.Context, id, viewer string) (bool, error)
+	// ReserveIdempotencyKey binds key (of username) to postID, or returns
+	// the post id it was bound to within config.IdempotencyTTL.
+	ReserveIdempotencyKey(ctx context.Context, username, key, postID string) (string, error)
+	// ReleaseIdempotencyKey forgets the key, the post failed to be saved.
+	ReleaseIdempotencyKey(ctx context.Context, username, key string)
+}
+
+// AccountStore has the profiles and bans of the users (BigTable), the
+// caches in front of it are getProfiles and getBans.
+type AccountStore interface {
+	// Profiles returns the profiles of the users who have one.
+	Profiles(ctx context.Context, usernames []string) (map[string]*Profile, error)
+	// Bans returns the active bans of the users who have one.
+	Bans(ctx context.Context, usernames []string) (map[string]*Ban, error)
+}
+
+// SearchIndex is where the posts are searched (ES).
+type SearchIndex interface {
+	// Index adds (or replaces) the post under id.
+	Index(p *Post, id string) error
+	// Delete removes the post, a missing one is no error.
+	Delete(id string) error
+	// Search returns the page of posts matching the /search params, in the
+	// order of the params. A timeout is an *ESTimeoutError.
+	Search(sp *searchParams) (*PostHits, error)
+	// FindDuplicate returns the id of a post of p.User with the very same
+	// message, created since then within radiusKm of p, "" if there is none.
+	FindDuplicate(p *Post, since int64, radiusKm float64) (string, error)
+}
+
+// PostHits is a page of search results.
+type PostHits struct {
+	// every matching post, not only this page
+	Total      int64
+	TookMillis int64
+	// the hits of the page, Posts skips the ones which can't be decoded
+	Hits  int
+	Posts []Post
+	// by post id, only with SORT_RELEVANCE
+	Scores map[string]*float64
+}
+
+// The production ones, tests swap them for newMemPostStore,
+// newMemSearchIndex and newMemAccountStore.
+var (
+	postStore    PostStore    = bigtablePostStore{}
+	searchIndex  SearchIndex  = esSearchIndex{}
+	accountStore AccountStore = bigtableAccountStore{}
+)
+
+//***************  BIGTABLE + ES ***************************
+type bigtablePostStore struct{}
+
+func (bigtablePostStore) Save(p *Post, id string) error { return saveToBigTable(p, id) }
+
+func (bigtablePostStore) Read(ctx context.Context, id string) (*Post, error) {
+	return readPostFromBigTable(ctx, id)
+}
+
+func (bigtablePostStore) Delete(ctx context.Context, id string) error {
+	return deleteFromBigTable(ctx, id)
+}
+
+func (bigtablePostStore) ReserveID(ctx context.Context, id string) (bool, error) {
+	return reservePostRow(ctx, id)
+}
+
+func (bigtablePostStore) Stats(ctx context.Context, ids []string) (map[string]PostStats, error) {
+	return readPostStatsFromBigTable(ctx, ids)
+}
+
+func (bigtablePostStore) CountView(ctx context.Context, id, viewer string) (bool, error) {
+	return countViewInBigTable(ctx, id, viewer)
+}
+
+func (bigtablePostStore) ReserveIdempotencyKey(ctx context.Context, username, key, postID string) (string, error) {
+	return reserveIdempotencyKey(ctx, username, key, postID)
+}
+
+func (bigtablePostStore) ReleaseIdempotencyKey(ctx context.Context, username, key string) {
+	releaseIdempotencyKey(ctx, username, key)
+}
+
+type bigtableAccountStore struct{}
+
+func (bigtableAccountStore) Profiles(ctx context.Context, usernames []string) (map[string]*Profile, error) {
+	return readProfilesFromBigTable(ctx, usernames)
+}
+
+func (bigtableAccountStore) Bans(ctx context.Context, usernames []string) (map[string]*Ban, error) {
+	return readBansFromBigTable(ctx, usernames)
+}
+
+type esSearchIndex struct{}
+
+func (esSearchIndex) Index(p *Post, id string) error { return saveToES(p, id) }
+
+func (esSearchIndex) Delete(id string) error { return deleteFromES(id) }
+
+func (esSearchIndex) FindDuplicate(p *Post, since int64, radiusKm float64) (string, error) {
+	return findDuplicateInES(p, since, radiusKm)
+}
+
+func (esSearchIndex) Search(sp *searchParams) (*PostHits, error) {
+	client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// Some delay may range from seconds to minutes. So if you don't get enough results. Try it later.
+	search := client.Search().
+		Index(config.ESIndex).
+		Query(buildSearchQuery(sp)).
+		Size(sp.Size)
+	if fields := sp.sourceFields(); fields != nil {
+		search = search.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(fields...))
+	}
+	if !sp.CursorMode {
+		search = search.From(sp.From)
+	}
+	search = search.SortBy(postSorters(sp)...)
+	ctx, cancel := esContext(ES_OP_SEARCH)
+	defer cancel()
+	searchResult, err := search.DoC(ctx)
+	if err != nil {
+		return nil, esError(ctx, ES_OP_SEARCH, err)
+	}
+
+	hits := &PostHits{
+		Total:      searchResult.TotalHits(),
+		TookMillis: searchResult.TookInMillis,
+		Hits:       len(searchResult.Hits.Hits),
+		Scores:     map[string]*float64{},
+	}
+	// Go through the hits ourselves (instead of searchResult.Each), because we
+	// need the doc id of each post as well. Like Each, skip what can't be decoded.
+	for _, hit := range searchResult.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			continue
+		}
+		p.Id = hit.Id
+		hits.Scores[p.Id] = hit.Score
+		hits.Posts = append(hits.Posts, p)
+	}
+	return hits, nil
+}
+
+//***************  IN MEMORY ***************************
+// memPostStore keeps the posts in a map, for tests.
+type memPostStore struct {
+	mu    sync.RWMutex
+	posts map[string]Post
+	stats map[string]PostStats
+	// ids reserved by ReserveID, until Save or Delete
+	reserved map[string]bool
+	// last counted view, by viewRowKey
+	views map[string]time.Time
+	// by idempotencyRowKey
+	idemKeys map[string]memIdempotencyKey
+}
+
+type memIdempotencyKey struct {
+	postID string
+	at     time.Time
+}
+
+func newMemPostStore() *memPostStore {
+	return &memPostStore{
+		posts:    map[string]Post{},
+		stats:    map[string]PostStats{},
+		views:    map[string]time.Time{},
+		reserved: map[string]bool{},
+		idemKeys: map[string]memIdempotencyKey{},
+	}
+}
+
+func (s *memPostStore) Save(p *Post, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *p
+	stored.Id = id
+	s.posts[id] = stored
+	delete(s.reserved, id)
+	return nil
+}
+
+func (s *memPostStore) Read(ctx context.Context, id string) (*Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.posts[id]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (s *memPostStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.posts, id)
+	delete(s.reserved, id)
+	return nil
+}
+
+func (s *memPostStore) ReserveID(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.posts[id]; ok || s.reserved[id] {
+		return false, nil
+	}
+	s.reserved[id] = true
+	return true, nil
+}
+
+func (s *memPostStore) Stats(ctx context.Context, ids []string) (map[string]PostStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := map[string]PostStats{}
+	for _, id := range ids {
+		if st, ok := s.stats[id]; ok {
+			stats[id] = st
+		}
+	}
+	return stats, nil
+}
+
+func (s *memPostStore) CountView(ctx context.Context, id, viewer string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := viewRowKey(id, viewer)
+	if last, ok := s.views[k]; ok && time.Since(last) < config.ViewDedupWindow {
+		return false, nil
+	}
+	s.views[k] = time.Now()
+	st := s.stats[id]
+	st.Views++
+	s.stats[id] = st
+	return true, nil
+}
+
+func (s *memPostStore) ReserveIdempotencyKey(ctx context.Context, username, key, postID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := idempotencyRowKey(username, key)
+	if first, ok := s.idemKeys[k]; ok && time.Since(first.at) < config.IdempotencyTTL {
+		return first.postID, nil
+	}
+	s.idemKeys[k] = memIdempotencyKey{postID: postID, at: time.Now()}
+	return "", nil
+}
+
+func (s *memPostStore) ReleaseIdempotencyKey(ctx context.Context, username, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.idemKeys, idempotencyRowKey(username, key))
+}
+
+// memAccountStore keeps profiles and bans in maps, for tests.
+type memAccountStore struct {
+	mu       sync.RWMutex
+	profiles map[string]*Profile
+	bans     map[string]*Ban
+}
+
+func newMemAccountStore() *memAccountStore {
+	return &memAccountStore{profiles: map[string]*Profile{}, bans: map[string]*Ban{}}
+}
+
+func (s *memAccountStore) Profiles(ctx context.Context, usernames []string) (map[string]*Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	profiles := map[string]*Profile{}
+	for _, name := range usernames {
+		if p, ok := s.profiles[name]; ok {
+			profiles[name] = p
+		}
+	}
+	return profiles, nil
+}
+
+func (s *memAccountStore) Bans(ctx context.Context, usernames []string) (map[string]*Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bans := map[string]*Ban{}
+	for _, name := range usernames {
+		if b := s.bans[name]; b.active() {
+			bans[name] = b
+		}
+	}
+	return bans, nil
+}
+
+// memSearchIndex searches a map of posts, for tests. It follows the ES
+// query closely enough for handler tests, not for relevance: the keyword
+// words are matched as lowercase substrings, and the score is the number of
+// words matched. No recency boost either, newest first unless sorted by
+// distance.
+type memSearchIndex struct {
+	mu    sync.RWMutex
+	posts map[string]Post
+}
+
+func newMemSearchIndex() *memSearchIndex {
+	return &memSearchIndex{posts: map[string]Post{}}
+}
+
+func (s *memSearchIndex) Index(p *Post, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	indexed := *p
+	indexed.Id = id
+	s.posts[id] = indexed
+	return nil
+}
+
+func (s *memSearchIndex) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.posts, id)
+	return nil
+}
+
+func (s *memSearchIndex) FindDuplicate(p *Post, since int64, radiusKm float64) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for id, other := range s.posts {
+		if other.User == p.User && other.Message == p.Message && other.Created >= since &&
+			distanceKm(p.Location, other.Location) <= radiusKm {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *memSearchIndex) Search(sp *searchParams) (*PostHits, error) {
+	s.mu.RLock()
+	var matches []Post
+	scores := map[string]*float64{}
+	for _, p := range s.posts {
+		if score, ok := sp.memMatch(p); ok {
+			matches = append(matches, p)
+			if sp.Sort == SORT_RELEVANCE {
+				scores[p.Id] = &score
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		switch {
+		case sp.Sort == SORT_RELEVANCE && *scores[a.Id] != *scores[b.Id]:
+			return *scores[a.Id] > *scores[b.Id]
+		case sp.Sort == SORT_DISTANCE:
+			center := Location{Lat: sp.Lat, Lon: sp.Lon}
+			return distanceKm(center, a.Location) < distanceKm(center, b.Location)
+		case a.Created != b.Created:
+			return a.Created > b.Created
+		}
+		return a.Id > b.Id
+	})
+
+	hits := &PostHits{Total: int64(len(matches)), Scores: scores}
+	if !sp.CursorMode {
+		if sp.From >= len(matches) {
+			matches = nil
+		} else {
+			matches = matches[sp.From:]
+		}
+	}
+	if len(matches) > sp.Size {
+		matches = matches[:sp.Size]
+	}
+	hits.Hits = len(matches)
+	hits.Posts = matches
+	return hits, nil
+}
+
+// memMatch is buildFilterQuery for one post, with the score of the keyword.
+func (sp *searchParams) memMatch(p Post) (float64, bool) {
+	if p.isScheduled() || !sp.inArea(p.Location) {
+		return 0, false
+	}
+	if sp.HasImage && p.Url == "" {
+		return 0, false
+	}
+	if sp.Since != 0 && p.Created < sp.Since {
+		return 0, false
+	}
+	if sp.Cursor != nil {
+		if p.Created > sp.Cursor.Created {
+			return 0, false
+		}
+		for _, id := range sp.Cursor.Ids {
+			if id == p.Id {
+				return 0, false
+			}
+		}
+	}
+	msg := strings.ToLower(p.Message)
+	for _, term := range sp.Exclude {
+		if strings.Contains(msg, strings.ToLower(term)) {
+			return 0, false
+		}
+	}
+	if sp.Keyword == "" {
+		return 0, true
+	}
+	words := strings.Fields(strings.ToLower(strings.Replace(sp.Keyword, `"`, " ", -1)))
+	var score float64
+	for _, word := range words {
+		if strings.Contains(msg, word) {
+			score++
+		}
+	}
+	if score == 0 || (sp.MatchMode == MATCH_ALL && int(score) < len(words)) {
+		return 0, false
+	}
+	return score, true
+}
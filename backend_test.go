@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// memBackends is what setupMemBackends put in place of BigTable and ES.
+type memBackends struct {
+	posts    *memPostStore
+	index    *memSearchIndex
+	accounts *memAccountStore
+}
+
+// setupMemBackends runs the handlers on the default config and the in-memory
+// backends, the images stored in a temp dir. Everything is put back after t.
+func setupMemBackends(t *testing.T) *memBackends {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// always read through to the stores, no cache left by another test
+	cfg.ProfileCacheTTL = 0
+	banCacheMu.Lock()
+	banCache = map[string]cachedBan{}
+	banCacheMu.Unlock()
+
+	oldConfig, oldPosts, oldIndex, oldAccounts, oldStorer := config, postStore, searchIndex, accountStore, storer
+	oldSearchSlots, oldUploadSlots := searchSlots, uploadSlots
+	t.Cleanup(func() {
+		// a post created by the test may still be on its way to the webhooks
+		webhookFanouts.Wait()
+		config, postStore, searchIndex, accountStore, storer = oldConfig, oldPosts, oldIndex, oldAccounts, oldStorer
+		searchSlots, uploadSlots = oldSearchSlots, oldUploadSlots
+	})
+
+	config = cfg
+	if err := loadFilteredWords(""); err != nil {
+		t.Fatal(err)
+	}
+	searchSlots = make(chan struct{}, config.MaxConcurrentSearches)
+	uploadSlots = make(chan struct{}, config.MaxConcurrentUploads)
+	storer = &localStorer{dir: t.TempDir(), baseURL: "http://localhost/files/"}
+
+	b := &memBackends{posts: newMemPostStore(), index: newMemSearchIndex(), accounts: newMemAccountStore()}
+	postStore, searchIndex, accountStore = b.posts, b.index, b.accounts
+	return b
+}
+
+// asUser is r as jwtMiddleware leaves it for a valid token of username.
+func asUser(r *http.Request, username string) *http.Request {
+	token := &jwt.Token{Claims: jwt.MapClaims{"username": username}, Valid: true}
+	return r.WithContext(context.WithValue(r.Context(), "user", token))
+}
+
+// smallPNG is a 4x4 PNG.
+func smallPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	var pic bytes.Buffer
+	if err := png.Encode(&pic, img); err != nil {
+		t.Fatal(err)
+	}
+	return pic.Bytes()
+}
+
+// newPostRequest is a POST /post of username, with a small PNG.
+func newPostRequest(t *testing.T, username, message string, lat, lon string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("message", message)
+	mw.WriteField("lat", lat)
+	mw.WriteField("lon", lon)
+	fw, err := mw.CreateFormFile("image", "pic.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(smallPNG(t))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/post", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return asUser(r, username)
+}
+
+// createPost posts through handlerPost and returns the response.
+func createPost(t *testing.T, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handlerPost(w, r)
+	return w
+}
+
+func createdID(t *testing.T, w *httptest.ResponseRecorder) string {
+	if w.Code != http.StatusOK {
+		t.Fatalf("post: got %d %s", w.Code, w.Body.String())
+	}
+	var res struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Id
+}
+
+// search runs handlerSearch as viewer and returns the results.
+func search(t *testing.T, viewer, query string) []PostResult {
+	w := httptest.NewRecorder()
+	handlerSearch(w, asUser(httptest.NewRequest("GET", "/search?"+query, nil), viewer))
+	if w.Code != http.StatusOK {
+		t.Fatalf("search: got %d %s", w.Code, w.Body.String())
+	}
+	var sr SearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatal(err)
+	}
+	return sr.Results
+}
+
+func TestHandlerPostThenSearch(t *testing.T) {
+	b := setupMemBackends(t)
+	b.accounts.profiles["alice"] = &Profile{Username: "alice", DisplayName: "Alice A."}
+
+	id := createdID(t, createPost(t, newPostRequest(t, "alice", "hello around", "37.5", "-122.3")))
+	p, _ := b.posts.Read(context.Background(), id)
+	if p == nil || p.Message != "hello around" || len(p.Urls) != 1 {
+		t.Fatalf("stored post %+v", p)
+	}
+
+	results := search(t, "bob", "lat=37.5&lon=-122.3&range=10")
+	if len(results) != 1 || results[0].Id != id {
+		t.Fatalf("got %+v, want post %s", results, id)
+	}
+	if results[0].DisplayName != "Alice A." {
+		t.Errorf("display name %q, want the one of the profile", results[0].DisplayName)
+	}
+
+	// out of range
+	if results := search(t, "bob", "lat=0&lon=0&range=10"); len(results) != 0 {
+		t.Errorf("got %d results far away", len(results))
+	}
+}
+
+func TestHandlerPostIdempotencyKey(t *testing.T) {
+	b := setupMemBackends(t)
+
+	r := newPostRequest(t, "alice", "only once", "37.5", "-122.3")
+	r.Header.Set("Idempotency-Key", "k1")
+	first := createdID(t, createPost(t, r))
+
+	r = newPostRequest(t, "alice", "only once", "37.5", "-122.3")
+	r.Header.Set("Idempotency-Key", "k1")
+	w := createPost(t, r)
+	if second := createdID(t, w); second != first {
+		t.Errorf("replay got post %s, want %s", second, first)
+	}
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is not marked")
+	}
+	if len(b.posts.posts) != 1 {
+		t.Errorf("%d posts stored, want 1", len(b.posts.posts))
+	}
+}
+
+func TestHandlerPostDuplicate(t *testing.T) {
+	setupMemBackends(t)
+
+	createdID(t, createPost(t, newPostRequest(t, "alice", "same again", "37.5", "-122.3")))
+	if w := createPost(t, newPostRequest(t, "alice", "same again", "37.5", "-122.3")); w.Code != http.StatusConflict {
+		t.Errorf("duplicate: got %d, want 409", w.Code)
+	}
+	// someone else may say the same
+	createdID(t, createPost(t, newPostRequest(t, "bob", "same again", "37.5", "-122.3")))
+}
+
+func TestHandlerPostShortID(t *testing.T) {
+	b := setupMemBackends(t)
+	config.IDStrategy = ID_STRATEGY_SHORT
+
+	id := createdID(t, createPost(t, newPostRequest(t, "alice", "short", "37.5", "-122.3")))
+	if len(id) != SHORT_ID_LENGTH {
+		t.Errorf("id %q is not a short id", id)
+	}
+	if p, _ := b.posts.Read(context.Background(), id); p == nil {
+		t.Errorf("post %s is not stored", id)
+	}
+}
+
+func TestHandlerPostValidation(t *testing.T) {
+	b := setupMemBackends(t)
+
+	w := createPost(t, newPostRequest(t, "alice", "nowhere", "91", "-122.3"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad lat: got %d, want 400", w.Code)
+	}
+	if len(b.posts.posts) != 0 || len(b.index.posts) != 0 {
+		t.Error("an invalid post was stored")
+	}
+}
+
+func TestHandlerSearchHidesBanned(t *testing.T) {
+	b := setupMemBackends(t)
+	now := time.Now().Unix()
+	b.index.Index(&Post{User: "alice", Message: "hi", Location: Location{Lat: 37.5, Lon: -122.3}, Created: now}, "p1")
+	b.index.Index(&Post{User: "mallory", Message: "spam", Location: Location{Lat: 37.5, Lon: -122.3}, Created: now}, "p2")
+	b.accounts.bans["mallory"] = &Ban{Reason: "spam"}
+
+	results := search(t, "bob", "lat=37.5&lon=-122.3&range=10")
+	if len(results) != 1 || results[0].Id != "p1" {
+		t.Errorf("got %+v, want p1 only", results)
+	}
+}
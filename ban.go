@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// BigTable table of banned users.
+	// row key: <username>, columns: ban:until (unix seconds, 0 = forever), ban:reason
+	BAN_TABLE = "ban"
+
+	// Every authenticated request checks the ban of its caller, a ban (or
+	// unban) can take this long to apply.
+	BAN_CACHE_TTL = 30 * time.Second
+
+	AUDIT_BAN   = "ban_user"
+	AUDIT_UNBAN = "unban_user"
+)
+
+type Ban struct {
+	Reason string `json:"reason"`
+	// zero for a permanent ban, the end of the suspension otherwise
+	Until time.Time `json:"until,omitempty"`
+}
+
+func (b *Ban) active() bool {
+	return b != nil && (b.Until.IsZero() || time.Now().Before(b.Until))
+}
+
+// Bans read recently, a nil ban means the user is not banned.
+var (
+	banCacheMu sync.Mutex
+	banCache   = map[string]cachedBan{}
+)
+
+type cachedBan struct {
+	ban *Ban
+	at  time.Time
+}
+
+//***************  BAN MIDDLEWARE ***************************
+// notBanned wraps an (already JWT-checked) handler to reject banned users
+// with 403, their tokens stay valid otherwise until they expire.
+func notBanned(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := usernameFromToken(r)
+		bans, err := getBans(r.Context(), []string{username})
+		if err != nil {
+			// don't lock everyone out when BigTable has a hiccup
+			fmt.Printf("Failed to check ban of %s %v\n", username, err)
+		}
+		if b := bans[username]; b.active() {
+			http.Error(w, banMessage(b), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// banMessage tells a banned user why and until when.
+func banMessage(b *Ban) string {
+	msg := "Your account is banned"
+	if !b.Until.IsZero() {
+		msg = "Your account is suspended until " + b.Until.UTC().Format(time.RFC3339)
+	}
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	return msg
+}
+
+//***************  BAN HANDLERS ***************************
+// banUserHandler bans a user, for good or for a while:
+// {"reason": "spam", "duration": "72h"} (both optional, no duration = forever).
+func banUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	fmt.Printf("Received one ban request for %s\n", username)
+
+	var body struct {
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	b := &Ban{Reason: strings.TrimSpace(body.Reason)}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration, e.g. \"72h\"", http.StatusBadRequest)
+			return
+		}
+		b.Until = time.Now().Add(d)
+	}
+	if username == usernameFromToken(r) {
+		http.Error(w, "Cannot ban yourself", http.StatusBadRequest)
+		return
+	}
+	if _, err := getUser(username); elastic.IsNotFound(err) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Printf("Failed to read user %s %v\n", username, err)
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveBan(context.Background(), username, b); err != nil {
+		fmt.Printf("Failed to ban %s %v\n", username, err)
+		http.Error(w, "Failed to ban user", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_BAN, username, banMessage(b))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unbanUserHandler lifts the ban of a user.
+func unbanUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	fmt.Printf("Received one unban request for %s\n", username)
+
+	if err := deleteBan(context.Background(), username); err != nil {
+		fmt.Printf("Failed to unban %s %v\n", username, err)
+		http.Error(w, "Failed to unban user", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_UNBAN, username, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//***************  BAN STORE ***************************
+// getBans returns the active bans of the given users (nil = not banned).
+func getBans(ctx context.Context, usernames []string) (map[string]*Ban, error) {
+	bans := map[string]*Ban{}
+	var missing []string
+
+	banCacheMu.Lock()
+	for _, name := range usernames {
+		if _, done := bans[name]; done {
+			continue
+		}
+		if c, ok := banCache[name]; ok && time.Since(c.at) < BAN_CACHE_TTL {
+			bans[name] = c.ban
+		} else {
+			bans[name] = nil
+			missing = append(missing, name)
+		}
+	}
+	banCacheMu.Unlock()
+
+	if len(missing) == 0 {
+		return bans, nil
+	}
+	found, err := accountStore.Bans(ctx, missing)
+	if err != nil {
+		return bans, err
+	}
+
+	now := time.Now()
+	banCacheMu.Lock()
+	for _, name := range missing {
+		bans[name] = found[name]
+		banCache[name] = cachedBan{ban: found[name], at: now}
+	}
+	banCacheMu.Unlock()
+	return bans, nil
+}
+
+// readBansFromBigTable is bigtableAccountStore.Bans, in one batch.
+func readBansFromBigTable(ctx context.Context, usernames []string) (map[string]*Ban, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	found := map[string]*Ban{}
+	err = bt_client.Open(BAN_TABLE).ReadRows(ctx, bigtable.RowList(usernames), func(row bigtable.Row) bool {
+		if b := banFromRow(row); b.active() {
+			found[row.Key()] = b
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return found, err
+}
+
+func banFromRow(row bigtable.Row) *Ban {
+	b := &Ban{}
+	for _, item := range row["ban"] {
+		val := string(item.Value)
+		switch item.Column {
+		case "ban:reason":
+			b.Reason = val
+		case "ban:until":
+			if until, _ := strconv.ParseInt(val, 10, 64); until > 0 {
+				b.Until = time.Unix(until, 0)
+			}
+		}
+	}
+	return b
+}
+
+func saveBan(ctx context.Context, username string, b *Ban) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	var until int64
+	if !b.Until.IsZero() {
+		until = b.Until.Unix()
+	}
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("ban", "reason", t, []byte(b.Reason))
+	mut.Set("ban", "until", t, []byte(strconv.FormatInt(until, 10)))
+	if err := bt_client.Open(BAN_TABLE).Apply(ctx, username, mut); err != nil {
+		return err
+	}
+
+	banCacheMu.Lock()
+	delete(banCache, username)
+	banCacheMu.Unlock()
+	return nil
+}
+
+func deleteBan(ctx context.Context, username string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	if err := bt_client.Open(BAN_TABLE).Apply(ctx, username, mut); err != nil {
+		return err
+	}
+
+	banCacheMu.Lock()
+	delete(banCache, username)
+	banCacheMu.Unlock()
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Routes whose body is not a small JSON and keep no limit: the images of a
+// post (MultipartMemory bounds what is kept in memory), the NDJSON import.
+var unlimitedBodyPaths = map[string]bool{
+	"/post":         true,
+	"/admin/import": true,
+}
+
+//***************  REQUEST BODY LIMIT ***************************
+// limitBody caps the body of every request at config.MaxJSONBodyBytes, so a
+// huge body can't exhaust the memory while it is decoded. Reading past the
+// limit fails, see writeDecodeError. New JSON routes get it for free.
+func limitBody(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !unlimitedBodyPaths[r.URL.Path] {
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxJSONBodyBytes)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeDecodeError answers a request whose body can't be decoded: 413 when
+// it is over the limit, 400 with msg otherwise.
+func writeDecodeError(w http.ResponseWriter, err error, msg string) {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, msg, http.StatusBadRequest)
+}
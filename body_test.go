@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeHandler decodes a JSON body like the handlers do.
+var decodeHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+})
+
+func TestLimitBody(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config = &Config{MaxJSONBodyBytes: 64}
+
+	big := `{"message":"` + strings.Repeat("a", 100) + `"}`
+	tests := []struct {
+		path, body string
+		code       int
+	}{
+		{"/profile", `{"message":"hi"}`, http.StatusNoContent},
+		{"/profile", big, http.StatusRequestEntityTooLarge},
+		{"/profile", `{"message":`, http.StatusBadRequest},
+		// multipart / NDJSON routes keep no limit
+		{"/admin/import", big, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		limitBody(decodeHandler).ServeHTTP(w, httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s with %d bytes: got %d, want %d", tt.path, len(tt.body), w.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// BigTable table of comments, each one is stored twice so it can be read
+	// by post and by user:
+	//	post#<post id>#<comment id>  and  user#<username>#<post id>#<comment id>
+	// columns: comment:user, comment:message, comment:parent, comment:created,
+	// comment:updated_at
+	// The comment id starts with its creation time, so a post's comments are
+	// read oldest first.
+	COMMENT_TABLE = "comment"
+
+	// Replies can be nested this deep: 1 --> replies to top level comments only.
+	MAX_COMMENT_DEPTH = 1
+)
+
+// @username, with the characters a username can have
+var mentionPattern = regexp.MustCompile(`@([a-z0-9_]+)`)
+
+type Comment struct {
+	Id       string `json:"id"`
+	PostId   string `json:"post_id"`
+	User     string `json:"user"`
+	Message  string `json:"message"`
+	ParentId string `json:"parent_id,omitempty"`
+	Created  int64  `json:"created"`
+	// UpdatedAt is the unix time (seconds) of the last edit, 0 if never edited.
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+	// only in GET /post/{id}/comments, the replies to this comment (oldest first)
+	Replies []*Comment `json:"replies,omitempty"`
+}
+
+//***************  COMMENT HANDLERS ***************************
+// addCommentHandler comments a post, {"message": "...", "parent_id": "..."}.
+// parent_id (optional) makes it a reply to another comment of the same post.
+func addCommentHandler(w http.ResponseWriter, r *http.Request) {
+	postID := mux.Vars(r)["id"]
+	username := usernameFromToken(r)
+	fmt.Printf("Received one comment request from %s on %s\n", username, postID)
+
+	var c Comment
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeDecodeError(w, err, "Cannot decode comment")
+		return
+	}
+	var errs ValidationErrors
+	if strings.TrimSpace(c.Message) == "" {
+		errs.Add("message", "message is required")
+	} else {
+		config.Policy.checkMessage(&errs, "message", c.Message)
+	}
+	// drop mode --> rejected, mask mode --> stored masked
+	c.PostId, c.User = postID, username
+	if errs == nil && !moderateNewComment(&c) {
+		errs.Add("message", "message contains filtered words")
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx := context.Background()
+	if _, ok := readVisiblePost(ctx, w, username, postID); !ok {
+		return
+	}
+
+	if c.ParentId != "" {
+		parent, err := getComment(ctx, postID, c.ParentId)
+		if err != nil {
+			fmt.Printf("Failed to read comment %s %v\n", c.ParentId, err)
+			http.Error(w, "Failed to read parent comment", http.StatusInternalServerError)
+			return
+		}
+		if parent == nil {
+			writeValidationErrors(w, ValidationErrors{{Field: "parent_id", Message: "no such comment on this post"}})
+			return
+		}
+		if commentDepth(ctx, parent)+1 > MAX_COMMENT_DEPTH {
+			writeValidationErrors(w, ValidationErrors{{Field: "parent_id", Message: fmt.Sprintf("replies can only be %d level deep", MAX_COMMENT_DEPTH)}})
+			return
+		}
+	}
+
+	now := time.Now()
+	c.Id = fmt.Sprintf("%019d-%s", now.UnixNano(), uuid.New())
+	c.PostId = postID
+	c.User = username
+	c.Created = now.Unix()
+	c.Replies = nil
+	if err := saveComment(ctx, &c); err != nil {
+		fmt.Printf("Failed to save comment %v\n", err)
+		http.Error(w, "Failed to save comment", http.StatusInternalServerError)
+		return
+	}
+
+	// capped like a post's, the extra ones get no push
+	names, _ := capTags(mentions(c.Message), config.MaxMentionsPerPost)
+	for _, name := range names {
+		if name != username {
+			notify(Push{Username: name, Title: username + " mentioned you", Body: pushExcerpt(c.Message),
+				Data: map[string]string{"type": "mention", "user": username, "post_id": postID, "comment_id": c.Id}})
+		}
+	}
+
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// editCommentHandler replaces the message of a comment, {"message": "..."}.
+// Only its author, checked like a new comment (policy, word filter).
+//
+//	PUT /post/{id}/comment/{commentId}
+func editCommentHandler(w http.ResponseWriter, r *http.Request) {
+	postID, commentID := mux.Vars(r)["id"], mux.Vars(r)["commentId"]
+	username := usernameFromToken(r)
+	fmt.Printf("Received one edit comment request %s from %s\n", commentID, username)
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode comment")
+		return
+	}
+	edited := Comment{Message: body.Message, PostId: postID, User: username}
+	var errs ValidationErrors
+	if strings.TrimSpace(edited.Message) == "" {
+		errs.Add("message", "message is required")
+	} else {
+		config.Policy.checkMessage(&errs, "message", edited.Message)
+	}
+	if errs == nil && !moderateNewComment(&edited) {
+		errs.Add("message", "message contains filtered words")
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx := context.Background()
+	c, ok := authorComment(ctx, w, r, postID, commentID)
+	if !ok {
+		return
+	}
+	c.Message = edited.Message
+	c.UpdatedAt = time.Now().Unix()
+	if err := updateComment(ctx, c); err != nil {
+		fmt.Printf("Failed to update comment %s %v\n", commentID, err)
+		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// deleteCommentHandler deletes a comment, only its author. Its replies stay
+// (shown at the top level, see threadComments).
+//
+//	DELETE /post/{id}/comment/{commentId}
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	postID, commentID := mux.Vars(r)["id"], mux.Vars(r)["commentId"]
+	fmt.Printf("Received one delete comment request %s from %s\n", commentID, usernameFromToken(r))
+
+	ctx := context.Background()
+	c, ok := authorComment(ctx, w, r, postID, commentID)
+	if !ok {
+		return
+	}
+	if err := deleteCommentRows(ctx, c); err != nil {
+		fmt.Printf("Failed to delete comment %s %v\n", commentID, err)
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+	if err := incrementPostCounter(ctx, postID, COUNTER_COMMENTS, -1); err != nil {
+		fmt.Printf("Failed to count deleted comment %s on %s %v\n", commentID, postID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorComment reads the comment for its author, else answers 404 (no such
+// comment) or 403 (someone else's) and returns false.
+func authorComment(ctx context.Context, w http.ResponseWriter, r *http.Request, postID, commentID string) (*Comment, bool) {
+	c, err := getComment(ctx, postID, commentID)
+	if err != nil {
+		fmt.Printf("Failed to read comment %s %v\n", commentID, err)
+		http.Error(w, "Failed to read comment", http.StatusInternalServerError)
+		return nil, false
+	}
+	if c == nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return nil, false
+	}
+	if c.User != usernameFromToken(r) {
+		http.Error(w, "Only its author can change a comment", http.StatusForbidden)
+		return nil, false
+	}
+	return c, true
+}
+
+// listCommentsHandler returns the comments of a post, oldest first, with the
+// replies nested in their parent comment. Like the post, only to whoever can
+// see it.
+func listCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	postID := mux.Vars(r)["id"]
+	fmt.Printf("Received one list comments request on %s\n", postID)
+
+	ctx := context.Background()
+	if _, ok := readVisiblePost(ctx, w, usernameFromToken(r), postID); !ok {
+		return
+	}
+	comments, err := commentsOfPost(ctx, postID)
+	if err != nil {
+		fmt.Printf("Failed to read comments of %s %v\n", postID, err)
+		http.Error(w, "Failed to read comments", http.StatusInternalServerError)
+		return
+	}
+
+	var kept []*Comment
+	for _, c := range comments {
+		if moderateComment(c) {
+			kept = append(kept, c)
+		}
+	}
+
+	js, err := json.Marshal(threadComments(kept))
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// threadComments nests each reply into its parent. A reply whose parent is
+// gone (deleted account, filtered) is shown at the top level rather than lost.
+func threadComments(comments []*Comment) []*Comment {
+	byID := map[string]*Comment{}
+	for _, c := range comments {
+		byID[c.Id] = c
+	}
+	top := []*Comment{}
+	for _, c := range comments {
+		if parent := byID[c.ParentId]; c.ParentId != "" && parent != nil {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			top = append(top, c)
+		}
+	}
+	return top
+}
+
+// mentions returns the users @mentioned in a message, once each.
+func mentions(message string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(message, -1) {
+		if name := m[1]; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//***************  COMMENT STORE ***************************
+func commentPostKey(postID, commentID string) string { return "post#" + postID + "#" + commentID }
+func commentUserKey(username, postID, commentID string) string {
+	return "user#" + username + "#" + postID + "#" + commentID
+}
+
+// saveComment writes both rows of the comment and counts it on the post.
+func saveComment(ctx context.Context, c *Comment) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(COMMENT_TABLE)
+	t := bigtable.Now()
+	for _, key := range []string{commentPostKey(c.PostId, c.Id), commentUserKey(c.User, c.PostId, c.Id)} {
+		mut := bigtable.NewMutation()
+		mut.Set("comment", "user", t, []byte(c.User))
+		mut.Set("comment", "message", t, []byte(c.Message))
+		mut.Set("comment", "parent", t, []byte(c.ParentId))
+		mut.Set("comment", "created", t, []byte(strconv.FormatInt(c.Created, 10)))
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return err
+		}
+	}
+	return incrementPostCounter(ctx, c.PostId, COUNTER_COMMENTS, 1)
+}
+
+// updateComment writes the new message of the comment to both rows.
+func updateComment(ctx context.Context, c *Comment) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(COMMENT_TABLE)
+	t := bigtable.Now()
+	for _, key := range []string{commentPostKey(c.PostId, c.Id), commentUserKey(c.User, c.PostId, c.Id)} {
+		mut := bigtable.NewMutation()
+		mut.Set("comment", "message", t, []byte(c.Message))
+		mut.Set("comment", "updated_at", t, []byte(strconv.FormatInt(c.UpdatedAt, 10)))
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getComment returns one comment of a post, or nil if there is no such comment.
+func getComment(ctx context.Context, postID, commentID string) (*Comment, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	row, err := bt_client.Open(COMMENT_TABLE).ReadRow(ctx, commentPostKey(postID, commentID), bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil || len(row) == 0 {
+		return nil, err
+	}
+	return commentFromRow(postID, commentID, row), nil
+}
+
+// commentDepth is 0 for a top level comment, 1 for a reply, and so on.
+// The parents are read one by one, MAX_COMMENT_DEPTH keeps it short.
+func commentDepth(ctx context.Context, c *Comment) int {
+	depth := 0
+	for c.ParentId != "" && depth <= MAX_COMMENT_DEPTH {
+		parent, err := getComment(ctx, c.PostId, c.ParentId)
+		if err != nil || parent == nil {
+			break
+		}
+		c = parent
+		depth++
+	}
+	return depth
+}
+
+// commentsOfPost returns all the comments of a post, oldest first.
+func commentsOfPost(ctx context.Context, postID string) ([]*Comment, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	prefix := commentPostKey(postID, "")
+	var comments []*Comment
+	err = bt_client.Open(COMMENT_TABLE).ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		comments = append(comments, commentFromRow(postID, strings.TrimPrefix(row.Key(), prefix), row))
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return comments, err
+}
+
+// commentsOfUser returns all the comments written by username.
+func commentsOfUser(ctx context.Context, username string) ([]*Comment, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	prefix := commentUserKey(username, "", "")
+	comments := []*Comment{}
+	err = bt_client.Open(COMMENT_TABLE).ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		// <post id>#<comment id>
+		ids := strings.SplitN(strings.TrimPrefix(row.Key(), prefix), "#", 2)
+		if len(ids) == 2 {
+			comments = append(comments, commentFromRow(ids[0], ids[1], row))
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return comments, err
+}
+
+func commentFromRow(postID, commentID string, row bigtable.Row) *Comment {
+	c := &Comment{Id: commentID, PostId: postID}
+	for _, item := range row["comment"] {
+		val := string(item.Value)
+		switch item.Column {
+		case "comment:user":
+			c.User = val
+		case "comment:message":
+			c.Message = val
+		case "comment:parent":
+			c.ParentId = val
+		case "comment:created":
+			c.Created, _ = strconv.ParseInt(val, 10, 64)
+		case "comment:updated_at":
+			c.UpdatedAt, _ = strconv.ParseInt(val, 10, 64)
+		}
+	}
+	return c
+}
+
+// deleteCommentsOfPost removes all the comments of a deleted post (both rows
+// of each). Its comment counter goes away with the post stats.
+func deleteCommentsOfPost(ctx context.Context, postID string) error {
+	comments, err := commentsOfPost(ctx, postID)
+	if err != nil {
+		return err
+	}
+	for _, c := range comments {
+		if err := deleteCommentRows(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCommentsOfUser removes every comment written by username, for
+// account deletion. Replies of other users to them stay.
+func deleteCommentsOfUser(ctx context.Context, username string) (int, error) {
+	comments, err := commentsOfUser(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range comments {
+		if err := deleteCommentRows(ctx, c); err != nil {
+			return 0, err
+		}
+		if err := incrementPostCounter(ctx, c.PostId, COUNTER_COMMENTS, -1); err != nil {
+			return 0, err
+		}
+	}
+	return len(comments), nil
+}
+
+func deleteCommentRows(ctx context.Context, c *Comment) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(COMMENT_TABLE)
+	for _, key := range []string{commentPostKey(c.PostId, c.Id), commentUserKey(c.User, c.PostId, c.Id)} {
+		mut := bigtable.NewMutation()
+		mut.DeleteRow()
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
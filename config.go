@@ -0,0 +1,642 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//***************  CONFIG ***************************
+// Config holds the settings which can be changed per deployment.
+// All of them are read from environment variables at startup.
+type Config struct {
+	// Address the server listens on, e.g. ":8080" or "127.0.0.1:9000".
+	ListenAddr string
+	// Cert and key (PEM files) to serve HTTPS directly. Both or none must be set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// When serving HTTPS, also listen on this address (e.g. ":80") and
+	// redirect plain HTTP requests to HTTPS. Empty means no redirect.
+	HTTPRedirectAddr string
+
+	// Origins (e.g. "https://around.app") browsers may call the API from
+	// (CORS_ALLOWED_ORIGINS, comma-separated). Empty by default, no origin is
+	// allowed. "*" allows any origin without credentials, for dev only.
+	CORSAllowedOrigins []string
+
+	// Users who get the admin claim in their token at login (ADMIN_USERS, comma-separated).
+	AdminUsers []string
+
+	// Secrets of the session tokens (JWT_KEYS, "kid:secret" comma-separated),
+	// the first one signs, all of them validate. See jwtkeys.go.
+	JWTKeys []JWTKey
+
+	// Where the post images are kept (STORAGE, STORAGE_GCS by default), and
+	// for STORAGE_LOCAL the directory and the url it is served at.
+	Storage    string
+	StorageDir string
+	StorageURL string
+
+	// GCS bucket of the post images.
+	GCSBucket string
+	// Create the bucket at startup if it doesn't exist, in GCSProject at
+	// GCSLocation. For first time / dev deployments only: in production a
+	// typo in the bucket name should fail, not silently make a new bucket.
+	GCSCreateBucket bool
+	GCSProject      string
+	GCSLocation     string
+
+	// How post ids are made, ID_STRATEGY_UUID (default) or ID_STRATEGY_SHORT
+	// for shorter permalinks.
+	IDStrategy string
+
+	// ES index (shared by posts and users) and type of posts. Change them to
+	// run several environments on one cluster. ESIndex is an alias of the
+	// real index, so the mapping can change (POST /admin/migrate).
+	ESIndex string
+	ESType  string
+	// Sniff the cluster for its nodes every ESSniffInterval (ES_SNIFF, off by
+	// default, turn it on for a multi-node cluster), and healthcheck the nodes
+	// every ESHealthcheckInterval (0 turns the healthcheck off).
+	ESSniff               bool
+	ESSniffInterval       time.Duration
+	ESHealthcheckInterval time.Duration
+	// Refresh the index after each post write (ES_REFRESH). "true" (default):
+	// a post is searchable as soon as its request returns, but every write
+	// costs a refresh. "false": ES refreshes on its own (about every second),
+	// much more writes per second, but a new / deleted post may still be
+	// missing / showing in searches for that long (X-Read-Your-Writes covers
+	// the author's own new posts). ES 2.x has no "wait_for", it is rejected.
+	ESRefresh bool
+	// How long one ES call may take, per kind: index a post, search, get
+	// by id, delete, and bulk (admin import). Past it the call is given up
+	// and the request gets a 504.
+	ESIndexTimeout  time.Duration
+	ESSearchTimeout time.Duration
+	ESGetTimeout    time.Duration
+	ESDeleteTimeout time.Duration
+	ESBulkTimeout   time.Duration
+
+	// Radius (km) used by search when the client doesn't give a "range".
+	DefaultRadiusKm float64
+	// Largest radius (km) a client can search, bigger ranges are capped to it.
+	MaxRadiusKm float64
+	// Most hits one search returns, a bigger "size" is clamped to it.
+	MaxSearchResults int
+	// Most /search queries in flight to ES at once, more are refused with
+	// 503 + Retry-After instead of piling up on a struggling cluster.
+	MaxConcurrentSearches int
+	// Most images written to GCS at once, one more waits up to
+	// UploadQueueTimeout for a slot, then the post is refused with 503.
+	MaxConcurrentUploads int
+	UploadQueueTimeout   time.Duration
+	// A /search taking longer than this (in ES or in total) is logged with
+	// its query, 0 turns it off.
+	SlowSearchThreshold time.Duration
+	// Lowest level written by logger (LOG_LEVEL: debug, info, warn, error).
+	LogLevel slog.Level
+	// Boost the newer posts of a /search with no sort and no cursor
+	// (RECENCY_BOOST, on by default), "what's happening now". The score of
+	// a post older than RecencyOffset is multiplied by RecencyDecay when it
+	// is RecencyScale older than that, less and less after (gauss).
+	RecencyBoost  bool
+	RecencyScale  time.Duration
+	RecencyOffset time.Duration
+	RecencyDecay  float64
+
+	// /trending ranks the posts of the last TrendingWindow by
+	// likes*TrendingLikeWeight + comments*TrendingCommentWeight + views*TrendingViewWeight.
+	TrendingWindow        time.Duration
+	TrendingLikeWeight    float64
+	TrendingCommentWeight float64
+	TrendingViewWeight    float64
+	// A user viewing a post again within ViewDedupWindow is not one more view.
+	ViewDedupWindow time.Duration
+
+	// The word filter of search results can be turned off, and either drops
+	// the posts with filtered words (default) or masks the words.
+	FilterEnabled bool
+	FilterMode    string
+	// File of the filtered words with their severity (block, mask or flag),
+	// see loadFilteredWords. Words without a severity follow FilterMode.
+	// Empty uses the built-in list.
+	FilterWordsFile string
+	// Which Moderator judges posts (MODERATOR, "words" by default), and for
+	// "http" the service url and how long it may take per post.
+	Moderator         string
+	ModerationURL     string
+	ModerationTimeout time.Duration
+
+	// /search shows the other authors as pseudonymous handles (off by
+	// default), see anonymize.go. The salt keeps the handles from being
+	// reversed, it is required with it and must not change (the handles would).
+	AnonymizeUsers bool
+	AnonymizeSalt  string
+
+	// Search results (and feeds, trending ...) show each post up to this far
+	// (in meters) from where it is, so posts at one spot don't stack on a map.
+	// 0 (default) turns it off. Only the responses, the stored location and
+	// the distances stay true.
+	LocationJitterMeters float64
+
+	// How old an account must be to post (MIN_ACCOUNT_AGE, e.g. 30m), against
+	// throwaway spam accounts. 0 (default) turns it off.
+	MinAccountAge time.Duration
+
+	// A post with the message of a post of the same user, within this time
+	// (0 turns the check off) and this distance, is refused with 409 unless
+	// sent with force=true.
+	DuplicatePostWindow   time.Duration
+	DuplicatePostRadiusKm float64
+
+	// File of the post writes BigTable failed while ES took them, retried
+	// every BTDeferRetryInterval. Empty (default) rolls such a post back
+	// instead. See deferred.go.
+	BTDeferFile          string
+	BTDeferRetryInterval time.Duration
+
+	// What usernames and messages may be, see ContentPolicy.
+	Policy *ContentPolicy
+
+	// Most images in one post, more is rejected before anything is uploaded.
+	MaxImagesPerPost int
+	// Most #hashtags and @mentions kept of a post (a comment's mentions too),
+	// the extra ones are ignored, see extractTags.
+	MaxHashtagsPerPost int
+	MaxMentionsPerPost int
+
+	// Largest body of a request (MAX_JSON_BODY_KB), a bigger one gets a 413.
+	// /post and /admin/import have no such limit.
+	MaxJSONBodyBytes int64
+
+	// Bytes of a post upload kept in memory by ParseMultipartForm (MULTIPART_MEMORY_MB).
+	// The rest of the upload is written to temp files. Lower it on small
+	// instances (less memory, more disk IO), raise it when memory is plenty
+	// (faster, but each concurrent upload can hold that much memory).
+	MultipartMemory int64
+	// Read the posts bigger than MultipartMemory as a stream instead
+	// (STREAM_UPLOADS, off by default), see streamupload.go.
+	StreamUploads bool
+	// Biggest image of a post (MAX_IMAGE_MB).
+	MaxImageBytes int64
+	// Longest one image of a streamed post may take to arrive
+	// (UPLOAD_PART_TIMEOUT), so a slow client can't hold an upload slot.
+	UploadPartTimeout time.Duration
+
+	// How long a profile stays cached, a changed display name or avatar
+	// can take that long to show up in search results.
+	ProfileCacheTTL time.Duration
+
+	// How long an Idempotency-Key of a post is remembered.
+	IdempotencyTTL time.Duration
+
+	// Minimum time between two data exports of the same user.
+	ExportInterval time.Duration
+
+	// Posts newer than this are merged from BigTable into searches sent with
+	// "X-Read-Your-Writes: true". Older ones are expected to be in ES already.
+	ReadYourWritesWindow time.Duration
+
+	// Max requests per minute from one IP on /login and /signup.
+	LoginRateLimit  int
+	SignupRateLimit int
+	// Set it when running behind a proxy / load balancer, so the client IP
+	// is read from X-Forwarded-For.
+	TrustProxy bool
+
+	// Reject login until the user opened the link in the verification email.
+	RequireVerifiedEmail bool
+	// Address the users reach the service at, used to build links in emails.
+	PublicURL string
+	// SMTP server to send emails ("host:port"). When empty, emails are only
+	// printed to the log, which is handy for local development.
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	MailFrom     string
+
+	// Firebase project to send push notifications with (FCM_PROJECT_ID).
+	// When empty, no push is sent.
+	FCMProjectID string
+	// Key file of the service account FCM is called as (FCM_CREDENTIALS_FILE).
+	// Empty uses the application default credentials.
+	FCMCredentialsFile string
+
+	// OAuth client id of the app for "Sign in with Google" (GOOGLE_CLIENT_ID),
+	// Google ID tokens must be issued for it. Empty turns it off.
+	GoogleClientID string
+}
+
+var config *Config
+
+// loadConfig reads the config from env, falling back to the defaults in main.go.
+func loadConfig() (*Config, error) {
+	c := &Config{}
+	var err error
+
+	c.ListenAddr = envString("LISTEN_ADDR", LISTEN_ADDR)
+	c.TLSCertFile = envString("TLS_CERT_FILE", "")
+	c.TLSKeyFile = envString("TLS_KEY_FILE", "")
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	c.HTTPRedirectAddr = envString("HTTP_REDIRECT_ADDR", "")
+	if c.HTTPRedirectAddr != "" && !c.TLSEnabled() {
+		return nil, fmt.Errorf("HTTP_REDIRECT_ADDR needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	c.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS", "")
+
+	c.AdminUsers = envList("ADMIN_USERS", "")
+
+	if c.JWTKeys, err = parseJWTKeys(envList("JWT_KEYS", DEFAULT_JWT_KID+":"+string(mySigningKey))); err != nil {
+		return nil, err
+	}
+
+	c.Storage = envString("STORAGE", STORAGE_GCS)
+	c.StorageDir = envString("STORAGE_DIR", LOCAL_STORAGE_DIR)
+	c.StorageURL = envString("STORAGE_URL", LOCAL_STORAGE_URL)
+
+	c.GCSBucket = envString("GCS_BUCKET", BUCKET_NAME)
+	if c.GCSCreateBucket, err = envBool("GCS_CREATE_BUCKET", false); err != nil {
+		return nil, err
+	}
+	c.GCSProject = envString("GCS_PROJECT", PROJECT_ID)
+	c.GCSLocation = envString("GCS_LOCATION", BUCKET_LOCATION)
+
+	c.IDStrategy = envString("ID_STRATEGY", ID_STRATEGY_UUID)
+	if c.IDStrategy != ID_STRATEGY_UUID && c.IDStrategy != ID_STRATEGY_SHORT {
+		return nil, fmt.Errorf("ID_STRATEGY must be %q or %q", ID_STRATEGY_UUID, ID_STRATEGY_SHORT)
+	}
+
+	c.ESIndex = strings.TrimSpace(envString("ES_INDEX", INDEX))
+	c.ESType = strings.TrimSpace(envString("ES_TYPE", TYPE))
+	if c.ESIndex == "" || c.ESType == "" {
+		return nil, fmt.Errorf("ES_INDEX and ES_TYPE must not be empty")
+	}
+	if c.ESSniff, err = envBool("ES_SNIFF", false); err != nil {
+		return nil, err
+	}
+	if c.ESSniffInterval, err = envDuration("ES_SNIFF_INTERVAL", ES_SNIFF_INTERVAL); err != nil {
+		return nil, err
+	}
+	if c.ESHealthcheckInterval, err = envDuration("ES_HEALTHCHECK_INTERVAL", ES_HEALTHCHECK_INTERVAL); err != nil {
+		return nil, err
+	}
+	switch refresh := envString("ES_REFRESH", "true"); refresh {
+	case "true", "false":
+		c.ESRefresh = refresh == "true"
+	case "wait_for":
+		return nil, fmt.Errorf("ES_REFRESH=wait_for needs Elasticsearch 5+, use true or false")
+	default:
+		return nil, fmt.Errorf("ES_REFRESH must be true or false, not %q", refresh)
+	}
+	if c.ESSniffInterval <= 0 || c.ESHealthcheckInterval < 0 {
+		return nil, fmt.Errorf("ES_SNIFF_INTERVAL must be positive and ES_HEALTHCHECK_INTERVAL not negative")
+	}
+
+	if c.DefaultRadiusKm, err = envFloat("DEFAULT_RADIUS_KM", DEFAULT_RADIUS_KM); err != nil {
+		return nil, err
+	}
+	if c.MaxRadiusKm, err = envFloat("MAX_RADIUS_KM", MAX_RADIUS_KM); err != nil {
+		return nil, err
+	}
+	if c.DefaultRadiusKm <= 0 || c.MaxRadiusKm <= 0 {
+		return nil, fmt.Errorf("search radius must be positive")
+	}
+	if c.DefaultRadiusKm > c.MaxRadiusKm {
+		return nil, fmt.Errorf("DEFAULT_RADIUS_KM (%v) is larger than MAX_RADIUS_KM (%v)", c.DefaultRadiusKm, c.MaxRadiusKm)
+	}
+	for _, t := range []struct {
+		key string
+		def time.Duration
+		dst *time.Duration
+	}{
+		{"ES_INDEX_TIMEOUT", ES_INDEX_TIMEOUT, &c.ESIndexTimeout},
+		{"ES_SEARCH_TIMEOUT", ES_SEARCH_TIMEOUT, &c.ESSearchTimeout},
+		{"ES_GET_TIMEOUT", ES_GET_TIMEOUT, &c.ESGetTimeout},
+		{"ES_DELETE_TIMEOUT", ES_DELETE_TIMEOUT, &c.ESDeleteTimeout},
+		{"ES_BULK_TIMEOUT", ES_BULK_TIMEOUT, &c.ESBulkTimeout},
+	} {
+		if *t.dst, err = envDuration(t.key, t.def); err != nil {
+			return nil, err
+		}
+		if *t.dst <= 0 {
+			return nil, fmt.Errorf("%s must be positive", t.key)
+		}
+	}
+	if c.MaxSearchResults, err = envInt("MAX_SEARCH_RESULTS", MAX_SEARCH_RESULTS); err != nil {
+		return nil, err
+	}
+	if c.MaxSearchResults <= 0 {
+		return nil, fmt.Errorf("MAX_SEARCH_RESULTS must be positive")
+	}
+	if c.MaxConcurrentSearches, err = envInt("MAX_CONCURRENT_SEARCHES", MAX_CONCURRENT_SEARCHES); err != nil {
+		return nil, err
+	}
+	if c.MaxConcurrentSearches <= 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_SEARCHES must be positive")
+	}
+	if c.MaxConcurrentUploads, err = envInt("MAX_CONCURRENT_UPLOADS", MAX_CONCURRENT_UPLOADS); err != nil {
+		return nil, err
+	}
+	if c.MaxConcurrentUploads <= 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_UPLOADS must be positive")
+	}
+	if c.UploadQueueTimeout, err = envDuration("UPLOAD_QUEUE_TIMEOUT", UPLOAD_QUEUE_TIMEOUT); err != nil {
+		return nil, err
+	}
+	if c.SlowSearchThreshold, err = envDuration("SLOW_SEARCH_THRESHOLD", SLOW_SEARCH_THRESHOLD); err != nil {
+		return nil, err
+	}
+	if c.SlowSearchThreshold < 0 {
+		return nil, fmt.Errorf("SLOW_SEARCH_THRESHOLD must not be negative")
+	}
+	if err := c.LogLevel.UnmarshalText([]byte(envString("LOG_LEVEL", LOG_LEVEL))); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %v", err)
+	}
+	if c.RecencyBoost, err = envBool("RECENCY_BOOST", true); err != nil {
+		return nil, err
+	}
+	if c.RecencyScale, err = envDuration("RECENCY_SCALE", RECENCY_SCALE); err != nil {
+		return nil, err
+	}
+	if c.RecencyOffset, err = envDuration("RECENCY_OFFSET", RECENCY_OFFSET); err != nil {
+		return nil, err
+	}
+	if c.RecencyDecay, err = envFloat("RECENCY_DECAY", RECENCY_DECAY); err != nil {
+		return nil, err
+	}
+	if c.RecencyScale < time.Second || c.RecencyOffset < 0 {
+		return nil, fmt.Errorf("RECENCY_SCALE must be 1s or more, RECENCY_OFFSET must not be negative")
+	}
+	if c.RecencyDecay <= 0 || c.RecencyDecay >= 1 {
+		return nil, fmt.Errorf("RECENCY_DECAY must be between 0 and 1 (excluded)")
+	}
+
+	if c.TrendingWindow, err = envDuration("TRENDING_WINDOW", TRENDING_WINDOW); err != nil {
+		return nil, err
+	}
+	if c.TrendingWindow <= 0 {
+		return nil, fmt.Errorf("TRENDING_WINDOW must be positive")
+	}
+	if c.TrendingLikeWeight, err = envFloat("TRENDING_LIKE_WEIGHT", TRENDING_LIKE_WEIGHT); err != nil {
+		return nil, err
+	}
+	if c.TrendingCommentWeight, err = envFloat("TRENDING_COMMENT_WEIGHT", TRENDING_COMMENT_WEIGHT); err != nil {
+		return nil, err
+	}
+	if c.TrendingViewWeight, err = envFloat("TRENDING_VIEW_WEIGHT", TRENDING_VIEW_WEIGHT); err != nil {
+		return nil, err
+	}
+	if c.ViewDedupWindow, err = envDuration("VIEW_DEDUP_WINDOW", VIEW_DEDUP_WINDOW); err != nil {
+		return nil, err
+	}
+	if c.ViewDedupWindow <= 0 {
+		return nil, fmt.Errorf("VIEW_DEDUP_WINDOW must be positive")
+	}
+
+	if c.FilterEnabled, err = envBool("FILTER_ENABLED", true); err != nil {
+		return nil, err
+	}
+	c.FilterMode = envString("FILTER_MODE", FILTER_MODE_DROP)
+	if c.FilterMode != FILTER_MODE_DROP && c.FilterMode != FILTER_MODE_MASK {
+		return nil, fmt.Errorf("FILTER_MODE must be %q or %q", FILTER_MODE_DROP, FILTER_MODE_MASK)
+	}
+	c.FilterWordsFile = os.Getenv("FILTER_WORDS_FILE")
+	c.Moderator = envString("MODERATOR", MODERATOR_WORDS)
+	c.ModerationURL = envString("MODERATION_URL", "")
+	if c.ModerationTimeout, err = envDuration("MODERATION_TIMEOUT", MODERATION_TIMEOUT); err != nil {
+		return nil, err
+	}
+
+	if c.MinAccountAge, err = envDuration("MIN_ACCOUNT_AGE", 0); err != nil {
+		return nil, err
+	}
+	if c.MinAccountAge < 0 {
+		return nil, fmt.Errorf("MIN_ACCOUNT_AGE must not be negative")
+	}
+
+	if c.DuplicatePostWindow, err = envDuration("DUPLICATE_POST_WINDOW", DUPLICATE_POST_WINDOW); err != nil {
+		return nil, err
+	}
+	if c.DuplicatePostRadiusKm, err = envFloat("DUPLICATE_POST_RADIUS_KM", DUPLICATE_POST_RADIUS_KM); err != nil {
+		return nil, err
+	}
+	if c.DuplicatePostWindow < 0 || c.DuplicatePostRadiusKm <= 0 {
+		return nil, fmt.Errorf("DUPLICATE_POST_WINDOW must not be negative, DUPLICATE_POST_RADIUS_KM must be positive")
+	}
+
+	if c.AnonymizeUsers, err = envBool("ANONYMIZE_USERS", false); err != nil {
+		return nil, err
+	}
+	c.AnonymizeSalt = envString("ANONYMIZE_USERS_SALT", "")
+	if c.AnonymizeUsers && c.AnonymizeSalt == "" {
+		return nil, fmt.Errorf("ANONYMIZE_USERS needs ANONYMIZE_USERS_SALT")
+	}
+
+	if c.LocationJitterMeters, err = envFloat("LOCATION_JITTER_METERS", 0); err != nil {
+		return nil, err
+	}
+	if c.LocationJitterMeters < 0 || c.LocationJitterMeters > MAX_LOCATION_JITTER_METERS {
+		return nil, fmt.Errorf("LOCATION_JITTER_METERS must be between 0 and %d", MAX_LOCATION_JITTER_METERS)
+	}
+
+	c.BTDeferFile = envString("BT_DEFER_FILE", "")
+	if c.BTDeferRetryInterval, err = envDuration("BT_DEFER_RETRY_INTERVAL", BT_DEFER_RETRY_INTERVAL); err != nil {
+		return nil, err
+	}
+	if c.BTDeferRetryInterval <= 0 {
+		return nil, fmt.Errorf("BT_DEFER_RETRY_INTERVAL must be positive")
+	}
+	if c.Policy, err = loadPolicy(); err != nil {
+		return nil, err
+	}
+	if c.MaxImagesPerPost, err = envInt("MAX_IMAGES_PER_POST", MAX_IMAGES_PER_POST); err != nil {
+		return nil, err
+	}
+	if c.MaxImagesPerPost <= 0 {
+		return nil, fmt.Errorf("MAX_IMAGES_PER_POST must be positive")
+	}
+	if c.MaxHashtagsPerPost, err = envInt("MAX_HASHTAGS_PER_POST", MAX_HASHTAGS_PER_POST); err != nil {
+		return nil, err
+	}
+	if c.MaxMentionsPerPost, err = envInt("MAX_MENTIONS_PER_POST", MAX_MENTIONS_PER_POST); err != nil {
+		return nil, err
+	}
+	if c.MaxHashtagsPerPost < 0 || c.MaxMentionsPerPost < 0 {
+		return nil, fmt.Errorf("MAX_HASHTAGS_PER_POST and MAX_MENTIONS_PER_POST must not be negative")
+	}
+
+	bodyKB, err := envInt("MAX_JSON_BODY_KB", MAX_JSON_BODY_KB)
+	if err != nil {
+		return nil, err
+	}
+	if bodyKB <= 0 {
+		return nil, fmt.Errorf("MAX_JSON_BODY_KB must be positive")
+	}
+	c.MaxJSONBodyBytes = int64(bodyKB) << 10
+
+	memoryMB, err := envInt("MULTIPART_MEMORY_MB", MULTIPART_MEMORY_MB)
+	if err != nil {
+		return nil, err
+	}
+	if memoryMB <= 0 {
+		return nil, fmt.Errorf("MULTIPART_MEMORY_MB must be positive")
+	}
+	c.MultipartMemory = int64(memoryMB) << 20
+	if c.StreamUploads, err = envBool("STREAM_UPLOADS", false); err != nil {
+		return nil, err
+	}
+	imageMB, err := envInt("MAX_IMAGE_MB", MAX_IMAGE_MB)
+	if err != nil {
+		return nil, err
+	}
+	if imageMB <= 0 {
+		return nil, fmt.Errorf("MAX_IMAGE_MB must be positive")
+	}
+	c.MaxImageBytes = int64(imageMB) << 20
+	if c.UploadPartTimeout, err = envDuration("UPLOAD_PART_TIMEOUT", UPLOAD_PART_TIMEOUT); err != nil {
+		return nil, err
+	}
+	if c.UploadPartTimeout <= 0 {
+		return nil, fmt.Errorf("UPLOAD_PART_TIMEOUT must be positive")
+	}
+
+	if c.ProfileCacheTTL, err = envDuration("PROFILE_CACHE_TTL", PROFILE_CACHE_TTL); err != nil {
+		return nil, err
+	}
+
+	if c.IdempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", IDEMPOTENCY_TTL); err != nil {
+		return nil, err
+	}
+	if c.IdempotencyTTL <= 0 {
+		return nil, fmt.Errorf("IDEMPOTENCY_TTL must be positive")
+	}
+	if c.ExportInterval, err = envDuration("EXPORT_INTERVAL", EXPORT_INTERVAL); err != nil {
+		return nil, err
+	}
+	if c.ReadYourWritesWindow, err = envDuration("READ_YOUR_WRITES_WINDOW", READ_YOUR_WRITES_WINDOW); err != nil {
+		return nil, err
+	}
+	if c.LoginRateLimit, err = envInt("LOGIN_RATE_LIMIT", LOGIN_RATE_LIMIT); err != nil {
+		return nil, err
+	}
+	if c.SignupRateLimit, err = envInt("SIGNUP_RATE_LIMIT", SIGNUP_RATE_LIMIT); err != nil {
+		return nil, err
+	}
+	if c.LoginRateLimit <= 0 || c.SignupRateLimit <= 0 {
+		return nil, fmt.Errorf("LOGIN_RATE_LIMIT and SIGNUP_RATE_LIMIT must be positive")
+	}
+	if c.TrustProxy, err = envBool("TRUST_PROXY", false); err != nil {
+		return nil, err
+	}
+	if c.RequireVerifiedEmail, err = envBool("REQUIRE_VERIFIED_EMAIL", false); err != nil {
+		return nil, err
+	}
+	c.PublicURL = strings.TrimRight(envString("PUBLIC_URL", "http://localhost:8080"), "/")
+	c.SMTPAddr = envString("SMTP_ADDR", "")
+	c.SMTPUser = envString("SMTP_USER", "")
+	c.SMTPPassword = envString("SMTP_PASSWORD", "")
+	c.MailFrom = envString("MAIL_FROM", "no-reply@around.local")
+	// the legacy API it was for is shut down, say so rather than pushing nothing
+	if os.Getenv("FCM_SERVER_KEY") != "" {
+		return nil, fmt.Errorf("FCM_SERVER_KEY is not supported anymore, set FCM_PROJECT_ID (and FCM_CREDENTIALS_FILE)")
+	}
+	c.FCMProjectID = envString("FCM_PROJECT_ID", "")
+	c.FCMCredentialsFile = envString("FCM_CREDENTIALS_FILE", "")
+	c.GoogleClientID = envString("GOOGLE_CLIENT_ID", "")
+
+	return c, nil
+}
+
+// isAdminUser tells whether username is listed in ADMIN_USERS.
+func (c *Config) isAdminUser(username string) bool {
+	for _, name := range c.AdminUsers {
+		if name == username {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSEnabled tells whether the server terminates TLS itself.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+//***************  HELPER ***************************
+// envString returns the env value, or def if it is not set.
+func envString(key, def string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return def
+}
+
+// envList returns the comma-separated env value as a list (blanks dropped),
+// or def split the same way if it is not set.
+func envList(key, def string) []string {
+	var list []string
+	for _, item := range strings.Split(envString(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envFloat returns the env value as float64, or def if it is not set.
+func envFloat(key string, def float64) (float64, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number: %q", key, val)
+	}
+	return f, nil
+}
+
+// envDuration returns the env value as time.Duration (e.g. "24h"), or def if it is not set.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a duration: %q", key, val)
+	}
+	return d, nil
+}
+
+// envInt returns the env value as int, or def if it is not set.
+func envInt(key string, def int) (int, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an integer: %q", key, val)
+	}
+	return i, nil
+}
+
+// envBool returns the env value as bool ("true", "1", "false" ...), or def if it is not set.
+func envBool(key string, def bool) (bool, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a bool: %q", key, val)
+	}
+	return b, nil
+}
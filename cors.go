@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	CORS_ALLOWED_METHODS = "GET,POST,PUT,PATCH,DELETE,OPTIONS"
+	CORS_ALLOWED_HEADERS = "Content-Type,Authorization,Idempotency-Key,X-Read-Your-Writes,X-Request-Id,X-API-Key"
+	CORS_EXPOSED_HEADERS = "Retry-After,X-Size-Clamped,X-Request-Id"
+)
+
+//***************  CORS ***************************
+// cors sets the CORS headers for every route in one place. An origin listed
+// in CORS_ALLOWED_ORIGINS is echoed back with credentials, so browsers can
+// send the JWT. The "*" wildcard lets any origin in, but never with
+// credentials. For other origins no CORS header is set at all, and the
+// browser blocks the response.
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		listed, wildcard := originAllowed(origin)
+		if origin != "" && (listed || wildcard) {
+			if listed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSED_HEADERS)
+
+			// preflight --> answer it here, the routes only know their real method
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOWED_METHODS)
+				w.Header().Set("Access-Control-Allow-Headers", CORS_ALLOWED_HEADERS)
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed tells whether origin is listed by name, and whether the "*"
+// wildcard is configured.
+func originAllowed(origin string) (listed, wildcard bool) {
+	for _, allowed := range config.CORSAllowedOrigins {
+		if allowed == "*" {
+			wildcard = true
+		} else if strings.EqualFold(allowed, origin) {
+			listed = true
+		}
+	}
+	return listed, wildcard
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//***************  DEFERRED BIGTABLE WRITES ***************************
+// With BT_DEFER_FILE set, a post saved to ES but not to BigTable (BigTable
+// down, timing out) is not rolled back: it is searchable from ES, and its
+// BigTable write is appended to that file (one JSON post per line) and
+// retried in the background every BT_DEFER_RETRY_INTERVAL, until it goes
+// through. The file survives a restart, the retries go on from it.
+//
+// Until then the post is missing from BigTable: reacting, commenting or
+// reading it raw gets a 404. A post deleted meanwhile (gone from ES) is
+// dropped instead of written back.
+
+var (
+	// only one writer of the file at a time
+	deferMu sync.Mutex
+
+	btDeferredWrites  = expvar.NewInt("bt_deferred_writes")
+	btDeferredPending = expvar.NewInt("bt_deferred_pending")
+)
+
+// canDeferBigTable tells whether a failed BigTable write of a post can wait
+// in the file: the mode is on and the error looks like an outage.
+func canDeferBigTable(err error) bool {
+	return config.BTDeferFile != "" && (retryableBigTableError(err) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// deferBigTableWrite appends p to the file, to be written to BigTable later.
+func deferBigTableWrite(p *Post) error {
+	js, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	deferMu.Lock()
+	defer deferMu.Unlock()
+	if err := appendLines(config.BTDeferFile, [][]byte{js}); err != nil {
+		return err
+	}
+	btDeferredWrites.Add(1)
+	btDeferredPending.Add(1)
+	log.Printf("WARNING: BigTable write of post %s is deferred to %s", p.Id, config.BTDeferFile)
+	return nil
+}
+
+// startDeferredWriter retries the deferred writes in the background, from
+// the start (whatever a previous run left) then every BTDeferRetryInterval.
+func startDeferredWriter() {
+	if config.BTDeferFile == "" {
+		return
+	}
+	// what a previous run left is pending too, from then on only the
+	// changes are added
+	for _, path := range []string{config.BTDeferFile, config.BTDeferFile + ".retrying"} {
+		if posts, err := readDeferredPosts(path); err == nil {
+			btDeferredPending.Add(int64(len(posts)))
+		}
+	}
+	go func() {
+		for {
+			if err := flushDeferredWrites(context.Background()); err != nil {
+				fmt.Printf("Failed to retry deferred BigTable writes %v\n", err)
+			}
+			time.Sleep(config.BTDeferRetryInterval)
+		}
+	}()
+}
+
+// flushDeferredWrites moves the file aside (new deferrals go to a new one),
+// writes what it can, and puts the rest back.
+func flushDeferredWrites(ctx context.Context) error {
+	retrying := config.BTDeferFile + ".retrying"
+	deferMu.Lock()
+	// a .retrying file left by a crash is taken as is, then the current file next time
+	if _, err := os.Stat(retrying); os.IsNotExist(err) {
+		if err := os.Rename(config.BTDeferFile, retrying); os.IsNotExist(err) {
+			deferMu.Unlock()
+			return nil
+		} else if err != nil {
+			deferMu.Unlock()
+			return err
+		}
+	}
+	deferMu.Unlock()
+
+	posts, err := readDeferredPosts(retrying)
+	if err != nil {
+		return err
+	}
+
+	var left [][]byte
+	written, dropped := 0, 0
+	for _, p := range posts {
+		// deleted meanwhile --> nothing to write back
+		if found, err := postsFromES([]string{p.Id}); err == nil && len(found) == 0 {
+			dropped++
+			continue
+		}
+		if err := postStore.Save(p, p.Id); err != nil {
+			// retrying won't fix it --> it would stay in the file forever
+			if !canDeferBigTable(err) {
+				log.Printf("WARNING: dropping the deferred BigTable write of post %s: %v", p.Id, err)
+				dropped++
+				continue
+			}
+			js, _ := json.Marshal(p)
+			left = append(left, js)
+			continue
+		}
+		written++
+	}
+
+	deferMu.Lock()
+	defer deferMu.Unlock()
+	if err := appendLines(config.BTDeferFile, left); err != nil {
+		return err
+	}
+	if len(posts) > 0 {
+		fmt.Printf("Deferred BigTable writes: %d written, %d dropped, %d left\n", written, dropped, len(left))
+	}
+	btDeferredPending.Add(int64(len(left) - len(posts)))
+	return os.Remove(retrying)
+}
+
+func readDeferredPosts(path string) ([]*Post, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var posts []*Post
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var p Post
+		// a line cut by a crash while appending, nothing to save from it
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil || p.Id == "" {
+			log.Printf("WARNING: skipping a bad line of %s", path)
+			continue
+		}
+		posts = append(posts, &p)
+	}
+	return posts, scanner.Err()
+}
+
+// appendLines appends each line to the file and syncs it to disk.
+func appendLines(path string, lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failingPostStore fails the Save of the posts in errs.
+type failingPostStore struct {
+	*memPostStore
+	errs map[string]error
+}
+
+func (s *failingPostStore) Save(p *Post, id string) error {
+	if err := s.errs[id]; err != nil {
+		return err
+	}
+	return s.memPostStore.Save(p, id)
+}
+
+func TestFlushDeferredWrites(t *testing.T) {
+	b := setupMemBackends(t)
+	config.BTDeferFile = filepath.Join(t.TempDir(), "deferred")
+	postStore = &failingPostStore{memPostStore: b.posts, errs: map[string]error{
+		"busy": status.Error(codes.Unavailable, "busy"),
+		"bad":  status.Error(codes.InvalidArgument, "bad"),
+	}}
+	pending := btDeferredPending.Value()
+	t.Cleanup(func() { btDeferredPending.Set(pending) })
+
+	for _, id := range []string{"ok", "busy", "bad"} {
+		if err := deferBigTableWrite(&Post{Id: id, User: "alice", Message: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flushDeferredWrites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, _ := b.posts.Read(context.Background(), "ok"); p == nil {
+		t.Error("post ok is not written")
+	}
+	// only the outage is retried, the bad one is dropped
+	left, err := readDeferredPosts(config.BTDeferFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Id != "busy" {
+		t.Errorf("left %v, want busy only", left)
+	}
+	if got := btDeferredPending.Value() - pending; got != 1 {
+		t.Errorf("%d pending, want 1", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Most recent posts of the user near the new one looked at to find a duplicate.
+const DUPLICATE_SEARCH_SIZE = 10
+
+//***************  DUPLICATE POSTS ***************************
+// findDuplicatePost returns the id of a post of the same user with the same
+// message, posted within config.DuplicatePostWindow and
+// config.DuplicatePostRadiusKm of p, "" if there is none. A retrying client
+// (no Idempotency-Key) double posts that way.
+// Errors are only logged: better a duplicate than a post refused for nothing.
+func findDuplicatePost(p *Post) string {
+	if config.DuplicatePostWindow == 0 || p.Message == "" {
+		return ""
+	}
+	since := time.Now().Add(-config.DuplicatePostWindow).Unix()
+	id, err := searchIndex.FindDuplicate(p, since, config.DuplicatePostRadiusKm)
+	if err != nil {
+		fmt.Printf("Failed to check duplicate post %v\n", err)
+		return ""
+	}
+	return id
+}
+
+// findDuplicateInES is esSearchIndex.FindDuplicate.
+func findDuplicateInES(p *Post, since int64, radiusKm float64) (string, error) {
+	es_client, err := getESClient()
+	if err != nil {
+		return "", err
+	}
+
+	radius := strconv.FormatFloat(radiusKm, 'f', -1, 64) + "km"
+	q := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("user", p.User)).
+		Filter(elastic.NewRangeQuery("created").Gte(since)).
+		Filter(elastic.NewGeoDistanceQuery("location").Distance(radius).Lat(p.Location.Lat).Lon(p.Location.Lon)).
+		Must(elastic.NewMatchPhraseQuery("message", p.Message))
+
+	ctx, cancel := esContext(ES_OP_SEARCH)
+	defer cancel()
+	res, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(q).
+		Size(DUPLICATE_SEARCH_SIZE).
+		DoC(ctx)
+	if err != nil {
+		return "", esError(ctx, ES_OP_SEARCH, err)
+	}
+	// the phrase matches longer messages too, only the very same one counts
+	for _, hit := range res.Hits.Hits {
+		var other Post
+		if err := json.Unmarshal(*hit.Source, &other); err == nil && other.Message == p.Message {
+			return hit.Id, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Methods tried on a route to tell the allowed ones of a 405.
+var routeMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+//***************  404 / 405 ***************************
+// mux answers an unknown route or method in plain text, these answer in the
+// envelope of writeValidationErrors like the rest of the API:
+//
+//	404 {"errors":[{"field":"path","message":"..."}]}
+//	405 {"errors":[{"field":"method","message":"..."}],"allowed":["GET","POST"]}
+func notFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeRouteError(w, http.StatusNotFound, map[string]interface{}{
+			"errors": ValidationErrors{{Field: "path", Message: "no such endpoint " + r.URL.Path}},
+		})
+	})
+}
+
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedMethods(router, r)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeRouteError(w, http.StatusMethodNotAllowed, map[string]interface{}{
+			"errors":  ValidationErrors{{Field: "method", Message: fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path)}},
+			"allowed": allowed,
+		})
+	})
+}
+
+// allowedMethods returns the methods some route takes for the path of r.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	allowed := []string{}
+	for _, method := range routeMethods {
+		req := r.Clone(r.Context())
+		req.Method = method
+		var match mux.RouteMatch
+		// with the handlers above set, Match is true on a miss too, with a MatchErr
+		if router.Match(req, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+func writeRouteError(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Kinds of ES calls, each with its own timeout (see esContext).
+const (
+	ES_OP_INDEX  = "index"
+	ES_OP_SEARCH = "search"
+	ES_OP_GET    = "get"
+	ES_OP_DELETE = "delete"
+	ES_OP_BULK   = "bulk"
+)
+
+//***************  ES CLIENT ***************************
+// esClient is the one ES client of the process, created by setupBackends.
+// A client runs its own sniffer and healthcheck goroutines, one per request
+// would pile them up and hit the cluster with every one of them.
+var esClient *elastic.Client
+
+var errNoESClient = errors.New("ES client not created yet")
+
+// getESClient returns the shared client. The routes answer 503 until
+// setupBackends created it (see untilStarted), so it is an error only for a
+// caller running before that.
+func getESClient() (*elastic.Client, error) {
+	if esClient == nil {
+		return nil, errNoESClient
+	}
+	return esClient, nil
+}
+
+// newESClient creates an ES client with the sniff / healthcheck settings of config.
+// Sniffing is off by default: a single node (dev) often publishes an address
+// the client can't reach. Turn it on (ES_SNIFF) for a real cluster, so the
+// client finds the other nodes and stops sending requests to dead ones.
+func newESClient() (*elastic.Client, error) {
+	return elastic.NewClient(
+		elastic.SetURL(ES_URL),
+		elastic.SetSniff(config.ESSniff),
+		elastic.SetSnifferInterval(config.ESSniffInterval),
+		elastic.SetHealthcheck(config.ESHealthcheckInterval > 0),
+		elastic.SetHealthcheckInterval(config.ESHealthcheckInterval),
+		elastic.SetHttpClient(&http.Client{Transport: esWriteTransport{http.DefaultTransport}}),
+	)
+}
+
+//***************  ES WRITES ***************************
+// esWriteTransport sees every request to ES. The writes of docs through the
+// alias wait while a migration moves it, and are recorded while it runs (see
+// migrate.go), so none is lost by the move.
+type esWriteTransport struct {
+	next http.RoundTripper
+}
+
+func (t esWriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	refs, write, err := esWrittenDocs(req)
+	if err != nil {
+		return nil, err
+	}
+	if !write {
+		return t.next.RoundTrip(req)
+	}
+	esWriteGate.RLock()
+	defer esWriteGate.RUnlock()
+	recordMigrationWrites(refs)
+	return t.next.RoundTrip(req)
+}
+
+// esWrittenDocs tells whether req writes docs of the alias, and which ones:
+// /<alias>/<type>/<id>[/_update|/_create], or the lines of a bulk request
+// for the alias. A bulk body is read, req gets a copy of it.
+func esWrittenDocs(req *http.Request) ([]docRef, bool, error) {
+	if req.Method != "PUT" && req.Method != "POST" && req.Method != "DELETE" {
+		return nil, false, nil
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if parts[len(parts)-1] == "_bulk" {
+		if req.Body == nil {
+			return nil, false, nil
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, false, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		refs := bulkWrittenDocs(body)
+		return refs, len(refs) > 0, nil
+	}
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != config.ESIndex ||
+		strings.HasPrefix(parts[1], "_") || strings.HasPrefix(parts[2], "_") {
+		return nil, false, nil
+	}
+	if len(parts) == 4 && parts[3] != "_update" && parts[3] != "_create" {
+		return nil, false, nil
+	}
+	return []docRef{{Type: parts[1], Id: parts[2]}}, true, nil
+}
+
+// bulkWrittenDocs returns the docs of the alias a bulk body writes. Its
+// action lines name them, the lines of the docs after them are skipped.
+func bulkWrittenDocs(body []byte) []docRef {
+	var refs []docRef
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(nil, len(body)+1)
+	for sc.Scan() {
+		var action map[string]struct {
+			Index string `json:"_index"`
+			Type  string `json:"_type"`
+			Id    string `json:"_id"`
+		}
+		if json.Unmarshal(sc.Bytes(), &action) != nil {
+			continue
+		}
+		for op, meta := range action {
+			if meta.Index == config.ESIndex && meta.Id != "" {
+				refs = append(refs, docRef{Type: meta.Type, Id: meta.Id})
+			}
+			// all but a delete are followed by a doc
+			if op != "delete" {
+				sc.Scan()
+			}
+		}
+	}
+	return refs
+}
+
+//***************  ES TIMEOUTS ***************************
+// ESTimeoutError is returned when an ES call ran out of its time.
+type ESTimeoutError struct {
+	Op      string
+	Timeout time.Duration
+}
+
+func (e *ESTimeoutError) Error() string {
+	return fmt.Sprintf("ES %s timed out after %v", e.Op, e.Timeout)
+}
+
+func esTimeout(op string) time.Duration {
+	switch op {
+	case ES_OP_INDEX:
+		return config.ESIndexTimeout
+	case ES_OP_SEARCH:
+		return config.ESSearchTimeout
+	case ES_OP_GET:
+		return config.ESGetTimeout
+	case ES_OP_DELETE:
+		return config.ESDeleteTimeout
+	}
+	return config.ESBulkTimeout
+}
+
+// esContext is the context of one ES call of kind op, pass it to DoC. A
+// search shouldn't hang as long as a bulk import may.
+func esContext(op string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), esTimeout(op))
+}
+
+// esError turns the error of a call made with ctx into an *ESTimeoutError
+// when it's because the time ran out.
+func esError(ctx context.Context, op string, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &ESTimeoutError{Op: op, Timeout: esTimeout(op)}
+	}
+	return err
+}
+
+// writeESTimeout responds 504 naming the ES call if err is a timeout, and
+// tells whether it did.
+func writeESTimeout(w http.ResponseWriter, err error) bool {
+	t, ok := err.(*ESTimeoutError)
+	if !ok {
+		return false
+	}
+	fmt.Printf("%v\n", t)
+	http.Error(w, t.Error(), http.StatusGatewayTimeout)
+	return true
+}
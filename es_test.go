@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestESWrittenDocs(t *testing.T) {
+	config = &Config{ESIndex: "around"}
+	tests := []struct {
+		method, path string
+		refs         []docRef
+		write        bool
+	}{
+		{"PUT", "/around/post/p1", []docRef{{"post", "p1"}}, true},
+		{"POST", "/around/user/bob/_update", []docRef{{"user", "bob"}}, true},
+		{"DELETE", "/around/post/p1", []docRef{{"post", "p1"}}, true},
+		{"GET", "/around/post/p1", nil, false},
+		{"POST", "/around/post/_search", nil, false},
+		{"POST", "/around/_search", nil, false},
+		// the new index of a migration is written directly
+		{"PUT", "/around_20200101000000/post/p1", nil, false},
+		{"POST", "/_aliases", nil, false},
+	}
+	for _, tt := range tests {
+		refs, write, err := esWrittenDocs(httptest.NewRequest(tt.method, tt.path, nil))
+		if err != nil || write != tt.write || !reflect.DeepEqual(refs, tt.refs) {
+			t.Errorf("%s %s: got %v %v %v", tt.method, tt.path, refs, write, err)
+		}
+	}
+}
+
+func TestESWrittenDocsBulk(t *testing.T) {
+	config = &Config{ESIndex: "around"}
+	body := `{"index":{"_index":"around","_type":"post","_id":"p1"}}
+{"message":"{\"delete\":{}}"}
+{"delete":{"_index":"around","_type":"post","_id":"p2"}}
+{"create":{"_index":"around_new","_type":"post","_id":"p3"}}
+{"user":"bob"}
+`
+	req := httptest.NewRequest("POST", "/_bulk", strings.NewReader(body))
+	refs, write, err := esWrittenDocs(req)
+	if err != nil || !write {
+		t.Fatalf("got %v %v", write, err)
+	}
+	want := []docRef{{"post", "p1"}, {"post", "p2"}}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("got %v, want %v", refs, want)
+	}
+	// the body is still there for ES
+	if got, _ := ioutil.ReadAll(req.Body); string(got) != body {
+		t.Errorf("body changed to %q", got)
+	}
+}
+
+func TestMigrationWrites(t *testing.T) {
+	recordMigrationWrites([]docRef{{"post", "before"}})
+	trackMigrationWrites(true)
+	recordMigrationWrites([]docRef{{"post", "p1"}, {"user", "bob"}})
+	refs := trackMigrationWrites(false)
+	if len(refs) != 2 || !refs[docRef{"post", "p1"}] || !refs[docRef{"user", "bob"}] {
+		t.Errorf("got %v", refs)
+	}
+	recordMigrationWrites([]docRef{{"post", "after"}})
+	if refs := trackMigrationWrites(false); refs != nil {
+		t.Errorf("recorded without a migration %v", refs)
+	}
+}
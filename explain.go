@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+//***************  SEARCH EXPLAIN ***************************
+// explainSearchHandler runs the ES query of a /search (same params) with
+// explain and profile on, and returns the query as sent plus the raw ES
+// response: why each hit matched and its score, and where the time went.
+// The hits are not word-filtered, visibility-filtered nor enriched, to see
+// what ES itself returns. Admins only.
+//
+//	GET /admin/search/explain?lat=37.7&lon=-122.4&range=5&keyword=coffee
+//	--> {"query": {...}, "response": {"took": 3, "hits": {...}, "profile": {...}}}
+func explainSearchHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one search explain request")
+	sp, err := parseSearchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := explainBody(sp)
+	if err != nil {
+		fmt.Printf("Failed to build search query %v\n", err)
+		http.Error(w, "Failed to build search query", http.StatusInternalServerError)
+		return
+	}
+	es_client, err := getESClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to ES %v\n", err)
+		http.Error(w, "Failed to explain search", http.StatusInternalServerError)
+		return
+	}
+	// the raw API: the body is exactly what we show, and the profile comes
+	// back as ES sends it
+	res, err := es_client.PerformRequest("POST", "/"+config.ESIndex+"/_search", nil, body)
+	if err != nil {
+		fmt.Printf("Failed to explain search %v\n", err)
+		http.Error(w, "Failed to explain search: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := marshalResponse(map[string]interface{}{"query": body, "response": res.Body}, sp.Pretty)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// explainBody is the body of the /search query of sp, with explain and profile.
+func explainBody(sp *searchParams) (map[string]interface{}, error) {
+	q, err := buildSearchQuery(sp).Source()
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{
+		"query":   q,
+		"size":    sp.Size,
+		"explain": true,
+		"profile": true,
+	}
+	if !sp.CursorMode {
+		body["from"] = sp.From
+	}
+	var sorts []interface{}
+	for _, s := range postSorters(sp) {
+		src, err := s.Source()
+		if err != nil {
+			return nil, err
+		}
+		sorts = append(sorts, src)
+	}
+	if sorts != nil {
+		body["sort"] = sorts
+	}
+	if fields := sp.sourceFields(); fields != nil {
+		body["_source"] = fields
+	}
+	return body, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Last export time of each user, an export is expensive so we limit how often it runs.
+var (
+	exportMu   sync.Mutex
+	lastExport = map[string]time.Time{}
+)
+
+//*************** EXPORT HANDLER ***************************
+// Download everything stored for the caller as one JSON file:
+//
+//	{"account": {...}, "profile": {...}, "reactions": [...], "comments": [...],
+//	 "following": [...], "followers": [...], "posts": [{"id": ..., "post": {...}}, ...]}
+//
+// Posts (with their image urls) are streamed from ES, so a big account
+// doesn't have to fit in memory.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one export request")
+
+	username := usernameFromToken(r)
+	if wait := allowExport(username); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many export requests", http.StatusTooManyRequests)
+		return
+	}
+
+	account, err := getUser(username)
+	if err != nil {
+		fmt.Printf("Failed to read user %s %v\n", username, err)
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return
+	}
+	// never hand out the password, even to its owner
+	account.Password = ""
+
+	profile, err := getProfile(r.Context(), username)
+	if err != nil {
+		fmt.Printf("Failed to read profile %s %v\n", username, err)
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+
+	reactions, err := reactionsOfUser(r.Context(), username)
+	if err != nil {
+		fmt.Printf("Failed to read reactions of %s %v\n", username, err)
+		http.Error(w, "Failed to read reactions", http.StatusInternalServerError)
+		return
+	}
+
+	comments, err := commentsOfUser(r.Context(), username)
+	if err != nil {
+		fmt.Printf("Failed to read comments of %s %v\n", username, err)
+		http.Error(w, "Failed to read comments", http.StatusInternalServerError)
+		return
+	}
+
+	following, err := followingOf(r.Context(), username, FOLLOW_APPROVED)
+	if err != nil {
+		fmt.Printf("Failed to read follows of %s %v\n", username, err)
+		http.Error(w, "Failed to read follows", http.StatusInternalServerError)
+		return
+	}
+	followers, err := followersOf(r.Context(), username, FOLLOW_APPROVED)
+	if err != nil {
+		fmt.Printf("Failed to read followers of %s %v\n", username, err)
+		http.Error(w, "Failed to read followers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+username+`-export.json"`)
+
+	enc := json.NewEncoder(w)
+	w.Write([]byte(`{"account":`))
+	enc.Encode(account)
+	w.Write([]byte(`,"profile":`))
+	enc.Encode(profile)
+	w.Write([]byte(`,"reactions":`))
+	enc.Encode(reactions)
+	w.Write([]byte(`,"comments":`))
+	enc.Encode(comments)
+	w.Write([]byte(`,"following":`))
+	enc.Encode(following)
+	w.Write([]byte(`,"followers":`))
+	enc.Encode(followers)
+	w.Write([]byte(`,"posts":[`))
+
+	first := true
+	err = scrollPostsByUser(username, func(hit *elastic.SearchHit) error {
+		if !first {
+			w.Write([]byte(","))
+		}
+		first = false
+		if err := enc.Encode(map[string]interface{}{"id": hit.Id, "post": hit.Source}); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// headers are already sent, the best we can do is to break the JSON
+		// so the client doesn't take a partial export for a complete one.
+		fmt.Printf("Export of %s failed %v\n", username, err)
+		return
+	}
+	w.Write([]byte("]}"))
+}
+
+// allowExport returns how long the user has to wait before the next export,
+// or 0 if the export can start now (and records it).
+func allowExport(username string) time.Duration {
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	if last, ok := lastExport[username]; ok {
+		if wait := config.ExportInterval - time.Since(last); wait > 0 {
+			return wait
+		}
+	}
+	lastExport[username] = time.Now()
+	return 0
+}
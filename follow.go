@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// BigTable table of follows, each one is stored twice so it can be read
+	// from both sides:
+	//	following#<follower>#<followee>  and  follower#<followee>#<follower>
+	// column: follow:status
+	FOLLOW_TABLE = "follow"
+
+	// Following a public user is approved right away, a private one has to
+	// approve the request first.
+	FOLLOW_APPROVED = "approved"
+	FOLLOW_PENDING  = "pending"
+
+	// Followed users whose posts make up a feed, the rest are ignored.
+	MAX_FEED_FOLLOWEES = 1000
+	DEFAULT_FEED_SIZE  = 20
+	MAX_FEED_SIZE      = 100
+)
+
+//***************  FOLLOW HANDLERS ***************************
+// followHandler makes the caller follow a user. It's a pending request when
+// that user is private: {"status": "pending"}.
+func followHandler(w http.ResponseWriter, r *http.Request) {
+	followee := mux.Vars(r)["username"]
+	follower := usernameFromToken(r)
+	fmt.Printf("Received one follow request from %s to %s\n", follower, followee)
+
+	if followee == follower {
+		http.Error(w, "Cannot follow yourself", http.StatusBadRequest)
+		return
+	}
+	if _, err := getUser(followee); elastic.IsNotFound(err) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Printf("Failed to read user %s %v\n", followee, err)
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := context.Background()
+	profile, err := getProfile(ctx, followee)
+	if err != nil {
+		fmt.Printf("Failed to read profile %s %v\n", followee, err)
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+	status, err := followStatus(ctx, follower, followee)
+	if err != nil {
+		fmt.Printf("Failed to read follow %v\n", err)
+		http.Error(w, "Failed to follow", http.StatusInternalServerError)
+		return
+	}
+	// following again never downgrades an approved follow
+	if status != FOLLOW_APPROVED {
+		status = FOLLOW_APPROVED
+		if profile != nil && profile.Private {
+			status = FOLLOW_PENDING
+		}
+		if err := saveFollow(ctx, follower, followee, status); err != nil {
+			fmt.Printf("Failed to save follow %v\n", err)
+			http.Error(w, "Failed to follow", http.StatusInternalServerError)
+			return
+		}
+		title := follower + " started following you"
+		if status == FOLLOW_PENDING {
+			title = follower + " wants to follow you"
+		}
+		notify(Push{Username: followee, Title: title, Data: map[string]string{"type": "follow", "user": follower}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// followRequestsHandler lists the users waiting for the caller's approval.
+func followRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	requests, err := followersOf(context.Background(), username, FOLLOW_PENDING)
+	if err != nil {
+		fmt.Printf("Failed to read follow requests of %s %v\n", username, err)
+		http.Error(w, "Failed to read follow requests", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// approveFollowHandler approves the pending follow request of {username}.
+func approveFollowHandler(w http.ResponseWriter, r *http.Request) {
+	follower := mux.Vars(r)["username"]
+	followee := usernameFromToken(r)
+	fmt.Printf("Received one approve follow request from %s for %s\n", followee, follower)
+
+	ctx := context.Background()
+	status, err := followStatus(ctx, follower, followee)
+	if err != nil {
+		fmt.Printf("Failed to read follow %v\n", err)
+		http.Error(w, "Failed to approve", http.StatusInternalServerError)
+		return
+	}
+	if status != FOLLOW_PENDING {
+		http.Error(w, "No such follow request", http.StatusNotFound)
+		return
+	}
+	if err := saveFollow(ctx, follower, followee, FOLLOW_APPROVED); err != nil {
+		fmt.Printf("Failed to save follow %v\n", err)
+		http.Error(w, "Failed to approve", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//***************  USER PAGE ***************************
+// userHandler returns the profile of a user. A private user's details are
+// hidden from everyone but themselves and their approved followers.
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	viewer := usernameFromToken(r)
+	fmt.Printf("Received one user request for %s\n", username)
+
+	if _, err := getUser(username); elastic.IsNotFound(err) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Printf("Failed to read user %s %v\n", username, err)
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := context.Background()
+	profile, err := getProfile(ctx, username)
+	if err != nil {
+		fmt.Printf("Failed to read profile %s %v\n", username, err)
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+	if profile == nil {
+		profile = &Profile{Username: username, DisplayName: username}
+	}
+	visible, err := visibleAuthors(ctx, viewer, map[string]*Profile{username: profile})
+	if err != nil {
+		fmt.Printf("Failed to read follows of %s %v\n", viewer, err)
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return
+	}
+	if !visible[username] {
+		// the badge stays, it's there to tell who the account is
+		profile = &Profile{Username: username, Private: true, Verified: profile.Verified}
+	} else {
+		// a copy, the cached profile is shared
+		p := *profile
+		profile = &p
+		if profile.LastActive, err = lastActive(ctx, username); err != nil {
+			fmt.Printf("Failed to read last activity of %s %v\n", username, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+//***************  FEED ***************************
+// feedHandler returns the posts of the users the caller follows (approved
+// follows only), newest first, in the envelope of /search.
+//
+//	GET /feed?from=0&size=20
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one feed request from %s\n", username)
+
+	from, size, err := parsePage(r, DEFAULT_FEED_SIZE, MAX_FEED_SIZE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	followees, err := followingOf(ctx, username, FOLLOW_APPROVED)
+	if err != nil {
+		fmt.Printf("Failed to read follows of %s %v\n", username, err)
+		http.Error(w, "Failed to read feed", http.StatusInternalServerError)
+		return
+	}
+	resp := SearchResponse{From: from, Size: size, Results: []PostResult{}}
+	if len(followees) > MAX_FEED_FOLLOWEES {
+		followees = followees[:MAX_FEED_FOLLOWEES]
+	}
+
+	if len(followees) > 0 {
+		es_client, err := getESClient()
+		if err != nil {
+			panic(err)
+		}
+		users := make([]interface{}, len(followees))
+		for i, f := range followees {
+			users[i] = f
+		}
+		searchResult, err := es_client.Search().
+			Index(config.ESIndex).
+			Type(config.ESType).
+			Query(publishedOnly(elastic.NewTermsQuery("user", users...))).
+			Sort("created", false).
+			From(from).
+			Size(size).
+			Do()
+		if err != nil {
+			fmt.Printf("Failed to search feed of %s %v\n", username, err)
+			http.Error(w, "Failed to read feed", http.StatusInternalServerError)
+			return
+		}
+
+		var ps []Post
+		for _, hit := range searchResult.Hits.Hits {
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				continue
+			}
+			p.Id = hit.Id
+			if moderatePost(&p) {
+				ps = append(ps, p)
+			}
+		}
+		// followees can be banned since
+		if ps, err = filterVisiblePosts(ctx, username, ps); err != nil {
+			fmt.Printf("Failed to check visibility of posts %v\n", err)
+			http.Error(w, "Failed to read feed", http.StatusInternalServerError)
+			return
+		}
+		// counted by ES before filterVisiblePosts --> an upper bound
+		resp.Total = searchResult.TotalHits()
+		resp.Results = enrichPosts(ctx, ps, nil)
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Write(js)
+}
+
+//***************  VISIBILITY ***************************
+// filterVisiblePosts drops the posts viewer is not allowed to see: posts of
+// private users viewer doesn't (approved) follow, and of banned users.
+func filterVisiblePosts(ctx context.Context, viewer string, ps []Post) ([]Post, error) {
+	var authors []string
+	for _, p := range ps {
+		authors = append(authors, p.User)
+	}
+	profiles, err := getProfiles(ctx, authors)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := visibleAuthors(ctx, viewer, profiles)
+	if err != nil {
+		return nil, err
+	}
+	bans, err := getBans(ctx, authors)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []Post
+	for _, p := range ps {
+		if visible[p.User] && !bans[p.User].active() {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
+
+// readVisiblePost reads a post for viewer, answering 404 (and false) when it
+// doesn't exist or viewer isn't allowed to see it: a hidden post looks like a
+// missing one.
+func readVisiblePost(ctx context.Context, w http.ResponseWriter, viewer, id string) (*Post, bool) {
+	p, err := postStore.Read(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to read post", http.StatusInternalServerError)
+		return nil, false
+	}
+	if p == nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return nil, false
+	}
+	visible, err := filterVisiblePosts(ctx, viewer, []Post{*p})
+	if err != nil {
+		fmt.Printf("Failed to check visibility of post %s %v\n", id, err)
+		http.Error(w, "Failed to read post", http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(visible) == 0 {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return nil, false
+	}
+	return p, true
+}
+
+// visibleAuthors tells for each author (with their profile) whether viewer
+// can see them: public users, themselves, and private users they follow.
+func visibleAuthors(ctx context.Context, viewer string, profiles map[string]*Profile) (map[string]bool, error) {
+	visible := map[string]bool{}
+	var private []string
+	for name, prof := range profiles {
+		if name == viewer || prof == nil || !prof.Private {
+			visible[name] = true
+		} else {
+			private = append(private, name)
+		}
+	}
+	if len(private) == 0 {
+		return visible, nil
+	}
+
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	keys := make([]string, len(private))
+	for i, name := range private {
+		keys[i] = followingKey(viewer, name)
+	}
+	prefix := followingKey(viewer, "")
+	err = bt_client.Open(FOLLOW_TABLE).ReadRows(ctx, bigtable.RowList(keys), func(row bigtable.Row) bool {
+		if followStatusFromRow(row) == FOLLOW_APPROVED {
+			visible[strings.TrimPrefix(row.Key(), prefix)] = true
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return visible, err
+}
+
+//***************  FOLLOW STORE ***************************
+func followingKey(follower, followee string) string { return "following#" + follower + "#" + followee }
+func followerKey(followee, follower string) string  { return "follower#" + followee + "#" + follower }
+
+func followStatusFromRow(row bigtable.Row) string {
+	for _, item := range row["follow"] {
+		if item.Column == "follow:status" {
+			return string(item.Value)
+		}
+	}
+	return ""
+}
+
+// followStatus returns FOLLOW_APPROVED, FOLLOW_PENDING or "" (not following).
+func followStatus(ctx context.Context, follower, followee string) (string, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return "", err
+	}
+	defer bt_client.Close()
+
+	row, err := bt_client.Open(FOLLOW_TABLE).ReadRow(ctx, followingKey(follower, followee), bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return "", err
+	}
+	return followStatusFromRow(row), nil
+}
+
+func saveFollow(ctx context.Context, follower, followee, status string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(FOLLOW_TABLE)
+	t := bigtable.Now()
+	for _, key := range []string{followingKey(follower, followee), followerKey(followee, follower)} {
+		mut := bigtable.NewMutation()
+		mut.Set("follow", "status", t, []byte(status))
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followingOf returns who username follows, with the given status.
+func followingOf(ctx context.Context, username, status string) ([]string, error) {
+	return listFollows(ctx, followingKey(username, ""), status)
+}
+
+// followersOf returns who follows username, with the given status.
+func followersOf(ctx context.Context, username, status string) ([]string, error) {
+	return listFollows(ctx, followerKey(username, ""), status)
+}
+
+func listFollows(ctx context.Context, prefix, status string) ([]string, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	names := []string{}
+	err = bt_client.Open(FOLLOW_TABLE).ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		if followStatusFromRow(row) == status {
+			names = append(names, strings.TrimPrefix(row.Key(), prefix))
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return names, err
+}
+
+// deleteFollowsOfUser removes the follows of username in both directions
+// (both rows of each), for account deletion.
+func deleteFollowsOfUser(ctx context.Context, username string) (int, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return 0, err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(FOLLOW_TABLE)
+	var keys []string
+	for _, side := range []struct {
+		prefix  string
+		reverse func(other string) string
+	}{
+		{followingKey(username, ""), func(other string) string { return followerKey(other, username) }},
+		{followerKey(username, ""), func(other string) string { return followingKey(other, username) }},
+	} {
+		err = tbl.ReadRows(ctx, bigtable.PrefixRange(side.prefix), func(row bigtable.Row) bool {
+			keys = append(keys, row.Key(), side.reverse(strings.TrimPrefix(row.Key(), side.prefix)))
+			return true
+		}, bigtable.RowFilter(bigtable.StripValueFilter()))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, key := range keys {
+		mut := bigtable.NewMutation()
+		mut.DeleteRow()
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys) / 2, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadVisiblePost(t *testing.T) {
+	b := setupMemBackends(t)
+	ctx := context.Background()
+	b.posts.Save(&Post{User: "alice", Message: "hi"}, "p1")
+	b.posts.Save(&Post{User: "mallory", Message: "spam"}, "p2")
+	b.accounts.bans["mallory"] = &Ban{Reason: "spam"}
+	b.accounts.profiles["carol"] = &Profile{Username: "carol", Private: true}
+	b.posts.Save(&Post{User: "carol", Message: "mine"}, "p3")
+
+	tests := []struct {
+		viewer, id string
+		code       int
+	}{
+		{"bob", "p1", http.StatusOK},
+		{"bob", "p2", http.StatusNotFound}, // banned author
+		{"bob", "nope", http.StatusNotFound},
+		{"carol", "p3", http.StatusOK}, // private, but her own
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p, ok := readVisiblePost(ctx, w, tt.viewer, tt.id)
+		if ok != (tt.code == http.StatusOK) || w.Code != tt.code {
+			t.Errorf("%s reading %s: got %v/%d, want %d", tt.viewer, tt.id, ok, w.Code, tt.code)
+		}
+		if ok && p == nil {
+			t.Errorf("%s reading %s: no post", tt.viewer, tt.id)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+const (
+	EARTH_RADIUS_KM = 6371.0
+	MILES_PER_KM    = 0.621371
+
+	// Points a search polygon can have, a long geo_polygon is slow to match.
+	MAX_POLYGON_POINTS = 500
+
+	// Most LOCATION_JITTER_METERS can be, more would move posts off their street.
+	MAX_LOCATION_JITTER_METERS = 50
+	METERS_PER_DEGREE_LAT      = 111320.0
+)
+
+//***************  GEO HELPER ***************************
+// distanceKm returns the great-circle distance between two points (haversine formula).
+func distanceKm(a, b Location) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Sqrt(h))
+}
+
+// jitterLocation moves loc by up to meters in a direction picked from the
+// post id, for maps: posts at the same spot (a venue) get markers of their
+// own instead of one stack. The same post always moves the same way, so its
+// marker doesn't jump between searches.
+func jitterLocation(id string, loc Location, meters float64) Location {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	angle := float64(sum&0xffffffff) / (1 << 32) * 2 * math.Pi
+	// sqrt --> spread evenly over the disc, not bunched at the center
+	dist := meters * math.Sqrt(float64(sum>>32)/(1<<32))
+
+	lat := loc.Lat + dist*math.Cos(angle)/METERS_PER_DEGREE_LAT
+	lon := loc.Lon
+	// near the poles a meter is too many degrees of lon, leave lon alone
+	if c := math.Cos(loc.Lat * math.Pi / 180); c > 0.01 {
+		lon += dist * math.Sin(angle) / (METERS_PER_DEGREE_LAT * c)
+	}
+	return Location{Lat: math.Max(-90, math.Min(90, lat)), Lon: math.Max(-180, math.Min(180, lon))}
+}
+
+// roundedPtr rounds f to the given decimals (2 --> 0.01), as a pointer for
+// optional JSON fields.
+func roundedPtr(f float64, decimals int) *float64 {
+	pow := math.Pow(10, float64(decimals))
+	r := math.Round(f*pow) / pow
+	return &r
+}
+
+// parseLocation validates the lat/lon sent by a client: both are required,
+// must be numbers, and in range (lat -90..90, lon -180..180).
+func parseLocation(latStr, lonStr string) (Location, error) {
+	if latStr == "" || lonStr == "" {
+		return Location{}, fmt.Errorf("lat and lon are required")
+	}
+	lat, err := parseLat(latStr)
+	if err != nil {
+		return Location{}, err
+	}
+	lon, err := parseLon(lonStr)
+	if err != nil {
+		return Location{}, err
+	}
+	return Location{Lat: lat, Lon: lon}, nil
+}
+
+// parseLat / parseLon check one coordinate, for callers reporting each field.
+func parseLat(latStr string) (float64, error) {
+	lat, err := strconv.ParseFloat(latStr, 64)
+	if err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return 0, fmt.Errorf("Invalid lat %q, it must be between -90 and 90", latStr)
+	}
+	return lat, nil
+}
+
+func parseLon(lonStr string) (float64, error) {
+	lon, err := strconv.ParseFloat(lonStr, 64)
+	if err != nil || math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return 0, fmt.Errorf("Invalid lon %q, it must be between -180 and 180", lonStr)
+	}
+	return lon, nil
+}
+
+//***************  GEO POLYGON ***************************
+// Polygon is a closed ring of points, the first point repeated at the end.
+type Polygon []Location
+
+// parsePolygon reads a GeoJSON polygon:
+//
+//	{"type":"Polygon","coordinates":[[[lon,lat],[lon,lat],[lon,lat],[lon,lat]]]}
+//
+// GeoJSON puts lon before lat. Only the outer ring is used, geo_polygon has
+// no holes. The ring must be closed (last point == first) and have at least
+// 3 distinct points.
+func parsePolygon(s string) (Polygon, error) {
+	var g struct {
+		Type        string        `json:"type"`
+		Coordinates [][][]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal([]byte(s), &g); err != nil {
+		return nil, fmt.Errorf("Invalid polygon, it must be a GeoJSON Polygon")
+	}
+	if g.Type != "Polygon" {
+		return nil, fmt.Errorf("Invalid polygon type %q, only Polygon is supported", g.Type)
+	}
+	if len(g.Coordinates) != 1 {
+		return nil, fmt.Errorf("Invalid polygon, it must have exactly one ring (no holes)")
+	}
+	ring := g.Coordinates[0]
+	if len(ring) > MAX_POLYGON_POINTS {
+		return nil, fmt.Errorf("Invalid polygon, it has more than %d points", MAX_POLYGON_POINTS)
+	}
+
+	var poly Polygon
+	for _, pos := range ring {
+		if len(pos) != 2 {
+			return nil, fmt.Errorf("Invalid polygon, each point must be [lon, lat]")
+		}
+		lon, lat := pos[0], pos[1]
+		if math.IsNaN(lat) || lat < -90 || lat > 90 || math.IsNaN(lon) || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("Invalid polygon point [%v, %v], lat must be between -90 and 90, lon between -180 and 180", lon, lat)
+		}
+		poly = append(poly, Location{Lat: lat, Lon: lon})
+	}
+	// closed + 3 distinct points --> at least 4 positions
+	if len(poly) < 4 {
+		return nil, fmt.Errorf("Invalid polygon, it needs at least 3 points")
+	}
+	if poly[0] != poly[len(poly)-1] {
+		return nil, fmt.Errorf("Invalid polygon, it is not closed (the last point must be the first one)")
+	}
+	distinct := map[Location]bool{}
+	for _, p := range poly {
+		distinct[p] = true
+	}
+	if len(distinct) < 3 {
+		return nil, fmt.Errorf("Invalid polygon, it needs at least 3 points")
+	}
+	return poly, nil
+}
+
+// contains tells if loc is inside the polygon (ray casting, lat/lon taken as
+// a plane, like geo_polygon does for small areas).
+func (poly Polygon) contains(loc Location) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.Lat > loc.Lat) != (b.Lat > loc.Lat) &&
+			loc.Lon < (b.Lon-a.Lon)*(loc.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			in = !in
+		}
+	}
+	return in
+}
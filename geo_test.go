@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		lat, lon string
+		ok       bool
+	}{
+		{"37.5", "-122.3", true},
+		{"-90", "180", true},
+		{"90", "-180", true},
+		{"", "-122.3", false},
+		{"37.5", "", false},
+		{"90.1", "0", false},
+		{"0", "-180.5", false},
+		{"abc", "0", false},
+		{"NaN", "0", false},
+		{"0", "NaN", false},
+		{"Inf", "0", false},
+	}
+	for _, tt := range tests {
+		loc, err := parseLocation(tt.lat, tt.lon)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q,%q: got %v, %v", tt.lat, tt.lon, loc, err)
+		}
+	}
+	if loc, _ := parseLocation("37.5", "-122.3"); loc != (Location{Lat: 37.5, Lon: -122.3}) {
+		t.Errorf("got %v", loc)
+	}
+}
+
+func TestParseCircle(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config = &Config{DefaultRadiusKm: 20, MaxRadiusKm: 100}
+
+	tests := []struct {
+		query  string
+		radius float64
+		ok     bool
+	}{
+		{"lat=1&lon=2", 20, true},
+		{"lat=1&lon=2&range=5", 5, true},
+		{"lat=1&lon=2&range=500", 100, true}, // capped
+		{"lat=1&lon=2&range=0", 0, false},
+		{"lat=1&lon=2&range=-3", 0, false},
+		{"lat=1&lon=2&range=far", 0, false},
+		{"lat=1", 0, false},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		_, radius, err := parseCircle(query)
+		if (err == nil) != tt.ok || radius != tt.radius {
+			t.Errorf("%s: got %v, %v", tt.query, radius, err)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// Google's public keys (x509 certs by key id) which sign its ID tokens.
+	GOOGLE_CERTS_URL = "https://www.googleapis.com/oauth2/v1/certs"
+	// Used when Google's response has no max-age.
+	GOOGLE_CERTS_TTL = time.Hour
+
+	// Username of a new Google user: the start of the email, then a few
+	// random digits when it is taken.
+	MAX_GOOGLE_USERNAME_LENGTH = 20
+	MAX_GOOGLE_USERNAME_TRIES  = 5
+	GOOGLE_USERNAME_SUFFIX     = 4
+
+	// A token with a key id we don't know makes us read Google's keys again
+	// (they rotate), at most once in this interval: anyone can send one.
+	GOOGLE_CERTS_REFETCH_INTERVAL = time.Minute
+
+	// An ID token confirming a sensitive action (DELETE /user/me) must be
+	// issued this recently: the user just signed in with Google again.
+	GOOGLE_REAUTH_MAX_AGE = 5 * time.Minute
+)
+
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// GoogleIdentity is what we use of a checked Google ID token.
+type GoogleIdentity struct {
+	Sub   string
+	Email string
+	// unix time the token was issued
+	IssuedAt int64
+}
+
+//***************  GOOGLE LOGIN ***************************
+// googleLoginHandler signs in with a Google ID token, {"id_token": "..."}:
+//   - a user linked to this Google account gets our token
+//   - no user with this email --> one is created (no usable password), linked
+//   - a password user with this email --> 409, they log in with the password
+//     and link Google with POST /user/me/google first, so nobody gets into
+//     an existing account only because Google says they own its email
+func googleLoginHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one Google login request")
+	w.Header().Set("Content-Type", "text/plain")
+	if config.GoogleClientID == "" {
+		http.Error(w, "Google login is not setup", http.StatusNotFound)
+		return
+	}
+
+	id, err := googleIdentityFromBody(r)
+	if err != nil {
+		fmt.Printf("Invalid Google ID token %v\n", err)
+		http.Error(w, "Invalid Google ID token", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := context.Background()
+	u, err := findUserByEmail(id.Email)
+	if err != nil {
+		fmt.Printf("Failed to find user by email %v\n", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if u == nil {
+		if u, err = addGoogleUser(ctx, id); err != nil {
+			fmt.Printf("Failed to add Google user %s %v\n", id.Email, err)
+			http.Error(w, "Failed to add a new user", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		profile, err := getProfile(ctx, u.Username)
+		if err != nil {
+			fmt.Printf("Failed to read profile %s %v\n", u.Username, err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+		if profile == nil || profile.GoogleSub != id.Sub {
+			http.Error(w, "An account with this email exists, log in with its password and link your Google account", http.StatusConflict)
+			return
+		}
+	}
+
+	bans, err := getBans(ctx, []string{u.Username})
+	if err != nil {
+		fmt.Printf("Failed to check ban of %s %v\n", u.Username, err)
+	}
+	if b := bans[u.Username]; b.active() {
+		http.Error(w, banMessage(b), http.StatusForbidden)
+		return
+	}
+
+	tokenString, err := newSessionToken(u.Username)
+	if err != nil {
+		panic(err)
+	}
+	w.Write([]byte(tokenString))
+}
+
+// linkGoogleHandler links a Google account to the caller, {"id_token": "..."}.
+// The Google email must be the email of the account.
+func linkGoogleHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one link Google request from %s\n", username)
+	if config.GoogleClientID == "" {
+		http.Error(w, "Google login is not setup", http.StatusNotFound)
+		return
+	}
+
+	id, err := googleIdentityFromBody(r)
+	if err != nil {
+		fmt.Printf("Invalid Google ID token %v\n", err)
+		http.Error(w, "Invalid Google ID token", http.StatusUnauthorized)
+		return
+	}
+	u, err := getUser(username)
+	if err != nil {
+		fmt.Printf("Failed to read user %s %v\n", username, err)
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return
+	}
+	if !strings.EqualFold(u.Email, id.Email) {
+		http.Error(w, "The Google account has another email than yours", http.StatusConflict)
+		return
+	}
+	if err := setGoogleSub(context.Background(), username, id.Sub); err != nil {
+		fmt.Printf("Failed to link Google account of %s %v\n", username, err)
+		http.Error(w, "Failed to link Google account", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// googleConfirms tells whether idToken is a fresh ID token of the Google
+// account linked to username, the re-confirmation of a user who has no
+// password of their own (see addGoogleUser).
+func googleConfirms(ctx context.Context, username, idToken string) bool {
+	if config.GoogleClientID == "" {
+		return false
+	}
+	id, err := verifyGoogleIDToken(idToken)
+	if err != nil {
+		fmt.Printf("Invalid Google ID token %v\n", err)
+		return false
+	}
+	if time.Since(time.Unix(id.IssuedAt, 0)) > GOOGLE_REAUTH_MAX_AGE {
+		return false
+	}
+	profile, err := getProfile(ctx, username)
+	if err != nil {
+		fmt.Printf("Failed to read profile %s %v\n", username, err)
+		return false
+	}
+	return profile != nil && profile.GoogleSub != "" && profile.GoogleSub == id.Sub
+}
+
+func googleIdentityFromBody(r *http.Request) (*GoogleIdentity, error) {
+	var body struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return verifyGoogleIDToken(body.IdToken)
+}
+
+// addGoogleUser creates the account of a new Google user. Its password is
+// random and never told, so it can only sign in with Google (or reset it).
+func addGoogleUser(ctx context.Context, id *GoogleIdentity) (*User, error) {
+	username, err := freeGoogleUsername(id.Email)
+	if err != nil {
+		return nil, err
+	}
+	password, err := randomBase62(32)
+	if err != nil {
+		return nil, err
+	}
+	u := User{Username: username, Password: password, Email: id.Email, EmailVerified: true}
+	if !addUser(u) {
+		return nil, fmt.Errorf("cannot add user %s", username)
+	}
+	if err := setGoogleSub(ctx, username, id.Sub); err != nil {
+		return nil, err
+	}
+	fmt.Printf("User %s is added from Google\n", username)
+	return &u, nil
+}
+
+var notUsernameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// freeGoogleUsername makes a username from the email: "Jane.Doe@x.com" --> "jane_doe",
+// or "jane_doe1234" when it is taken. Every name tried must pass the policy,
+// like a name picked at signup.
+func freeGoogleUsername(email string) (string, error) {
+	base, err := googleUsernameBase(email, config.Policy)
+	if err != nil {
+		return "", err
+	}
+
+	name := base
+	for i := 0; i < MAX_GOOGLE_USERNAME_TRIES; i++ {
+		var errs ValidationErrors
+		config.Policy.checkUsername(&errs, "username", name)
+		if errs == nil {
+			if _, err := getUser(name); elastic.IsNotFound(err) {
+				return name, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+		suffix, err := randomDigits(GOOGLE_USERNAME_SUFFIX)
+		if err != nil {
+			return "", err
+		}
+		name = base + suffix
+	}
+	return "", fmt.Errorf("no free username for %s after %d tries", email, MAX_GOOGLE_USERNAME_TRIES)
+}
+
+// googleUsernameBase is the start of the email as a username, padded with
+// random digits up to the min length, cut so a suffix still fits the max.
+func googleUsernameBase(email string, p *ContentPolicy) (string, error) {
+	base := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+	base = strings.Trim(notUsernameChars.ReplaceAllString(base, "_"), "_")
+	if base == "" {
+		base = "user"
+	}
+	max := MAX_GOOGLE_USERNAME_LENGTH
+	if p.UsernameMaxLength-GOOGLE_USERNAME_SUFFIX < max {
+		max = p.UsernameMaxLength - GOOGLE_USERNAME_SUFFIX
+	}
+	if max > 0 && len(base) > max {
+		base = base[:max]
+	}
+	if len(base) < p.UsernameMinLength {
+		pad, err := randomDigits(p.UsernameMinLength - len(base))
+		if err != nil {
+			return "", err
+		}
+		base += pad
+	}
+	return base, nil
+}
+
+func randomDigits(n int) (string, error) {
+	s, err := randomBase62(n)
+	if err != nil {
+		return "", err
+	}
+	digits := make([]byte, n)
+	for i := range digits {
+		digits[i] = '0' + s[i]%10
+	}
+	return string(digits), nil
+}
+
+//***************  GOOGLE ID TOKEN ***************************
+// verifyGoogleIDToken checks the signature (Google's keys), issuer, audience
+// (our client id) and expiry of an ID token, and that its email is verified.
+func verifyGoogleIDToken(idToken string) (*GoogleIdentity, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return googlePublicKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if !claims.VerifyAudience(config.GoogleClientID, true) {
+		return nil, fmt.Errorf("token is for another client")
+	}
+	issuerOK := false
+	for _, iss := range googleIssuers {
+		issuerOK = issuerOK || claims.VerifyIssuer(iss, true)
+	}
+	if !issuerOK {
+		return nil, fmt.Errorf("token is not issued by Google")
+	}
+
+	id := &GoogleIdentity{}
+	id.Sub, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	if iat, ok := claims["iat"].(float64); ok {
+		id.IssuedAt = int64(iat)
+	}
+	// a bool, but some tokens have it as a string
+	verified := fmt.Sprint(claims["email_verified"]) == "true"
+	if id.Sub == "" || id.Email == "" || !verified {
+		return nil, fmt.Errorf("token has no verified email")
+	}
+	return id, nil
+}
+
+// Google's keys, read again when they expire (Cache-Control max-age).
+var (
+	googleKeysMu      sync.Mutex
+	googleKeys        map[string]*rsa.PublicKey
+	googleKeysExpires time.Time
+	googleKeysFetched time.Time
+)
+
+func googlePublicKey(kid string) (*rsa.PublicKey, error) {
+	googleKeysMu.Lock()
+	defer googleKeysMu.Unlock()
+
+	// expired or an unknown kid --> read them again, but not more often than
+	// the interval (a failed fetch counts too), the old keys do until then
+	now := time.Now()
+	due := now.Sub(googleKeysFetched) >= GOOGLE_CERTS_REFETCH_INTERVAL
+	if due && (googleKeys == nil || now.After(googleKeysExpires) || googleKeys[kid] == nil) {
+		googleKeysFetched = now
+		keys, ttl, err := fetchGoogleKeys()
+		if err != nil {
+			return nil, err
+		}
+		googleKeys, googleKeysExpires = keys, now.Add(ttl)
+	}
+	key := googleKeys[kid]
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func fetchGoogleKeys() (map[string]*rsa.PublicKey, time.Duration, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(GOOGLE_CERTS_URL)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Google certs returned %s", resp.Status)
+	}
+
+	var certs map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return nil, 0, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for kid, cert := range certs {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(cert))
+		if err != nil {
+			return nil, 0, fmt.Errorf("bad Google cert %s: %v", kid, err)
+		}
+		keys[kid] = key
+	}
+
+	ttl := GOOGLE_CERTS_TTL
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && secs > 0 {
+				ttl = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return keys, ttl, nil
+}
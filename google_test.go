@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoogleUsernameBase(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		email  string
+		prefix string
+		length int
+	}{
+		{"Jane.Doe@x.com", "jane_doe", 8},
+		// below USERNAME_MIN_LENGTH --> padded with digits
+		{"a@x.com", "a", USERNAME_MIN_LENGTH},
+		{"...@x.com", "user", 4},
+		{strings.Repeat("a", 40) + "@x.com", "aaaa", MAX_GOOGLE_USERNAME_LENGTH},
+	}
+	for _, tt := range tests {
+		base, err := googleUsernameBase(tt.email, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(base, tt.prefix) || len(base) != tt.length {
+			t.Errorf("%s: got %q", tt.email, base)
+		}
+		var errs ValidationErrors
+		p.checkUsername(&errs, "username", base)
+		if errs != nil {
+			t.Errorf("%s: %q is refused by the policy: %v", tt.email, base, errs)
+		}
+	}
+
+	// room for the suffix under a lower USERNAME_MAX_LENGTH
+	p.UsernameMaxLength = 10
+	base, _ := googleUsernameBase(strings.Repeat("a", 40)+"@x.com", p)
+	if len(base)+GOOGLE_USERNAME_SUFFIX != 10 {
+		t.Errorf("got %q, want %d chars", base, 10-GOOGLE_USERNAME_SUFFIX)
+	}
+}
+
+func TestGooglePublicKeyUnknownKid(t *testing.T) {
+	known := &rsa.PublicKey{}
+	googleKeysMu.Lock()
+	oldKeys, oldExpires, oldFetched := googleKeys, googleKeysExpires, googleKeysFetched
+	googleKeys = map[string]*rsa.PublicKey{"k1": known}
+	googleKeysExpires = time.Now().Add(time.Hour)
+	googleKeysFetched = time.Now()
+	googleKeysMu.Unlock()
+	t.Cleanup(func() {
+		googleKeysMu.Lock()
+		googleKeys, googleKeysExpires, googleKeysFetched = oldKeys, oldExpires, oldFetched
+		googleKeysMu.Unlock()
+	})
+
+	if key, err := googlePublicKey("k1"); err != nil || key != known {
+		t.Errorf("known kid: got %v %v", key, err)
+	}
+	// fetched just now --> Google is not asked again
+	_, err := googlePublicKey("forged")
+	if err == nil || !strings.Contains(err.Error(), "unknown key id") {
+		t.Errorf("got %v, want unknown key id", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const (
+	// BigTable table to remember the Idempotency-Key of posts.
+	// row key: <username>#<key>, column: result:post_id
+	IDEMPOTENCY_TABLE = "idempotency"
+)
+
+//***************  IDEMPOTENCY KEY ***************************
+// reserveIdempotencyKey binds key (scoped to username) to postID.
+// If the key was already used within the TTL, nothing is written and the
+// post id of the first request is returned. Otherwise it returns "".
+func reserveIdempotencyKey(ctx context.Context, username, key, postID string) (string, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return "", err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(IDEMPOTENCY_TABLE)
+	rowKey := idempotencyRowKey(username, key)
+
+	// Only a cell written within the TTL counts, older keys can be reused.
+	fresh := bigtable.ChainFilters(
+		bigtable.ColumnFilter("post_id"),
+		bigtable.TimestampRangeFilter(time.Now().Add(-config.IdempotencyTTL), time.Time{}),
+	)
+	mut := bigtable.NewMutation()
+	mut.Set("result", "post_id", bigtable.Now(), []byte(postID))
+
+	// Check and set in one call, so two retries racing each other can't both win.
+	var matched bool
+	condMut := bigtable.NewCondMutation(fresh, nil, mut)
+	if err := tbl.Apply(ctx, rowKey, condMut, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return "", err
+	}
+	if !matched {
+		return "", nil
+	}
+
+	row, err := tbl.ReadRow(ctx, rowKey, bigtable.RowFilter(fresh))
+	if err != nil {
+		return "", err
+	}
+	for _, item := range row["result"] {
+		return string(item.Value), nil
+	}
+	// expired between the two calls, just treat it as a new request
+	return "", nil
+}
+
+// releaseIdempotencyKey forgets the key, used when the post failed to be saved.
+func releaseIdempotencyKey(ctx context.Context, username, key string) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	bt_client.Open(IDEMPOTENCY_TABLE).Apply(ctx, idempotencyRowKey(username, key), mut)
+}
+
+func idempotencyRowKey(username, key string) string {
+	return username + "#" + key
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// How post ids are made (ID_STRATEGY).
+	ID_STRATEGY_UUID  = "uuid"  // 36 chars, e.g. 9a0f6b3e-5c1d-4f0e-8b7a-2d9c1e3f4a5b (default)
+	ID_STRATEGY_SHORT = "short" // SHORT_ID_LENGTH base62 chars, e.g. 4fZq81XbKd
+
+	// 62^10 ~ 8*10^17 ids, a collision is already unlikely before we check.
+	SHORT_ID_LENGTH = 10
+	// New short ids tried before giving up, each one already taken costs a try.
+	MAX_SHORT_ID_ATTEMPTS = 5
+
+	BASE62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+//***************  POST ID ***************************
+// newPostID returns the id of a new post, the same in ES, BigTable and GCS.
+// Short ids are random, so each one is reserved in the post store (the
+// source of truth, where every post has a row) before use: checked and
+// claimed at once, two posts can't get the same id. A post failing before
+// it is saved gives its id back with releasePostID.
+func newPostID(ctx context.Context) (string, error) {
+	if config.IDStrategy != ID_STRATEGY_SHORT {
+		return uuid.New(), nil
+	}
+
+	for i := 0; i < MAX_SHORT_ID_ATTEMPTS; i++ {
+		id, err := randomBase62(SHORT_ID_LENGTH)
+		if err != nil {
+			return "", err
+		}
+		reserved, err := postStore.ReserveID(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			return id, nil
+		}
+		fmt.Printf("Short id %s is taken, trying another one\n", id)
+	}
+	return "", fmt.Errorf("no free short id after %d attempts", MAX_SHORT_ID_ATTEMPTS)
+}
+
+// releasePostID gives back the id of a post which failed before it was
+// saved. Only short ids are reserved.
+func releasePostID(ctx context.Context, id string) {
+	if config.IDStrategy != ID_STRATEGY_SHORT {
+		return
+	}
+	if err := postStore.Delete(ctx, id); err != nil {
+		fmt.Printf("Failed to release post id %s %v\n", id, err)
+	}
+}
+
+// reservePostRow writes post:reserved in the row of id if the row is empty,
+// and tells whether it did. The row is then a post without post:user until
+// the post is saved, see readPostFromBigTable.
+func reservePostRow(ctx context.Context, id string) (bool, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return false, err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.Set("post", "reserved", bigtable.Now(), []byte("1"))
+	// any cell at all --> taken
+	var taken bool
+	cond := bigtable.NewCondMutation(bigtable.StripValueFilter(), nil, mut)
+	if err := bt_client.Open("post").Apply(ctx, id, cond, bigtable.GetCondMutationResult(&taken)); err != nil {
+		return false, err
+	}
+	return !taken, nil
+}
+
+// randomBase62 returns n random chars of BASE62 (URL-safe), from crypto/rand.
+func randomBase62(n int) (string, error) {
+	max := big.NewInt(int64(len(BASE62)))
+	b := make([]byte, n)
+	for i := range b {
+		k, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = BASE62[k.Int64()]
+	}
+	return string(b), nil
+}
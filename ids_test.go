@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// takenPostStore says the first taken ids it is asked for are taken.
+type takenPostStore struct {
+	*memPostStore
+	taken int
+	tried []string
+}
+
+func (s *takenPostStore) ReserveID(ctx context.Context, id string) (bool, error) {
+	s.tried = append(s.tried, id)
+	if len(s.tried) <= s.taken {
+		return false, nil
+	}
+	return s.memPostStore.ReserveID(ctx, id)
+}
+
+func TestNewPostIDCollision(t *testing.T) {
+	b := setupMemBackends(t)
+	config.IDStrategy = ID_STRATEGY_SHORT
+	store := &takenPostStore{memPostStore: b.posts, taken: 2}
+	postStore = store
+
+	id, err := newPostID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.tried) != 3 || id != store.tried[2] {
+		t.Errorf("got %s after %v, want the third id tried", id, store.tried)
+	}
+	// reserved --> not given twice
+	if ok, _ := b.posts.ReserveID(context.Background(), id); ok {
+		t.Errorf("id %s was reserved again", id)
+	}
+
+	// released --> free again
+	releasePostID(context.Background(), id)
+	if ok, _ := b.posts.ReserveID(context.Background(), id); !ok {
+		t.Errorf("released id %s is still taken", id)
+	}
+}
+
+func TestNewPostIDAllTaken(t *testing.T) {
+	b := setupMemBackends(t)
+	config.IDStrategy = ID_STRATEGY_SHORT
+	store := &takenPostStore{memPostStore: b.posts, taken: MAX_SHORT_ID_ATTEMPTS}
+	postStore = store
+
+	if id, err := newPostID(context.Background()); err == nil {
+		t.Errorf("got id %s, want an error", id)
+	}
+	if len(store.tried) != MAX_SHORT_ID_ATTEMPTS {
+		t.Errorf("%d ids tried, want %d", len(store.tried), MAX_SHORT_ID_ATTEMPTS)
+	}
+}
+
+func TestReserveIDOfSavedPost(t *testing.T) {
+	s := newMemPostStore()
+	s.Save(&Post{User: "alice", Message: "hi"}, "p1")
+	if ok, _ := s.ReserveID(context.Background(), "p1"); ok {
+		t.Error("the id of a saved post was reserved")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// Posts written to BigTable then bulk-indexed to ES together.
+	IMPORT_BATCH_SIZE = 500
+	// Longest line (one post) of an import.
+	MAX_IMPORT_LINE_BYTES = 1 << 20
+	// Errors listed in the report, the counts are always complete.
+	MAX_IMPORT_ERRORS = 1000
+
+	AUDIT_IMPORT_POSTS = "import_posts"
+)
+
+// ImportReport is the outcome of one /admin/import.
+type ImportReport struct {
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// ImportError tells why the post of a line (1-based) was not imported.
+type ImportError struct {
+	Line   int              `json:"line"`
+	Error  string           `json:"error"`
+	Fields ValidationErrors `json:"fields,omitempty"`
+}
+
+func (rep *ImportReport) fail(line int, msg string, fields ValidationErrors) {
+	rep.Failed++
+	if len(rep.Errors) < MAX_IMPORT_ERRORS {
+		rep.Errors = append(rep.Errors, ImportError{Line: line, Error: msg, Fields: fields})
+	}
+}
+
+// a post waiting in the batch, with the line it came from
+type importedPost struct {
+	line int
+	post *Post
+}
+
+//***************  ADMIN IMPORT ***************************
+// importHandler imports posts from NDJSON, one post object per line:
+//
+//	{"user": "jack", "message": "hi", "location": {"lat": 37.4, "lon": -122.1}, "url": "https://...", "created": 1500000000}
+//
+// Each post gets a new id, created defaults to now. A bad line is reported
+// and skipped, the other lines are still imported. Blank lines are ignored.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one admin import request")
+	ctx := context.Background()
+	rep := &ImportReport{Errors: []ImportError{}}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), MAX_IMPORT_LINE_BYTES)
+	var batch []importedPost
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		p := &Post{}
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(p); err != nil {
+			rep.fail(line, "invalid JSON: "+err.Error(), nil)
+			continue
+		}
+		if errs := validateImportedPost(p); errs != nil {
+			rep.fail(line, "invalid post", errs)
+			continue
+		}
+		if !moderateNewPost(p) {
+			rep.fail(line, "invalid post", ValidationErrors{{Field: "message", Message: "message is not allowed"}})
+			continue
+		}
+		batch = append(batch, importedPost{line: line, post: p})
+		if len(batch) == IMPORT_BATCH_SIZE {
+			importBatch(ctx, batch, rep)
+			batch = nil
+		}
+	}
+	importBatch(ctx, batch, rep)
+
+	status := http.StatusOK
+	if err := scanner.Err(); err != nil {
+		// the lines before are imported, say where it stopped
+		rep.fail(line+1, "cannot read line: "+err.Error(), nil)
+		status = http.StatusBadRequest
+	}
+	audit(r, AUDIT_IMPORT_POSTS, "posts", fmt.Sprintf("imported %d, failed %d", rep.Imported, rep.Failed))
+	fmt.Printf("Import done: %d imported, %d failed\n", rep.Imported, rep.Failed)
+
+	js, err := json.Marshal(rep)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// importBatch writes the posts to BigTable one by one, then indexes the
+// saved ones to ES in one bulk request. A post ES refuses is removed from
+// BigTable again, so it's not half imported.
+func importBatch(ctx context.Context, batch []importedPost, rep *ImportReport) {
+	if len(batch) == 0 {
+		return
+	}
+	es_client, err := getESClient()
+	if err != nil {
+		for _, ip := range batch {
+			rep.fail(ip.line, "ES is not setup: "+err.Error(), nil)
+		}
+		return
+	}
+
+	var saved []importedPost
+	bulk := es_client.Bulk()
+	for _, ip := range batch {
+		p := ip.post
+		if p.Created == 0 {
+			p.Created = time.Now().Unix()
+		}
+		if p.Url == "" && len(p.Urls) > 0 {
+			p.Url = p.Urls[0]
+		}
+		id, err := newPostID(ctx)
+		if err == nil {
+			p.Id = id
+			if err = postStore.Save(p, id); err != nil {
+				releasePostID(ctx, id)
+			}
+		}
+		if err != nil {
+			rep.fail(ip.line, "cannot save post: "+err.Error(), nil)
+			continue
+		}
+		saved = append(saved, ip)
+		bulk = bulk.Add(elastic.NewBulkIndexRequest().Index(config.ESIndex).Type(config.ESType).Id(p.Id).Doc(p))
+	}
+	if len(saved) == 0 {
+		return
+	}
+
+	// id --> why ES refused it
+	failed := map[string]string{}
+	bulkCtx, cancel := esContext(ES_OP_BULK)
+	defer cancel()
+	res, err := bulk.Refresh(config.ESRefresh).DoC(bulkCtx)
+	err = esError(bulkCtx, ES_OP_BULK, err)
+	if err != nil {
+		for _, ip := range saved {
+			failed[ip.post.Id] = err.Error()
+		}
+	} else {
+		for _, item := range res.Failed() {
+			failed[item.Id] = "rejected by ES"
+			if item.Error != nil {
+				failed[item.Id] = item.Error.Reason
+			}
+		}
+	}
+	for _, ip := range saved {
+		reason, ok := failed[ip.post.Id]
+		if !ok {
+			rep.Imported++
+			continue
+		}
+		if err := postStore.Delete(ctx, ip.post.Id); err != nil {
+			fmt.Printf("Rollback of imported post %s in BigTable failed %v\n", ip.post.Id, err)
+		}
+		rep.fail(ip.line, "cannot index post: "+reason, nil)
+	}
+}
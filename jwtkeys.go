@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key id of the secret tokens were signed with before JWT_KEYS, the default.
+const DEFAULT_JWT_KID = "default"
+
+// JWTKey is one secret of JWT_KEYS, tokens name it in their "kid" header.
+type JWTKey struct {
+	Kid    string
+	Secret []byte
+}
+
+//***************  JWT KEYS ***************************
+// Session tokens are signed with the first (newest) key of config.JWTKeys
+// and validated with whichever key their kid names, so the secret can be
+// rotated without logging everybody out:
+//  1. JWT_KEYS=new:<new secret>,default:<old secret>  --> new tokens use "new"
+//  2. a token lifetime (24h) later, drop the old key
+//
+// A token without kid (made before kids) is checked with the oldest key.
+//
+// The one-off email tokens and password fingerprints use the newest key
+// only (mySigningKey): a link mailed before a rotation stops working.
+
+// parseJWTKeys reads "kid:secret,kid:secret" (newest first).
+func parseJWTKeys(list []string) ([]JWTKey, error) {
+	var keys []JWTKey
+	seen := map[string]bool{}
+	for _, item := range list {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("JWT_KEYS entries must be kid:secret")
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("JWT_KEYS has kid %s twice", parts[0])
+		}
+		seen[parts[0]] = true
+		keys = append(keys, JWTKey{Kid: parts[0], Secret: []byte(parts[1])})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWT_KEYS needs at least one key")
+	}
+	return keys, nil
+}
+
+// signingKey is the key new session tokens are signed with.
+func signingKey() JWTKey {
+	return config.JWTKeys[0]
+}
+
+// sessionKey is the ValidationKeyGetter of jwtMiddleware: the secret of the
+// token's kid.
+func sessionKey(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodHS256 {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return config.JWTKeys[len(config.JWTKeys)-1].Secret, nil
+	}
+	for _, k := range config.JWTKeys {
+		if k.Kid == kid {
+			return k.Secret, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %s", kid)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// withJWTKeys sets config.JWTKeys for the test.
+func withJWTKeys(t *testing.T, list ...string) {
+	keys, err := parseJWTKeys(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := config
+	t.Cleanup(func() { config = old })
+	config = &Config{JWTKeys: keys}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	withJWTKeys(t, "default:old-secret")
+	before, err := newSessionToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated: new tokens use "new", the ones signed before still work
+	withJWTKeys(t, "new:new-secret", "default:old-secret")
+	after, err := newSessionToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]string{"older key": before, "newest key": after} {
+		if token, err := jwt.Parse(s, sessionKey); err != nil || !token.Valid {
+			t.Errorf("token of the %s rejected: %v", name, err)
+		}
+	}
+	if token, _ := jwt.Parse(after, sessionKey); token.Header["kid"] != "new" {
+		t.Errorf("new token signed with kid %v, want new", token.Header["kid"])
+	}
+
+	// the old key dropped --> its tokens are rejected
+	withJWTKeys(t, "new:new-secret")
+	if _, err := jwt.Parse(before, sessionKey); err == nil {
+		t.Error("token of a dropped key accepted")
+	}
+}
+
+func TestSessionKeyUnknownKid(t *testing.T) {
+	withJWTKeys(t, "new:new-secret", "default:old-secret")
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "alice"})
+	token.Header["kid"] = "other"
+	// even signed with a known secret
+	s, err := token.SignedString([]byte("new-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(s, sessionKey); err == nil {
+		t.Error("token of an unknown kid accepted")
+	}
+
+	// without kid (made before kids) --> the oldest key
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "alice"})
+	if s, err = token.SignedString([]byte("old-secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(s, sessionKey); err != nil {
+		t.Errorf("token without kid rejected: %v", err)
+	}
+}
+
+func TestParseJWTKeys(t *testing.T) {
+	for _, list := range [][]string{nil, {"nosecret"}, {":secret"}, {"a:1", "a:2"}} {
+		if _, err := parseJWTKeys(list); err == nil {
+			t.Errorf("%q accepted", list)
+		}
+	}
+}
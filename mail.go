@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+//***************  SEND EMAIL ***************************
+// sendMail sends a plain text email through the configured SMTP server.
+// Without SMTP config, the email is printed instead (local development).
+func sendMail(to, subject, body string) error {
+	if config.SMTPAddr == "" {
+		fmt.Printf("SMTP is not setup, email to %s: %s\n%s\n", to, subject, body)
+		return nil
+	}
+	// don't let a crafted address add its own headers
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+
+	msg := "From: " + config.MailFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+
+	var auth smtp.Auth
+	if config.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(config.SMTPAddr)
+		auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPassword, host)
+	}
+	return smtp.SendMail(config.SMTPAddr, auth, config.MailFrom, []string{to}, []byte(msg))
+}
@@ -3,13 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"mime/multipart"
+	"net"
 	"net/http"
-	"reflect"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	// Import Cloud Server & Plantform
 	"cloud.google.com/go/bigtable"
@@ -19,7 +26,7 @@ import (
 	"github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
-	"github.com/pborman/uuid"
+	"golang.org/x/sync/errgroup"
 )
 
 type Location struct {
@@ -27,17 +34,133 @@ type Location struct {
 	Lon float64 `json:"lon"`
 }
 type Post struct {
+	// Id is the same in ES, BigTable and GCS (the image name).
+	Id string `json:"id"`
 	// `json:"user"` is for the json parsing of this User field. Otherwise, by default it's 'User'.
 	User     string   `json:"user"`
 	Message  string   `json:"message"`
 	Location Location `json:"location"`
 	Url      string   `json:"url"`
+	// Urls of all the images of the post (the first one is Url too).
+	Urls []string `json:"urls,omitempty"`
+	// Created is the unix time (seconds) of the post, 0 for older posts.
+	Created int64 `json:"created,omitempty"`
+	// UpdatedAt is the unix time (seconds) of the last edit, 0 if never edited.
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+	// PublishAt is the unix time (seconds) a scheduled post goes live, 0 for
+	// a post live right away. See scheduled.go.
+	PublishAt int64 `json:"publish_at,omitempty"`
+	// Files tells the original name and size of each image, in the order of Urls.
+	Files []ImageInfo `json:"files,omitempty"`
+	// #hashtags (lowercase) and @mentions of the message, capped, see tags.go.
+	Hashtags []string `json:"hashtags,omitempty"`
+	Mentions []string `json:"mentions,omitempty"`
 }
 
 const (
-	INDEX    = "around"
-	TYPE     = "post"
-	DISTANCE = "200km"
+	// ES index and type of posts (default), see Config.ESIndex.
+	INDEX = "around"
+	TYPE  = "post"
+
+	// Where the server listens (default).
+	LISTEN_ADDR = ":8080"
+
+	// Defaults for the search radius (in km), can be overridden by config.
+	DEFAULT_RADIUS_KM = 200
+	MAX_RADIUS_KM     = 1000
+
+	// Hits returned by search when no size is given, and the most it can
+	// return whatever the size (default of MAX_SEARCH_RESULTS).
+	DEFAULT_SEARCH_SIZE = 10
+	MAX_SEARCH_RESULTS  = 100
+
+	// ES searches of /search running at the same time (default of
+	// MAX_CONCURRENT_SEARCHES), more get a 503.
+	MAX_CONCURRENT_SEARCHES = 50
+
+	// Images written to GCS at the same time (default of
+	// MAX_CONCURRENT_UPLOADS), and how long one more waits for its turn
+	// before the post gets a 503 (default of UPLOAD_QUEUE_TIMEOUT).
+	MAX_CONCURRENT_UPLOADS = 20
+	UPLOAD_QUEUE_TIMEOUT   = 10 * time.Second
+
+	// A search slower than this is logged (default of SLOW_SEARCH_THRESHOLD).
+	SLOW_SEARCH_THRESHOLD = time.Second
+	// Lowest level logged (default of LOG_LEVEL).
+	LOG_LEVEL = "info"
+
+	// How often the deferred BigTable writes are retried (default of
+	// BT_DEFER_RETRY_INTERVAL), see deferred.go.
+	BT_DEFER_RETRY_INTERVAL = 30 * time.Second
+
+	// The same message of the same user, this close in time and space, is
+	// taken for a double post (defaults of DUPLICATE_POST_*).
+	DUPLICATE_POST_WINDOW    = 2 * time.Minute
+	DUPLICATE_POST_RADIUS_KM = 0.1
+
+	// Largest request body (default of MAX_JSON_BODY_KB), except the post
+	// upload and the import.
+	MAX_JSON_BODY_KB = 64
+
+	// Defaults of the ES timeouts, per kind of call (ES_*_TIMEOUT).
+	ES_INDEX_TIMEOUT  = 5 * time.Second
+	ES_SEARCH_TIMEOUT = 5 * time.Second
+	ES_GET_TIMEOUT    = 2 * time.Second
+	ES_DELETE_TIMEOUT = 5 * time.Second
+	ES_BULK_TIMEOUT   = time.Minute
+
+	// Defaults of the recency boost of /search: posts newer than the offset
+	// score fully, then their score halves (the decay) every scale or so.
+	RECENCY_SCALE  = 6 * time.Hour
+	RECENCY_OFFSET = time.Hour
+	RECENCY_DECAY  = 0.5
+
+	// Defaults of the trending ranking, a comment is worth more than a like.
+	TRENDING_WINDOW         = 24 * time.Hour
+	TRENDING_LIKE_WEIGHT    = 2.0
+	TRENDING_COMMENT_WEIGHT = 3.0
+	TRENDING_VIEW_WEIGHT    = 0.1
+	VIEW_DEDUP_WINDOW       = time.Hour
+
+	// What to do with posts containing filtered words (FILTER_MODE).
+	FILTER_MODE_DROP = "drop" // hide the whole post
+	FILTER_MODE_MASK = "mask" // keep the post, replace the words with *
+
+	// Images one post can have (default of MAX_IMAGES_PER_POST).
+	MAX_IMAGES_PER_POST = 4
+
+	// #hashtags and @mentions kept of one post (defaults).
+	MAX_HASHTAGS_PER_POST = 10
+	MAX_MENTIONS_PER_POST = 10
+
+	// Memory used to parse an upload before spilling to temp files (default, MB).
+	MULTIPART_MEMORY_MB = 32
+	// Biggest image of a post (default, MB).
+	MAX_IMAGE_MB = 32
+	// Longest one streamed image may take to arrive (default).
+	UPLOAD_PART_TIMEOUT = time.Minute
+
+	// How long profiles read from BigTable are cached (default).
+	PROFILE_CACHE_TTL = time.Minute
+
+	// How long a post's Idempotency-Key is kept (default).
+	IDEMPOTENCY_TTL = 24 * time.Hour
+
+	// A user can download an export of their data once per interval (default).
+	EXPORT_INTERVAL = time.Hour
+
+	// How long after creation a post is read back from BigTable for
+	// read-your-writes searches (default).
+	READ_YOUR_WRITES_WINDOW = 5 * time.Minute
+
+	// Requests per minute allowed from one IP (default).
+	LOGIN_RATE_LIMIT  = 10
+	SIGNUP_RATE_LIMIT = 5
+
+	// How long the link in the verification email works.
+	VERIFY_EMAIL_TOKEN_TTL = 48 * time.Hour
+	// How long the link in the password reset email works.
+	RESET_PASSWORD_TOKEN_TTL = time.Hour
 
 	// Use to find BigTable instance
 	PROJECT_ID  = "around-264500"
@@ -46,70 +169,258 @@ const (
 	// Needs to update this URL if you deploy it to cloud.
 	// Use to deploy ElasticSearch on GCE
 	ES_URL = "http://35.232.83.97:9200"
+	// same as the defaults of the ES client
+	ES_SNIFF_INTERVAL       = 15 * time.Minute
+	ES_HEALTHCHECK_INTERVAL = 60 * time.Second
 
-	// Use to find GCS instance (Google Cloud Storage)
+	// Use to find GCS instance (Google Cloud Storage), default of GCS_BUCKET
 	BUCKET_NAME = "post-images-264500"
+	// Where the bucket is created when GCS_CREATE_BUCKET is set (default).
+	BUCKET_LOCATION = "US"
 )
 
 var mySigningKey = []byte("secret")
 
+// logger writes leveled key=value lines, main sets its level from the config.
+var logger = newLogger(slog.LevelInfo)
+
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
 //***************  MAIN ***************************
 func main() {
-	// Create a client
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+	// Read deployment settings first, so a bad config fails before we touch ES.
+	// -listen flag wins over the LISTEN_ADDR env.
+	listen := flag.String("listen", "", "address to listen on, e.g. :8080 (default LISTEN_ADDR or :8080)")
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if *listen != "" {
+		cfg.ListenAddr = *listen
+	}
+	config = cfg
+	logger = newLogger(config.LogLevel)
+	mySigningKey = signingKey().Secret
+	searchSlots = make(chan struct{}, config.MaxConcurrentSearches)
+	uploadSlots = make(chan struct{}, config.MaxConcurrentUploads)
+	if err := loadFilteredWords(config.FilterWordsFile); err != nil {
+		log.Fatalf("Cannot load the filtered words: %v", err)
+	}
+	if moderator, err = newModerator(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if storer, err = newStorer(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	// Here we are instantiating the gorilla/mux router
+	r := mux.NewRouter()
+	r.NotFoundHandler = notFoundHandler()
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+
+	var jwtMiddleware = jwtmiddleware.New(jwtmiddleware.Options{
+		ValidationKeyGetter: sessionKey,
+		SigningMethod:       jwt.SigningMethodHS256,
+	})
+	// a valid token of a banned user is rejected too
+	authed := func(h http.Handler) http.Handler {
+		return jwtMiddleware.Handler(notBanned(trackPresence(h)))
+	}
+	// the routes services need take an X-API-Key too (instead of the JWT)
+	keyed := func(h http.Handler) http.Handler {
+		return apiKeyOrJWT(jwtMiddleware.Handler, notBanned(trackPresence(h)))
+	}
+
+	// new POST/SEARCH/LOGIN/LOGON handle (after encryption)
+	// if validation faild --> jwtMiddleware return panic --> Operation faild
+	r.Handle("/post", keyed(http.HandlerFunc(handlerPost))).Methods("POST")
+	r.Handle("/search", keyed(http.HandlerFunc(handlerSearch))).Methods("GET")
+	r.Handle("/search/count", keyed(http.HandlerFunc(searchCountHandler))).Methods("GET")
+	r.Handle("/stats/regions", keyed(http.HandlerFunc(regionsHandler))).Methods("GET")
+	r.Handle("/stats/activity", keyed(http.HandlerFunc(activityHandler))).Methods("GET")
+	r.Handle("/area/users", keyed(http.HandlerFunc(areaUsersHandler))).Methods("GET")
+	r.Handle("/trending", keyed(http.HandlerFunc(trendingHandler))).Methods("GET")
+	r.Handle("/random", authed(http.HandlerFunc(randomPostHandler))).Methods("GET")
+	r.Handle("/post/{id}/react", authed(http.HandlerFunc(reactHandler))).Methods("POST")
+	r.Handle("/post/{id}/react", authed(http.HandlerFunc(unreactHandler))).Methods("DELETE")
+	r.Handle("/post/{id}/like/toggle", authed(http.HandlerFunc(toggleLikeHandler))).Methods("POST")
+	r.Handle("/post/{id}/comments", authed(http.HandlerFunc(addCommentHandler))).Methods("POST")
+	r.Handle("/post/{id}/comments", authed(http.HandlerFunc(listCommentsHandler))).Methods("GET")
+	r.Handle("/post/{id}/comment/{commentId}", authed(http.HandlerFunc(editCommentHandler))).Methods("PUT")
+	r.Handle("/post/{id}/comment/{commentId}", authed(http.HandlerFunc(deleteCommentHandler))).Methods("DELETE")
+	r.Handle("/post/{id}/likes", authed(http.HandlerFunc(likesHandler))).Methods("GET")
+	r.Handle("/post/{id}/view", authed(http.HandlerFunc(viewPostHandler))).Methods("POST")
+	r.Handle("/post/{id}/raw", authed(http.HandlerFunc(rawPostHandler))).Methods("GET")
+	r.Handle("/post/{id}/location", authed(http.HandlerFunc(updateLocationHandler))).Methods("PATCH")
+
+	// Admin only (admin claim in the token)
+	r.Handle("/admin/user/{username}/verify", authed(adminOnly(http.HandlerFunc(verifyUserHandler)))).Methods("POST")
+	r.Handle("/admin/audit", authed(adminOnly(http.HandlerFunc(auditHandler)))).Methods("GET")
+	r.Handle("/admin/post/{id}", authed(adminOnly(http.HandlerFunc(adminDeletePostHandler)))).Methods("DELETE")
+	r.Handle("/admin/user/{username}/ban", authed(adminOnly(http.HandlerFunc(banUserHandler)))).Methods("POST")
+	r.Handle("/admin/user/{username}/unban", authed(adminOnly(http.HandlerFunc(unbanUserHandler)))).Methods("POST")
+	r.Handle("/admin/consistency", authed(adminOnly(http.HandlerFunc(consistencyHandler)))).Methods("GET")
+	r.Handle("/admin/posts", authed(adminOnly(http.HandlerFunc(adminPostsHandler)))).Methods("GET")
+	r.Handle("/admin/search/explain", authed(adminOnly(http.HandlerFunc(explainSearchHandler)))).Methods("GET")
+	r.Handle("/admin/metrics", authed(adminOnly(expvar.Handler()))).Methods("GET")
+	r.Handle("/admin/export", authed(adminOnly(http.HandlerFunc(exportPostsHandler)))).Methods("GET")
+	r.Handle("/admin/import", authed(adminOnly(http.HandlerFunc(importHandler)))).Methods("POST")
+	r.Handle("/admin/migrate", authed(adminOnly(http.HandlerFunc(migrateIndexHandler)))).Methods("POST")
+	r.Handle("/admin/api-keys", authed(adminOnly(http.HandlerFunc(createAPIKeyHandler)))).Methods("POST")
+	r.Handle("/admin/api-keys", authed(adminOnly(http.HandlerFunc(listAPIKeysHandler)))).Methods("GET")
+	r.Handle("/admin/api-keys/{id}", authed(adminOnly(http.HandlerFunc(revokeAPIKeyHandler)))).Methods("DELETE")
+	r.Handle("/webhooks", keyed(adminOrService(http.HandlerFunc(createWebhookHandler)))).Methods("POST")
+	r.Handle("/webhooks", keyed(adminOrService(http.HandlerFunc(listWebhooksHandler)))).Methods("GET")
+	r.Handle("/webhooks/{id}", keyed(adminOrService(http.HandlerFunc(deleteWebhookHandler)))).Methods("DELETE")
+
+	r.Handle("/devices", authed(http.HandlerFunc(registerDeviceHandler))).Methods("POST")
+	r.Handle("/me", authed(http.HandlerFunc(meHandler))).Methods("GET")
+	// checking a token is not activity, no presence
+	r.Handle("/auth/validate", jwtMiddleware.Handler(notBanned(http.HandlerFunc(validateTokenHandler)))).Methods("GET")
+	r.Handle("/me/likes", authed(http.HandlerFunc(myLikesHandler))).Methods("GET")
+	r.Handle("/me/posts/delete", authed(http.HandlerFunc(bulkDeleteHandler))).Methods("POST")
+	r.Handle("/posts/like-status", authed(http.HandlerFunc(likeStatusHandler))).Methods("POST")
+	r.Handle("/feed", authed(http.HandlerFunc(feedHandler))).Methods("GET")
+	r.Handle("/follow-requests", authed(http.HandlerFunc(followRequestsHandler))).Methods("GET")
+	r.Handle("/follow-requests/{username}/approve", authed(http.HandlerFunc(approveFollowHandler))).Methods("POST")
+	r.Handle("/user/me", authed(http.HandlerFunc(deleteAccountHandler))).Methods("DELETE")
+	r.Handle("/user/me/profile", authed(http.HandlerFunc(updateProfileHandler))).Methods("POST")
+	r.Handle("/user/me/export", authed(http.HandlerFunc(exportHandler))).Methods("GET")
+	r.Handle("/user/me/google", authed(http.HandlerFunc(linkGoogleHandler))).Methods("POST")
+	r.Handle("/me/scheduled", authed(http.HandlerFunc(scheduledPostsHandler))).Methods("GET")
+	r.Handle("/me/scheduled/{id}", authed(http.HandlerFunc(cancelScheduledHandler))).Methods("DELETE")
+	r.Handle("/users/active", authed(http.HandlerFunc(activeUsersHandler))).Methods("GET")
+	r.Handle("/user/{username}", authed(http.HandlerFunc(userHandler))).Methods("GET")
+	r.Handle("/user/{username}/stats", authed(http.HandlerFunc(userStatsHandler))).Methods("GET")
+	r.Handle("/user/{username}/follow", authed(http.HandlerFunc(followHandler))).Methods("POST")
+
+	// Readiness of the load balancers, no auth
+	r.HandleFunc("/ready", readyHandler).Methods("GET")
+
+	// Images of the local storage, public like the GCS ones
+	if config.Storage == STORAGE_LOCAL {
+		r.PathPrefix(LOCAL_FILES_PATH).Handler(http.StripPrefix(LOCAL_FILES_PATH, http.FileServer(http.Dir(config.StorageDir)))).Methods("GET")
+	}
+
+	// Sign up & log in --> TOKEN don't exist
+	// so limit them by client IP instead (against brute-force & spam accounts)
+	loginLimiter := newIPRateLimiter(config.LoginRateLimit, time.Minute)
+	signupLimiter := newIPRateLimiter(config.SignupRateLimit, time.Minute)
+	r.Handle("/login", loginLimiter.Handler(http.HandlerFunc(loginHandler))).Methods("POST")
+	r.Handle("/login/google", loginLimiter.Handler(http.HandlerFunc(googleLoginHandler))).Methods("POST")
+	r.Handle("/signup", signupLimiter.Handler(http.HandlerFunc(signupHandler))).Methods("POST")
+	r.Handle("/verify", http.HandlerFunc(verifyEmailHandler)).Methods("GET")
+	// forgot sends an email too, so it shares the signup limit
+	r.Handle("/password/forgot", signupLimiter.Handler(http.HandlerFunc(forgotPasswordHandler))).Methods("POST")
+	r.Handle("/password/reset", http.HandlerFunc(resetPasswordFormHandler)).Methods("GET")
+	r.Handle("/password/reset", loginLimiter.Handler(http.HandlerFunc(resetPasswordHandler))).Methods("POST")
+
+	// Use our own http.Server (instead of http.ListenAndServe), so the address
+	// is configurable and the server can be shut down later.
+	srv := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: cors(withRequestID(untilStarted(limitBody(r)))), // directly connect server without keywords, CORS for every route
+	}
+
+	// Bind first, to fail with a clear message when the port is taken.
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("Cannot listen on %s, is the port already in use? %v", srv.Addr, err)
+	}
+
+	// Serve right away, but not ready (see /ready) until the index is there,
+	// every other route answers 503 until then (see untilStarted).
+	go func() {
+		setupBackends()
+		startPushWorker()
+		startDeferredWriter()
+		setStarted()
+		setReady(true)
+		fmt.Println("started-service")
+	}()
+	shutdownDone := make(chan struct{})
+	go shutdownOnSignal(srv, shutdownDone)
+
+	// With a cert and key we terminate TLS ourselves (HTTP/2 comes with it),
+	// otherwise plain HTTP, e.g. behind a proxy which does TLS.
+	if config.TLSEnabled() {
+		if config.HTTPRedirectAddr != "" {
+			go redirectToHTTPS(config.HTTPRedirectAddr, config.ListenAddr)
+		}
+		fmt.Printf("Listening on %s (HTTPS)\n", srv.Addr)
+		err = srv.ServeTLS(ln, config.TLSCertFile, config.TLSKeyFile)
+	} else {
+		fmt.Printf("Listening on %s\n", srv.Addr)
+		err = srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as Shutdown starts, wait for the requests in
+	// flight to be done before the process exits.
+	<-shutdownDone
+}
+
+// setupBackends creates the ES index and checks the GCS bucket. Any failure
+// stops the service, it is not usable without them.
+func setupBackends() {
+	// Create the client shared by every request
+	client, err := newESClient()
 	if err != nil {
 		panic(err)
 	}
+	esClient = client
 
 	// Use the IndexExists service to check if a specified index exists.
-	exists, err := client.IndexExists(INDEX).Do()
+	exists, err := client.IndexExists(config.ESIndex).Do()
 	if err != nil {
 		panic(err)
 	}
 	if !exists {
-		// Create a new index.
-		mapping := `{
-			"mappings":{
-				"post":{
-					"properties":{
-						"location":{
-							"type":"geo_point"
-						}
-					}
-				}
-			}
-		}`
-		_, err := client.CreateIndex(INDEX).Body(mapping).Do()
+		// Create a new index, with every field mapped (see mapping.go),
+		// behind the alias config.ESIndex (see migrate.go).
+		name, err := createAliasedIndex(client)
 		if err != nil {
 			// Handle error
 			panic(err)
 		}
+		fmt.Printf("Index %s is created, alias %s\n", name, config.ESIndex)
+	} else {
+		if aliased, err := indicesOfAlias(client); err == nil && len(aliased) == 0 {
+			log.Printf("WARNING: %s is an index, not an alias, POST /admin/migrate to move it behind one", config.ESIndex)
+		}
+		checkMapping(client)
 	}
 
-	fmt.Println("started-service")
-
-	// Here we are instantiating the gorilla/mux router
-	r := mux.NewRouter()
+	if err := storer.Init(context.Background()); err != nil {
+		log.Fatalf("Cannot use the image storage: %v", err)
+	}
+}
 
-	var jwtMiddleware = jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return mySigningKey, nil
-		},
-		SigningMethod: jwt.SigningMethodHS256,
+//***************  HTTP --> HTTPS ***************************
+// redirectToHTTPS listens on addr and sends every request to the same URL
+// on HTTPS (served on tlsAddr).
+func redirectToHTTPS(addr, tlsAddr string) {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
 	})
 
-	// new POST/SEARCH/LOGIN/LOGON handle (after encryption)
-	// if validation faild --> jwtMiddleware return panic --> Operation faild
-	r.Handle("/post", jwtMiddleware.Handler(http.HandlerFunc(handlerPost))).Methods("POST")
-	r.Handle("/search", jwtMiddleware.Handler(http.HandlerFunc(handlerSearch))).Methods("GET")
-
-	// Sign up & log in --> TOKEN don't exist
-	r.Handle("/login", http.HandlerFunc(loginHandler)).Methods("POST")
-	r.Handle("/signup", http.HandlerFunc(signupHandler)).Methods("POST")
-
-	http.Handle("/", r) // directly connect server without keywords
-	log.Fatal(http.ListenAndServe(":8080", nil))
-
+	fmt.Printf("Redirecting HTTP on %s to HTTPS\n", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Fatalf("Cannot listen on %s for HTTP redirect: %v", addr, err)
+	}
 }
 
 //***************  POST ***************************
@@ -123,105 +434,305 @@ func main() {
 // }
 func handlerPost(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
-
-	user := r.Context().Value("user")
-	claims := user.(*jwt.Token).Claims
-	username := claims.(jwt.MapClaims)["username"]
-
-	// 32 << 20 is the maxMemory param for ParseMultipartForm, equals to 32MB
-	//		(1MB = 1024 * 1024 bytes = 2^20 bytes)
-	// After you call ParseMultipartForm, the file will be saved in the server memory
-	//		with maxMemory size.
-	// If the file size is larger than maxMemory, the rest of the data will be saved
-	//		in a system temporary file.
-	r.ParseMultipartForm(32 << 20)
-
-	// Parse from form data.
-	fmt.Printf("Received one post request %s\n", r.FormValue("message"))
-	lat, _ := strconv.ParseFloat(r.FormValue("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.FormValue("lon"), 64)
+
+	username := usernameFromToken(r)
+
+	// throwaway accounts can't post right away (MIN_ACCOUNT_AGE)
+	if wait, err := accountWait(r); err != nil {
+		fmt.Printf("Failed to read account of %s %v\n", username, err)
+		http.Error(w, "Failed to save post", http.StatusInternalServerError)
+		return
+	} else if wait > 0 {
+		http.Error(w, fmt.Sprintf("Your account is too new to post, please wait %d more minutes", (wait+time.Minute-1)/time.Minute), http.StatusForbidden)
+		return
+	}
+
+	// a big post is read part by part, the images stored as they arrive
+	// (see streamupload.go), only its text fields are checked here
+	streaming := streamUpload(r)
+	var mr *multipart.Reader
+	var firstImage *multipart.Part
+	var files []multipart.File
+	var location Location
+	var errs ValidationErrors
+	if streaming {
+		var err error
+		if mr, firstImage, err = readPostFields(r); err != nil {
+			http.Error(w, "Cannot read post: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("Received one streamed post request %s\n", r.FormValue("message"))
+		location, errs = validatePostFields(r)
+	} else {
+		// MultipartMemory is the maxMemory param for ParseMultipartForm, 32MB by default
+		//		(1MB = 1024 * 1024 bytes = 2^20 bytes)
+		// After you call ParseMultipartForm, the file will be saved in the server memory
+		//		with maxMemory size.
+		// If the file size is larger than maxMemory, the rest of the data will be saved
+		//		in a system temporary file.
+		r.ParseMultipartForm(config.MultipartMemory)
+
+		// Parse from form data.
+		fmt.Printf("Received one post request %s\n", r.FormValue("message"))
+		// check all the fields first, the client gets every problem in one response
+		location, files, errs = validatePost(r)
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	defer closeFiles(files)
+
 	p := &Post{
-		User:    username.(string),
-		Message: r.FormValue("message"),
-		Location: Location{
-			Lat: lat,
-			Lon: lon,
-		},
-	}
-	id := uuid.New()
-	// FormFile(key string) --> retrurn 1.file 2.header 3.err
-	file, _, err := r.FormFile("image")
+		User:     username,
+		Message:  r.FormValue("message"),
+		Location: location,
+		Created:  time.Now().Unix(),
+	}
+	// already checked, an error now means the time just passed: post it live
+	if publishAt, _ := parsePublishAt(r.FormValue("publish_at"), time.Now()); publishAt != 0 {
+		p.PublishAt = publishAt
+		p.Created = publishAt
+	}
+	ctx := context.Background()
+	id, err := newPostID(ctx)
 	if err != nil {
-		http.Error(w, "Image is not available", http.StatusInternalServerError)
-		fmt.Printf("Image is not available %v.\n", err)
+		fmt.Printf("Failed to make a post id %v\n", err)
+		http.Error(w, "Failed to save post", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	p.Id = id
+	p.Files = uploadedImageInfos(r)
+	extractTags(p)
+	// give the id back if we fail before the post is saved
+	saved := false
+	defer func() {
+		if !saved {
+			releasePostID(ctx, id)
+		}
+	}()
 
-	ctx := context.Background()
+	// Idempotency-Key is optional. If this key was already used by the same user,
+	// return the post created the first time instead of creating a new one.
+	idemKey := r.Header.Get("Idempotency-Key")
+	if idemKey != "" {
+		firstID, err := postStore.ReserveIdempotencyKey(ctx, p.User, idemKey, id)
+		if err != nil {
+			http.Error(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+			fmt.Printf("Failed to check Idempotency-Key %v\n", err)
+			return
+		}
+		if firstID != "" {
+			fmt.Printf("Replay post %s for Idempotency-Key %s\n", firstID, idemKey)
+			w.Header().Set("Idempotent-Replayed", "true")
+			writePostCreated(w, firstID, nil)
+			return
+		}
+	}
+	// release the key if we fail before the post is saved, so the client can retry
+	defer func() {
+		if idemKey != "" && !saved {
+			postStore.ReleaseIdempotencyKey(ctx, p.User, idemKey)
+		}
+	}()
 
-	// replace it with your real bucket name (in Const).
-	_, attrs, err := saveToGCS(ctx, file, BUCKET_NAME, id)
-	if err != nil {
-		http.Error(w, "GCS is not setup", http.StatusInternalServerError)
-		fmt.Printf("GCS is not setup %v\n", err)
+	// a post the moderator blocks is refused right away, a masked one is stored masked
+	if !moderateNewPost(p) {
+		var errs ValidationErrors
+		errs.Add("message", "message is not allowed")
+		writeValidationErrors(w, errs)
 		return
 	}
 
-	// Update the media link after saving to GCS.
-	p.Url = attrs.MediaLink
+	// the same message again, right here right now --> most likely a retry.
+	// force=true posts it anyway.
+	if force, _ := strconv.ParseBool(r.FormValue("force")); !force {
+		if dupID := findDuplicatePost(p); dupID != "" {
+			fmt.Printf("Post of %s is a duplicate of %s\n", p.User, dupID)
+			http.Error(w, "You just posted the same message here (post "+dupID+"), send force=true to post it again", http.StatusConflict)
+			return
+		}
+	}
 
-	// Save to ES.
-	saveToES(p, id)
+	// the storage comes from config (STORAGE, GCS_BUCKET ...).
+	if streaming {
+		err = streamImages(ctx, http.NewResponseController(w), p, mr, firstImage)
+	} else {
+		err = saveImages(ctx, p, files)
+	}
+	if verrs, ok := err.(ValidationErrors); ok {
+		writeValidationErrors(w, verrs)
+		return
+	}
+	if err == storage.ErrBucketNotExist {
+		// an operator problem (wrong bucket name / bucket deleted), retrying won't help
+		log.Printf("ERROR: GCS bucket %s does not exist, no post can be created until it's fixed", config.GCSBucket)
+		http.Error(w, "Image storage is not configured, please contact the operator", http.StatusInternalServerError)
+		return
+	}
+	if err == errUploadTooSlow {
+		http.Error(w, "An image took too long to arrive", http.StatusRequestTimeout)
+		return
+	}
+	if err == errUploadsBusy {
+		fmt.Printf("Too many uploads in flight (%d), refusing one post\n", config.MaxConcurrentUploads)
+		w.Header().Set("Retry-After", UPLOAD_RETRY_AFTER)
+		http.Error(w, "Too many uploads right now, please retry", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		// most likely transient (network, GCS hiccup) --> the client may retry
+		fmt.Printf("Failed to save image to GCS %v\n", err)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Image storage is temporarily unavailable, please retry", http.StatusServiceUnavailable)
+		return
+	}
 
-	// Save to BigTable.
-	saveToBigTable(p, id)
+	// Save to ES and BigTable at the same time, the post needs both.
+	if err := savePost(ctx, p, id); err != nil {
+		if writeESTimeout(w, err) {
+			return
+		}
+		// the detail (backend, index, row) stays in the log
+		fmt.Printf("Failed to save post %s %v\n", id, err)
+		http.Error(w, "Failed to save post", http.StatusInternalServerError)
+		return
+	}
 
+	saved = true
+	if p.isScheduled() {
+		deliverWhenPublished(*p)
+	} else {
+		deliverNewPost(*p)
+		notifyMentions(*p)
+	}
+	writePostCreated(w, id, p.Files)
 }
 
-//***************  Save a Post to Google Cloud Storage (GCS) ***************************
-func saveToGCS(ctx context.Context, r io.Reader, bucketName, name string) (*storage.ObjectHandle, *storage.ObjectAttrs, error) {
-	// create a client
-	client, err := storage.NewClient(ctx)
+// writePostCreated tells the client the id of the created post, with the
+// info of its images when known (not on a replay).
+func writePostCreated(w http.ResponseWriter, id string, files []ImageInfo) {
+	js, err := json.Marshal(map[string]interface{}{"id": id, "files": files})
 	if err != nil {
-		return nil, nil, err
+		panic(err)
 	}
-	defer client.Close()
+	w.Write(js)
+}
 
-	bucket := client.Bucket(bucketName)
-	// Next check if the bucket exists
-	if _, err = bucket.Attrs(ctx); err != nil {
-		return nil, nil, err
+//***************  Save the images of a Post (see storer.go) ***************************
+// saveImages uploads the images of a post, the first one as <id> and the
+// others as <id>-1, <id>-2 ..., and sets Url / Urls. The images already
+// uploaded are deleted if one fails.
+func saveImages(ctx context.Context, p *Post, files []multipart.File) error {
+	for i, file := range files {
+		name := imageName(p.Id, i)
+		img, err := orientImage(file)
+		if err == errTooManyPixels {
+			err = ValidationErrors{{Field: "image", Message: fmt.Sprintf("image %d is over the limit of %d megapixels", i+1, MAX_IMAGE_PIXELS/1000000)}}
+		}
+		var url string
+		if err == nil {
+			var info ImageInfo
+			if i < len(p.Files) {
+				info = p.Files[i]
+			}
+			url, err = saveImage(ctx, img, name, info)
+		}
+		if err != nil {
+			if i > 0 {
+				if err := deletePostImages(ctx, p.Id); err != nil {
+					fmt.Printf("Rollback of images of %s failed %v\n", p.Id, err)
+				}
+			}
+			return err
+		}
+		p.Urls = append(p.Urls, url)
 	}
+	// Url stays the (first) image, for clients which only know one
+	p.Url = p.Urls[0]
+	return nil
+}
 
-	obj := bucket.Object(name)
-	wc := obj.NewWriter(ctx)
-	if _, err := io.Copy(wc, r); err != nil {
-		return nil, nil, err
+// imageName is the name of the ith image (from 0) of a post.
+func imageName(id string, i int) string {
+	if i == 0 {
+		return id
 	}
-	if err := wc.Close(); err != nil {
-		return nil, nil, err
+	return fmt.Sprintf("%s-%d", id, i)
+}
+
+// saveImage stores one image, once an upload slot is free.
+func saveImage(ctx context.Context, r io.Reader, name string, info ImageInfo) (string, error) {
+	if err := acquireUploadSlot(ctx); err != nil {
+		return "", err
 	}
+	defer releaseUploadSlot()
+	return storer.Save(ctx, r, name, info)
+}
 
-	if err := obj.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
-		return nil, nil, err
+//***************  Save a Post to ES + BigTable ***************************
+// savePost writes the post to ES and BigTable concurrently (the image is
+// already in GCS). If any of them fails, whatever was saved is rolled back,
+// the image included, and the error says which store failed.
+func savePost(ctx context.Context, p *Post, id string) error {
+	var esErr, btErr error
+	var g errgroup.Group
+	g.Go(func() error {
+		esErr = searchIndex.Index(p, id)
+		return esErr
+	})
+	g.Go(func() error {
+		btErr = postStore.Save(p, id)
+		return btErr
+	})
+	if g.Wait() == nil {
+		return nil
+	}
+	// ES has it, BigTable is down: keep the post, write BigTable later
+	if esErr == nil && canDeferBigTable(btErr) {
+		err := deferBigTableWrite(p)
+		if err == nil {
+			fmt.Printf("Post %s saved to ES only for now, BigTable failed %v\n", id, btErr)
+			return nil
+		}
+		fmt.Printf("Failed to defer BigTable write of post %s %v\n", id, err)
 	}
 
-	attrs, err := obj.Attrs(ctx)
-	fmt.Printf("Post is saved to GCS: %s\n", attrs.MediaLink)
-	return obj, attrs, err
+	// Roll back: nothing of a half saved post should stay around.
+	var failed []string
+	if esErr != nil {
+		failed = append(failed, "ES: "+esErr.Error())
+	} else if err := searchIndex.Delete(id); err != nil {
+		fmt.Printf("Rollback of post %s in ES failed %v\n", id, err)
+	}
+	if btErr != nil {
+		failed = append(failed, "BigTable: "+btErr.Error())
+	} else if err := postStore.Delete(ctx, id); err != nil {
+		fmt.Printf("Rollback of post %s in BigTable failed %v\n", id, err)
+	}
+	if err := deletePostImages(ctx, id); err != nil {
+		fmt.Printf("Rollback of post %s in GCS failed %v\n", id, err)
+	}
+	// the handler answers 504 to it
+	if _, ok := esErr.(*ESTimeoutError); ok {
+		return esErr
+	}
+	return errors.New(strings.Join(failed, "; "))
 }
 
 //***************  Save a Post to BigTable ***************************
-func saveToBigTable(p *Post, id string) {
-	ctx := context.Background()
+// saveToBigTable writes the post and its user index row. Transient errors are
+// retried (see retryBigTable): the cells have a fixed timestamp and the row
+// keys are fixed too, so applying a write twice stores the same thing.
+func saveToBigTable(p *Post, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), BT_WRITE_TIMEOUT)
+	defer cancel()
 	// you must update project name here
 	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer bt_client.Close()
 
 	tbl := bt_client.Open("post")
 	mut := bigtable.NewMutation()
@@ -229,50 +740,171 @@ func saveToBigTable(p *Post, id string) {
 
 	mut.Set("post", "user", t, []byte(p.User))
 	mut.Set("post", "message", t, []byte(p.Message))
+	mut.Set("post", "url", t, []byte(p.Url))
+	if len(p.Urls) > 0 {
+		urls, _ := json.Marshal(p.Urls)
+		mut.Set("post", "urls", t, urls)
+	}
+	if len(p.Files) > 0 {
+		files, _ := json.Marshal(p.Files)
+		mut.Set("post", "files", t, files)
+	}
+	if len(p.Hashtags) > 0 {
+		tags, _ := json.Marshal(p.Hashtags)
+		mut.Set("post", "hashtags", t, tags)
+	}
+	if len(p.Mentions) > 0 {
+		names, _ := json.Marshal(p.Mentions)
+		mut.Set("post", "mentions", t, names)
+	}
 	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
 	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
+	mut.Set("post", "created", t, []byte(strconv.FormatInt(p.Created, 10)))
+	if p.PublishAt != 0 {
+		mut.Set("post", "publish_at", t, []byte(strconv.FormatInt(p.PublishAt, 10)))
+	}
 
-	err = tbl.Apply(ctx, id, mut)
+	err = retryBigTable(ctx, func() error { return tbl.Apply(ctx, id, mut) })
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("Post is saved to BigTable: %s\n", p.Message)
 
+	// Also index it by user (newest first), so a user's recent posts can be
+	// read back without going through ES.
+	idx := bigtable.NewMutation()
+	idx.Set("post", "id", t, []byte(id))
+	// from the post, not now: a replayed save writes the same row
+	idxKey := userPostRowKey(p.User, time.Unix(p.Created, 0), id)
+	idxTbl := bt_client.Open(USER_POST_TABLE)
+	err = retryBigTable(ctx, func() error { return idxTbl.Apply(ctx, idxKey, idx) })
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Post is saved to BigTable: %s\n", p.Message)
+	return nil
 }
 
 //***************  Save a Post to ElasticSearch ***************************
-func saveToES(p *Post, id string) {
+func saveToES(p *Post, id string) error {
 	// Create a client
-	es_client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+	es_client, err := getESClient()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Save it to index
+	ctx, cancel := esContext(ES_OP_INDEX)
+	defer cancel()
 	_, err = es_client.Index().
-		Index(INDEX).
-		Type(TYPE).
+		Index(config.ESIndex).
+		Type(config.ESType).
 		Id(id).
 		BodyJson(p).
-		Refresh(true).
-		Do()
+		Refresh(config.ESRefresh).
+		DoC(ctx)
 	if err != nil {
-		panic(err)
+		return esError(ctx, ES_OP_INDEX, err)
 	}
 
 	fmt.Printf("Post is saved to Index: %s\n", p.Message)
+	return nil
+}
+
+//***************  Delete a Post (GCS + BigTable + ElasticSearch) ***************************
+// deletePost removes everything stored for one post. It keeps going when one of
+// the stores fails, and returns the first error.
+func deletePost(ctx context.Context, id string) error {
+	var firstErr error
+	// a tombstone first, while we still know where the post was
+	if p, err := postStore.Read(ctx, id); err != nil {
+		firstErr = err
+	} else if p != nil && !p.isScheduled() {
+		// a scheduled post was never seen, nothing to purge
+		if err := saveTombstone(ctx, p); err != nil {
+			fmt.Printf("Failed to save tombstone of post %s %v\n", id, err)
+		}
+	}
+	for _, del := range []func() error{
+		func() error { return deletePostImages(ctx, id) },
+		func() error { return postStore.Delete(ctx, id) },
+		func() error { return deletePostStats(ctx, id) },
+		func() error { return deleteReactionsOfPost(ctx, id) },
+		func() error { return deleteCommentsOfPost(ctx, id) },
+		func() error { return searchIndex.Delete(id) },
+	} {
+		if err := del(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// deletePostImages deletes all the images of a post: <id>, <id>-1, <id>-2 ...
+func deletePostImages(ctx context.Context, id string) error {
+	names, err := storer.List(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// another id can start with this one, only take ours
+		if name != id && !strings.HasPrefix(name, id+"-") {
+			continue
+		}
+		if err := storer.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteFromBigTable(ctx context.Context, id string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	if err := bt_client.Open("post").Apply(ctx, id, mut); err != nil {
+		return err
+	}
+	fmt.Printf("Post is deleted from BigTable: %s\n", id)
+	return nil
+}
+
+func deleteFromES(id string) error {
+	es_client, err := getESClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := esContext(ES_OP_DELETE)
+	defer cancel()
+	_, err = es_client.Delete().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Id(id).
+		Refresh(config.ESRefresh).
+		DoC(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return esError(ctx, ES_OP_DELETE, err)
+	}
+	fmt.Printf("Post is deleted from Index: %s\n", id)
+	return nil
 }
 
 //***************  SEARCH (GET) ***************************
 func handlerSearch(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Received one request for search")
-	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
-	// range is optional
-	ran := DISTANCE
-	if val := r.URL.Query().Get("range"); val != "" {
-		ran = val + "km"
+	start := time.Now()
+	sp, err := parseSearchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	lat, lon, radius := sp.Lat, sp.Lon, sp.RadiusKm
+	ran := strconv.FormatFloat(radius, 'f', -1, 64) + "km"
 
 	fmt.Println("range is ", ran)
 	//	//****** TEST ******
@@ -294,71 +926,115 @@ func handlerSearch(w http.ResponseWriter, r *http.Request) {
 	//	w.Header().Set("Content-Type", "application/json")
 	//	w.Write(js)
 
-	fmt.Printf("Search received: %f %f %s\n", lat, lon, ran)
-	// Create a client
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		panic(err)
+	if sp.Polygon != nil {
+		fmt.Printf("Search received: polygon of %d points\n", len(sp.Polygon))
+	} else {
+		fmt.Printf("Search received: %f %f %s\n", lat, lon, ran)
 	}
-
-	// Define geo distance query as specified in
-	// https://www.elastic.co/guide/en/elasticsearch/reference/5.2/query-dsl-geo-distance-query.html
-	q := elastic.NewGeoDistanceQuery("location")
-	q = q.Distance(ran).Lat(lat).Lon(lon)
-
-	// Some delay may range from seconds to minutes. So if you don't get enough results. Try it later.
-	searchResult, err := client.Search().
-		Index(INDEX).
-		Query(q).
-		Pretty(true).
-		Do()
+	// a full house --> ES is busy enough, tell the client to come back
+	if !acquireSearchSlot() {
+		fmt.Printf("Too many searches in flight (%d), refusing one\n", config.MaxConcurrentSearches)
+		w.Header().Set("Retry-After", SEARCH_RETRY_AFTER)
+		http.Error(w, "Too many searches right now, please retry", http.StatusServiceUnavailable)
+		return
+	}
+	// the ES query is in esSearchIndex.Search
+	hits, err := searchIndex.Search(sp)
+	releaseSearchSlot()
 	if err != nil {
+		if writeESTimeout(w, err) {
+			return
+		}
 		// Handle error
 		panic(err)
 	}
 
-	// searchResult is of type SearchResult and returns hits, suggestions,
-	// and all kinds of other information from Elasticsearch.
-	fmt.Printf("Query took %d milliseconds\n", searchResult.TookInMillis)
-	// TotalHits is another convenience function that works even when something goes wrong.
-	fmt.Printf("Found a total of %d post\n", searchResult.TotalHits())
+	fmt.Printf("Query took %d milliseconds\n", hits.TookMillis)
+	defer logSlowSearch(r, start, hits.TookMillis)
+	fmt.Printf("Found a total of %d post\n", hits.Total)
 
-	// Each is a convenience function that iterates over hits in a search result.
-	// It makes sure you don't need to check for nil values in the response.
-	// However, it ignores errors in serialization.
-	var typ Post
 	var ps []Post
-	//*******get each item which is type of POST
-	for _, item := range searchResult.Each(reflect.TypeOf(typ)) { // instance of
-		p := item.(Post) // p = (Post) item
+	page := hits.Posts
+	//*******get each hit which is type of POST
+	for _, p := range page {
 		fmt.Printf("Post by %s: %s at lat %v and lon %v\n",
 			p.User, p.Message, p.Location.Lat, p.Location.Lon)
 
-		// TODO(student homework): Perform filtering based on keywords such as web spam etc.
-		if !containsFilteredWords(&p.Message) {
+		// Filter (drop or mask) posts with filtered words, see moderatePost.
+		if moderatePost(&p) {
 			ps = append(ps, p)
 		}
 
 	}
-	js, err := json.Marshal(ps)
+
+	// Posts of private users are only for their approved followers.
+	ps, err = filterVisiblePosts(context.Background(), usernameFromToken(r), ps)
 	if err != nil {
-		panic(err)
+		fmt.Printf("Failed to check visibility of posts %v\n", err)
+		http.Error(w, "Failed to search posts", http.StatusInternalServerError)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Write(js)
-}
+	// Read-your-writes is opt-in, see mergeRecentOwnPosts.
+	if r.Header.Get("X-Read-Your-Writes") == "true" {
+		ps = mergeRecentOwnPosts(context.Background(), ps, usernameFromToken(r), sp.inArea)
+	}
 
-//***************  HELPER ***************************
-func containsFilteredWords(s *string) bool {
-	filteredWords := []string{
-		"fuck",
+	// Add the author's display name, avatar and the distance to each post
+	// (a polygon has no center, so no distance).
+	center := &Location{Lat: lat, Lon: lon}
+	if sp.Polygon != nil {
+		center = nil
 	}
-	for _, word := range filteredWords {
-		if strings.Contains(*s, word) {
-			return true
+	results := enrichPosts(context.Background(), ps, center)
+	anonymizeResults(results, usernameFromToken(r), isAdmin(r))
+	if sp.Sort == SORT_RELEVANCE {
+		// posts merged from BigTable (read-your-writes) have no score
+		for i := range results {
+			results[i].Score = hits.Scores[results[i].Id]
 		}
 	}
-	return false
+
+	sr := SearchResponse{
+		Total:   hits.Total,
+		From:    sp.From,
+		Size:    sp.Size,
+		Results: results,
+	}
+	// few hits for a keyword, maybe it's misspelled. Only then, it costs another query.
+	if sp.Keyword != "" && hits.Total < SUGGEST_MAX_HITS {
+		if sr.Suggestion, err = suggestKeyword(sp.Keyword); err != nil {
+			fmt.Printf("Failed to suggest keyword %v\n", err)
+		}
+	}
+	if sp.IncludeDeleted {
+		if sr.Tombstones, err = tombstonesSince(context.Background(), sp.Since, sp.inArea); err != nil {
+			fmt.Printf("Failed to read tombstones %v\n", err)
+			http.Error(w, "Failed to read deleted posts", http.StatusInternalServerError)
+			return
+		}
+	}
+	// a full page --> there may be more (the cursor is built before the word filter)
+	if sp.CursorMode && hits.Hits == sp.Size && len(page) > 0 {
+		sr.NextCursor = encodeCursor(nextCursor(sp.Cursor, page))
+	}
+	var resp interface{} = sr
+	if sp.Format == FORMAT_ARRAY {
+		resp = results
+	}
+	if sp.Fields != nil {
+		if resp, err = projectResults(resp, sp.Fields); err != nil {
+			panic(err)
+		}
+	}
+	js, err := marshalResponse(resp, sp.Pretty)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if sp.SizeClamped {
+		w.Header().Set("X-Size-Clamped", strconv.Itoa(sp.Size))
+	}
+	w.Write(js)
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Field of an ES mapping, e.g. {"type": "string", "index": "not_analyzed"}.
+type fieldMapping map[string]interface{}
+
+// ES 2.x has no keyword / text types: an exact value is a not_analyzed
+// string, a full text one an (analyzed) string.
+var (
+	keywordField = fieldMapping{"type": "string", "index": "not_analyzed"}
+	textField    = fieldMapping{"type": "string"}
+	dateField    = fieldMapping{"type": "date", "format": "epoch_second"}
+)
+
+// Every field of a post, nothing is left to the dynamic mapping (which maps
+// a date sent as a number to long, or a username to an analyzed string).
+var postMapping = map[string]fieldMapping{
+	"id":         keywordField,
+	"user":       keywordField,
+	"message":    textField,
+	"location":   {"type": "geo_point"},
+	"url":        keywordField,
+	"urls":       keywordField,
+	"created":    dateField,
+	"updated_at": dateField,
+	"publish_at": dateField,
+	"hashtags":   keywordField,
+	"mentions":   keywordField,
+	"files": {"properties": map[string]fieldMapping{
+		"original_name": keywordField,
+		"size":          {"type": "long"},
+	}},
+}
+
+// Users share the index (type TYPE_USER). The email stays analyzed, see findUserByEmail.
+var userMapping = map[string]fieldMapping{
+	"username":       keywordField,
+	"password":       {"type": "string", "index": "no"},
+	"age":            {"type": "integer"},
+	"gender":         keywordField,
+	"email":          textField,
+	"email_verified": {"type": "boolean"},
+	"created_at":     dateField,
+}
+
+//***************  ES MAPPING ***************************
+// indexMapping is the body to create the index with.
+func indexMapping() (string, error) {
+	body := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			config.ESType: map[string]interface{}{"properties": postMapping},
+			TYPE_USER:     map[string]interface{}{"properties": userMapping},
+		},
+	}
+	js, err := json.Marshal(body)
+	return string(js), err
+}
+
+// checkMapping warns about every field of the existing index whose mapping
+// is not the one of indexMapping (an index made before a field was added
+// here, or by hand). It can't be fixed in place, only by reindexing.
+func checkMapping(client *elastic.Client) {
+	res, err := client.GetMapping().Index(config.ESIndex).Do()
+	if err != nil {
+		log.Printf("WARNING: cannot read the mapping of index %s: %v", config.ESIndex, err)
+		return
+	}
+	// {"<index>": {"mappings": {"<type>": {"properties": {...}}}}}, the index
+	// may be reached by an alias, so take the only one there is
+	var types map[string]interface{}
+	for _, idx := range res {
+		if m, ok := idx.(map[string]interface{}); ok {
+			types, _ = m["mappings"].(map[string]interface{})
+		}
+	}
+
+	for typ, want := range map[string]map[string]fieldMapping{config.ESType: postMapping, TYPE_USER: userMapping} {
+		t, _ := types[typ].(map[string]interface{})
+		props, _ := t["properties"].(map[string]interface{})
+		for _, diff := range mappingDiffs(want, props) {
+			log.Printf("WARNING: index %s type %s: %s", config.ESIndex, typ, diff)
+		}
+	}
+}
+
+// mappingDiffs compares the wanted fields with the properties of an existing
+// type, only on the settings we care about (type, index, format).
+func mappingDiffs(want map[string]fieldMapping, props map[string]interface{}) []string {
+	var diffs []string
+	for field, w := range want {
+		got, ok := props[field].(map[string]interface{})
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("field %s is not mapped yet, it will be mapped dynamically", field))
+			continue
+		}
+		for _, key := range []string{"type", "index", "format"} {
+			if wv, ok := w[key]; ok && fmt.Sprint(got[key]) != fmt.Sprint(wv) {
+				diffs = append(diffs, fmt.Sprintf("field %s has %s %v, expected %v", field, key, got[key], wv))
+			}
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
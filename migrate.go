@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// Docs copied per bulk request by a migration.
+	MIGRATE_BATCH_SIZE = 500
+	// An index made before the alias is replaced this many times at most, if
+	// a write of another instance keeps creating it again (see swapLegacyIndex).
+	LEGACY_SWAP_ATTEMPTS = 3
+
+	AUDIT_MIGRATE_INDEX = "migrate_index"
+)
+
+// MigrationReport is the response of /admin/migrate.
+type MigrationReport struct {
+	Alias    string `json:"alias"`
+	OldIndex string `json:"old_index"`
+	NewIndex string `json:"new_index"`
+	Copied   int    `json:"copied"`
+	// docs written or deleted during the copy, brought up to date after it
+	Replayed int      `json:"replayed"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// 1 while a migration runs, there is only one at a time.
+var migrating int32
+
+// docRef names a doc of the index, by type and id.
+type docRef struct {
+	Type string
+	Id   string
+}
+
+var (
+	// Every write of a doc through the alias holds it for reading (see
+	// esWriteTransport), a migration holds it while it moves the alias.
+	esWriteGate sync.RWMutex
+
+	// Docs written through the alias while a migration runs, nil otherwise.
+	migrationWritesMu sync.Mutex
+	migrationWrites   map[docRef]bool
+)
+
+func recordMigrationWrites(refs []docRef) {
+	migrationWritesMu.Lock()
+	defer migrationWritesMu.Unlock()
+	if migrationWrites == nil {
+		return
+	}
+	for _, ref := range refs {
+		migrationWrites[ref] = true
+	}
+}
+
+// trackMigrationWrites starts (on) or stops recording the writes, and returns
+// the ones recorded so far.
+func trackMigrationWrites(on bool) map[docRef]bool {
+	migrationWritesMu.Lock()
+	defer migrationWritesMu.Unlock()
+	refs := migrationWrites
+	migrationWrites = nil
+	if on {
+		migrationWrites = map[docRef]bool{}
+	}
+	return refs
+}
+
+//***************  INDEX ALIAS ***************************
+// config.ESIndex is an alias, every ES call goes through it. The index behind
+// it is named <alias>_<creation time>, so a new one can be made next to it
+// and the alias moved in one step (see migrateIndexHandler).
+func newIndexName() string {
+	return config.ESIndex + "_" + time.Now().UTC().Format("20060102150405")
+}
+
+// indicesOfAlias returns the indices behind config.ESIndex, none if it is an
+// index itself (made before the alias) or doesn't exist.
+func indicesOfAlias(client *elastic.Client) ([]string, error) {
+	res, err := client.Aliases().Index("_all").Do()
+	if err != nil {
+		return nil, err
+	}
+	return res.IndicesByAlias(config.ESIndex), nil
+}
+
+// createAliasedIndex creates a new index with the mapping and points the alias at it.
+func createAliasedIndex(client *elastic.Client) (string, error) {
+	mapping, err := indexMapping()
+	if err != nil {
+		return "", err
+	}
+	name := newIndexName()
+	if _, err := client.CreateIndex(name).Body(mapping).Do(); err != nil {
+		return "", err
+	}
+	if _, err := client.Alias().Add(name, config.ESIndex).Do(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+//***************  INDEX MIGRATION ***************************
+// POST /admin/migrate
+//
+// migrateIndexHandler moves the alias to a new index with the current mapping
+// (see mapping.go), without downtime:
+//  1. create <alias>_<now> with the mapping
+//  2. copy every doc (posts and users) of the old index into it
+//  3. copy again the docs written meanwhile (only the missing ones)
+//  4. hold the writes, bring the docs written or deleted during 2-3 up to
+//     date in the new index, move the alias to it, let the writes go
+//
+// Searches and writes keep going to the old index until 4. The writes of
+// this instance are recorded from 1 on, the posts deleted by any instance
+// are found in their tombstones. The old index is kept, to move back to if
+// needed, delete it by hand when done.
+//
+// An index made before the alias (named like the alias) can't stay next to
+// an alias of the same name: it is deleted right before the alias is added,
+// searches fail for that moment.
+func migrateIndexHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one migrate index request")
+	if !atomic.CompareAndSwapInt32(&migrating, 0, 1) {
+		http.Error(w, "A migration is already running", http.StatusConflict)
+		return
+	}
+	defer atomic.StoreInt32(&migrating, 0)
+
+	rep, err := migrateIndex()
+	if err != nil {
+		fmt.Printf("Failed to migrate index %v\n", err)
+		http.Error(w, "Failed to migrate index: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_MIGRATE_INDEX, rep.NewIndex, fmt.Sprintf("from %s, copied %d, failed %d", rep.OldIndex, rep.Copied, rep.Failed))
+
+	js, err := json.Marshal(rep)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func migrateIndex() (*MigrationReport, error) {
+	client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+	rep := &MigrationReport{Alias: config.ESIndex}
+
+	old, err := indicesOfAlias(client)
+	if err != nil {
+		return nil, err
+	}
+	legacy := len(old) == 0
+	switch {
+	case legacy:
+		rep.OldIndex = config.ESIndex
+	case len(old) == 1:
+		rep.OldIndex = old[0]
+	default:
+		return nil, fmt.Errorf("alias %s points to %d indices %v, expected one", config.ESIndex, len(old), old)
+	}
+
+	mapping, err := indexMapping()
+	if err != nil {
+		return nil, err
+	}
+	rep.NewIndex = newIndexName()
+	if _, err := client.CreateIndex(rep.NewIndex).Body(mapping).Do(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Migrating %s: %s --> %s\n", config.ESIndex, rep.OldIndex, rep.NewIndex)
+
+	started := time.Now()
+	trackMigrationWrites(true)
+	defer trackMigrationWrites(false)
+
+	// twice: everything, then what was written during the first pass
+	for pass := 0; pass < 2; pass++ {
+		n, err := copyIndex(client, rep, rep.OldIndex, "create")
+		rep.Copied += n
+		if err != nil {
+			return rep, err
+		}
+	}
+
+	// no write through the alias (of this instance) from here until it's moved
+	esWriteGate.Lock()
+	defer esWriteGate.Unlock()
+	if err := replayWrites(client, rep, started); err != nil {
+		return rep, err
+	}
+	if legacy {
+		err = swapLegacyIndex(client, rep)
+	} else {
+		_, err = client.Alias().Remove(rep.OldIndex, config.ESIndex).Add(rep.NewIndex, config.ESIndex).Do()
+	}
+	if err != nil {
+		return rep, err
+	}
+	fmt.Printf("Alias %s now points to %s\n", config.ESIndex, rep.NewIndex)
+	return rep, nil
+}
+
+// replayWrites brings the docs written during the copy up to date in the new
+// index: copied again from the old index, deleted if they are gone from it.
+// The writes of this instance were recorded, the posts deleted by any
+// instance since started have a tombstone.
+func replayWrites(client *elastic.Client, rep *MigrationReport, started time.Time) error {
+	refs := trackMigrationWrites(false)
+	if refs == nil {
+		refs = map[docRef]bool{}
+	}
+	tombstones, err := tombstonesSince(context.Background(), started.Unix(), func(Location) bool { return true })
+	if err != nil {
+		return err
+	}
+	for _, t := range tombstones {
+		refs[docRef{Type: config.ESType, Id: t.Id}] = true
+	}
+
+	for ref := range refs {
+		res, err := client.Get().Index(rep.OldIndex).Type(ref.Type).Id(ref.Id).Do()
+		if err != nil && !elastic.IsNotFound(err) {
+			return err
+		}
+		if err == nil && res.Found {
+			_, err = client.Index().Index(rep.NewIndex).Type(ref.Type).Id(ref.Id).BodyJson(res.Source).Do()
+		} else if _, err = client.Delete().Index(rep.NewIndex).Type(ref.Type).Id(ref.Id).Do(); elastic.IsNotFound(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		rep.Replayed++
+	}
+	return nil
+}
+
+// swapLegacyIndex replaces the index made before the alias by the alias. A
+// write of another instance between the delete and the alias creates the
+// index again (ES creates a missing index on write): its docs are moved to
+// the new index and it is deleted again.
+func swapLegacyIndex(client *elastic.Client, rep *MigrationReport) error {
+	var err error
+	for attempt := 0; attempt < LEGACY_SWAP_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			log.Printf("WARNING: index %s was created again by a write, moving its docs", config.ESIndex)
+			n, err := copyIndex(client, rep, config.ESIndex, "index")
+			rep.Replayed += n
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("WARNING: deleting index %s to replace it with an alias, searches fail until it's added", config.ESIndex)
+		if _, err = client.DeleteIndex(config.ESIndex).Do(); err != nil {
+			return err
+		}
+		if _, err = client.Alias().Add(rep.NewIndex, config.ESIndex).Do(); err == nil {
+			return nil
+		}
+		if exists, xerr := client.IndexExists(config.ESIndex).Do(); xerr != nil || !exists {
+			return err
+		}
+	}
+	return err
+}
+
+// copyIndex copies the docs of index from to rep.NewIndex, page by page, and
+// returns how many were. opType "create" never overwrites a doc already
+// copied, "index" does.
+func copyIndex(client *elastic.Client, rep *MigrationReport, from, opType string) (int, error) {
+	copied := 0
+	scroll := client.Scroll(from).Size(MIGRATE_BATCH_SIZE).Scroll("5m")
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			return copied, nil
+		}
+		if err != nil {
+			return copied, err
+		}
+		if len(res.Hits.Hits) == 0 {
+			return copied, nil
+		}
+
+		bulk := client.Bulk()
+		for _, hit := range res.Hits.Hits {
+			bulk = bulk.Add(elastic.NewBulkIndexRequest().
+				OpType(opType).
+				Index(rep.NewIndex).
+				Type(hit.Type).
+				Id(hit.Id).
+				Doc(hit.Source))
+		}
+		ctx, cancel := esContext(ES_OP_BULK)
+		bres, err := bulk.DoC(ctx)
+		err = esError(ctx, ES_OP_BULK, err)
+		cancel()
+		if err != nil {
+			return copied, err
+		}
+		failed := 0
+		for _, item := range bres.Failed() {
+			// already copied
+			if item.Status == http.StatusConflict {
+				continue
+			}
+			failed++
+			if len(rep.Errors) < CONSISTENCY_MAX_IDS && item.Error != nil {
+				rep.Errors = append(rep.Errors, item.Type+"/"+item.Id+": "+item.Error.Reason)
+			}
+		}
+		rep.Failed += failed
+		copied += len(bres.Succeeded())
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The built-in list, used when there is no FILTER_WORDS_FILE. Its words have
+// the severity of FILTER_MODE.
+var filteredWords = []string{
+	"fuck",
+}
+
+// What a filtered word is replaced with in mask mode. Always the same
+// length, so the mask doesn't give away which word it was.
+const MASK = "****"
+
+// Severity of a filtered word, what happens to a text containing it.
+// A text gets the highest severity of the words it contains.
+type Severity int
+
+const (
+	SEVERITY_NONE  Severity = iota
+	SEVERITY_FLAG           // kept as it is, logged for a moderator to review
+	SEVERITY_MASK           // kept, the words are replaced with MASK
+	SEVERITY_BLOCK          // dropped (or rejected)
+)
+
+// Names of the severities in the words file.
+var severityNames = map[string]Severity{
+	"flag":  SEVERITY_FLAG,
+	"mask":  SEVERITY_MASK,
+	"block": SEVERITY_BLOCK,
+}
+
+// One pattern per severity, matching any of its words, ignoring case.
+// A severity without words has no pattern. Set by loadFilteredWords.
+var filteredWordsPatterns = map[Severity]*regexp.Regexp{}
+
+//***************  MODERATION ***************************
+// moderateText applies the word filter to any user text (post message,
+// comment ...), so every surface behaves the same, and returns the severity
+// found: SEVERITY_BLOCK --> the text must be dropped (or rejected). Masked
+// words are replaced in s, a flagged text is kept as it is, logging it is up
+// to the caller (only once, at creation).
+func moderateText(s *string) Severity {
+	if !config.FilterEnabled {
+		return SEVERITY_NONE
+	}
+	severity := containsFilteredWords(s)
+	if severity == SEVERITY_MASK {
+		*s = maskFilteredWords(*s)
+	}
+	return severity
+}
+
+// moderateNewPost applies the moderator (see moderator.go) to a post about
+// to be stored, which is the one time it is asked. It returns false if the
+// post must be refused. A masked message is stored masked, a flagged post is
+// logged for review.
+func moderateNewPost(p *Post) bool {
+	if !config.FilterEnabled {
+		return true
+	}
+	v := evaluatePost(p)
+	switch v.Severity {
+	case SEVERITY_BLOCK:
+		return false
+	case SEVERITY_MASK:
+		p.Message = v.Message
+	case SEVERITY_FLAG:
+		log.Printf("WARNING: post %s of %s flagged for review by the moderator", p.Id, p.User)
+	}
+	return true
+}
+
+// moderatePost applies the word filter again to a post about to be returned,
+// for the words added since it was stored. It returns false if the post must
+// be dropped. Any other moderator (an external service) judged the post once
+// at creation, it is not called per read.
+func moderatePost(p *Post) bool {
+	if !config.FilterEnabled {
+		return true
+	}
+	if _, ok := moderator.(wordListModerator); !ok {
+		return true
+	}
+	v := evaluatePost(p)
+	switch v.Severity {
+	case SEVERITY_BLOCK:
+		return false
+	case SEVERITY_MASK:
+		p.Message = v.Message
+	}
+	return true
+}
+
+// moderateNewComment applies the word filter to a comment about to be stored
+// (new or edited), and logs it if flagged. It returns false if the comment
+// must be refused.
+func moderateNewComment(c *Comment) bool {
+	switch moderateText(&c.Message) {
+	case SEVERITY_BLOCK:
+		return false
+	case SEVERITY_FLAG:
+		log.Printf("WARNING: comment of %s on post %s flagged for review by the word filter", c.User, c.PostId)
+	}
+	return true
+}
+
+// moderateComment applies the word filter again to a comment about to be
+// listed (stored before a word was added to the filter). It was flagged, if
+// ever, at creation.
+func moderateComment(c *Comment) bool {
+	return moderateText(&c.Message) != SEVERITY_BLOCK
+}
+
+//***************  WORDS FILE ***************************
+// loadFilteredWords sets the word filter from path, or from the built-in list
+// if path is empty. One word (or phrase) per line, optionally after its
+// severity, blank lines and # comments are skipped:
+//
+//	# severity: words, comma-separated
+//	block: fuck
+//	mask: damn, crap
+//	flag: free money
+//	scam
+//
+// A word without a severity gets the one of FILTER_MODE.
+func loadFilteredWords(path string) error {
+	def := SEVERITY_BLOCK
+	if config.FilterMode == FILTER_MODE_MASK {
+		def = SEVERITY_MASK
+	}
+	words := map[Severity][]string{}
+	if path == "" {
+		words[def] = filteredWords
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			severity := def
+			if i := strings.Index(line, ":"); i >= 0 {
+				name := strings.ToLower(strings.TrimSpace(line[:i]))
+				s, ok := severityNames[name]
+				if !ok {
+					return fmt.Errorf("%s line %d: unknown severity %q, use flag, mask or block", path, n, name)
+				}
+				severity, line = s, line[i+1:]
+			}
+			for _, word := range strings.Split(line, ",") {
+				if word = strings.TrimSpace(word); word != "" {
+					words[severity] = append(words[severity], word)
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	patterns := map[Severity]*regexp.Regexp{}
+	for severity, list := range words {
+		patterns[severity] = compileWordsPattern(list)
+	}
+	filteredWordsPatterns = patterns
+	fmt.Printf("Word filter: %d block, %d mask, %d flag\n",
+		len(words[SEVERITY_BLOCK]), len(words[SEVERITY_MASK]), len(words[SEVERITY_FLAG]))
+	return nil
+}
+
+//***************  HELPER ***************************
+// containsFilteredWords checks s for filtered words, ignoring case, and
+// returns the highest severity found (SEVERITY_NONE for a clean text).
+func containsFilteredWords(s *string) Severity {
+	for _, severity := range []Severity{SEVERITY_BLOCK, SEVERITY_MASK, SEVERITY_FLAG} {
+		if p := filteredWordsPatterns[severity]; p != nil && p.MatchString(*s) {
+			return severity
+		}
+	}
+	return SEVERITY_NONE
+}
+
+// maskFilteredWords replaces each filtered word of mask severity in s with MASK,
+// whatever its case ("Fuck" and "FUCK" too), and keeps the rest of the message as it is.
+func maskFilteredWords(s string) string {
+	if p := filteredWordsPatterns[SEVERITY_MASK]; p != nil {
+		return p.ReplaceAllLiteralString(s, MASK)
+	}
+	return s
+}
+
+func compileWordsPattern(words []string) *regexp.Regexp {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// withWordsFile loads a words file of one word per severity.
+func withWordsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte("block: spam\nmask: damn\nflag: money\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFilteredWords(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The same text gets the same treatment as a post, a comment or a reply.
+func TestModerationSurfaces(t *testing.T) {
+	setupMemBackends(t)
+	withWordsFile(t)
+
+	tests := []struct {
+		text string
+		kept bool
+		want string
+	}{
+		{"hello there", true, "hello there"},
+		{"buy spam now", false, ""},
+		{"Damn good coffee", true, MASK + " good coffee"},
+		{"free money", true, "free money"}, // flagged: kept as it is
+	}
+	for _, tt := range tests {
+		// post, on creation and read
+		p := Post{User: "alice", Message: tt.text}
+		if kept := moderateNewPost(&p); kept != tt.kept || (kept && p.Message != tt.want) {
+			t.Errorf("new post %q: got %v %q", tt.text, kept, p.Message)
+		}
+		p = Post{User: "alice", Message: tt.text}
+		if kept := moderatePost(&p); kept != tt.kept || (kept && p.Message != tt.want) {
+			t.Errorf("post read %q: got %v %q", tt.text, kept, p.Message)
+		}
+
+		// comment and reply, on creation and listing
+		for _, parent := range []string{"", "c1"} {
+			c := Comment{PostId: "p1", User: "bob", Message: tt.text, ParentId: parent}
+			if kept := moderateNewComment(&c); kept != tt.kept || (kept && c.Message != tt.want) {
+				t.Errorf("new comment (parent %q) %q: got %v %q", parent, tt.text, kept, c.Message)
+			}
+			c = Comment{PostId: "p1", User: "bob", Message: tt.text, ParentId: parent}
+			if kept := moderateComment(&c); kept != tt.kept || (kept && c.Message != tt.want) {
+				t.Errorf("listed comment (parent %q) %q: got %v %q", parent, tt.text, kept, c.Message)
+			}
+		}
+	}
+}
+
+func TestAddCommentBlocked(t *testing.T) {
+	setupMemBackends(t)
+	withWordsFile(t)
+
+	// a reply is refused before anything is read or stored
+	body := `{"message": "buy spam now", "parent_id": "c1"}`
+	r := httptest.NewRequest("POST", "/post/p1/comments", bytes.NewBufferString(body))
+	r = mux.SetURLVars(asUser(r, "bob"), map[string]string{"id": "p1"})
+	w := httptest.NewRecorder()
+	addCommentHandler(w, r)
+	if fields := fieldsOf(t, w); len(fields) != 1 || fields[0] != "message" {
+		t.Errorf("got errors on %v, want message", fields)
+	}
+}
+
+func TestModerationOff(t *testing.T) {
+	setupMemBackends(t)
+	withWordsFile(t)
+	config.FilterEnabled = false
+
+	c := Comment{Message: "buy spam now"}
+	if !moderateNewComment(&c) || !moderateComment(&c) || c.Message != "buy spam now" {
+		t.Errorf("filter off, got %q", c.Message)
+	}
+	if moderateText(&c.Message) != SEVERITY_NONE {
+		t.Error("filter off, got a severity")
+	}
+}
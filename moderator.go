@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Moderators MODERATOR can name.
+	MODERATOR_WORDS = "words" // the word filter, default
+	MODERATOR_HTTP  = "http"  // an external service, see httpModerator
+
+	// Default of MODERATION_TIMEOUT, per post.
+	MODERATION_TIMEOUT = 2 * time.Second
+)
+
+// Verdict is what a Moderator decides about a post.
+type Verdict struct {
+	Severity Severity
+	// The message to show instead, for SEVERITY_MASK.
+	Message string
+}
+
+// Moderator judges posts when they are created, the word filter is applied
+// again every time they are returned (see moderatePost).
+// Implementations are picked by MODERATOR (see newModerator): the word
+// filter, an external HTTP service, a Vision API one later...
+type Moderator interface {
+	Evaluate(p *Post) (Verdict, error)
+}
+
+// The configured one, set in main.
+var moderator Moderator = wordListModerator{}
+
+// newModerator returns the moderator config.Moderator names.
+func newModerator() (Moderator, error) {
+	switch config.Moderator {
+	case MODERATOR_WORDS:
+		return wordListModerator{}, nil
+	case MODERATOR_HTTP:
+		if config.ModerationURL == "" {
+			return nil, fmt.Errorf("MODERATOR=http needs MODERATION_URL")
+		}
+		return &httpModerator{url: config.ModerationURL, client: &http.Client{Timeout: config.ModerationTimeout}}, nil
+	}
+	return nil, fmt.Errorf("unknown MODERATOR %q, use %s or %s", config.Moderator, MODERATOR_WORDS, MODERATOR_HTTP)
+}
+
+//***************  WORD LIST ***************************
+// wordListModerator is the word filter of moderation.go.
+type wordListModerator struct{}
+
+func (wordListModerator) Evaluate(p *Post) (Verdict, error) {
+	v := Verdict{Severity: containsFilteredWords(&p.Message)}
+	if v.Severity == SEVERITY_MASK {
+		v.Message = maskFilteredWords(p.Message)
+	}
+	return v, nil
+}
+
+//***************  HTTP SERVICE ***************************
+// httpModerator asks an external service: the post is POSTed as JSON to the
+// url, which answers {"verdict": "block", "message": "..."} (verdict "",
+// "flag", "mask" or "block", message only for mask). It is called once per
+// post, when it is created (see moderateNewPost).
+type httpModerator struct {
+	url    string
+	client *http.Client
+}
+
+func (m *httpModerator) Evaluate(p *Post) (Verdict, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return Verdict{}, err
+	}
+	resp, err := m.client.Post(m.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Verdict{}, fmt.Errorf("moderation service answered %s", resp.Status)
+	}
+
+	var res struct {
+		Verdict string `json:"verdict"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return Verdict{}, err
+	}
+	v := Verdict{Message: res.Message}
+	if res.Verdict != "" {
+		var ok bool
+		if v.Severity, ok = severityNames[res.Verdict]; !ok {
+			return Verdict{}, fmt.Errorf("moderation service answered unknown verdict %q", res.Verdict)
+		}
+	}
+	return v, nil
+}
+
+//***************  APPLY ***************************
+// evaluatePost asks the moderator about p. A moderator failing lets the post
+// through (logged): better an unmoderated post than none at all.
+func evaluatePost(p *Post) Verdict {
+	v, err := moderator.Evaluate(p)
+	if err != nil {
+		log.Printf("WARNING: moderation of post %s failed, letting it through: %v", p.Id, err)
+		return Verdict{}
+	}
+	return v
+}
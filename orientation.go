@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+)
+
+const (
+	// Quality of a JPEG re-encoded after rotating it.
+	ROTATED_JPEG_QUALITY = 90
+	// The EXIF block is near the start of the file, don't read further for it.
+	MAX_EXIF_SCAN_BYTES = 256 * 1024
+
+	EXIF_ORIENTATION_TAG = 0x0112
+
+	// An image is decoded (to turn it) only up to this many pixels, a decoded
+	// pixel takes 4 bytes and the turned copy as many again. A small file can
+	// claim a huge size, it is checked from the header first.
+	MAX_IMAGE_PIXELS = 50 * 1000 * 1000
+)
+
+var errTooManyPixels = errors.New("image has too many pixels")
+
+//***************  IMAGE ORIENTATION ***************************
+// orientImage returns the image to upload: as it is, or for a JPEG with an
+// EXIF orientation (phones store the pixels as the sensor saw them, plus a
+// flag saying how to turn them), re-encoded with the pixels turned so it
+// shows the right way up everywhere. The re-encoded JPEG has no EXIF left.
+func orientImage(file multipart.File) (io.Reader, error) {
+	orientation := exifOrientation(io.LimitReader(file, MAX_EXIF_SCAN_BYTES))
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if orientation <= 1 || orientation > 8 {
+		return file, nil
+	}
+	// a header we can't read is left to jpeg.Decode
+	if err := checkPixels(file); err == errTooManyPixels {
+		return nil, err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	// an image we can't turn is still uploaded, only sideways
+	img, err := jpeg.Decode(file)
+	var buf bytes.Buffer
+	if err == nil {
+		err = jpeg.Encode(&buf, applyOrientation(img, orientation), &jpeg.Options{Quality: ROTATED_JPEG_QUALITY})
+	}
+	if err != nil {
+		fmt.Printf("Cannot fix orientation %d of image %v\n", orientation, err)
+		if _, err := file.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	return &buf, nil
+}
+
+// orientStream is orientImage for an image read as a stream (see
+// streamupload.go): the EXIF block is peeked at, so it needs a reader
+// buffering MAX_EXIF_SCAN_BYTES. There is no going back, an image that
+// needs turning but can't be decoded is an error.
+func orientStream(br *bufio.Reader) (io.Reader, error) {
+	head, _ := br.Peek(MAX_EXIF_SCAN_BYTES)
+	orientation := exifOrientation(bytes.NewReader(head))
+	if orientation <= 1 || orientation > 8 {
+		return br, nil
+	}
+	// the size must be in what was peeked, nothing is decoded blindly
+	if err := checkPixels(bytes.NewReader(head)); err == errTooManyPixels {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read size of image: %v", err)
+	}
+
+	img, err := jpeg.Decode(br)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fix orientation %d of image: %v", orientation, err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, applyOrientation(img, orientation), &jpeg.Options{Quality: ROTATED_JPEG_QUALITY}); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// checkPixels reads the size of a JPEG from its header, and fails with
+// errTooManyPixels if it is over MAX_IMAGE_PIXELS.
+func checkPixels(r io.Reader) error {
+	cfg, err := jpeg.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MAX_IMAGE_PIXELS {
+		return errTooManyPixels
+	}
+	return nil
+}
+
+// applyOrientation turns the pixels for an EXIF orientation (1 to 8):
+//
+//	1 as is            2 mirrored           3 rotated 180    4 flipped upside down
+//	5 mirrored + 270   6 rotated 90 (CW)    7 mirrored + 90  8 rotated 270 (CW)
+func applyOrientation(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// exifOrientation reads the orientation tag of a JPEG, 0 when it is not a
+// JPEG or has no such tag. It stops at the first APP1 (EXIF) segment.
+func exifOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 0
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return 0
+		}
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		// start of scan: the pixels start, no EXIF before them
+		if marker[1] == 0xDA || size < 0 {
+			return 0
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 0
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return orientationFromTIFF(segment[6:])
+		}
+	}
+}
+
+// orientationFromTIFF finds the orientation in IFD0 of the EXIF TIFF block.
+func orientationFromTIFF(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == EXIF_ORIENTATION_TAG {
+			// a SHORT, stored in the first 2 bytes of the value field
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
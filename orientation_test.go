@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"testing"
+)
+
+// readSeekFile is a multipart.File over bytes.
+type readSeekFile struct {
+	*bytes.Reader
+}
+
+func (readSeekFile) Close() error { return nil }
+
+// sampleJPEG is a w x h JPEG, red on its left half and blue on its right
+// half, with an EXIF orientation tag when orientation > 0.
+func sampleJPEG(t *testing.T, w, h, orientation int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= w/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	js := buf.Bytes()
+	if orientation == 0 {
+		return js
+	}
+
+	// little endian TIFF, IFD0 with the orientation entry only
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = append(tiff, 1, 0)
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], EXIF_ORIENTATION_TAG)
+	binary.LittleEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], uint16(orientation))
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	// right after the SOI marker
+	out := append([]byte{}, js[:2]...)
+	out = append(out, app1...)
+	return append(out, js[2:]...)
+}
+
+// withSize rewrites the size in the SOF0 header of a JPEG.
+func withSize(t *testing.T, js []byte, w, h int) []byte {
+	out := append([]byte{}, js...)
+	i := bytes.Index(out, []byte{0xFF, 0xC0})
+	if i < 0 {
+		t.Fatal("no SOF0 marker")
+	}
+	binary.BigEndian.PutUint16(out[i+5:], uint16(h))
+	binary.BigEndian.PutUint16(out[i+7:], uint16(w))
+	return out
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xC000 && b < 0x4000
+}
+
+func TestExifOrientation(t *testing.T) {
+	for _, o := range []int{0, 1, 3, 6, 8} {
+		if got := exifOrientation(bytes.NewReader(sampleJPEG(t, 16, 8, o))); got != o {
+			t.Errorf("orientation %d: got %d", o, got)
+		}
+	}
+	if got := exifOrientation(bytes.NewReader([]byte("not a jpeg"))); got != 0 {
+		t.Errorf("not a jpeg: got %d", got)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	tests := []struct {
+		orientation int
+		w, h        int
+		// where the red half ends up
+		redX, redY int
+	}{
+		{1, 16, 8, 2, 4},
+		{3, 16, 8, 13, 4}, // 180: red on the right
+		{6, 8, 16, 4, 2},  // 90 CW: red on top
+		{8, 8, 16, 4, 13}, // 270 CW: red at the bottom
+	}
+	for _, tt := range tests {
+		js := sampleJPEG(t, 16, 8, tt.orientation)
+		r, err := orientImage(readSeekFile{bytes.NewReader(js)})
+		if err != nil {
+			t.Fatalf("orientation %d: %v", tt.orientation, err)
+		}
+		img, err := jpeg.Decode(r)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", tt.orientation, err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if !isRed(img.At(tt.redX, tt.redY)) {
+			t.Errorf("orientation %d: (%d,%d) is not red", tt.orientation, tt.redX, tt.redY)
+		}
+	}
+}
+
+func TestOrientImageTooManyPixels(t *testing.T) {
+	js := withSize(t, sampleJPEG(t, 16, 8, 6), 10000, 10000)
+	if _, err := orientImage(readSeekFile{bytes.NewReader(js)}); err != errTooManyPixels {
+		t.Errorf("got %v, want errTooManyPixels", err)
+	}
+
+	// without an orientation it is not decoded, nothing to check
+	js = withSize(t, sampleJPEG(t, 16, 8, 0), 10000, 10000)
+	r, err := orientImage(readSeekFile{bytes.NewReader(js)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, js) {
+		t.Error("image without orientation was changed")
+	}
+}
+
+func TestOrientStreamTooManyPixels(t *testing.T) {
+	js := withSize(t, sampleJPEG(t, 16, 8, 6), 10000, 10000)
+	br := bufio.NewReaderSize(bytes.NewReader(js), MAX_EXIF_SCAN_BYTES)
+	if _, err := orientStream(br); err != errTooManyPixels {
+		t.Errorf("got %v, want errTooManyPixels", err)
+	}
+
+	js = sampleJPEG(t, 16, 8, 6)
+	br = bufio.NewReaderSize(bytes.NewReader(js), MAX_EXIF_SCAN_BYTES)
+	r, err := orientStream(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 16 {
+		t.Errorf("got %dx%d, want 8x16", b.Dx(), b.Dy())
+	}
+}
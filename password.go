@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//*************** FORGOT PASSWORD HANDLER ***************************
+// Body: {"username": "..."} or {"email": "..."}
+// Always answers the same way, so it can't be used to find out which accounts exist.
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one forgot password request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	var req User
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+
+	var u *User
+	var err error
+	if req.Username != "" {
+		u, err = getUser(req.Username)
+	} else if req.Email != "" {
+		u, err = findUserByEmail(req.Email)
+	}
+	if err == nil && u != nil && u.Email != "" {
+		if err := sendResetPasswordEmail(*u); err != nil {
+			fmt.Printf("Failed to send reset email to %s %v\n", u.Email, err)
+		}
+	} else {
+		fmt.Printf("No account to reset for %q %q\n", req.Username, req.Email)
+	}
+
+	w.Write([]byte("If the account exists, a reset email has been sent."))
+}
+
+//*************** RESET PASSWORD HANDLER ***************************
+// The link of the reset email opens this page, a form which posts the new
+// password (with the token) to resetPasswordHandler.
+var resetPasswordPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Reset your password</title></head>
+<body>
+<form method="POST" action="/password/reset">
+<input type="hidden" name="token" value="{{.}}">
+<label>New password <input type="password" name="password" required></label>
+<button type="submit">Reset password</button>
+</form>
+</body>
+</html>
+`))
+
+func resetPasswordFormHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the token is in the page, don't let it be framed or leak as referrer
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	resetPasswordPage.Execute(w, token)
+}
+
+// Body: {"token": "...", "password": "<new password>"}, or the same fields
+// form-encoded (the form of resetPasswordFormHandler).
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one reset password request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		req.Token = r.PostFormValue("token")
+		req.Password = r.PostFormValue("password")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "Empty password", http.StatusBadRequest)
+		return
+	}
+
+	u, err := checkResetToken(req.Token, getUser)
+	if err != nil {
+		fmt.Printf("Invalid reset token %v\n", err)
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	username := u.Username
+
+	if err := updatePassword(username, req.Password); err != nil {
+		fmt.Printf("Failed to reset password of %s %v\n", username, err)
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("Password of %s is reset.\n", username)
+	w.Write([]byte("Password reset successfully."))
+}
+
+// checkResetToken returns the user a reset token is for, or an error if it
+// is invalid, expired or already used. lookup reads the user (getUser).
+func checkResetToken(tokenString string, lookup func(string) (*User, error)) (*User, error) {
+	claims, err := parsePurposeClaims(PURPOSE_RESET_PASSWORD, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	username := claims["username"].(string)
+
+	u, err := lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("no user %s", username)
+	}
+	// The token is bound to the password it was issued for,
+	// so it stops working as soon as the password is changed (used once).
+	if claims["pwd"] != passwordFingerprint(u.Password) {
+		return nil, fmt.Errorf("reset token of %s was already used", username)
+	}
+	return u, nil
+}
+
+// sendResetPasswordEmail mails the user a token to reset the password.
+func sendResetPasswordEmail(u User) error {
+	extra := jwt.MapClaims{"pwd": passwordFingerprint(u.Password)}
+	tokenString, err := signPurposeToken(PURPOSE_RESET_PASSWORD, u.Username, RESET_PASSWORD_TOKEN_TTL, extra)
+	if err != nil {
+		return err
+	}
+	link := config.PublicURL + "/password/reset?token=" + url.QueryEscape(tokenString)
+	body := "Hi " + u.Username + ",\n\nUse this link to choose a new password, it only works for a short time:\n" + link +
+		"\n\nIf you didn't ask for it, just ignore this email.\n"
+	return sendMail(u.Email, "Reset your password", body)
+}
+
+// updatePassword stores the bcrypt hash of the new password.
+func updatePassword(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	es_client, err := getESClient()
+	if err != nil {
+		return err
+	}
+	_, err = es_client.Update().
+		Index(config.ESIndex).
+		Type(TYPE_USER).
+		Id(username).
+		Doc(map[string]interface{}{"password": hash}).
+		Refresh(true).
+		Do()
+	return err
+}
+
+// findUserByEmail returns the user with this email, nil if there is none.
+func findUserByEmail(email string) (*User, error) {
+	es_client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// email is an analyzed field --> match all its words, then compare exactly
+	queryResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(TYPE_USER).
+		Query(elastic.NewMatchQuery("email", email).Operator("and")).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	var tyu User
+	for _, item := range queryResult.Each(reflect.TypeOf(tyu)) {
+		u := item.(User)
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+// passwordFingerprint is a short digest of the stored password (hash),
+// put in reset tokens without exposing the hash itself.
+func passwordFingerprint(stored string) string {
+	sum := sha256.Sum256(append([]byte(stored), mySigningKey...))
+	return hex.EncodeToString(sum[:8])
+}
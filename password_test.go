@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// resetToken is the token sendResetPasswordEmail would send to u.
+func resetToken(t *testing.T, u *User, ttl time.Duration) string {
+	extra := jwt.MapClaims{"pwd": passwordFingerprint(u.Password)}
+	token, err := signPurposeToken(PURPOSE_RESET_PASSWORD, u.Username, ttl, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCheckResetToken(t *testing.T) {
+	u := &User{Username: "alice", Password: "old-hash"}
+	lookup := func(string) (*User, error) { return u, nil }
+
+	token := resetToken(t, u, time.Hour)
+	got, err := checkResetToken(token, lookup)
+	if err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if got.Username != "alice" {
+		t.Errorf("got user %s, want alice", got.Username)
+	}
+
+	// the password changed with it --> the same token can't be used again
+	u.Password = "new-hash"
+	if _, err := checkResetToken(token, lookup); err == nil {
+		t.Error("reused token was accepted")
+	}
+}
+
+func TestCheckResetTokenExpired(t *testing.T) {
+	u := &User{Username: "alice", Password: "old-hash"}
+	lookup := func(string) (*User, error) { return u, nil }
+
+	token := resetToken(t, u, -time.Minute)
+	if _, err := checkResetToken(token, lookup); err == nil {
+		t.Error("expired token was accepted")
+	}
+}
+
+func TestCheckResetTokenOtherPurpose(t *testing.T) {
+	u := &User{Username: "alice", Password: "old-hash"}
+	lookup := func(string) (*User, error) { return u, nil }
+
+	token, err := signPurposeToken(PURPOSE_VERIFY_EMAIL, u.Username, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkResetToken(token, lookup); err == nil {
+		t.Error("verify email token was accepted to reset the password")
+	}
+}
+
+func TestResetPasswordForm(t *testing.T) {
+	w := httptest.NewRecorder()
+	resetPasswordFormHandler(w, httptest.NewRequest("GET", `/password/reset?token=abc"><script>`, nil))
+	if w.Code != 200 {
+		t.Fatalf("got %d, want 200", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `action="/password/reset"`) || strings.Contains(body, "<script>") {
+		t.Errorf("unexpected form %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	resetPasswordFormHandler(w, httptest.NewRequest("GET", "/password/reset", nil))
+	if w.Code != 400 {
+		t.Errorf("no token: got %d, want 400", w.Code)
+	}
+}
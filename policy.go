@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Defaults of the content policy (USERNAME_MIN_LENGTH, USERNAME_MAX_LENGTH,
+	// USERNAME_PATTERN, MAX_MESSAGE_LENGTH, MESSAGE_URL_SCHEMES).
+	USERNAME_MIN_LENGTH = 3
+	USERNAME_MAX_LENGTH = 32
+	USERNAME_PATTERN    = `^[a-z0-9_]+$`
+	MAX_MESSAGE_LENGTH  = 1000 // characters
+	MESSAGE_URL_SCHEMES = "http,https"
+)
+
+// Separates the parts of the row keys usernames are in (user#<username>#...),
+// so no username may contain it, whatever USERNAME_PATTERN says.
+const USERNAME_KEY_SEPARATOR = "#"
+
+// scheme://... in a message, the scheme is checked against the allowed ones
+var messageURLPattern = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*)://`)
+
+// ContentPolicy holds the rules of what users may write: usernames at
+// signup, messages of posts and comments. Every check goes through it, so
+// the rules live (and are tuned) in one place.
+type ContentPolicy struct {
+	UsernameMinLength int
+	UsernameMaxLength int
+	// What a username must match, USERNAME_PATTERN by default.
+	UsernamePattern *regexp.Regexp
+	// In characters.
+	MaxMessageLength int
+	// Schemes of the links a message may contain (lowercase), "http" and
+	// "https" by default: no javascript: or file:// links.
+	AllowedURLSchemes []string
+}
+
+//***************  CONTENT POLICY ***************************
+// loadPolicy reads the policy from the env, see the consts above for the defaults.
+func loadPolicy() (*ContentPolicy, error) {
+	p := &ContentPolicy{}
+	var err error
+	if p.UsernameMinLength, err = envInt("USERNAME_MIN_LENGTH", USERNAME_MIN_LENGTH); err != nil {
+		return nil, err
+	}
+	if p.UsernameMaxLength, err = envInt("USERNAME_MAX_LENGTH", USERNAME_MAX_LENGTH); err != nil {
+		return nil, err
+	}
+	if p.UsernameMinLength <= 0 || p.UsernameMaxLength < p.UsernameMinLength {
+		return nil, fmt.Errorf("USERNAME_MIN_LENGTH must be positive and not above USERNAME_MAX_LENGTH")
+	}
+	if p.UsernamePattern, err = regexp.Compile(envString("USERNAME_PATTERN", USERNAME_PATTERN)); err != nil {
+		return nil, fmt.Errorf("invalid USERNAME_PATTERN: %v", err)
+	}
+	// checkUsername refuses them anyway, but a pattern allowing them is a mistake
+	for _, probe := range []string{"#", "a#b", "user#123"} {
+		if p.UsernamePattern.MatchString(probe) {
+			return nil, fmt.Errorf("USERNAME_PATTERN must not allow %q, it separates the parts of row keys", USERNAME_KEY_SEPARATOR)
+		}
+	}
+	if p.MaxMessageLength, err = envInt("MAX_MESSAGE_LENGTH", MAX_MESSAGE_LENGTH); err != nil {
+		return nil, err
+	}
+	if p.MaxMessageLength <= 0 {
+		return nil, fmt.Errorf("MAX_MESSAGE_LENGTH must be positive")
+	}
+	for _, scheme := range envList("MESSAGE_URL_SCHEMES", MESSAGE_URL_SCHEMES) {
+		p.AllowedURLSchemes = append(p.AllowedURLSchemes, strings.ToLower(scheme))
+	}
+	return p, nil
+}
+
+// checkUsername adds to errs what is wrong with a new username.
+func (p *ContentPolicy) checkUsername(errs *ValidationErrors, field, username string) {
+	n := utf8.RuneCountInString(username)
+	switch {
+	case n == 0:
+		errs.Add(field, "%s is required", field)
+	case n < p.UsernameMinLength || n > p.UsernameMaxLength:
+		errs.Add(field, "%s must be %d to %d characters", field, p.UsernameMinLength, p.UsernameMaxLength)
+	case !p.UsernamePattern.MatchString(username) || strings.Contains(username, USERNAME_KEY_SEPARATOR):
+		errs.Add(field, "%s has characters that are not allowed", field)
+	case strings.HasPrefix(username, SERVICE_USER_PREFIX):
+		errs.Add(field, "%s must not start with %q, it is kept for services", field, SERVICE_USER_PREFIX)
+	}
+}
+
+// checkExistingUsername adds to errs what is wrong with the username of an
+// existing user (an import): names made before the policy, or before it was
+// tightened, are fine. Only what would break the row keys is refused.
+func (p *ContentPolicy) checkExistingUsername(errs *ValidationErrors, field, username string) {
+	switch {
+	case username == "":
+		errs.Add(field, "%s is required", field)
+	case strings.Contains(username, USERNAME_KEY_SEPARATOR):
+		errs.Add(field, "%s must not contain %q", field, USERNAME_KEY_SEPARATOR)
+	case strings.HasPrefix(username, SERVICE_USER_PREFIX):
+		errs.Add(field, "%s must not start with %q, it is kept for services", field, SERVICE_USER_PREFIX)
+	}
+}
+
+// checkMessage adds to errs what is wrong with the message of a post or a
+// comment. An empty message is fine here, the caller decides if it's required.
+func (p *ContentPolicy) checkMessage(errs *ValidationErrors, field, message string) {
+	if n := utf8.RuneCountInString(message); n > p.MaxMessageLength {
+		errs.Add(field, "%s is %d characters, the limit is %d", field, n, p.MaxMessageLength)
+	}
+	for _, m := range messageURLPattern.FindAllStringSubmatch(message, -1) {
+		if scheme := strings.ToLower(m[1]); !p.allowedScheme(scheme) {
+			errs.Add(field, "%s links are not allowed, only %s", scheme, strings.Join(p.AllowedURLSchemes, ", "))
+			return
+		}
+	}
+}
+
+func (p *ContentPolicy) allowedScheme(scheme string) bool {
+	for _, s := range p.AllowedURLSchemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
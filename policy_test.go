@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func testPolicy(t *testing.T) *ContentPolicy {
+	p, err := loadPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCheckUsername(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		username string
+		ok       bool
+	}{
+		{"alice", true},
+		{"al", false}, // below USERNAME_MIN_LENGTH
+		{"", false},
+		{"Alice", false},
+		{"a#b_c", false},
+	}
+	for _, tt := range tests {
+		var errs ValidationErrors
+		p.checkUsername(&errs, "username", tt.username)
+		if (errs == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.username, errs)
+		}
+	}
+}
+
+func TestCheckExistingUsername(t *testing.T) {
+	p := testPolicy(t)
+	// made before the policy: shorter than the min now, or with other characters
+	for _, name := range []string{"al", "x", "Old.Name"} {
+		var errs ValidationErrors
+		p.checkExistingUsername(&errs, "user", name)
+		if errs != nil {
+			t.Errorf("%q refused: %v", name, errs)
+		}
+	}
+	for _, name := range []string{"", "a#b", "svc-partner"} {
+		var errs ValidationErrors
+		p.checkExistingUsername(&errs, "user", name)
+		if errs == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func TestLoadPolicyKeySeparator(t *testing.T) {
+	t.Setenv("USERNAME_PATTERN", `^[a-z0-9_#]+$`)
+	if _, err := loadPolicy(); err == nil {
+		t.Error("a pattern allowing # was accepted")
+	}
+
+	t.Setenv("USERNAME_PATTERN", `^[a-z0-9_.-]+$`)
+	if _, err := loadPolicy(); err != nil {
+		t.Errorf("a pattern without # refused: %v", err)
+	}
+}
+
+func TestCheckUsernameServicePrefix(t *testing.T) {
+	// a custom pattern allowing '-' still can't make a service name
+	t.Setenv("USERNAME_PATTERN", `^[a-z0-9_-]+$`)
+	p := testPolicy(t)
+	for _, name := range []string{"svc-partner", "svc-"} {
+		var errs ValidationErrors
+		p.checkUsername(&errs, "username", name)
+		if errs == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+	var errs ValidationErrors
+	p.checkUsername(&errs, "username", "my-svc")
+	if errs != nil {
+		t.Errorf("my-svc refused: %v", errs)
+	}
+}
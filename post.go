@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+//***************  RAW POST (BigTable) ***************************
+// Read a post straight from BigTable (the source of truth), bypassing ES.
+// Handy to debug posts missing from search. Only its author or an admin.
+func rawPostHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	fmt.Printf("Received one raw post request %s\n", id)
+	w.Header().Set("Content-Type", "application/json")
+
+	p, err := postStore.Read(context.Background(), id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to read post", http.StatusInternalServerError)
+		return
+	}
+	// same answer for a missing post and someone else's post
+	if p == nil || (p.User != usernameFromToken(r) && !isAdmin(r)) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(js)
+}
+
+//***************  POST LOCATION ***************************
+// updateLocationHandler moves a mis-geotagged post, {"lat": 37.5, "lon": -122.1}.
+// Only its author, and only the location: the message is not editable here.
+func updateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := usernameFromToken(r)
+	fmt.Printf("Received one update location request %s from %s\n", id, username)
+
+	var body struct {
+		Lat *float64 `json:"lat"`
+		Lon *float64 `json:"lon"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	var errs ValidationErrors
+	if body.Lat == nil {
+		errs.Add("lat", "lat is required")
+	} else if *body.Lat < -90 || *body.Lat > 90 {
+		errs.Add("lat", "lat must be between -90 and 90")
+	}
+	if body.Lon == nil {
+		errs.Add("lon", "lon is required")
+	} else if *body.Lon < -180 || *body.Lon > 180 {
+		errs.Add("lon", "lon must be between -180 and 180")
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx := context.Background()
+	p, err := postStore.Read(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to read post", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if p.User != username {
+		http.Error(w, "Only the author can move a post", http.StatusForbidden)
+		return
+	}
+
+	old, oldUpdatedAt := p.Location, p.UpdatedAt
+	p.Location = Location{Lat: *body.Lat, Lon: *body.Lon}
+	p.UpdatedAt = time.Now().Unix()
+	// BigTable first (the source of truth), put it back if ES fails
+	if err := saveLocationToBigTable(ctx, id, p.Location, p.UpdatedAt); err != nil {
+		fmt.Printf("Failed to save location of post %s to BigTable %v\n", id, err)
+		http.Error(w, "Failed to update location", http.StatusInternalServerError)
+		return
+	}
+	if err := saveLocationToES(id, p.Location, p.UpdatedAt); err != nil {
+		fmt.Printf("Failed to save location of post %s to ES %v\n", id, err)
+		if err := saveLocationToBigTable(ctx, id, old, oldUpdatedAt); err != nil {
+			fmt.Printf("Rollback of location of post %s in BigTable failed %v\n", id, err)
+		}
+		if writeESTimeout(w, err) {
+			return
+		}
+		http.Error(w, "Failed to update location", http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func saveLocationToBigTable(ctx context.Context, id string, loc Location, updatedAt int64) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(loc.Lat, 'f', -1, 64)))
+	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(loc.Lon, 'f', -1, 64)))
+	mut.Set("post", "updated_at", t, []byte(strconv.FormatInt(updatedAt, 10)))
+	return bt_client.Open("post").Apply(ctx, id, mut)
+}
+
+func saveLocationToES(id string, loc Location, updatedAt int64) error {
+	es_client, err := getESClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := esContext(ES_OP_INDEX)
+	defer cancel()
+	_, err = es_client.Update().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Id(id).
+		Doc(map[string]interface{}{"location": loc, "updated_at": updatedAt}).
+		Refresh(config.ESRefresh).
+		DoC(ctx)
+	return esError(ctx, ES_OP_INDEX, err)
+}
+
+// readPostFromBigTable returns the post, or nil if there is no such row.
+func readPostFromBigTable(ctx context.Context, id string) (*Post, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	row, err := bt_client.Open("post").ReadRow(ctx, id, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return nil, err
+	}
+	if len(row) == 0 {
+		return nil, nil
+	}
+	p := postFromRow(row)
+	if p.User == "" {
+		// only reserved by newPostID, not saved (yet)
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// postFromRow rebuilds a Post from its row in the "post" table (post:user,
+// post:message, post:url, post:urls, post:files, post:hashtags, post:mentions, post:created, post:updated_at, post:publish_at, location:lat, location:lon). Missing columns are
+// left empty, the row is expected to hold only the latest cell of each.
+func postFromRow(row bigtable.Row) Post {
+	p := Post{Id: row.Key()}
+	for _, items := range row {
+		for _, item := range items {
+			val := string(item.Value)
+			switch strings.SplitN(item.Column, ":", 2)[1] {
+			case "user":
+				p.User = val
+			case "message":
+				p.Message = val
+			case "url":
+				p.Url = val
+			case "urls":
+				json.Unmarshal(item.Value, &p.Urls)
+			case "files":
+				json.Unmarshal(item.Value, &p.Files)
+			case "hashtags":
+				json.Unmarshal(item.Value, &p.Hashtags)
+			case "mentions":
+				json.Unmarshal(item.Value, &p.Mentions)
+			case "created":
+				p.Created, _ = strconv.ParseInt(val, 10, 64)
+			case "updated_at":
+				p.UpdatedAt, _ = strconv.ParseInt(val, 10, 64)
+			case "publish_at":
+				p.PublishAt, _ = strconv.ParseInt(val, 10, 64)
+			case "lat":
+				p.Location.Lat, _ = strconv.ParseFloat(val, 64)
+			case "lon":
+				p.Location.Lon, _ = strconv.ParseFloat(val, 64)
+			}
+		}
+	}
+	return p
+}
+
+// postsFromES reads posts by id in one request. Posts not in ES (deleted)
+// are missing from the map.
+func postsFromES(ids []string) (map[string]Post, error) {
+	posts := map[string]Post{}
+	if len(ids) == 0 {
+		return posts, nil
+	}
+	es_client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+	mget := es_client.MultiGet()
+	for _, id := range ids {
+		mget = mget.Add(elastic.NewMultiGetItem().Index(config.ESIndex).Type(config.ESType).Id(id))
+	}
+	ctx, cancel := esContext(ES_OP_GET)
+	defer cancel()
+	res, err := mget.DoC(ctx)
+	if err != nil {
+		return nil, esError(ctx, ES_OP_GET, err)
+	}
+	for _, doc := range res.Docs {
+		if !doc.Found || doc.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(*doc.Source, &p); err == nil {
+			p.Id = doc.Id
+			posts[doc.Id] = p
+		}
+	}
+	return posts, nil
+}
+
+//***************  BULK DELETE OWN POSTS ***************************
+const (
+	// Max ids in one bulk delete request ("all" has no limit).
+	MAX_BULK_DELETE_IDS = 100
+	// Posts deleted at the same time, each one hits GCS, BigTable and ES.
+	BULK_DELETE_CONCURRENCY = 5
+)
+
+type BulkDeleteRequest struct {
+	Ids []string `json:"ids"`
+	All bool     `json:"all"`
+}
+
+// BulkDeleteResult is the outcome for one post id.
+type BulkDeleteResult struct {
+	Id      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bulkDeleteHandler deletes several posts of the caller in one request:
+// {"ids":["id1","id2"]} or {"all":true}. Ids which are not the caller's are
+// reported as not found, they are never deleted.
+//
+//	POST /me/posts/delete
+func bulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one bulk delete request from %s\n", username)
+	w.Header().Set("Content-Type", "application/json")
+
+	var req BulkDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, err, "Cannot decode bulk delete request")
+		return
+	}
+	if req.All == (len(req.Ids) > 0) {
+		http.Error(w, "Give either ids or all", http.StatusBadRequest)
+		return
+	}
+	if len(req.Ids) > MAX_BULK_DELETE_IDS {
+		http.Error(w, fmt.Sprintf("At most %d ids per request", MAX_BULK_DELETE_IDS), http.StatusBadRequest)
+		return
+	}
+
+	ids := req.Ids
+	if req.All {
+		var err error
+		if ids, err = listPostIDsByUser(username); err != nil {
+			fmt.Printf("Failed to list posts of %s %v\n", username, err)
+			http.Error(w, "Failed to list posts", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	results := bulkDeletePosts(context.Background(), username, ids, !req.All)
+	js, err := json.Marshal(map[string]interface{}{"results": results})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(js)
+}
+
+// bulkDeletePosts deletes the posts, at most BULK_DELETE_CONCURRENCY at a time.
+// With checkOwner each post is first read from BigTable to make sure it's username's.
+func bulkDeletePosts(ctx context.Context, username string, ids []string, checkOwner bool) []BulkDeleteResult {
+	results := make([]BulkDeleteResult, len(ids))
+	sem := make(chan struct{}, BULK_DELETE_CONCURRENCY)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = BulkDeleteResult{Id: id}
+
+			if checkOwner {
+				p, err := postStore.Read(ctx, id)
+				if err != nil {
+					fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+					results[i].Error = "failed to read post"
+					return
+				}
+				// same answer for a missing post and someone else's post
+				if p == nil || p.User != username {
+					results[i].Error = "not found"
+					return
+				}
+			}
+			// the user_post index row is left behind, reading it skips missing posts
+			if err := deletePost(ctx, id); err != nil {
+				fmt.Printf("Failed to delete post %s %v\n", id, err)
+				results[i].Error = "failed to delete post"
+				return
+			}
+			results[i].Deleted = true
+		}(i, id)
+	}
+	wg.Wait()
+	return results
+}
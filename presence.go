@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const (
+	// BigTable table of the last activity of each user, row key: <username>
+	// columns: presence:last_active (unix seconds), presence:lat, presence:lon
+	// (where they last searched from, rounded to ~1km, missing if never)
+	PRESENCE_TABLE = "presence"
+
+	// A user's activity is written at most once per interval.
+	PRESENCE_INTERVAL = time.Minute
+	// Active within this window --> listed by /users/active ("online now").
+	ACTIVE_WINDOW = 15 * time.Minute
+	// Most users /users/active returns, the most recently active first.
+	MAX_ACTIVE_USERS = 100
+	// Decimals of the stored location, 2 is about 1km: near enough to be
+	// "nearby", not enough to find someone's home.
+	PRESENCE_DECIMALS = 2
+
+	// BigTable table of where users were active recently, for /users/active.
+	// row key: <bucket>#<cell>#<username>, same columns as PRESENCE_TABLE.
+	// The time bucket (unix seconds a PRESENCE_BUCKET starts at) comes first,
+	// so a listing reads the buckets of ACTIVE_WINDOW only, and in them only
+	// the cells of its area. Older buckets are never read again: give the
+	// table a max age GC policy (an hour is plenty).
+	PRESENCE_AREA_TABLE = "presence_area"
+	PRESENCE_BUCKET     = 5 * time.Minute
+	// Cells are that many degrees of lat by lon.
+	PRESENCE_CELL_DEGREES = 1.0
+	// An area over more cells than that reads its buckets whole.
+	MAX_PRESENCE_CELLS = 64
+)
+
+// ActiveUser is one user of /users/active.
+type ActiveUser struct {
+	Username    string   `json:"username"`
+	DisplayName string   `json:"display_name"`
+	AvatarURL   string   `json:"avatar_url"`
+	LastActive  int64    `json:"last_active"`
+	DistanceKm  *float64 `json:"distance_km,omitempty"`
+}
+
+// When each user's activity was last written (by this instance), the
+// entries older than PRESENCE_INTERVAL are pruned every interval.
+var (
+	presenceMu        sync.Mutex
+	presenceWrittenAt = map[string]time.Time{}
+	presencePrunedAt  time.Time
+)
+
+//***************  PRESENCE MIDDLEWARE ***************************
+// trackPresence wraps an (already authenticated) handler to record that the
+// caller is active, and where if the request has a lat/lon. Services (API
+// keys) are not users, they are skipped.
+func trackPresence(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isService(r) {
+			username := usernameFromToken(r)
+			var loc *Location
+			if l, err := parseLocation(r.URL.Query().Get("lat"), r.URL.Query().Get("lon")); err == nil {
+				loc = &l
+			}
+			if presenceDue(username, time.Now()) {
+				go func() {
+					if err := savePresence(context.Background(), username, time.Now(), loc); err != nil {
+						fmt.Printf("Failed to save presence of %s %v\n", username, err)
+					}
+				}()
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// presenceDue tells whether username's activity should be written now, and
+// if so takes note of it.
+func presenceDue(username string, now time.Time) bool {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	if now.Sub(presencePrunedAt) >= PRESENCE_INTERVAL {
+		// due anyway, no need to remember them
+		for name, at := range presenceWrittenAt {
+			if now.Sub(at) >= PRESENCE_INTERVAL {
+				delete(presenceWrittenAt, name)
+			}
+		}
+		presencePrunedAt = now
+	}
+	if now.Sub(presenceWrittenAt[username]) < PRESENCE_INTERVAL {
+		return false
+	}
+	presenceWrittenAt[username] = now
+	return true
+}
+
+//***************  ACTIVE USERS ***************************
+// activeUsersHandler lists the users active in the last ACTIVE_WINDOW near a
+// point (same area params as /search). Private users are only listed to
+// their approved followers.
+//
+//	GET /users/active?lat=37.7&lon=-122.4&range=5
+func activeUsersHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one active users request")
+	sp, err := parseSearchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	since := time.Now().Add(-ACTIVE_WINDOW)
+	presences, err := presencesSince(ctx, since, presenceCells(sp))
+	if err != nil {
+		fmt.Printf("Failed to read presences %v\n", err)
+		http.Error(w, "Failed to read active users", http.StatusInternalServerError)
+		return
+	}
+
+	viewer := usernameFromToken(r)
+	var names []string
+	for name, p := range presences {
+		if name != viewer && p.loc != nil && sp.inArea(*p.loc) {
+			names = append(names, name)
+		}
+	}
+	// without the profiles a private user would look public
+	profiles, err := getProfiles(ctx, names)
+	if err != nil {
+		fmt.Printf("Failed to read profiles %v\n", err)
+		http.Error(w, "Failed to read active users", http.StatusInternalServerError)
+		return
+	}
+	visible, err := visibleAuthors(ctx, viewer, profiles)
+	if err != nil {
+		fmt.Printf("Failed to read follows of %s %v\n", viewer, err)
+		http.Error(w, "Failed to read active users", http.StatusInternalServerError)
+		return
+	}
+
+	users := []ActiveUser{}
+	for _, name := range names {
+		if !visible[name] {
+			continue
+		}
+		p := presences[name]
+		u := ActiveUser{Username: name, DisplayName: name, LastActive: p.lastActive}
+		if prof := profiles[name]; prof != nil {
+			if prof.DisplayName != "" {
+				u.DisplayName = prof.DisplayName
+			}
+			u.AvatarURL = prof.AvatarURL
+		}
+		if sp.Polygon == nil {
+			d := distanceKm(Location{Lat: sp.Lat, Lon: sp.Lon}, *p.loc)
+			u.DistanceKm = &d
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].LastActive > users[j].LastActive })
+	if len(users) > MAX_ACTIVE_USERS {
+		users = users[:MAX_ACTIVE_USERS]
+	}
+
+	js, err := json.Marshal(users)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+//***************  PRESENCE STORE ***************************
+type presence struct {
+	lastActive int64
+	loc        *Location
+}
+
+func presenceBucket(t time.Time) int64 {
+	size := int64(PRESENCE_BUCKET / time.Second)
+	return t.Unix() / size * size
+}
+
+func presenceCell(loc Location) string {
+	return fmt.Sprintf("%+04d%+05d", int(math.Floor(loc.Lat/PRESENCE_CELL_DEGREES)), int(math.Floor(loc.Lon/PRESENCE_CELL_DEGREES)))
+}
+
+func presenceAreaKey(bucket int64, cell, username string) string {
+	return fmt.Sprintf("%010d#%s#%s", bucket, cell, username)
+}
+
+// presenceCells returns the cells covering the area of sp, nil when there
+// are too many of them (or it crosses the antimeridian): read everything.
+func presenceCells(sp *searchParams) []string {
+	var min, max Location
+	if sp.Polygon != nil {
+		min, max = sp.Polygon[0], sp.Polygon[0]
+		for _, p := range sp.Polygon {
+			min.Lat, min.Lon = math.Min(min.Lat, p.Lat), math.Min(min.Lon, p.Lon)
+			max.Lat, max.Lon = math.Max(max.Lat, p.Lat), math.Max(max.Lon, p.Lon)
+		}
+	} else {
+		dLat := sp.RadiusKm * 1000 / METERS_PER_DEGREE_LAT
+		cos := math.Cos(sp.Lat * math.Pi / 180)
+		if cos < 0.01 {
+			// at a pole, every lon is near
+			return nil
+		}
+		dLon := dLat / cos
+		min = Location{Lat: math.Max(sp.Lat-dLat, -90), Lon: sp.Lon - dLon}
+		max = Location{Lat: math.Min(sp.Lat+dLat, 90), Lon: sp.Lon + dLon}
+	}
+	if min.Lon < -180 || max.Lon > 180 {
+		return nil
+	}
+
+	lat0, lat1 := math.Floor(min.Lat/PRESENCE_CELL_DEGREES), math.Floor(max.Lat/PRESENCE_CELL_DEGREES)
+	lon0, lon1 := math.Floor(min.Lon/PRESENCE_CELL_DEGREES), math.Floor(max.Lon/PRESENCE_CELL_DEGREES)
+	if (lat1-lat0+1)*(lon1-lon0+1) > MAX_PRESENCE_CELLS {
+		return nil
+	}
+	var cells []string
+	for lat := lat0; lat <= lat1; lat++ {
+		for lon := lon0; lon <= lon1; lon++ {
+			cells = append(cells, presenceCell(Location{Lat: lat * PRESENCE_CELL_DEGREES, Lon: lon * PRESENCE_CELL_DEGREES}))
+		}
+	}
+	return cells
+}
+
+// savePresence writes the last activity of username, and where it was (if
+// known) in the bucket and cell of PRESENCE_AREA_TABLE.
+func savePresence(ctx context.Context, username string, at time.Time, loc *Location) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	t := bigtable.Time(at)
+	mut.Set("presence", "last_active", t, []byte(strconv.FormatInt(at.Unix(), 10)))
+	if loc != nil {
+		mut.Set("presence", "lat", t, []byte(roundCoordinate(loc.Lat)))
+		mut.Set("presence", "lon", t, []byte(roundCoordinate(loc.Lon)))
+	}
+	if err := bt_client.Open(PRESENCE_TABLE).Apply(ctx, username, mut); err != nil {
+		return err
+	}
+	if loc == nil {
+		return nil
+	}
+	key := presenceAreaKey(presenceBucket(at), presenceCell(*loc), username)
+	return bt_client.Open(PRESENCE_AREA_TABLE).Apply(ctx, key, mut)
+}
+
+func roundCoordinate(v float64) string {
+	scale := math.Pow(10, PRESENCE_DECIMALS)
+	return strconv.FormatFloat(math.Round(v*scale)/scale, 'f', -1, 64)
+}
+
+// lastActive returns when username was last active, 0 if never.
+func lastActive(ctx context.Context, username string) (int64, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return 0, err
+	}
+	defer bt_client.Close()
+
+	row, err := bt_client.Open(PRESENCE_TABLE).ReadRow(ctx, username, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return 0, err
+	}
+	return presenceFromRow(row).lastActive, nil
+}
+
+// presenceRanges are the rows of PRESENCE_AREA_TABLE of the buckets since
+// then, in the cells (all of them if nil).
+func presenceRanges(since, now time.Time, cells []string) bigtable.RowRangeList {
+	var ranges bigtable.RowRangeList
+	size := int64(PRESENCE_BUCKET / time.Second)
+	for b := presenceBucket(since); b <= presenceBucket(now); b += size {
+		if cells == nil {
+			ranges = append(ranges, bigtable.PrefixRange(fmt.Sprintf("%010d#", b)))
+			continue
+		}
+		for _, cell := range cells {
+			ranges = append(ranges, bigtable.PrefixRange(presenceAreaKey(b, cell, "")))
+		}
+	}
+	return ranges
+}
+
+// presencesSince returns the users active since then in the cells (see
+// presenceCells), with where they were, by username. Only the buckets since
+// then are read, and in them only the cells written since then.
+func presencesSince(ctx context.Context, since time.Time, cells []string) (map[string]presence, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	presences := map[string]presence{}
+	filter := bigtable.ChainFilters(
+		bigtable.TimestampRangeFilter(since, time.Time{}),
+		bigtable.LatestNFilter(1),
+	)
+	ranges := presenceRanges(since, time.Now(), cells)
+	err = bt_client.Open(PRESENCE_AREA_TABLE).ReadRows(ctx, ranges, func(row bigtable.Row) bool {
+		parts := strings.SplitN(row.Key(), "#", 3)
+		if len(parts) != 3 {
+			return true
+		}
+		// active in several buckets --> the latest
+		p := presenceFromRow(row)
+		if p.lastActive != 0 && p.loc != nil && p.lastActive > presences[parts[2]].lastActive {
+			presences[parts[2]] = p
+		}
+		return true
+	}, bigtable.RowFilter(filter))
+	return presences, err
+}
+
+func presenceFromRow(row bigtable.Row) presence {
+	var p presence
+	var lat, lon string
+	for _, item := range row["presence"] {
+		switch item.Column {
+		case "presence:last_active":
+			p.lastActive, _ = strconv.ParseInt(string(item.Value), 10, 64)
+		case "presence:lat":
+			lat = string(item.Value)
+		case "presence:lon":
+			lon = string(item.Value)
+		}
+	}
+	if loc, err := parseLocation(lat, lon); err == nil {
+		p.loc = &loc
+	}
+	return p
+}
+
+func deletePresence(ctx context.Context, username string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	if err := bt_client.Open(PRESENCE_TABLE).Apply(ctx, username, mut); err != nil {
+		return err
+	}
+
+	// the rows /users/active still reads, the older ones go with the GC
+	var keys []string
+	area := bt_client.Open(PRESENCE_AREA_TABLE)
+	ranges := presenceRanges(time.Now().Add(-ACTIVE_WINDOW), time.Now(), nil)
+	filter := bigtable.ChainFilters(bigtable.RowKeyFilter(".*#"+regexp.QuoteMeta(username)), bigtable.StripValueFilter())
+	err = area.ReadRows(ctx, ranges, func(row bigtable.Row) bool {
+		keys = append(keys, row.Key())
+		return true
+	}, bigtable.RowFilter(filter))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		mut := bigtable.NewMutation()
+		mut.DeleteRow()
+		if err := area.Apply(ctx, key, mut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
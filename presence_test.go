@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceDuePrunes(t *testing.T) {
+	presenceMu.Lock()
+	presenceWrittenAt = map[string]time.Time{}
+	presencePrunedAt = time.Time{}
+	presenceMu.Unlock()
+
+	now := time.Now()
+	if !presenceDue("alice", now) || presenceDue("alice", now.Add(time.Second)) {
+		t.Fatal("alice written twice within the interval")
+	}
+	presenceDue("bob", now.Add(PRESENCE_INTERVAL/2))
+
+	// a while later, bob's turn: alice is forgotten, due again anyway
+	later := now.Add(PRESENCE_INTERVAL + time.Second)
+	if presenceDue("bob", later) {
+		t.Error("bob written twice within the interval")
+	}
+	presenceMu.Lock()
+	_, kept := presenceWrittenAt["alice"]
+	presenceMu.Unlock()
+	if kept {
+		t.Error("alice was not pruned")
+	}
+	if !presenceDue("alice", later) {
+		t.Error("alice not due after the interval")
+	}
+}
+
+func TestPresenceCells(t *testing.T) {
+	cells := presenceCells(&searchParams{Lat: 37.5, Lon: -122.3, RadiusKm: 10})
+	if len(cells) != 1 || cells[0] != presenceCell(Location{Lat: 37.5, Lon: -122.3}) {
+		t.Errorf("got cells %v, want the one of the center", cells)
+	}
+
+	// on a cell corner, the 4 around it
+	if cells := presenceCells(&searchParams{Lat: 37, Lon: -122, RadiusKm: 5}); len(cells) != 4 {
+		t.Errorf("got %d cells, want 4", len(cells))
+	}
+
+	poly := Polygon{{Lat: 10.5, Lon: 20.5}, {Lat: 12.5, Lon: 20.5}, {Lat: 12.5, Lon: 21.5}, {Lat: 10.5, Lon: 20.5}}
+	if cells := presenceCells(&searchParams{Polygon: poly}); len(cells) != 6 {
+		t.Errorf("polygon: got %d cells, want 6", len(cells))
+	}
+
+	// too wide, or over the antimeridian --> everything
+	if cells := presenceCells(&searchParams{Lat: 0, Lon: 0, RadiusKm: 2000}); cells != nil {
+		t.Errorf("got %d cells, want all", len(cells))
+	}
+	if cells := presenceCells(&searchParams{Lat: 0, Lon: 179.9, RadiusKm: 20}); cells != nil {
+		t.Errorf("got %d cells, want all", len(cells))
+	}
+}
+
+func TestPresenceRanges(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	since := now.Add(-ACTIVE_WINDOW)
+	buckets := int((presenceBucket(now)-presenceBucket(since))/int64(PRESENCE_BUCKET/time.Second)) + 1
+
+	if got := presenceRanges(since, now, nil); len(got) != buckets {
+		t.Errorf("got %d ranges, want one per bucket (%d)", len(got), buckets)
+	}
+	if got := presenceRanges(since, now, []string{"a", "b"}); len(got) != 2*buckets {
+		t.Errorf("got %d ranges, want %d", len(got), 2*buckets)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// BigTable table of public profiles.
+	// row key: <username>, columns: profile:display_name, profile:avatar_url
+	PROFILE_TABLE = "profile"
+)
+
+// Profile is what other users see about a user.
+type Profile struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+	// Private: only approved followers see the posts and profile details.
+	Private bool `json:"private"`
+	// Verified (badge) is set by admins only, see verifyUserHandler.
+	Verified bool `json:"verified"`
+	// Google account (subject id) linked for "Sign in with Google", never shown.
+	GoogleSub string `json:"-"`
+	// LastActive (unix seconds) is not stored with the profile, see presence.go.
+	LastActive int64 `json:"last_active,omitempty"`
+}
+
+// PostResult is a post as returned by search, with its author's profile
+// and how far it is from the searched point.
+type PostResult struct {
+	Post
+	DisplayName string   `json:"display_name"`
+	AvatarURL   string   `json:"avatar_url"`
+	Verified    bool     `json:"verified"`
+	DistanceKm  *float64 `json:"distance_km,omitempty"`
+	DistanceMi  *float64 `json:"distance_mi,omitempty"`
+	// count of each reaction type, every type is there (0 if none)
+	Reactions map[string]int64 `json:"reactions"`
+	// ES score of the keyword match, only with sort=relevance
+	Score *float64 `json:"score,omitempty"`
+	// Where the post really is, when location is jittered for the maps
+	// (LOCATION_JITTER_METERS).
+	TrueLocation *Location `json:"true_location,omitempty"`
+}
+
+// Profiles read recently, a nil profile means the user has none.
+var (
+	profileCacheMu sync.Mutex
+	profileCache   = map[string]cachedProfile{}
+)
+
+type cachedProfile struct {
+	profile *Profile
+	at      time.Time
+}
+
+//***************  ENRICH POSTS ***************************
+// enrichPosts adds the author's display name and avatar to each post.
+// Authors without a profile (or if BigTable fails) show their username.
+// With a center, the distance of each post to it is added too.
+func enrichPosts(ctx context.Context, ps []Post, center *Location) []PostResult {
+	var authors []string
+	for _, p := range ps {
+		authors = append(authors, p.User)
+	}
+	profiles, err := getProfiles(ctx, authors)
+	if err != nil {
+		fmt.Printf("Failed to read profiles %v\n", err)
+	}
+
+	var ids []string
+	for _, p := range ps {
+		ids = append(ids, p.Id)
+	}
+	stats, err := getPostStats(ctx, ids)
+	if err != nil {
+		fmt.Printf("Failed to read post stats %v\n", err)
+	}
+
+	results := make([]PostResult, 0, len(ps))
+	for _, p := range ps {
+		res := PostResult{Post: p, DisplayName: p.User, Reactions: map[string]int64{}}
+		for _, t := range reactionTypes {
+			res.Reactions[t] = stats[p.Id].Reactions[t]
+		}
+		if prof := profiles[p.User]; prof != nil {
+			if prof.DisplayName != "" {
+				res.DisplayName = prof.DisplayName
+			}
+			res.AvatarURL = prof.AvatarURL
+			res.Verified = prof.Verified
+		}
+		if center != nil {
+			km := distanceKm(*center, p.Location)
+			res.DistanceKm = roundedPtr(km, 2)
+			res.DistanceMi = roundedPtr(km*MILES_PER_KM, 2)
+		}
+		if config.LocationJitterMeters > 0 {
+			loc := p.Location
+			res.TrueLocation = &loc
+			res.Location = jitterLocation(p.Id, loc, config.LocationJitterMeters)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+//***************  READ PROFILES ***************************
+// getProfiles returns the profiles of the users, from the cache or else
+// read from BigTable in one batch (no read per user).
+func getProfiles(ctx context.Context, usernames []string) (map[string]*Profile, error) {
+	profiles := map[string]*Profile{}
+	var missing []string
+
+	profileCacheMu.Lock()
+	for _, name := range usernames {
+		if _, done := profiles[name]; done {
+			continue
+		}
+		if c, ok := profileCache[name]; ok && time.Since(c.at) < config.ProfileCacheTTL {
+			profiles[name] = c.profile
+		} else {
+			profiles[name] = nil
+			missing = append(missing, name)
+		}
+	}
+	profileCacheMu.Unlock()
+
+	if len(missing) == 0 {
+		return profiles, nil
+	}
+	found, err := accountStore.Profiles(ctx, missing)
+	if err != nil {
+		return profiles, err
+	}
+
+	now := time.Now()
+	profileCacheMu.Lock()
+	for _, name := range missing {
+		profiles[name] = found[name]
+		profileCache[name] = cachedProfile{profile: found[name], at: now}
+	}
+	profileCacheMu.Unlock()
+	return profiles, nil
+}
+
+// readProfilesFromBigTable is bigtableAccountStore.Profiles, in one batch.
+func readProfilesFromBigTable(ctx context.Context, usernames []string) (map[string]*Profile, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	found := map[string]*Profile{}
+	err = bt_client.Open(PROFILE_TABLE).ReadRows(ctx, bigtable.RowList(usernames), func(row bigtable.Row) bool {
+		found[row.Key()] = profileFromRow(row)
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return found, err
+}
+
+// getProfile returns the profile of one user, nil if there is none.
+func getProfile(ctx context.Context, username string) (*Profile, error) {
+	profiles, err := getProfiles(ctx, []string{username})
+	return profiles[username], err
+}
+
+func profileFromRow(row bigtable.Row) *Profile {
+	p := &Profile{Username: row.Key()}
+	for _, item := range row["profile"] {
+		val := string(item.Value)
+		switch strings.TrimPrefix(item.Column, "profile:") {
+		case "display_name":
+			p.DisplayName = val
+		case "avatar_url":
+			p.AvatarURL = val
+		case "private":
+			p.Private = val == "true"
+		case "verified":
+			p.Verified = val == "true"
+		case "google_sub":
+			p.GoogleSub = val
+		}
+	}
+	return p
+}
+
+//***************  UPDATE PROFILE ***************************
+// Body: {"display_name": "...", "avatar_url": "...", "private": false}
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one update profile request")
+	w.Header().Set("Content-Type", "application/json")
+
+	var p Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	p.Username = usernameFromToken(r)
+	// not for users to change, the response shows the stored one
+	p.Verified = false
+	p.LastActive = 0
+	if len(p.DisplayName) > 64 {
+		http.Error(w, "Display name is too long", http.StatusBadRequest)
+		return
+	}
+	if p.AvatarURL != "" && !strings.HasPrefix(p.AvatarURL, "https://") {
+		http.Error(w, "Avatar url must be https", http.StatusBadRequest)
+		return
+	}
+
+	if err := saveProfile(context.Background(), &p); err != nil {
+		fmt.Printf("Failed to save profile of %s %v\n", p.Username, err)
+		http.Error(w, "Failed to save profile", http.StatusInternalServerError)
+		return
+	}
+	if stored, err := getProfile(context.Background(), p.Username); err == nil && stored != nil {
+		p.Verified = stored.Verified
+	}
+
+	js, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(js)
+}
+
+// saveProfile writes the profile to BigTable and drops it from the cache.
+// Verified is left as it is, see setVerified.
+func saveProfile(ctx context.Context, p *Profile) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("profile", "display_name", t, []byte(p.DisplayName))
+	mut.Set("profile", "avatar_url", t, []byte(p.AvatarURL))
+	mut.Set("profile", "private", t, []byte(strconv.FormatBool(p.Private)))
+	if err := bt_client.Open(PROFILE_TABLE).Apply(ctx, p.Username, mut); err != nil {
+		return err
+	}
+
+	profileCacheMu.Lock()
+	delete(profileCache, p.Username)
+	profileCacheMu.Unlock()
+	return nil
+}
+
+// deleteProfile removes the profile of a user (account deletion).
+func deleteProfile(ctx context.Context, username string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	if err := bt_client.Open(PROFILE_TABLE).Apply(ctx, username, mut); err != nil {
+		return err
+	}
+
+	profileCacheMu.Lock()
+	delete(profileCache, username)
+	profileCacheMu.Unlock()
+	return nil
+}
+
+//***************  VERIFIED BADGE ***************************
+// verifyUserHandler sets (or with {"verified": false} removes) the verified
+// badge of a user. Admins only.
+func verifyUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	fmt.Printf("Received one verify user request for %s\n", username)
+
+	body := struct {
+		Verified *bool `json:"verified"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	verified := body.Verified == nil || *body.Verified
+
+	if _, err := getUser(username); elastic.IsNotFound(err) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Printf("Failed to read user %s %v\n", username, err)
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return
+	}
+	if err := setVerified(context.Background(), username, verified); err != nil {
+		fmt.Printf("Failed to verify %s %v\n", username, err)
+		http.Error(w, "Failed to verify user", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_VERIFY_USER, username, "verified: "+strconv.FormatBool(verified))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setVerified writes the badge to the profile row (creating it if needed).
+func setVerified(ctx context.Context, username string, verified bool) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.Set("profile", "verified", bigtable.Now(), []byte(strconv.FormatBool(verified)))
+	if err := bt_client.Open(PROFILE_TABLE).Apply(ctx, username, mut); err != nil {
+		return err
+	}
+
+	profileCacheMu.Lock()
+	delete(profileCache, username)
+	profileCacheMu.Unlock()
+	return nil
+}
+
+// setGoogleSub links a Google account to the user, see googleLoginHandler.
+func setGoogleSub(ctx context.Context, username, sub string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.Set("profile", "google_sub", bigtable.Now(), []byte(sub))
+	if err := bt_client.Open(PROFILE_TABLE).Apply(ctx, username, mut); err != nil {
+		return err
+	}
+
+	profileCacheMu.Lock()
+	delete(profileCache, username)
+	profileCacheMu.Unlock()
+	return nil
+}
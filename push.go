@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// BigTable table of the device tokens push notifications go to.
+	// row key: <username>#<token>, column: device:registered (unix seconds)
+	DEVICE_TABLE = "device"
+
+	// FCM HTTP v1 API, one message per device token, authorized with an
+	// OAuth token of a service account of the Firebase project.
+	FCM_URL_FORMAT = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	FCM_SCOPE      = "https://www.googleapis.com/auth/firebase.messaging"
+	FCM_TIMEOUT    = 10 * time.Second
+
+	// A push shows at most this many characters of the user text it is
+	// about, the app fetches the rest.
+	PUSH_EXCERPT_LENGTH = 100
+
+	// Pushes waiting to be sent, more are dropped (and logged) rather than
+	// slowing down the requests which make them.
+	PUSH_QUEUE_SIZE = 1000
+
+	MAX_DEVICE_TOKEN_LENGTH = 4096
+)
+
+// Push is one notification to all the devices of a user.
+type Push struct {
+	Username string
+	Title    string
+	Body     string
+	// extra key/values for the app, e.g. {"type": "follow", "user": "bob"}
+	Data map[string]string
+}
+
+var pushQueue = make(chan Push, PUSH_QUEUE_SIZE)
+
+// Gets (and refreshes) the OAuth tokens FCM is called with, set by startPushWorker.
+var fcmTokens oauth2.TokenSource
+
+//***************  DEVICE HANDLER ***************************
+// registerDeviceHandler registers a device token of the caller,
+// {"token": "<FCM registration token>"}. Registering it again is fine.
+func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one register device request from %s\n", username)
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	token := strings.TrimSpace(body.Token)
+	if token == "" || len(token) > MAX_DEVICE_TOKEN_LENGTH {
+		http.Error(w, "Invalid device token", http.StatusBadRequest)
+		return
+	}
+
+	if err := saveDevice(context.Background(), username, token); err != nil {
+		fmt.Printf("Failed to save device of %s %v\n", username, err)
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//***************  PUSH NOTIFICATIONS ***************************
+// notify queues a push to the devices of username. It never blocks the
+// caller, and does nothing when FCM is not setup (FCM_PROJECT_ID).
+func notify(p Push) {
+	if config.FCMProjectID == "" {
+		return
+	}
+	select {
+	case pushQueue <- p:
+	default:
+		fmt.Printf("Push queue is full, dropped push to %s: %s\n", p.Username, p.Title)
+	}
+}
+
+// startPushWorker sends the queued pushes one by one, for the life of the server.
+func startPushWorker() {
+	if config.FCMProjectID == "" {
+		fmt.Println("FCM is not setup, push notifications are off")
+		return
+	}
+	ts, err := fcmTokenSource(context.Background())
+	if err != nil {
+		log.Fatalf("Cannot get FCM credentials: %v", err)
+	}
+	fcmTokens = ts
+	go func() {
+		for p := range pushQueue {
+			if err := sendPush(context.Background(), p); err != nil {
+				fmt.Printf("Failed to push to %s %v\n", p.Username, err)
+			}
+		}
+	}()
+}
+
+// fcmTokenSource uses the service account key in FCM_CREDENTIALS_FILE, or the
+// application default credentials (e.g. the one of the VM) without it.
+func fcmTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	if config.FCMCredentialsFile == "" {
+		return google.DefaultTokenSource(ctx, FCM_SCOPE)
+	}
+	js, err := os.ReadFile(config.FCMCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := google.CredentialsFromJSON(ctx, js, FCM_SCOPE)
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
+
+// sendPush sends p to every device of the user, and forgets the tokens FCM
+// says are dead (app uninstalled, token refreshed).
+func sendPush(ctx context.Context, p Push) error {
+	tokens, err := devicesOf(ctx, p.Username)
+	if err != nil || len(tokens) == 0 {
+		return err
+	}
+
+	for _, token := range tokens {
+		dead, err := sendFCM(token, p)
+		if err != nil {
+			return err
+		}
+		if dead {
+			fmt.Printf("Removing dead device token of %s\n", p.Username)
+			if err := deleteDevice(ctx, p.Username, token); err != nil {
+				fmt.Printf("Failed to remove device of %s %v\n", p.Username, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sendFCM sends p to one device, and tells if FCM rejected its token for good.
+func sendFCM(token string, p Push) (bool, error) {
+	msg := map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": p.Title, "body": p.Body},
+			"data":         p.Data,
+		},
+	}
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf(FCM_URL_FORMAT, config.FCMProjectID), bytes.NewReader(js))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	auth, err := fcmTokens.Token()
+	if err != nil {
+		return false, err
+	}
+	auth.SetAuthHeader(req)
+
+	client := &http.Client{Timeout: FCM_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	var result fcmError
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.deadToken() {
+		return true, nil
+	}
+	return false, fmt.Errorf("FCM returned %s %s", resp.Status, result.Error.Message)
+}
+
+// fcmError is the body of a failed FCM v1 send.
+type fcmError struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			ErrorCode       string `json:"errorCode"`
+			FieldViolations []struct {
+				Field string `json:"field"`
+			} `json:"fieldViolations"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// deadToken tells if the send failed because of the device token: not
+// registered anymore, or not a token at all.
+func (e *fcmError) deadToken() bool {
+	for _, d := range e.Error.Details {
+		if d.ErrorCode == "UNREGISTERED" {
+			return true
+		}
+		for _, v := range d.FieldViolations {
+			if e.Error.Status == "INVALID_ARGUMENT" && v.Field == "message.token" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pushExcerpt is the start of a (moderated) user text, to show in a push.
+func pushExcerpt(s string) string {
+	runes := []rune(s)
+	if len(runes) <= PUSH_EXCERPT_LENGTH {
+		return s
+	}
+	return string(runes[:PUSH_EXCERPT_LENGTH-1]) + "…"
+}
+
+//***************  DEVICE STORE ***************************
+func deviceKey(username, token string) string { return username + "#" + token }
+
+func saveDevice(ctx context.Context, username, token string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.Set("device", "registered", bigtable.Now(), []byte(fmt.Sprint(time.Now().Unix())))
+	return bt_client.Open(DEVICE_TABLE).Apply(ctx, deviceKey(username, token), mut)
+}
+
+// devicesOf returns the device tokens of username.
+func devicesOf(ctx context.Context, username string) ([]string, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	prefix := deviceKey(username, "")
+	var tokens []string
+	err = bt_client.Open(DEVICE_TABLE).ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		tokens = append(tokens, strings.TrimPrefix(row.Key(), prefix))
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	return tokens, err
+}
+
+func deleteDevice(ctx context.Context, username, token string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	return bt_client.Open(DEVICE_TABLE).Apply(ctx, deviceKey(username, token), mut)
+}
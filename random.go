@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Random posts asked from ES at once, so one is left after dropping the
+// filtered and private ones.
+const RANDOM_POST_CANDIDATES = 10
+
+//***************  RANDOM POST ***************************
+// randomPostHandler returns one random post of the area, to discover
+// something nearby. Same area params as /search (lat/lon/range or polygon,
+// keyword ...). 404 when there is nothing to show.
+func randomPostHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for a random post")
+	sp, err := parseSearchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to ES %v\n", err)
+		http.Error(w, "Failed to read a random post", http.StatusInternalServerError)
+		return
+	}
+	// https://www.elastic.co/guide/en/elasticsearch/reference/2.4/query-dsl-function-score-query.html#function-random
+	q := elastic.NewFunctionScoreQuery().
+		Query(buildFilterQuery(sp)).
+		AddScoreFunc(elastic.NewRandomFunction()).
+		BoostMode("replace")
+	ctx, cancel := esContext(ES_OP_SEARCH)
+	defer cancel()
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(q).
+		Size(RANDOM_POST_CANDIDATES).
+		DoC(ctx)
+	if err != nil {
+		if writeESTimeout(w, esError(ctx, ES_OP_SEARCH, err)) {
+			return
+		}
+		fmt.Printf("Failed to read a random post %v\n", err)
+		http.Error(w, "Failed to read a random post", http.StatusInternalServerError)
+		return
+	}
+
+	var ps []Post
+	for _, hit := range searchResult.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			continue
+		}
+		p.Id = hit.Id
+		if moderatePost(&p) {
+			ps = append(ps, p)
+		}
+	}
+	ps, err = filterVisiblePosts(context.Background(), usernameFromToken(r), ps)
+	if err != nil {
+		fmt.Printf("Failed to check visibility of posts %v\n", err)
+		http.Error(w, "Failed to read a random post", http.StatusInternalServerError)
+		return
+	}
+	if len(ps) == 0 {
+		http.Error(w, "No post nearby", http.StatusNotFound)
+		return
+	}
+
+	// already in random order, the first one will do
+	var center *Location
+	if sp.Polygon == nil {
+		center = &Location{Lat: sp.Lat, Lon: sp.Lon}
+	}
+	results := enrichPosts(context.Background(), ps[:1], center)
+	js, err := marshalResponse(results[0], sp.Pretty)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
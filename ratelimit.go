@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//***************  RATE LIMIT (BY IP) ***************************
+// ipRateLimiter allows at most limit requests per window for each client IP.
+// It counts in fixed windows, which is good enough to stop brute-force scripts.
+type ipRateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string]*ipWindow
+}
+
+type ipWindow struct {
+	start time.Time
+	count int
+}
+
+func newIPRateLimiter(limit int, window time.Duration) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   map[string]*ipWindow{},
+	}
+}
+
+// Handler rejects the request with 429 when its IP is over the limit.
+// Same usage as jwtMiddleware.Handler.
+func (l *ipRateLimiter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if wait := l.allow(ip, time.Now()); wait > 0 {
+			fmt.Printf("Rate limit hit by %s on %s\n", ip, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allow counts one request of ip, and returns how long it has to wait
+// if it is over the limit (0 means allowed).
+func (l *ipRateLimiter) allow(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// drop finished windows from time to time, so the map doesn't keep growing
+	if len(l.hits) > 10000 {
+		for k, v := range l.hits {
+			if now.Sub(v.start) >= l.window {
+				delete(l.hits, k)
+			}
+		}
+	}
+
+	win, ok := l.hits[ip]
+	if !ok || now.Sub(win.start) >= l.window {
+		win = &ipWindow{start: now}
+		l.hits[ip] = win
+	}
+	if win.count >= l.limit {
+		return win.start.Add(l.window).Sub(now)
+	}
+	win.count++
+	return 0
+}
+
+// clientIP returns the IP of the caller. X-Forwarded-For is only trusted
+// when we run behind a proxy (config), otherwise anyone could fake it.
+func clientIP(r *http.Request) string {
+	if config.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			// "client, proxy1, proxy2" --> the first one is the client
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
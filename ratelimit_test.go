@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config = &Config{}
+
+	l := newIPRateLimiter(3, time.Minute)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	login := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		l.Handler(ok).ServeHTTP(w, r)
+		return w
+	}
+
+	// rapid attempts: the first 3 go through, the next ones wait
+	for i := 0; i < 3; i++ {
+		if w := login("1.2.3.4:5000"); w.Code != http.StatusNoContent {
+			t.Fatalf("attempt %d: got %d", i+1, w.Code)
+		}
+	}
+	w := login("1.2.3.4:5001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("attempt 4: got %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	// another IP has its own count
+	if w := login("5.6.7.8:5000"); w.Code != http.StatusNoContent {
+		t.Errorf("other IP: got %d", w.Code)
+	}
+}
+
+func TestIPRateLimiterWindow(t *testing.T) {
+	l := newIPRateLimiter(2, time.Minute)
+	now := time.Now()
+	l.allow("ip", now)
+	l.allow("ip", now)
+	if wait := l.allow("ip", now.Add(10*time.Second)); wait != 50*time.Second {
+		t.Errorf("got wait %v, want 50s (the rest of the window)", wait)
+	}
+	if wait := l.allow("ip", now.Add(time.Minute)); wait != 0 {
+		t.Errorf("next window: got wait %v", wait)
+	}
+}
+
+func TestClientIPForwarded(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+
+	// not behind a proxy --> a client could fake it to dodge the limit
+	config = &Config{}
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("got %s, want the remote address", ip)
+	}
+	config = &Config{TrustProxy: true}
+	if ip := clientIP(r); ip != "1.2.3.4" {
+		t.Errorf("got %s, want the forwarded client", ip)
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// BigTable table of reactions, each one is stored twice so it can be read
+	// by post and by user:
+	//	post#<post id>#<username>  and  user#<username>#<post id>
+	// column: reaction:type
+	REACTION_TABLE = "reaction"
+
+	REACTION_LIKE = "like"
+	REACTION_LOVE = "love"
+	REACTION_HAHA = "haha"
+	REACTION_WOW  = "wow"
+
+	// Counter (in POST_STATS_TABLE) of one reaction type is "react_<type>".
+	// COUNTER_LIKES counts all the reactions, whatever their type.
+	REACTION_COUNTER_PREFIX = "react_"
+
+	// Tries of a reaction change racing other changes of the same reaction.
+	REACTION_ATTEMPTS = 3
+)
+
+// the reaction kept changing under a reaction change
+var errReactionConflict = errors.New("reaction changed meanwhile")
+
+// The only reaction types a client can send.
+var reactionTypes = []string{REACTION_LIKE, REACTION_LOVE, REACTION_HAHA, REACTION_WOW}
+
+func isReactionType(t string) bool {
+	for _, rt := range reactionTypes {
+		if rt == t {
+			return true
+		}
+	}
+	return false
+}
+
+//***************  REACTION HANDLERS ***************************
+// reactHandler sets the caller's reaction to a post, {"type":"love"}.
+// A user has one reaction per post, reacting again replaces it.
+func reactHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := usernameFromToken(r)
+	fmt.Printf("Received one react request from %s on %s\n", username, id)
+
+	var body struct {
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode reaction")
+		return
+	}
+	if !isReactionType(body.Type) {
+		http.Error(w, "Invalid reaction type, use one of "+strings.Join(reactionTypes, ", "), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	p, err := postStore.Read(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to read post", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	added, err := setReaction(ctx, id, username, body.Type)
+	if err == errReactionConflict {
+		http.Error(w, "The reaction changed meanwhile, please retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to save reaction %v\n", err)
+		http.Error(w, "Failed to save reaction", http.StatusInternalServerError)
+		return
+	}
+	// only the first reaction, changing it is not news
+	if added && p.User != username {
+		notify(Push{Username: p.User, Title: username + " reacted to your post",
+			Data: map[string]string{"type": "reaction", "user": username, "post_id": id}})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unreactHandler removes the caller's reaction to a post (if any).
+func unreactHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := usernameFromToken(r)
+	fmt.Printf("Received one unreact request from %s on %s\n", username, id)
+
+	_, err := removeReaction(context.Background(), id, username)
+	if err == errReactionConflict {
+		http.Error(w, "The reaction changed meanwhile, please retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to remove reaction %v\n", err)
+		http.Error(w, "Failed to remove reaction", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// toggleLikeHandler flips the caller's like of a post: a post they reacted to
+// (any type, like /posts/like-status) loses the reaction, else it gets a like.
+// Fast taps can't double count, see toggleLike.
+//
+//	POST /post/{id}/like/toggle  -->  {"liked": true, "likes": 12}
+func toggleLikeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := usernameFromToken(r)
+	fmt.Printf("Received one like toggle request from %s on %s\n", username, id)
+
+	ctx := context.Background()
+	p, err := postStore.Read(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to read post", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	liked, err := toggleLike(ctx, id, username)
+	if err == errReactionConflict {
+		http.Error(w, "The like changed meanwhile, please retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to toggle like %v\n", err)
+		http.Error(w, "Failed to toggle like", http.StatusInternalServerError)
+		return
+	}
+	if liked && p.User != username {
+		notify(Push{Username: p.User, Title: username + " reacted to your post",
+			Data: map[string]string{"type": "reaction", "user": username, "post_id": id}})
+	}
+
+	// the count after our toggle (and maybe others' since)
+	stats, err := getPostStats(ctx, []string{id})
+	if err != nil {
+		fmt.Printf("Failed to read post stats %v\n", err)
+	}
+	js, err := json.Marshal(map[string]interface{}{"liked": liked, "likes": stats[id].Likes})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+//***************  REACTION STORE ***************************
+func reactionPostKey(id, username string) string { return "post#" + id + "#" + username }
+func reactionUserKey(username, id string) string { return "user#" + username + "#" + id }
+
+// getReaction returns the reaction type of username on a post, "" if none.
+func getReaction(ctx context.Context, tbl *bigtable.Table, id, username string) (string, error) {
+	row, err := tbl.ReadRow(ctx, reactionPostKey(id, username), bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return "", err
+	}
+	for _, item := range row["reaction"] {
+		if item.Column == "reaction:type" {
+			return string(item.Value), nil
+		}
+	}
+	return "", nil
+}
+
+// setReaction saves the reaction and updates the counters of the post. It
+// tells whether the user had no reaction on the post before. Like in
+// toggleLike the post row is only changed if it still holds what we read, so
+// two reactions at once can't both count as the first one.
+func setReaction(ctx context.Context, id, username, reaction string) (bool, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return false, err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(REACTION_TABLE)
+	for attempt := 0; attempt < REACTION_ATTEMPTS; attempt++ {
+		prev, err := getReaction(ctx, tbl, id, username)
+		if err != nil || prev == reaction {
+			return false, err
+		}
+
+		mut := bigtable.NewMutation()
+		mut.Set("reaction", "type", bigtable.Now(), []byte(reaction))
+		var cond *bigtable.Mutation
+		if prev == "" {
+			// only if there is still no reaction
+			cond = bigtable.NewCondMutation(reactionTypeFilter(), nil, mut)
+		} else {
+			// only if the reaction is still the one we read
+			cond = bigtable.NewCondMutation(bigtable.ChainFilters(reactionTypeFilter(), bigtable.ValueFilter(prev)), mut, nil)
+		}
+		var matched bool
+		if err := tbl.Apply(ctx, reactionPostKey(id, username), cond, bigtable.GetCondMutationResult(&matched)); err != nil {
+			return false, err
+		}
+		if matched == (prev == "") {
+			// not applied, someone changed it meanwhile
+			continue
+		}
+
+		mut = bigtable.NewMutation()
+		mut.Set("reaction", "type", bigtable.Now(), []byte(reaction))
+		if err := tbl.Apply(ctx, reactionUserKey(username, id), mut); err != nil {
+			return false, err
+		}
+		if prev == "" {
+			if err := incrementPostCounter(ctx, id, COUNTER_LIKES, 1); err != nil {
+				return true, err
+			}
+		} else if err := incrementPostCounter(ctx, id, REACTION_COUNTER_PREFIX+prev, -1); err != nil {
+			return false, err
+		}
+		return prev == "", incrementPostCounter(ctx, id, REACTION_COUNTER_PREFIX+reaction, 1)
+	}
+	return false, errReactionConflict
+}
+
+// removeReaction deletes the reaction of username on a post, and tells
+// whether there was one. The post row is only deleted if it still holds the
+// reaction we read, so the counters go down once.
+func removeReaction(ctx context.Context, id, username string) (bool, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return false, err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(REACTION_TABLE)
+	for attempt := 0; attempt < REACTION_ATTEMPTS; attempt++ {
+		prev, err := getReaction(ctx, tbl, id, username)
+		if err != nil || prev == "" {
+			return false, err
+		}
+		matched, err := deleteReactionIf(ctx, tbl, id, username, prev)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			continue
+		}
+
+		if err := incrementPostCounter(ctx, id, COUNTER_LIKES, -1); err != nil {
+			return true, err
+		}
+		return true, incrementPostCounter(ctx, id, REACTION_COUNTER_PREFIX+prev, -1)
+	}
+	return false, errReactionConflict
+}
+
+// reactionTypeFilter keeps the latest reaction:type cell of a row.
+func reactionTypeFilter() bigtable.Filter {
+	return bigtable.ChainFilters(bigtable.FamilyFilter("reaction"), bigtable.ColumnFilter("type"), bigtable.LatestNFilter(1))
+}
+
+// deleteReactionIf deletes the reaction rows of username on a post if the
+// reaction is still prev, and tells whether it was.
+func deleteReactionIf(ctx context.Context, tbl *bigtable.Table, id, username, prev string) (bool, error) {
+	var matched bool
+	del := bigtable.NewMutation()
+	del.DeleteRow()
+	cond := bigtable.NewCondMutation(bigtable.ChainFilters(reactionTypeFilter(), bigtable.ValueFilter(prev)), del, nil)
+	if err := tbl.Apply(ctx, reactionPostKey(id, username), cond, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return false, err
+	}
+	if !matched {
+		return false, nil
+	}
+	del = bigtable.NewMutation()
+	del.DeleteRow()
+	return true, tbl.Apply(ctx, reactionUserKey(username, id), del)
+}
+
+// toggleLike removes the reaction of username on a post, or adds a like if
+// there is none, and tells whether the post is liked now. The post row is
+// only changed if it still holds what we read (a conditional mutation,
+// atomic in BigTable), so of two toggles at once one sees the other's
+// result: the counters move once per change that really happened.
+func toggleLike(ctx context.Context, id, username string) (bool, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return false, err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(REACTION_TABLE)
+	typeFilter := reactionTypeFilter()
+	for attempt := 0; attempt < REACTION_ATTEMPTS; attempt++ {
+		prev, err := getReaction(ctx, tbl, id, username)
+		if err != nil {
+			return false, err
+		}
+
+		var matched bool
+		if prev == "" {
+			// like, only if there is still no reaction
+			mut := bigtable.NewMutation()
+			mut.Set("reaction", "type", bigtable.Now(), []byte(REACTION_LIKE))
+			cond := bigtable.NewCondMutation(typeFilter, nil, mut)
+			if err := tbl.Apply(ctx, reactionPostKey(id, username), cond, bigtable.GetCondMutationResult(&matched)); err != nil {
+				return false, err
+			}
+			if matched {
+				continue
+			}
+			mut = bigtable.NewMutation()
+			mut.Set("reaction", "type", bigtable.Now(), []byte(REACTION_LIKE))
+			if err := tbl.Apply(ctx, reactionUserKey(username, id), mut); err != nil {
+				return true, err
+			}
+			if err := incrementPostCounter(ctx, id, COUNTER_LIKES, 1); err != nil {
+				return true, err
+			}
+			return true, incrementPostCounter(ctx, id, REACTION_COUNTER_PREFIX+REACTION_LIKE, 1)
+		}
+
+		// unlike, only if the reaction is still the one we read
+		matched, err = deleteReactionIf(ctx, tbl, id, username, prev)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			continue
+		}
+		if err := incrementPostCounter(ctx, id, COUNTER_LIKES, -1); err != nil {
+			return false, err
+		}
+		return false, incrementPostCounter(ctx, id, REACTION_COUNTER_PREFIX+prev, -1)
+	}
+	return false, errReactionConflict
+}
+
+func deleteReactionRows(ctx context.Context, tbl *bigtable.Table, id, username string) error {
+	for _, key := range []string{reactionPostKey(id, username), reactionUserKey(username, id)} {
+		mut := bigtable.NewMutation()
+		mut.DeleteRow()
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reaction is one reaction of a user, as exported.
+type Reaction struct {
+	PostId string    `json:"post_id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+}
+
+// reactionsOfUser returns all the reactions of username.
+func reactionsOfUser(ctx context.Context, username string) ([]Reaction, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	prefix := reactionUserKey(username, "")
+	reactions := []Reaction{}
+	err = bt_client.Open(REACTION_TABLE).ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		for _, item := range row["reaction"] {
+			reactions = append(reactions, Reaction{
+				PostId: strings.TrimPrefix(row.Key(), prefix),
+				Type:   string(item.Value),
+				Time:   item.Timestamp.Time(),
+			})
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return reactions, err
+}
+
+// deleteReactionsOfUser removes every reaction of username (and takes them
+// off the counters of the posts), for account deletion.
+func deleteReactionsOfUser(ctx context.Context, username string) (int, error) {
+	reactions, err := reactionsOfUser(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	for _, re := range reactions {
+		if _, err := removeReaction(ctx, re.PostId, username); err != nil {
+			return 0, err
+		}
+	}
+	return len(reactions), nil
+}
+
+// deleteReactionsOfPost removes all the reactions to a deleted post. Its
+// counters go away with the post stats.
+func deleteReactionsOfPost(ctx context.Context, id string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(REACTION_TABLE)
+	prefix := reactionPostKey(id, "")
+	var users []string
+	err = tbl.ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		users = append(users, strings.TrimPrefix(row.Key(), prefix))
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		return err
+	}
+	for _, username := range users {
+		if err := deleteReactionRows(ctx, tbl, id, username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//***************  LIKED BY ***************************
+const (
+	DEFAULT_LIKES_PAGE_SIZE = 20
+	MAX_LIKES_PAGE_SIZE     = 100
+)
+
+// Liker is a user who reacted to a post, with their profile.
+type Liker struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url"`
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+}
+
+// likesHandler lists who reacted to a post, newest first.
+//
+//	GET /post/{id}/likes?from=0&size=20
+//	--> {"total": 42, "from": 0, "size": 20, "results": [{"username": ..., "type": "love", ...}]}
+func likesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	fmt.Printf("Received one likes request on %s\n", id)
+
+	from, size, err := parsePage(r, DEFAULT_LIKES_PAGE_SIZE, MAX_LIKES_PAGE_SIZE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// a post the caller can't see has no likes to show either
+	ctx := context.Background()
+	if _, ok := readVisiblePost(ctx, w, usernameFromToken(r), id); !ok {
+		return
+	}
+
+	likers, err := likersOfPost(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read reactions of %s %v\n", id, err)
+		http.Error(w, "Failed to read likes", http.StatusInternalServerError)
+		return
+	}
+	total := len(likers)
+	page := []Liker{}
+	if from < total {
+		page = likers[from:]
+		if len(page) > size {
+			page = page[:size]
+		}
+	}
+
+	var usernames []string
+	for _, l := range page {
+		usernames = append(usernames, l.Username)
+	}
+	profiles, err := getProfiles(ctx, usernames)
+	if err != nil {
+		fmt.Printf("Failed to read profiles %v\n", err)
+	}
+	for i := range page {
+		page[i].DisplayName = page[i].Username
+		if prof := profiles[page[i].Username]; prof != nil {
+			if prof.DisplayName != "" {
+				page[i].DisplayName = prof.DisplayName
+			}
+			page[i].AvatarURL = prof.AvatarURL
+		}
+	}
+
+	js, err := json.Marshal(map[string]interface{}{"total": total, "from": from, "size": size, "results": page})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// likersOfPost returns everyone who reacted to a post, newest reaction first.
+// Reactions are keyed by username, so they are all read and sorted here.
+func likersOfPost(ctx context.Context, id string) ([]Liker, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	prefix := reactionPostKey(id, "")
+	likers := []Liker{}
+	err = bt_client.Open(REACTION_TABLE).ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		for _, item := range row["reaction"] {
+			likers = append(likers, Liker{
+				Username: strings.TrimPrefix(row.Key(), prefix),
+				Type:     string(item.Value),
+				Time:     item.Timestamp.Time(),
+			})
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(likers, func(i, j int) bool { return likers[i].Time.After(likers[j].Time) })
+	return likers, nil
+}
+
+//***************  MY LIKES ***************************
+// LikedPost is a post the caller reacted to, with the reaction.
+type LikedPost struct {
+	PostResult
+	Reaction string    `json:"reaction"`
+	LikedAt  time.Time `json:"liked_at"`
+}
+
+// myLikesHandler lists the posts the caller reacted to, newest reaction first,
+// paged with from/size. Posts deleted (or hidden from the caller) since are
+// skipped, so a page can be shorter than size.
+func myLikesHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one my likes request from %s\n", username)
+
+	from, size, err := parsePage(r, DEFAULT_LIKES_PAGE_SIZE, MAX_LIKES_PAGE_SIZE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	reactions, err := reactionsOfUser(ctx, username)
+	if err != nil {
+		fmt.Printf("Failed to read reactions of %s %v\n", username, err)
+		http.Error(w, "Failed to read likes", http.StatusInternalServerError)
+		return
+	}
+	sort.SliceStable(reactions, func(i, j int) bool { return reactions[i].Time.After(reactions[j].Time) })
+	total := len(reactions)
+	page := []Reaction{}
+	if from < total {
+		page = reactions[from:]
+		if len(page) > size {
+			page = page[:size]
+		}
+	}
+
+	var ids []string
+	for _, re := range page {
+		ids = append(ids, re.PostId)
+	}
+	posts, err := postsFromES(ids)
+	if err != nil {
+		if writeESTimeout(w, err) {
+			return
+		}
+		fmt.Printf("Failed to read liked posts of %s %v\n", username, err)
+		http.Error(w, "Failed to read likes", http.StatusInternalServerError)
+		return
+	}
+	var ps []Post
+	for _, id := range ids {
+		if p, ok := posts[id]; ok && moderatePost(&p) {
+			ps = append(ps, p)
+		}
+	}
+	if ps, err = filterVisiblePosts(ctx, username, ps); err != nil {
+		fmt.Printf("Failed to check visibility of posts %v\n", err)
+		http.Error(w, "Failed to read likes", http.StatusInternalServerError)
+		return
+	}
+
+	byPost := map[string]Reaction{}
+	for _, re := range page {
+		byPost[re.PostId] = re
+	}
+	results := []LikedPost{}
+	for _, res := range enrichPosts(ctx, ps, nil) {
+		re := byPost[res.Id]
+		results = append(results, LikedPost{PostResult: res, Reaction: re.Type, LikedAt: re.Time})
+	}
+
+	js, err := json.Marshal(map[string]interface{}{"total": total, "from": from, "size": size, "results": results})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+//***************  LIKE STATUS ***************************
+// Most post ids in one like-status request.
+const MAX_LIKE_STATUS_IDS = 100
+
+// likeStatusHandler tells for each post whether the caller reacted to it
+// (any reaction type), in one BigTable batch read instead of one request per
+// post of a feed. Unknown ids are just false.
+//
+//	POST /posts/like-status {"ids": ["a", "b"]}  -->  {"a": true, "b": false}
+func likeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one like status request from %s\n", username)
+
+	var body struct {
+		Ids []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	if len(body.Ids) > MAX_LIKE_STATUS_IDS {
+		http.Error(w, fmt.Sprintf("Too many ids, the limit is %d", MAX_LIKE_STATUS_IDS), http.StatusBadRequest)
+		return
+	}
+
+	liked, err := likedByUser(context.Background(), username, body.Ids)
+	if err != nil {
+		fmt.Printf("Failed to read reactions of %s %v\n", username, err)
+		http.Error(w, "Failed to read like status", http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(liked)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// likedByUser tells for each post id whether username reacted to it.
+func likedByUser(ctx context.Context, username string, ids []string) (map[string]bool, error) {
+	liked := map[string]bool{}
+	if len(ids) == 0 {
+		return liked, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		liked[id] = false
+		keys[i] = reactionUserKey(username, id)
+	}
+
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	prefix := reactionUserKey(username, "")
+	err = bt_client.Open(REACTION_TABLE).ReadRows(ctx, bigtable.RowList(keys), func(row bigtable.Row) bool {
+		liked[strings.TrimPrefix(row.Key(), prefix)] = true
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return liked, err
+}
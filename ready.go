@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// On SIGTERM / SIGINT, /ready fails first and we wait this long so the
+	// load balancers stop sending traffic, then the requests in flight get
+	// SHUTDOWN_TIMEOUT to finish.
+	SHUTDOWN_DRAIN_DELAY = 5 * time.Second
+	SHUTDOWN_TIMEOUT     = 30 * time.Second
+)
+
+// 1 when the service can take traffic: the ES index exists and the
+// clients are connected. Not ready while starting and while shutting down.
+var ready int32
+
+func setReady(r bool) {
+	var v int32
+	if r {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// 1 once setupBackends is done. Unlike ready it stays set while shutting
+// down, the requests that come in during the drain are still served.
+var started int32
+
+func setStarted() {
+	atomic.StoreInt32(&started, 1)
+}
+
+func isStarted() bool {
+	return atomic.LoadInt32(&started) == 1
+}
+
+// untilStarted answers 503 to everything but /ready while the backends are
+// being set up, so no handler runs against a missing index or storage.
+func untilStarted(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isStarted() && r.URL.Path != "/ready" {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Service is starting", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//***************  READINESS ***************************
+// readyHandler is the readiness probe of the load balancers, 200 when ready,
+// 503 otherwise. No auth, it tells nothing but that.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if !isReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}
+
+// shutdownOnSignal waits for SIGTERM / SIGINT, turns not ready, then shuts
+// srv down once its requests are done (or SHUTDOWN_TIMEOUT is over). done
+// is closed when Shutdown returned, main waits for it before exiting.
+func shutdownOnSignal(srv *http.Server, done chan<- struct{}) {
+	defer close(done)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	s := <-sig
+
+	fmt.Printf("Received %v, shutting down\n", s)
+	setReady(false)
+	time.Sleep(SHUTDOWN_DRAIN_DELAY)
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Printf("Failed to shut down cleanly %v\n", err)
+	}
+	webhookFanouts.Wait()
+	// no request left, stop its sniffer and healthcheck
+	if esClient != nil {
+		esClient.Stop()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const (
+	// BigTable table indexing posts by user, newest first.
+	// row key: <username>#<reversed timestamp>#<post id>, column: post:id
+	USER_POST_TABLE = "user_post"
+
+	// Max number of recent own posts merged into a search.
+	MAX_RECENT_OWN_POSTS = 20
+)
+
+//***************  READ YOUR WRITES ***************************
+// ES makes a new post searchable only after a refresh, so right after posting
+// a user may not find it. With "X-Read-Your-Writes: true", the caller's posts
+// from the last ReadYourWritesWindow are read from BigTable (the source of
+// truth) and merged into the results.
+//
+// Tradeoff: it costs extra BigTable reads on every such search, and only the
+// caller's own posts get this guarantee. Other users' posts still show up
+// when ES catches up (eventual consistency).
+//
+// inArea keeps only the posts of the searched area.
+func mergeRecentOwnPosts(ctx context.Context, ps []Post, username string, inArea func(Location) bool) []Post {
+	recent, err := recentPostsFromBigTable(ctx, username, time.Now().Add(-config.ReadYourWritesWindow))
+	if err != nil {
+		// still return what ES gave us
+		fmt.Printf("Failed to read recent posts of %s %v\n", username, err)
+		return ps
+	}
+	return mergePosts(ps, recent, inArea)
+}
+
+// mergePosts puts the recent posts not in ps yet ahead of ps, newest first
+// like a fresh post would be expected.
+func mergePosts(ps, recent []Post, inArea func(Location) bool) []Post {
+	seen := map[string]bool{}
+	for _, p := range ps {
+		seen[p.Id] = true
+	}
+	var missing []Post
+	for _, p := range recent {
+		if seen[p.Id] || !inArea(p.Location) || p.isScheduled() {
+			continue
+		}
+		if moderatePost(&p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return ps
+	}
+	// BigTable returns the batch in row key order, not by time
+	sort.SliceStable(missing, func(i, j int) bool { return missing[i].Created > missing[j].Created })
+	return append(missing, ps...)
+}
+
+// recentPostsFromBigTable returns the posts of username created after since.
+func recentPostsFromBigTable(ctx context.Context, username string, since time.Time) ([]Post, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	// 1. newest ids from the user index, stop at the first one too old
+	var ids []string
+	sinceKey := userPostRowKey(username, since, "")
+	err = bt_client.Open(USER_POST_TABLE).ReadRows(ctx, bigtable.PrefixRange(username+"#"), func(row bigtable.Row) bool {
+		if row.Key() > sinceKey {
+			return false
+		}
+		for _, item := range row["post"] {
+			ids = append(ids, string(item.Value))
+		}
+		return true
+	}, bigtable.LimitRows(MAX_RECENT_OWN_POSTS))
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	// 2. the posts themselves, in one batch
+	var ps []Post
+	err = bt_client.Open("post").ReadRows(ctx, bigtable.RowList(ids), func(row bigtable.Row) bool {
+		ps = append(ps, postFromRow(row))
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return ps, err
+}
+
+// userPostIDsFromBigTable returns the ids of all posts of username in the
+// user index, newest first.
+func userPostIDsFromBigTable(ctx context.Context, username string) ([]string, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	var ids []string
+	err = bt_client.Open(USER_POST_TABLE).ReadRows(ctx, bigtable.PrefixRange(username+"#"), func(row bigtable.Row) bool {
+		for _, item := range row["post"] {
+			ids = append(ids, string(item.Value))
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return ids, err
+}
+
+// userPostRowKey builds the row key of USER_POST_TABLE. The timestamp is
+// reversed so that a prefix scan returns the newest posts first.
+func userPostRowKey(username string, t time.Time, id string) string {
+	return fmt.Sprintf("%s#%019d#%s", username, math.MaxInt64-t.UnixNano(), id)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestMergePosts(t *testing.T) {
+	setupMemBackends(t)
+	everywhere := func(Location) bool { return true }
+
+	ps := []Post{{Id: "es1", Created: 100}, {Id: "r2", Created: 90}}
+	// in row key order, as BigTable gives them
+	recent := []Post{{Id: "r1", Created: 110}, {Id: "r2", Created: 90}, {Id: "r3", Created: 120}}
+
+	got := mergePosts(ps, recent, everywhere)
+	want := []string{"r3", "r1", "es1", "r2"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d posts, want %d", len(got), len(want))
+	}
+	for i, id := range want {
+		if got[i].Id != id {
+			t.Errorf("post %d: got %s, want %s", i, got[i].Id, id)
+		}
+	}
+
+	nowhere := func(Location) bool { return false }
+	if got := mergePosts(ps, recent, nowhere); len(got) != len(ps) {
+		t.Errorf("posts out of the area were merged: %d posts", len(got))
+	}
+}
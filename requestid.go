@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-Id"
+	// a longer id from the client / proxy is replaced by our own
+	MAX_REQUEST_ID_LENGTH = 128
+)
+
+//***************  REQUEST ID ***************************
+// withRequestID gives every request an id: the one set by the load balancer
+// or client if any, a new one otherwise. It is sent back in the response, so
+// a client report, the logs and the audit log can be matched.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+			id = uuid.New()
+			r.Header.Set(REQUEST_ID_HEADER, id)
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the id given to r by withRequestID.
+func requestID(r *http.Request) string {
+	return r.Header.Get(REQUEST_ID_HEADER)
+}
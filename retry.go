@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// A BigTable write is tried this many times, waiting BT_RETRY_BACKOFF,
+	// then twice as long each time, in between.
+	BT_WRITE_ATTEMPTS = 4
+	BT_RETRY_BACKOFF  = 100 * time.Millisecond
+	// All the attempts of one write must be done by then.
+	BT_WRITE_TIMEOUT = 10 * time.Second
+)
+
+//***************  BIGTABLE RETRY ***************************
+// retryBigTable calls write until it succeeds, fails with an error retrying
+// won't fix, or ctx is done. write must be safe to run again (same row key,
+// same cell timestamps), a retried write may have been applied already.
+func retryBigTable(ctx context.Context, write func() error) error {
+	backoff := BT_RETRY_BACKOFF
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = write(); err == nil || !retryableBigTableError(err) || attempt == BT_WRITE_ATTEMPTS {
+			return err
+		}
+		fmt.Printf("BigTable write failed (attempt %d), retrying %v\n", attempt, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// retryableBigTableError tells the transient errors (server busy / restarting,
+// a slow call) from the ones retrying won't fix (bad request, no table ...).
+func retryableBigTableError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.Internal, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
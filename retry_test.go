@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failingWrite fails with errs in turn, then succeeds. calls counts the tries.
+func failingWrite(calls *int, errs ...error) func() error {
+	return func() error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+		return nil
+	}
+}
+
+func TestRetryBigTableTransient(t *testing.T) {
+	busy := status.Error(codes.Unavailable, "busy")
+	var calls int
+	if err := retryBigTable(context.Background(), failingWrite(&calls, busy, busy)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("%d calls, want 3", calls)
+	}
+}
+
+func TestRetryBigTableGivesUp(t *testing.T) {
+	busy := status.Error(codes.Unavailable, "busy")
+	var errs []error
+	for i := 0; i < BT_WRITE_ATTEMPTS+1; i++ {
+		errs = append(errs, busy)
+	}
+	var calls int
+	if err := retryBigTable(context.Background(), failingWrite(&calls, errs...)); err != busy {
+		t.Errorf("got %v, want the last error", err)
+	}
+	if calls != BT_WRITE_ATTEMPTS {
+		t.Errorf("%d calls, want %d", calls, BT_WRITE_ATTEMPTS)
+	}
+}
+
+func TestRetryBigTablePermanent(t *testing.T) {
+	for _, err := range []error{status.Error(codes.NotFound, "no table"), errors.New("bad")} {
+		var calls int
+		if got := retryBigTable(context.Background(), failingWrite(&calls, err)); got != err {
+			t.Errorf("got %v, want %v", got, err)
+		}
+		if calls != 1 {
+			t.Errorf("%v: %d calls, want 1", err, calls)
+		}
+	}
+}
+
+func TestRetryBigTableContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	busy := status.Error(codes.Unavailable, "busy")
+	var calls int
+	if err := retryBigTable(ctx, failingWrite(&calls, busy, busy)); err != busy {
+		t.Errorf("got %v, want %v", err, busy)
+	}
+	if calls != 1 {
+		t.Errorf("%d calls after ctx is done, want 1", calls)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// How far ahead a post can be scheduled.
+	MAX_SCHEDULE_AHEAD = 90 * 24 * time.Hour
+	// Most scheduled posts /me/scheduled returns.
+	MAX_SCHEDULED_POSTS = 100
+)
+
+//***************  SCHEDULED POSTS ***************************
+// A post sent with publish_at (unix seconds, in the future) is saved right
+// away but hidden until then: every search of posts keeps only the ones with
+// no publish_at or one already past (see publishedOnly), so nothing has to
+// flip it live. Its created is publish_at, so once live it sorts (and syncs
+// with since=) as a post made at that time.
+
+// parsePublishAt returns the unix time of a publish_at form value, 0 if empty.
+func parsePublishAt(val string, now time.Time) (int64, error) {
+	if val == "" {
+		return 0, nil
+	}
+	t, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("publish_at must be a unix time in seconds")
+	}
+	if t <= now.Unix() {
+		return 0, fmt.Errorf("publish_at must be in the future")
+	}
+	if t > now.Add(MAX_SCHEDULE_AHEAD).Unix() {
+		return 0, fmt.Errorf("publish_at can be at most %d days ahead", int(MAX_SCHEDULE_AHEAD.Hours()/24))
+	}
+	return t, nil
+}
+
+// publishedOnly drops the scheduled posts not live yet from the results of q.
+// A post without publish_at has no value to compare, must_not keeps it.
+func publishedOnly(q elastic.Query) elastic.Query {
+	return elastic.NewBoolQuery().
+		Filter(q).
+		MustNot(elastic.NewRangeQuery("publish_at").Gt(time.Now().Unix()))
+}
+
+// isScheduled tells whether the post is not live yet.
+func (p *Post) isScheduled() bool {
+	return p.PublishAt > time.Now().Unix()
+}
+
+// deliverWhenPublished sends the webhooks (and mentions) of a scheduled post when it goes
+// live, unless it was canceled meanwhile. The timer is in memory only: a
+// post scheduled before a restart goes live but is never delivered.
+func deliverWhenPublished(p Post) {
+	time.AfterFunc(time.Until(time.Unix(p.PublishAt, 0)), func() {
+		stored, err := postStore.Read(context.Background(), p.Id)
+		if err != nil {
+			fmt.Printf("Failed to read scheduled post %s %v\n", p.Id, err)
+			return
+		}
+		if stored != nil {
+			deliverNewPost(*stored)
+			notifyMentions(*stored)
+		}
+	})
+}
+
+//***************  MY SCHEDULED POSTS ***************************
+// scheduledPostsHandler lists the caller's posts not live yet, the next one first.
+//
+//	GET /me/scheduled
+func scheduledPostsHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one scheduled posts request from %s\n", username)
+
+	es_client, err := getESClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to ES %v\n", err)
+		http.Error(w, "Failed to read scheduled posts", http.StatusInternalServerError)
+		return
+	}
+	q := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("user", username),
+		elastic.NewRangeQuery("publish_at").Gt(time.Now().Unix()),
+	)
+	ctx, cancel := esContext(ES_OP_SEARCH)
+	defer cancel()
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(q).
+		Sort("publish_at", true).
+		Size(MAX_SCHEDULED_POSTS).
+		DoC(ctx)
+	if err != nil {
+		if writeESTimeout(w, esError(ctx, ES_OP_SEARCH, err)) {
+			return
+		}
+		fmt.Printf("Failed to read scheduled posts of %s %v\n", username, err)
+		http.Error(w, "Failed to read scheduled posts", http.StatusInternalServerError)
+		return
+	}
+
+	ps := []Post{}
+	for _, hit := range searchResult.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			continue
+		}
+		p.Id = hit.Id
+		ps = append(ps, p)
+	}
+
+	js, err := json.Marshal(ps)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// cancelScheduledHandler deletes a scheduled post before it goes live. Only
+// its author, and only while it is still scheduled (a live post is deleted
+// like any other).
+//
+//	DELETE /me/scheduled/{id}
+func cancelScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := usernameFromToken(r)
+	fmt.Printf("Received one cancel scheduled post request %s from %s\n", id, username)
+
+	ctx := context.Background()
+	p, err := postStore.Read(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to cancel post", http.StatusInternalServerError)
+		return
+	}
+	// same answer for a missing post and someone else's post
+	if p == nil || p.User != username {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if !p.isScheduled() {
+		http.Error(w, "Post is already published", http.StatusConflict)
+		return
+	}
+
+	if err := deletePost(ctx, id); err != nil {
+		fmt.Printf("Failed to cancel post %s %v\n", id, err)
+		http.Error(w, "Failed to cancel post, please retry", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
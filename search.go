@@ -0,0 +1,645 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Shape of the /search response.
+const (
+	FORMAT_ENVELOPE = "envelope" // {"total":..., "from":..., "size":..., "results":[...]}
+	FORMAT_ARRAY    = "array"    // the bare results, for old clients until they move on
+)
+
+// Orders of /search results ("sort"), no sort keeps the order ES returns:
+// the best score first, newer posts boosted (see withRecency).
+const (
+	SORT_RELEVANCE = "relevance" // best keyword match first, with its score
+	SORT_DISTANCE  = "distance"  // nearest first, whatever the age
+)
+
+// Fields of a /search result a client can pick with "fields" (a PostResult):
+// true for the fields of the ES doc, false for the ones we add.
+var resultFields = map[string]bool{
+	"id": true, "user": true, "message": true, "location": true, "url": true,
+	"urls": true, "created": true, "updated_at": true,
+	"display_name": false, "avatar_url": false, "verified": false,
+	"distance_km": false, "distance_mi": false, "reactions": false, "score": false,
+	"true_location": false,
+}
+
+// ES fields always read, whatever "fields" says: the search itself needs
+// them (visibility, word filter, distance, cursor).
+var requiredSourceFields = []string{"user", "message", "location", "created"}
+
+// How the words of "keyword" are combined.
+const (
+	MATCH_ANY = "any" // OR, a post matching one of the words is enough
+	MATCH_ALL = "all" // AND, a post must match every word
+)
+
+//***************  SEARCH PARAMS ***************************
+// searchParams is what a client can ask /search for.
+type searchParams struct {
+	Lat      float64
+	Lon      float64
+	RadiusKm float64
+	// Polygon (optional) replaces the lat/lon/range circle, see parsePolygon.
+	Polygon Polygon
+	// Keyword (optional) is matched against the message, MatchMode says
+	// whether all of its words or any of them must match.
+	Keyword   string
+	MatchMode string
+	// Exclude drops posts whose message contains any of these terms.
+	Exclude []string
+	// HasImage keeps only the posts with an image (a url).
+	HasImage bool
+	// Since (unix seconds, 0 for none) keeps only the posts created since then.
+	Since int64
+	// IncludeDeleted adds the tombstones of the posts of the area deleted
+	// since Since, for the incremental sync of offline clients.
+	IncludeDeleted bool
+
+	// Page of results, Size is capped to config.MaxSearchResults
+	// (SizeClamped tells it was).
+	From        int
+	Size        int
+	SizeClamped bool
+
+	Format string
+	// Fields of each result to return, nil for all of them. The id is
+	// always returned.
+	Fields []string
+	// Pretty indents the response JSON, for humans debugging with curl.
+	Pretty bool
+	// Sort is "", SORT_RELEVANCE or SORT_DISTANCE. Relevance needs a
+	// keyword, without one every post scores the same, so the sort is dropped.
+	// Distance needs the lat/lon center, a polygon has none.
+	Sort string
+
+	// Cursor pagination (newest first), asked for with a "cursor" param:
+	// empty for the first page, then the next_cursor of the previous page.
+	// Cursor is nil on the first page.
+	CursorMode bool
+	Cursor     *searchCursor
+}
+
+// SearchResponse is the envelope of /search results. Total counts every
+// matching post in ES (not only this page), so clients know when to stop. It
+// is counted before the posts the caller can't see (private, banned) are
+// dropped, so it is an upper bound: a page can be shorter than size.
+type SearchResponse struct {
+	Total   int64        `json:"total"`
+	From    int          `json:"from"`
+	Size    int          `json:"size"`
+	Results []PostResult `json:"results"`
+	// "Did you mean", only for keyword searches with few hits. The client
+	// decides whether to search again with it.
+	Suggestion string `json:"suggestion,omitempty"`
+	// Only in cursor mode, missing on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Only with include_deleted: the posts of the area deleted since "since".
+	Tombstones []Tombstone `json:"tombstones,omitempty"`
+}
+
+// parseCircle reads lat, lon and range (km) of a query string.
+func parseCircle(query url.Values) (Location, float64, error) {
+	// lat & lon are required, only the radius is optional
+	loc, err := parseLocation(query.Get("lat"), query.Get("lon"))
+	if err != nil {
+		return Location{}, 0, err
+	}
+
+	// range is optional --> use default radius, and never go beyond the max one
+	radius := config.DefaultRadiusKm
+	if val := query.Get("range"); val != "" {
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil || v <= 0 {
+			return Location{}, 0, fmt.Errorf("Invalid range")
+		}
+		radius = v
+	}
+	if radius > config.MaxRadiusKm {
+		radius = config.MaxRadiusKm
+	}
+	return loc, radius, nil
+}
+
+// parseSearchParams reads and validates the query string of /search.
+func parseSearchParams(r *http.Request) (*searchParams, error) {
+	query := r.URL.Query()
+	sp := &searchParams{}
+	var err error
+	if val := query.Get("polygon"); val != "" {
+		// a polygon is the whole area, lat/lon/range make no sense with it
+		if query.Get("lat") != "" || query.Get("lon") != "" || query.Get("range") != "" {
+			return nil, fmt.Errorf("Use either polygon or lat/lon/range")
+		}
+		if sp.Polygon, err = parsePolygon(val); err != nil {
+			return nil, err
+		}
+	} else {
+		loc, radius, err := parseCircle(query)
+		if err != nil {
+			return nil, err
+		}
+		sp.Lat, sp.Lon, sp.RadiusKm = loc.Lat, loc.Lon, radius
+	}
+
+	sp.Keyword = query.Get("keyword")
+	sp.MatchMode = MATCH_ANY
+	if val := query.Get("match_mode"); val != "" {
+		if val != MATCH_ANY && val != MATCH_ALL {
+			return nil, fmt.Errorf("Invalid match_mode, use %q or %q", MATCH_ANY, MATCH_ALL)
+		}
+		sp.MatchMode = val
+	}
+
+	// exclude=ads,sale --> comma-separated, blanks are ignored
+	for _, term := range strings.Split(query.Get("exclude"), ",") {
+		if term = strings.TrimSpace(term); term != "" {
+			sp.Exclude = append(sp.Exclude, term)
+		}
+	}
+
+	if val := query.Get("has_image"); val != "" {
+		v, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid has_image, use true or false")
+		}
+		sp.HasImage = v
+	}
+	if val := query.Get("since"); val != "" {
+		v, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("Invalid since, use a unix time in seconds")
+		}
+		sp.Since = v
+	}
+
+	sp.Size = DEFAULT_SEARCH_SIZE
+	if val := query.Get("size"); val != "" {
+		v, err := strconv.Atoi(val)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("Invalid size")
+		}
+		sp.Size = v
+	}
+	if _, ok := query["cursor"]; ok {
+		if query.Get("from") != "" {
+			return nil, fmt.Errorf("Use either from or cursor")
+		}
+		sp.CursorMode = true
+		if val := query.Get("cursor"); val != "" {
+			if sp.Cursor, err = decodeCursor(val); err != nil {
+				return nil, fmt.Errorf("Invalid cursor")
+			}
+		}
+	}
+	if val := query.Get("from"); val != "" {
+		v, err := strconv.Atoi(val)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("Invalid from")
+		}
+		sp.From = v
+	}
+	// a huge size would hurt ES and the network --> clamp it, don't fail
+	if sp.Size > config.MaxSearchResults {
+		sp.Size = config.MaxSearchResults
+		sp.SizeClamped = true
+	}
+
+	sp.Format = FORMAT_ENVELOPE
+	if val := query.Get("format"); val != "" {
+		if val != FORMAT_ENVELOPE && val != FORMAT_ARRAY {
+			return nil, fmt.Errorf("Invalid format, use %q or %q", FORMAT_ENVELOPE, FORMAT_ARRAY)
+		}
+		sp.Format = val
+	}
+	// fields=id,message,location --> only those in each result
+	if val := query.Get("fields"); val != "" {
+		sp.Fields = []string{"id"}
+		for _, field := range strings.Split(val, ",") {
+			field = strings.TrimSpace(field)
+			if _, ok := resultFields[field]; !ok {
+				return nil, fmt.Errorf("Invalid field %q in fields", field)
+			}
+			sp.Fields = append(sp.Fields, field)
+		}
+	}
+	if val := query.Get("pretty"); val != "" {
+		v, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pretty, use true or false")
+		}
+		sp.Pretty = v
+	}
+
+	if val := query.Get("sort"); val != "" {
+		if val != SORT_RELEVANCE && val != SORT_DISTANCE {
+			return nil, fmt.Errorf("Invalid sort, use %q or %q", SORT_RELEVANCE, SORT_DISTANCE)
+		}
+		if sp.CursorMode {
+			return nil, fmt.Errorf("cursor is always newest first, it can't sort by %s", val)
+		}
+		if val == SORT_DISTANCE && sp.Polygon != nil {
+			return nil, fmt.Errorf("a polygon has no center, it can't sort by %s", val)
+		}
+		if val == SORT_DISTANCE || sp.Keyword != "" {
+			sp.Sort = val
+		}
+	}
+	// the bare array has no room for next_cursor
+	if sp.CursorMode && sp.Format == FORMAT_ARRAY {
+		return nil, fmt.Errorf("cursor needs format=%s", FORMAT_ENVELOPE)
+	}
+	if val := query.Get("include_deleted"); val != "" {
+		if sp.IncludeDeleted, err = strconv.ParseBool(val); err != nil {
+			return nil, fmt.Errorf("Invalid include_deleted, use true or false")
+		}
+	}
+	// without since, every tombstone ever would come back
+	if sp.IncludeDeleted && (sp.Since == 0 || sp.Format == FORMAT_ARRAY) {
+		return nil, fmt.Errorf("include_deleted needs since and format=%s", FORMAT_ENVELOPE)
+	}
+
+	return sp, nil
+}
+
+// sourceFields is what to read of each ES doc, nil for all of it.
+func (sp *searchParams) sourceFields() []string {
+	if sp.Fields == nil {
+		return nil
+	}
+	fields := append([]string{}, requiredSourceFields...)
+	for _, field := range sp.Fields {
+		if resultFields[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// projectResults keeps only the fields of each result in resp (the envelope
+// or the bare array), once encoded the way the client would get it.
+func projectResults(resp interface{}, fields []string) (interface{}, error) {
+	js, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(js, &generic); err != nil {
+		return nil, err
+	}
+	project := func(results interface{}) {
+		list, _ := results.([]interface{})
+		for i, res := range list {
+			all, _ := res.(map[string]interface{})
+			picked := map[string]interface{}{}
+			for _, field := range fields {
+				if v, ok := all[field]; ok {
+					picked[field] = v
+				}
+			}
+			list[i] = picked
+		}
+	}
+	if envelope, ok := generic.(map[string]interface{}); ok {
+		project(envelope["results"])
+	} else {
+		project(generic)
+	}
+	return generic, nil
+}
+
+// inArea tells if loc is in the searched area (polygon or circle).
+func (sp *searchParams) inArea(loc Location) bool {
+	if sp.Polygon != nil {
+		return sp.Polygon.contains(loc)
+	}
+	return distanceKm(Location{Lat: sp.Lat, Lon: sp.Lon}, loc) <= sp.RadiusKm
+}
+
+//***************  SEARCH QUERY ***************************
+// buildSearchQuery is the ES query of /search: the filters, and the recency
+// boost of the scores.
+func buildSearchQuery(sp *searchParams) elastic.Query {
+	return withRecency(sp, buildFilterQuery(sp))
+}
+
+// buildFilterQuery turns the params into the ES query matching the posts: the
+// geo distance (or polygon) is a filter, the keyword (if any) is what scores
+// the posts. /search/count uses it as is.
+func buildFilterQuery(sp *searchParams) elastic.Query {
+	var geo elastic.Query
+	if sp.Polygon != nil {
+		// https://www.elastic.co/guide/en/elasticsearch/reference/2.4/query-dsl-geo-polygon-query.html
+		poly := elastic.NewGeoPolygonQuery("location")
+		for _, p := range sp.Polygon {
+			poly = poly.AddPoint(p.Lat, p.Lon)
+		}
+		geo = poly
+	} else {
+		// Define geo distance query as specified in
+		// https://www.elastic.co/guide/en/elasticsearch/reference/5.2/query-dsl-geo-distance-query.html
+		ran := strconv.FormatFloat(sp.RadiusKm, 'f', -1, 64) + "km"
+		geo = elastic.NewGeoDistanceQuery("location").Distance(ran).Lat(sp.Lat).Lon(sp.Lon)
+	}
+	if sp.Keyword == "" && len(sp.Exclude) == 0 && !sp.HasImage && sp.Since == 0 && sp.Cursor == nil {
+		return publishedOnly(geo)
+	}
+
+	q := elastic.NewBoolQuery().Filter(geo)
+	// an empty url is not indexed, so exists skips those posts too
+	if sp.HasImage {
+		q = q.Filter(elastic.NewExistsQuery("url"))
+	}
+	if sp.Keyword != "" {
+		q = q.Must(buildKeywordQuery(sp.Keyword, sp.MatchMode))
+	}
+	if sp.Since != 0 {
+		q = q.Filter(elastic.NewRangeQuery("created").Gte(sp.Since))
+	}
+	// the next page: not newer than the last post, minus the ones already returned
+	if sp.Cursor != nil {
+		q = q.Filter(elastic.NewRangeQuery("created").Lte(sp.Cursor.Created))
+		if len(sp.Cursor.Ids) > 0 {
+			q = q.MustNot(elastic.NewIdsQuery(config.ESType).Ids(sp.Cursor.Ids...))
+		}
+	}
+	// as a phrase, so excluding "for sale" doesn't drop every post with "for"
+	for _, term := range sp.Exclude {
+		q = q.MustNot(elastic.NewMatchPhraseQuery("message", term))
+	}
+	return publishedOnly(q)
+}
+
+// postSorters is the order of the hits of a search, none for the ES default (score).
+func postSorters(sp *searchParams) []elastic.Sorter {
+	var sorters []elastic.Sorter
+	if sp.CursorMode {
+		// newest first, _uid breaks the ties so pages are stable
+		sorters = append(sorters, elastic.NewFieldSort("created").Desc(), elastic.NewFieldSort("_uid").Desc())
+	}
+	switch sp.Sort {
+	case SORT_RELEVANCE:
+		sorters = append(sorters, elastic.NewScoreSort().Desc())
+	case SORT_DISTANCE:
+		sorters = append(sorters, elastic.NewGeoDistanceSort("location").Point(sp.Lat, sp.Lon).Asc())
+	}
+	return sorters
+}
+
+// withRecency multiplies the score of each post by a gauss decay of its age,
+// so without an explicit order the fresh posts come first (a good keyword
+// match still beats a slightly newer post). An explicit sort, a time filter
+// or a cursor (newest first already) gets the query as is.
+func withRecency(sp *searchParams, q elastic.Query) elastic.Query {
+	if !config.RecencyBoost || sp.Sort != "" || sp.Since != 0 || sp.CursorMode {
+		return q
+	}
+	// https://www.elastic.co/guide/en/elasticsearch/reference/2.4/query-dsl-function-score-query.html#function-decay
+	decay := elastic.NewGaussDecayFunction().
+		FieldName("created").
+		Origin("now").
+		Scale(esDuration(config.RecencyScale)).
+		Offset(esDuration(config.RecencyOffset)).
+		Decay(config.RecencyDecay)
+	return elastic.NewFunctionScoreQuery().Query(q).AddScoreFunc(decay).BoostMode("multiply")
+}
+
+// esDuration writes d as an ES time unit, in seconds ("21600s").
+func esDuration(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
+// buildKeywordQuery matches the keyword against the message. Words in double
+// quotes are a phrase (word order matters, match_phrase), the rest are loose
+// terms (match). With MATCH_ALL every phrase and term must match, with
+// MATCH_ANY one of them is enough.
+//
+//	keyword=coffee "golden gate"  -->  match(coffee) + match_phrase(golden gate)
+func buildKeywordQuery(keyword, mode string) elastic.Query {
+	phrases, terms := splitKeyword(keyword)
+	operator := "or"
+	if mode == MATCH_ALL {
+		operator = "and"
+	}
+
+	var parts []elastic.Query
+	for _, phrase := range phrases {
+		parts = append(parts, elastic.NewMatchPhraseQuery("message", phrase))
+	}
+	if terms != "" {
+		parts = append(parts, elastic.NewMatchQuery("message", terms).Operator(operator))
+	}
+	if len(parts) == 1 {
+		return parts[0]
+	}
+
+	if mode == MATCH_ALL {
+		return elastic.NewBoolQuery().Must(parts...)
+	}
+	return elastic.NewBoolQuery().Should(parts...).MinimumNumberShouldMatch(1)
+}
+
+// splitKeyword separates the "quoted phrases" from the loose terms of a keyword.
+// A quote without its closing pair is ignored, its words become loose terms.
+func splitKeyword(keyword string) (phrases []string, terms string) {
+	var loose []string
+	parts := strings.Split(keyword, `"`)
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		// odd parts are between quotes, unless it's the unclosed last one
+		if i%2 == 1 && i != len(parts)-1 {
+			phrases = append(phrases, part)
+		} else {
+			loose = append(loose, part)
+		}
+	}
+	return phrases, strings.Join(loose, " ")
+}
+
+//***************  SEARCH CURSOR ***************************
+// searchCursor is where a page of cursor pagination ended. It works like ES
+// search_after (which our ES version doesn't have): results are sorted by
+// created (newest first), the next page starts at the created of the last
+// post, skipping the posts of that same second which were already returned.
+// Unlike from, the cost doesn't grow with the page number.
+//
+// Posts without created (older than the field) never show up in this mode.
+type searchCursor struct {
+	Created int64    `json:"c"`
+	Ids     []string `json:"ids"`
+}
+
+// nextCursor builds the cursor after a page of posts (as returned by ES, sorted
+// by created desc, before any filtering). prev is the cursor of this page.
+func nextCursor(prev *searchCursor, page []Post) *searchCursor {
+	last := page[len(page)-1].Created
+	next := &searchCursor{Created: last}
+	// the same second as the previous page --> still skip those
+	if prev != nil && prev.Created == last {
+		next.Ids = append(next.Ids, prev.Ids...)
+	}
+	for _, p := range page {
+		if p.Created == last {
+			next.Ids = append(next.Ids, p.Id)
+		}
+	}
+	return next
+}
+
+// the token is opaque for clients, they just send it back
+func encodeCursor(c *searchCursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(token string) (*searchCursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	c := &searchCursor{}
+	if err := json.Unmarshal(js, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//***************  PAGE PARAMS ***************************
+// parsePage reads the from/size query params of a list endpoint. size
+// defaults to def and is capped to max.
+func parsePage(r *http.Request, def, max int) (from, size int, err error) {
+	query := r.URL.Query()
+	size = def
+	if val := query.Get("size"); val != "" {
+		if size, err = strconv.Atoi(val); err != nil || size <= 0 {
+			return 0, 0, fmt.Errorf("Invalid size")
+		}
+	}
+	if size > max {
+		size = max
+	}
+	if val := query.Get("from"); val != "" {
+		if from, err = strconv.Atoi(val); err != nil || from < 0 {
+			return 0, 0, fmt.Errorf("Invalid from")
+		}
+	}
+	return from, size, nil
+}
+
+// marshalResponse encodes a response, compact unless pretty.
+func marshalResponse(v interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+//***************  SEARCH COUNT ***************************
+// searchCountHandler counts the posts /search would match, without reading
+// them: {"count": 42}, for "42 posts nearby" badges. Same params as /search,
+// the paging and ordering ones are ignored.
+func searchCountHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for search count")
+	sp, err := parseSearchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to ES %v\n", err)
+		http.Error(w, "Failed to count posts", http.StatusInternalServerError)
+		return
+	}
+	if !acquireSearchSlot() {
+		fmt.Printf("Too many searches in flight (%d), refusing one count\n", config.MaxConcurrentSearches)
+		w.Header().Set("Retry-After", SEARCH_RETRY_AFTER)
+		http.Error(w, "Too many searches right now, please retry", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := esContext(ES_OP_SEARCH)
+	defer cancel()
+	count, err := es_client.Count(config.ESIndex).
+		Type(config.ESType).
+		Query(buildFilterQuery(sp)).
+		DoC(ctx)
+	releaseSearchSlot()
+	if err != nil {
+		if writeESTimeout(w, esError(ctx, ES_OP_SEARCH, err)) {
+			return
+		}
+		fmt.Printf("Failed to count posts %v\n", err)
+		http.Error(w, "Failed to count posts", http.StatusInternalServerError)
+		return
+	}
+
+	js, err := marshalResponse(map[string]int64{"count": count}, sp.Pretty)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+//***************  SLOW SEARCH LOG ***************************
+// logSlowSearch warns about a search slower than config.SlowSearchThreshold,
+// in ES (took) or in total (since start, BigTable reads included), with its
+// query so the expensive patterns can be found.
+func logSlowSearch(r *http.Request, start time.Time, tookMillis int64) {
+	threshold := config.SlowSearchThreshold
+	total := time.Since(start)
+	took := time.Duration(tookMillis) * time.Millisecond
+	if threshold == 0 || (took < threshold && total < threshold) {
+		return
+	}
+	logger.Warn("slow search",
+		"took", took,
+		"total", total.Round(time.Millisecond),
+		"user", usernameFromToken(r),
+		"request_id", requestID(r),
+		"query", r.URL.RawQuery)
+}
+
+//***************  SEARCH CONCURRENCY ***************************
+// Seconds a client is told to wait when all the search slots are taken.
+const SEARCH_RETRY_AFTER = "1"
+
+// searchSlots holds one token per /search query in flight to ES, its size is
+// config.MaxConcurrentSearches (made in main once the config is loaded).
+var searchSlots chan struct{}
+
+// the in-flight count, at /admin/metrics
+var searchesInFlight = expvar.NewInt("search_in_flight")
+
+// acquireSearchSlot takes a slot without waiting, false when none is free.
+func acquireSearchSlot() bool {
+	select {
+	case searchSlots <- struct{}{}:
+		searchesInFlight.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSearchSlot() {
+	<-searchSlots
+	searchesInFlight.Add(-1)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+func TestSplitKeyword(t *testing.T) {
+	tests := []struct {
+		keyword string
+		phrases []string
+		terms   string
+	}{
+		{"coffee", nil, "coffee"},
+		{"good coffee", nil, "good coffee"},
+		{`"good coffee"`, []string{"good coffee"}, ""},
+		{`"good coffee" near "the park" cheap`, []string{"good coffee", "the park"}, "near cheap"},
+		// unclosed quote --> loose terms
+		{`cheap "good coffee`, nil, "cheap good coffee"},
+		{`"" coffee`, nil, "coffee"},
+		{"  ", nil, ""},
+	}
+	for _, tt := range tests {
+		phrases, terms := splitKeyword(tt.keyword)
+		if !reflect.DeepEqual(phrases, tt.phrases) || terms != tt.terms {
+			t.Errorf("%s: got %q %q, want %q %q", tt.keyword, phrases, terms, tt.phrases, tt.terms)
+		}
+	}
+}
+
+func TestBuildKeywordQuery(t *testing.T) {
+	tests := []struct {
+		keyword string
+		mode    string
+		want    elastic.Query
+	}{
+		{"coffee", MATCH_ANY, (*elastic.MatchQuery)(nil)},
+		{"good coffee", MATCH_ALL, (*elastic.MatchQuery)(nil)},
+		{`"good coffee"`, MATCH_ANY, (*elastic.MatchPhraseQuery)(nil)},
+		// a phrase and terms, or two phrases --> combined
+		{`"good coffee" cheap`, MATCH_ANY, (*elastic.BoolQuery)(nil)},
+		{`"good coffee" "the park"`, MATCH_ALL, (*elastic.BoolQuery)(nil)},
+	}
+	for _, tt := range tests {
+		got := buildKeywordQuery(tt.keyword, tt.mode)
+		if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+			t.Errorf("%s (%s): got a %T, want a %T", tt.keyword, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestLogSlowSearch(t *testing.T) {
+	setupMemBackends(t)
+	config.SlowSearchThreshold = time.Second
+	var out bytes.Buffer
+	oldLogger := logger
+	logger = slog.New(slog.NewTextHandler(&out, nil))
+	t.Cleanup(func() { logger = oldLogger })
+
+	r := asUser(httptest.NewRequest("GET", "/search?lat=1&lon=2", nil), "alice")
+	r.Header.Set(REQUEST_ID_HEADER, "req-1")
+
+	logSlowSearch(r, time.Now(), 10)
+	if out.Len() != 0 {
+		t.Errorf("fast search logged %s", out.String())
+	}
+
+	logSlowSearch(r, time.Now(), 1500)
+	line := out.String()
+	for _, want := range []string{"level=WARN", `msg="slow search"`, "took=1.5s", "user=alice", "request_id=req-1", `query="lat=1&lon=2"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("%s is missing %s", line, want)
+		}
+	}
+
+	// LOG_LEVEL=error --> dropped
+	out.Reset()
+	logger = slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelError}))
+	logSlowSearch(r, time.Now(), 1500)
+	if out.Len() != 0 {
+		t.Errorf("warning logged at level error: %s", out.String())
+	}
+}
+
+func TestLoadConfigLogLevel(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != slog.LevelWarn {
+		t.Errorf("got level %v, want WARN", cfg.LogLevel)
+	}
+
+	t.Setenv("LOG_LEVEL", "loud")
+	if _, err := loadConfig(); err == nil {
+		t.Error("bad LOG_LEVEL was accepted")
+	}
+}
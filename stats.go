@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// geohash precision of /stats/regions: 1 (~5000km cells) .. 7 (~150m cells)
+	DEFAULT_REGION_PRECISION = 3
+	MAX_REGION_PRECISION     = 7
+	// Most buckets returned, the busiest ones.
+	MAX_REGION_BUCKETS = 1000
+
+	GEOHASH_BASE32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// RegionCount is one cell of the activity map.
+type RegionCount struct {
+	Geohash string `json:"geohash"`
+	Count   int64  `json:"count"`
+	// center of the geohash cell
+	Centroid Location `json:"centroid"`
+}
+
+//***************  REGION STATS ***************************
+// regionsHandler counts the posts per geohash cell (geohash_grid aggregation),
+// busiest cells first, for a global activity map. bbox (optional) limits it
+// to an area.
+//
+//	GET /stats/regions?precision=4&bbox=<top>,<left>,<bottom>,<right>
+func regionsHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one region stats request")
+	query := r.URL.Query()
+
+	precision := DEFAULT_REGION_PRECISION
+	if val := query.Get("precision"); val != "" {
+		v, err := strconv.Atoi(val)
+		if err != nil || v < 1 {
+			http.Error(w, "Invalid precision", http.StatusBadRequest)
+			return
+		}
+		precision = v
+	}
+	// finer cells --> many more buckets to compute, cap it
+	if precision > MAX_REGION_PRECISION {
+		precision = MAX_REGION_PRECISION
+	}
+
+	var q elastic.Query = elastic.NewMatchAllQuery()
+	if val := query.Get("bbox"); val != "" {
+		bbox, err := parseBoundingBox(val)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q = bbox
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		panic(err)
+	}
+	agg := elastic.NewGeoHashGridAggregation().Field("location").Precision(precision).Size(MAX_REGION_BUCKETS)
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(publishedOnly(q)).
+		Aggregation("regions", agg).
+		Size(0).
+		Do()
+	if err != nil {
+		fmt.Printf("Failed to aggregate regions %v\n", err)
+		http.Error(w, "Failed to read region stats", http.StatusInternalServerError)
+		return
+	}
+
+	regions := []RegionCount{}
+	if buckets, found := searchResult.Aggregations.GeoHash("regions"); found {
+		for _, b := range buckets.Buckets {
+			hash, ok := b.Key.(string)
+			if !ok {
+				continue
+			}
+			regions = append(regions, RegionCount{Geohash: hash, Count: b.DocCount, Centroid: geohashCenter(hash)})
+		}
+	}
+	sort.SliceStable(regions, func(i, j int) bool { return regions[i].Count > regions[j].Count })
+
+	js, err := json.Marshal(regions)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// BoundingBox is the area between two corners. Left > Right means the box
+// crosses the antimeridian.
+type BoundingBox struct {
+	TopLeft     Location `json:"top_left"`
+	BottomRight Location `json:"bottom_right"`
+}
+
+// parseBoundingBox reads "top,left,bottom,right" (lat,lon,lat,lon) as a geo query.
+func parseBoundingBox(s string) (elastic.Query, error) {
+	box, err := parseBBox(s)
+	if err != nil {
+		return nil, err
+	}
+	return elastic.NewGeoBoundingBoxQuery("location").
+		TopLeft(box.TopLeft.Lat, box.TopLeft.Lon).
+		BottomRight(box.BottomRight.Lat, box.BottomRight.Lon), nil
+}
+
+func parseBBox(s string) (BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, fmt.Errorf("Invalid bbox, use top,left,bottom,right")
+	}
+	topLeft, err := parseLocation(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	if err != nil {
+		return BoundingBox{}, err
+	}
+	bottomRight, err := parseLocation(strings.TrimSpace(parts[2]), strings.TrimSpace(parts[3]))
+	if err != nil {
+		return BoundingBox{}, err
+	}
+	if topLeft.Lat < bottomRight.Lat {
+		return BoundingBox{}, fmt.Errorf("Invalid bbox, top is below bottom")
+	}
+	return BoundingBox{TopLeft: topLeft, BottomRight: bottomRight}, nil
+}
+
+// contains tells if loc is in the box, like geo_bounding_box does.
+func (b BoundingBox) contains(loc Location) bool {
+	if loc.Lat > b.TopLeft.Lat || loc.Lat < b.BottomRight.Lat {
+		return false
+	}
+	if b.TopLeft.Lon <= b.BottomRight.Lon {
+		return loc.Lon >= b.TopLeft.Lon && loc.Lon <= b.BottomRight.Lon
+	}
+	return loc.Lon >= b.TopLeft.Lon || loc.Lon <= b.BottomRight.Lon
+}
+
+// geohashCenter decodes a geohash to the center of its cell.
+func geohashCenter(hash string) Location {
+	minLat, maxLat := -90.0, 90.0
+	minLon, maxLon := -180.0, 180.0
+	even := true // bits alternate lon, lat, lon ...
+	for _, c := range hash {
+		idx := strings.IndexRune(GEOHASH_BASE32, c)
+		if idx < 0 {
+			break
+		}
+		for bit := 4; bit >= 0; bit-- {
+			on := idx&(1<<uint(bit)) != 0
+			if even {
+				mid := (minLon + maxLon) / 2
+				if on {
+					minLon = mid
+				} else {
+					maxLon = mid
+				}
+			} else {
+				mid := (minLat + maxLat) / 2
+				if on {
+					minLat = mid
+				} else {
+					maxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return Location{Lat: (minLat + maxLat) / 2, Lon: (minLon + maxLon) / 2}
+}
+
+//***************  ACTIVITY STATS ***************************
+const (
+	// Most buckets /stats/activity returns, a longer span needs a bigger interval.
+	MAX_ACTIVITY_BUCKETS = 500
+	// Buckets of the default span (no since): the last 24 hours, days ...
+	DEFAULT_ACTIVITY_BUCKETS = 24
+)
+
+// Intervals of /stats/activity, the names are the ES ones.
+var activityIntervals = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// ActivityBucket is one point of the activity graph.
+type ActivityBucket struct {
+	// start of the bucket, unix seconds
+	Time  int64 `json:"time"`
+	Count int64 `json:"count"`
+}
+
+// activityHandler counts the posts of an area per interval (date_histogram
+// on created), for the activity graph of the dashboards. Same area params as
+// /search (keyword too), since (default DEFAULT_ACTIVITY_BUCKETS intervals
+// ago) and until (default now), at most MAX_ACTIVITY_BUCKETS intervals apart.
+// Empty intervals are there with a 0.
+//
+//	GET /stats/activity?lat=37.7&lon=-122.4&range=5&interval=hour&since=1700000000
+func activityHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one activity stats request")
+	sp, err := parseSearchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("interval")
+	if name == "" {
+		name = "hour"
+	}
+	interval, ok := activityIntervals[name]
+	if !ok {
+		http.Error(w, "Invalid interval, use minute, hour or day", http.StatusBadRequest)
+		return
+	}
+	until := time.Now().Unix()
+	if val := r.URL.Query().Get("until"); val != "" {
+		if until, err = strconv.ParseInt(val, 10, 64); err != nil {
+			http.Error(w, "Invalid until, use a unix time in seconds", http.StatusBadRequest)
+			return
+		}
+	}
+	step := int64(interval / time.Second)
+	if sp.Since == 0 {
+		sp.Since = until - DEFAULT_ACTIVITY_BUCKETS*step
+	}
+	if until <= sp.Since {
+		http.Error(w, "until must be after since", http.StatusBadRequest)
+		return
+	}
+	if (until-sp.Since)/step > MAX_ACTIVITY_BUCKETS {
+		http.Error(w, fmt.Sprintf("At most %d intervals, use a shorter range or a bigger interval", MAX_ACTIVITY_BUCKETS), http.StatusBadRequest)
+		return
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		fmt.Printf("Failed to get the ES client %v\n", err)
+		http.Error(w, "Failed to read activity stats", http.StatusInternalServerError)
+		return
+	}
+	q := elastic.NewBoolQuery().Filter(buildFilterQuery(sp), elastic.NewRangeQuery("created").Lte(until))
+	// the bounds are in ms (like the keys), so the empty intervals at both ends are there too
+	agg := elastic.NewDateHistogramAggregation().
+		Field("created").
+		Interval(name).
+		MinDocCount(0).
+		ExtendedBoundsMin(sp.Since * 1000).
+		ExtendedBoundsMax(until * 1000)
+	ctx, cancel := esContext(ES_OP_SEARCH)
+	defer cancel()
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(q).
+		Aggregation("activity", agg).
+		Size(0).
+		DoC(ctx)
+	if err != nil {
+		if writeESTimeout(w, esError(ctx, ES_OP_SEARCH, err)) {
+			return
+		}
+		fmt.Printf("Failed to aggregate activity %v\n", err)
+		http.Error(w, "Failed to read activity stats", http.StatusInternalServerError)
+		return
+	}
+
+	buckets := []ActivityBucket{}
+	if hist, found := searchResult.Aggregations.DateHistogram("activity"); found {
+		for _, b := range hist.Buckets {
+			buckets = append(buckets, ActivityBucket{Time: b.Key / 1000, Count: b.DocCount})
+		}
+	}
+
+	js, err := json.Marshal(map[string]interface{}{
+		"interval": name,
+		"since":    sp.Since,
+		"until":    until,
+		"total":    searchResult.TotalHits(),
+		"buckets":  buckets,
+	})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+//***************  USER STATS ***************************
+const (
+	// geohash precision of the most active region of a user (~20km cells)
+	USER_REGION_PRECISION = 5
+	// Stats read all the posts of the user, they are cached this long.
+	USER_STATS_CACHE_TTL = 5 * time.Minute
+)
+
+type UserStats struct {
+	Username         string       `json:"username"`
+	Posts            int64        `json:"posts"`
+	LikesReceived    int64        `json:"likes_received"`
+	CommentsReceived int64        `json:"comments_received"`
+	TopRegion        *RegionCount `json:"top_region,omitempty"`
+}
+
+var (
+	userStatsCacheMu sync.Mutex
+	userStatsCache   = map[string]cachedUserStats{}
+)
+
+type cachedUserStats struct {
+	stats *UserStats
+	at    time.Time
+}
+
+// userStatsHandler returns the post stats of a user, for the profile page.
+// Like the profile, a private user's stats are for approved followers only.
+func userStatsHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	fmt.Printf("Received one user stats request for %s\n", username)
+
+	ctx := context.Background()
+	profile, err := getProfile(ctx, username)
+	if err != nil {
+		fmt.Printf("Failed to read profile %s %v\n", username, err)
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+	visible, err := visibleAuthors(ctx, usernameFromToken(r), map[string]*Profile{username: profile})
+	if err != nil {
+		fmt.Printf("Failed to check visibility of %s %v\n", username, err)
+		http.Error(w, "Failed to read stats", http.StatusInternalServerError)
+		return
+	}
+	if !visible[username] {
+		http.Error(w, "This account is private", http.StatusForbidden)
+		return
+	}
+
+	stats, err := getUserStats(ctx, username)
+	if err != nil {
+		fmt.Printf("Failed to compute stats of %s %v\n", username, err)
+		http.Error(w, "Failed to read stats", http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(stats)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// getUserStats returns the (possibly cached) stats of a user: post count and
+// top region from ES, likes and comments summed from the BigTable counters.
+func getUserStats(ctx context.Context, username string) (*UserStats, error) {
+	userStatsCacheMu.Lock()
+	c, ok := userStatsCache[username]
+	userStatsCacheMu.Unlock()
+	if ok && time.Since(c.at) < USER_STATS_CACHE_TTL {
+		return c.stats, nil
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+	agg := elastic.NewGeoHashGridAggregation().Field("location").Precision(USER_REGION_PRECISION).Size(1)
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(publishedOnly(elastic.NewTermQuery("user", username))).
+		Aggregation("regions", agg).
+		Size(0).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &UserStats{Username: username, Posts: searchResult.TotalHits()}
+	if buckets, found := searchResult.Aggregations.GeoHash("regions"); found && len(buckets.Buckets) > 0 {
+		b := buckets.Buckets[0]
+		if hash, ok := b.Key.(string); ok {
+			stats.TopRegion = &RegionCount{Geohash: hash, Count: b.DocCount, Centroid: geohashCenter(hash)}
+		}
+	}
+
+	ids, err := listPostIDsByUser(username)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := getPostStats(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range counters {
+		stats.LikesReceived += s.Likes
+		stats.CommentsReceived += s.Comments
+	}
+
+	userStatsCacheMu.Lock()
+	userStatsCache[username] = cachedUserStats{stats: stats, at: time.Now()}
+	userStatsCacheMu.Unlock()
+	return stats, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// Where the images are stored (STORAGE).
+	STORAGE_GCS   = "gcs"   // Google Cloud Storage, GCS_BUCKET (default)
+	STORAGE_LOCAL = "local" // a local directory, for development
+
+	// Defaults of STORAGE_DIR and STORAGE_URL for local storage, the files
+	// are served by this server under LOCAL_FILES_PATH.
+	LOCAL_STORAGE_DIR = "uploads"
+	LOCAL_STORAGE_URL = "http://localhost:8080/files/"
+	LOCAL_FILES_PATH  = "/files/"
+)
+
+// Storer keeps the images of the posts. Names are the post ids (see saveImages).
+type Storer interface {
+	// Init checks the storage is usable at startup.
+	Init(ctx context.Context) error
+	// Save stores the image under name and returns its public url. info is
+	// kept with it where the backend can.
+	Save(ctx context.Context, r io.Reader, name string, info ImageInfo) (string, error)
+	// Delete removes one image, a missing one is no error.
+	Delete(ctx context.Context, name string) error
+	// List returns the names starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// SignedURL is a url to read the image for ttl without other credentials.
+	SignedURL(ctx context.Context, name string, ttl time.Duration) (string, error)
+}
+
+// The configured one, set in main.
+var storer Storer
+
+// newStorer returns the storer config.Storage names.
+func newStorer() (Storer, error) {
+	switch config.Storage {
+	case STORAGE_GCS:
+		return &gcsStorer{bucket: config.GCSBucket}, nil
+	case STORAGE_LOCAL:
+		return &localStorer{dir: config.StorageDir, baseURL: config.StorageURL}, nil
+	}
+	return nil, fmt.Errorf("unknown STORAGE %q, use %s or %s", config.Storage, STORAGE_GCS, STORAGE_LOCAL)
+}
+
+//***************  GOOGLE CLOUD STORAGE ***************************
+type gcsStorer struct {
+	bucket string
+}
+
+// Without its bucket no post can be created, better not to start at all
+// (unless we are allowed to create it, for dev deployments).
+func (s *gcsStorer) Init(ctx context.Context) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(s.bucket)
+	if _, err := bucket.Attrs(ctx); err == storage.ErrBucketNotExist {
+		if !config.GCSCreateBucket {
+			return fmt.Errorf("GCS bucket %s does not exist", s.bucket)
+		}
+		log.Printf("GCS bucket %s does not exist, creating it in project %s (%s)", s.bucket, config.GCSProject, config.GCSLocation)
+		if err := bucket.Create(ctx, config.GCSProject, &storage.BucketAttrs{Location: config.GCSLocation}); err != nil {
+			return fmt.Errorf("cannot create GCS bucket %s: %v", s.bucket, err)
+		}
+		log.Printf("GCS bucket %s is created", s.bucket)
+	} else if err != nil {
+		log.Printf("WARNING: cannot check GCS bucket %s: %v", s.bucket, err)
+	}
+	return nil
+}
+
+// Save returns storage.ErrBucketNotExist if the bucket is gone.
+func (s *gcsStorer) Save(ctx context.Context, r io.Reader, name string, info ImageInfo) (string, error) {
+	// a writer which is not closed keeps its upload going, cancelling ctx is
+	// the way to abort it when reading r fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// create a client
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(s.bucket)
+	// Next check if the bucket exists (storage.ErrBucketNotExist if not)
+	if _, err = bucket.Attrs(ctx); err != nil {
+		return "", err
+	}
+
+	obj := bucket.Object(name)
+	wc := obj.NewWriter(ctx)
+	// the original name (sanitized) and size, for downloads and moderation
+	// a streamed image has no size yet
+	wc.Metadata = map[string]string{}
+	if info.Size > 0 {
+		wc.Metadata["original_size"] = strconv.FormatInt(info.Size, 10)
+	}
+	if info.OriginalName != "" {
+		wc.Metadata["original_name"] = info.OriginalName
+		wc.ContentDisposition = `inline; filename="` + info.OriginalName + `"`
+	}
+	if _, err := io.Copy(wc, r); err != nil {
+		return "", err
+	}
+	if err := wc.Close(); err != nil {
+		return "", err
+	}
+
+	if err := obj.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
+		return "", err
+	}
+
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Post is saved to GCS: %s\n", attrs.MediaLink)
+	return attrs.MediaLink, nil
+}
+
+func (s *gcsStorer) Delete(ctx context.Context, name string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// the image is already gone --> nothing to do
+	if err := client.Bucket(s.bucket).Object(name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	fmt.Printf("Post is deleted from GCS: %s\n", name)
+	return nil
+}
+
+func (s *gcsStorer) List(ctx context.Context, prefix string) ([]string, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var names []string
+	it := client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+// SignedURL signs with the credentials of the service account.
+func (s *gcsStorer) SignedURL(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	return client.Bucket(s.bucket).SignedURL(name, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(ttl),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+//***************  LOCAL DIRECTORY ***************************
+// localStorer keeps the images in a directory, served by this server under
+// LOCAL_FILES_PATH (see main). To run without a GCP account, not for
+// production: no metadata, no signing, one instance only.
+type localStorer struct {
+	dir     string
+	baseURL string
+}
+
+func (s *localStorer) Init(ctx context.Context) error {
+	return os.MkdirAll(s.dir, 0755)
+}
+
+func (s *localStorer) Save(ctx context.Context, r io.Reader, name string, info ImageInfo) (string, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	fmt.Printf("Post is saved to %s\n", path)
+	return s.baseURL + url.PathEscape(name), nil
+}
+
+func (s *localStorer) Delete(ctx context.Context, name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorer) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// SignedURL is the plain url, the files are public anyway.
+func (s *localStorer) SignedURL(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	return s.baseURL + url.PathEscape(name), nil
+}
+
+// path of name in the directory, a name reaching out of it is refused.
+func (s *localStorer) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
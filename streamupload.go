@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Largest text field of a streamed post (message, lat ...).
+	MAX_STREAM_FIELD_BYTES = 64 << 10
+)
+
+// returned while reading an image over config.MaxImageBytes
+var errImageTooBig = errors.New("image is too big")
+
+// returned when an image did not arrive within config.UploadPartTimeout
+var errUploadTooSlow = errors.New("image took too long to arrive")
+
+//***************  STREAMING UPLOAD ***************************
+// With STREAM_UPLOADS, a post bigger than MultipartMemory (or of unknown
+// size) is not parsed by ParseMultipartForm, which would keep MultipartMemory
+// of it in memory and write the rest to temp files before anything is
+// uploaded. Its parts are read one by one instead, and each image goes to the
+// storage as it arrives, through a small buffer.
+//
+// The text fields must then come before the images: they are all checked
+// (moderation, duplicates ...) before the first image is read. The images are
+// checked as they come, a bad one rolls back the ones already stored.
+
+// streamUpload tells whether the post request r is read as a stream.
+func streamUpload(r *http.Request) bool {
+	return config.StreamUploads && (r.ContentLength < 0 || r.ContentLength > config.MultipartMemory)
+}
+
+// readPostFields reads the text fields of a streamed post into r.Form (with
+// the query string, like ParseMultipartForm), so r.FormValue works as usual.
+// It stops at the first file, returned for streamImages, nil if none.
+func readPostFields(r *http.Request) (*multipart.Reader, *multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	form := url.Values{}
+	for k, v := range r.URL.Query() {
+		form[k] = v
+	}
+	r.Form = form
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return mr, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FileName() != "" {
+			return mr, part, nil
+		}
+		val, err := ioutil.ReadAll(io.LimitReader(part, MAX_STREAM_FIELD_BYTES+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(val) > MAX_STREAM_FIELD_BYTES {
+			return nil, nil, fmt.Errorf("field %s is too long", part.FormName())
+		}
+		form.Add(part.FormName(), string(val))
+	}
+}
+
+// streamImages stores the "image" parts from part on, like saveImages, and
+// sets Url / Urls / Files. A problem with what the client sent is returned
+// as ValidationErrors, after the images already stored are deleted. Each
+// image gets config.UploadPartTimeout to arrive (a read deadline through rc),
+// it holds an upload slot while it does.
+func streamImages(ctx context.Context, rc *http.ResponseController, p *Post, mr *multipart.Reader, part *multipart.Part) error {
+	// not supported (e.g. behind a test recorder) --> no deadline
+	defer rc.SetReadDeadline(time.Time{})
+
+	var errs ValidationErrors
+	var err error
+	for i := 0; part != nil && errs == nil; i++ {
+		rc.SetReadDeadline(time.Now().Add(config.UploadPartTimeout))
+		switch {
+		case part.FormName() != "image":
+			errs.Add(part.FormName(), "the fields must come before the images")
+		case i >= config.MaxImagesPerPost:
+			errs.Add("image", "more than %d images sent, the limit is %d per post", i, config.MaxImagesPerPost)
+		default:
+			info := ImageInfo{OriginalName: sanitizeFilename(part.FileName())}
+			var url string
+			if url, info.Size, err = streamImage(ctx, part, imageName(p.Id, i), info, i+1); err != nil {
+				break
+			}
+			p.Urls = append(p.Urls, url)
+			p.Files = append(p.Files, info)
+			if part, err = mr.NextPart(); err == io.EOF {
+				part, err = nil, nil
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && errs == nil && len(p.Urls) == 0 {
+		errs.Add("image", "image is required")
+	}
+	if errs != nil {
+		err = errs
+	}
+	if err != nil {
+		if len(p.Urls) > 0 {
+			if err := deletePostImages(ctx, p.Id); err != nil {
+				fmt.Printf("Rollback of images of %s failed %v\n", p.Id, err)
+			}
+		}
+		return err
+	}
+	// Url stays the (first) image, for clients which only know one
+	p.Url = p.Urls[0]
+	return nil
+}
+
+// streamImage checks and stores the nth image of a post while it's read, and
+// returns its url and size.
+func streamImage(ctx context.Context, r io.Reader, name string, info ImageInfo, n int) (string, int64, error) {
+	limited := &sizeLimitReader{r: r, max: config.MaxImageBytes}
+	br := bufio.NewReaderSize(limited, MAX_EXIF_SCAN_BYTES)
+	// the type is sniffed from the content, like validatePost does
+	head, _ := br.Peek(512)
+	if len(head) == 0 {
+		return "", 0, ValidationErrors{{Field: "image", Message: fmt.Sprintf("image %d can't be read", n)}}
+	}
+	if contentType := http.DetectContentType(head); !allowedImageTypes[contentType] {
+		return "", 0, ValidationErrors{{Field: "image", Message: fmt.Sprintf("image %d type %s is not supported, use jpeg, png or gif", n, contentType)}}
+	}
+
+	img, err := orientStream(br)
+	if err == errTooManyPixels {
+		return "", 0, ValidationErrors{{Field: "image", Message: fmt.Sprintf("image %d is over the limit of %d megapixels", n, MAX_IMAGE_PIXELS/1000000)}}
+	}
+	var url string
+	if err == nil {
+		url, err = saveImage(ctx, img, name, info)
+	}
+	if limited.over {
+		return "", 0, ValidationErrors{{Field: "image", Message: fmt.Sprintf("image %d is over the limit of %d MB", n, config.MaxImageBytes>>20)}}
+	}
+	if ne, ok := limited.err.(net.Error); ok && ne.Timeout() {
+		return "", 0, errUploadTooSlow
+	}
+	return url, limited.n, err
+}
+
+// sizeLimitReader counts what is read, and fails once it's over max. It
+// keeps the error of the client, err, the storage may return its own.
+type sizeLimitReader struct {
+	r    io.Reader
+	n    int64
+	max  int64
+	over bool
+	err  error
+}
+
+func (l *sizeLimitReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	if err != nil && err != io.EOF {
+		l.err = err
+	}
+	l.n += int64(n)
+	if l.n > l.max {
+		l.over = true
+		return n, errImageTooBig
+	}
+	return n, err
+}
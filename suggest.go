@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// A keyword search with fewer hits than this gets a "did you mean" suggestion.
+	SUGGEST_MAX_HITS = 3
+)
+
+//***************  DID YOU MEAN ***************************
+// suggestKeyword asks ES for a better spelling of the keyword, based on the
+// words of the indexed messages (term suggester). Each misspelled word is
+// replaced by its best option, "" if nothing would change.
+//
+//	keyword=cofee shpo  -->  "coffee shop"
+func suggestKeyword(keyword string) (string, error) {
+	es_client, err := getESClient()
+	if err != nil {
+		return "", err
+	}
+
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Suggester(elastic.NewTermSuggester("did_you_mean").Text(keyword).Field("message").Size(1)).
+		Size(0).
+		Do()
+	if err != nil {
+		return "", err
+	}
+	return applySuggestions(keyword, searchResult.Suggest["did_you_mean"]), nil
+}
+
+// applySuggestions replaces each suggested word at its offset in text.
+func applySuggestions(text string, suggestions []elastic.SearchSuggestion) string {
+	runes := []rune(text)
+	changed := false
+	// backwards, so the offsets of the words before stay right
+	for i := len(suggestions) - 1; i >= 0; i-- {
+		s := suggestions[i]
+		if len(s.Options) == 0 || s.Offset < 0 || s.Offset+s.Length > len(runes) {
+			continue
+		}
+		replaced := append([]rune(s.Options[0].Text), runes[s.Offset+s.Length:]...)
+		runes = append(runes[:s.Offset], replaced...)
+		changed = true
+	}
+	if !changed {
+		return ""
+	}
+	fmt.Printf("Suggest %q for %q\n", string(runes), text)
+	return string(runes)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// termSuggestions decodes the "suggest" part of an ES response, as ES sends it.
+func termSuggestions(t *testing.T, js string) []elastic.SearchSuggestion {
+	var s elastic.SearchSuggest
+	if err := json.Unmarshal([]byte(js), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s["did_you_mean"]
+}
+
+func TestApplySuggestions(t *testing.T) {
+	misspelled := termSuggestions(t, `{"did_you_mean": [
+		{"text": "cofee", "offset": 0, "length": 5, "options": [{"text": "coffee", "score": 0.8, "freq": 12}]},
+		{"text": "shpo", "offset": 6, "length": 4, "options": [{"text": "shop", "score": 0.75, "freq": 30}]}
+	]}`)
+	if got := applySuggestions("cofee shpo", misspelled); got != "coffee shop" {
+		t.Errorf("got %q, want coffee shop", got)
+	}
+
+	// only the second word is misspelled, the first one is kept
+	oneWord := termSuggestions(t, `{"did_you_mean": [
+		{"text": "good", "offset": 0, "length": 4, "options": []},
+		{"text": "cofee", "offset": 5, "length": 5, "options": [{"text": "coffee", "score": 0.8, "freq": 12}]}
+	]}`)
+	if got := applySuggestions("good cofee", oneWord); got != "good coffee" {
+		t.Errorf("got %q, want good coffee", got)
+	}
+
+	// spelled right --> no suggestion
+	none := termSuggestions(t, `{"did_you_mean": [{"text": "coffee", "offset": 0, "length": 6, "options": []}]}`)
+	if got := applySuggestions("coffee", none); got != "" {
+		t.Errorf("got %q, want none", got)
+	}
+
+	// offsets past the text (it changed?) are skipped
+	wrong := termSuggestions(t, `{"did_you_mean": [{"text": "x", "offset": 10, "length": 3, "options": [{"text": "y"}]}]}`)
+	if got := applySuggestions("short", wrong); got != "" {
+		t.Errorf("got %q, want none", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// #hashtag, letters (any language), digits and _
+var hashtagPattern = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+
+// posts whose hashtags or mentions were cut, at /admin/metrics
+var tagsTruncated = expvar.NewInt("posts_tags_truncated")
+
+//***************  HASHTAGS & MENTIONS ***************************
+// extractTags sets the hashtags and @mentions of a new post from its message,
+// at most config.MaxHashtagsPerPost / MaxMentionsPerPost of each (the first
+// ones): a spammer's extra tags are ignored, the post is not refused. A cut
+// is logged for the moderators.
+func extractTags(p *Post) {
+	tags, names := hashtags(p.Message), mentions(p.Message)
+	var tagsCut, namesCut bool
+	p.Hashtags, tagsCut = capTags(tags, config.MaxHashtagsPerPost)
+	p.Mentions, namesCut = capTags(names, config.MaxMentionsPerPost)
+	if tagsCut || namesCut {
+		tagsTruncated.Add(1)
+		log.Printf("WARNING: post %s of %s flagged for review: too many hashtags (%d) or mentions (%d), only the first ones are kept",
+			p.Id, p.User, len(tags), len(names))
+	}
+}
+
+// hashtags returns the #hashtags of a message, lowercase and once each.
+func hashtags(message string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, m := range hashtagPattern.FindAllStringSubmatch(message, -1) {
+		if tag := strings.ToLower(m[1]); !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// capTags keeps the first max tags, and tells if some were dropped.
+func capTags(tags []string, max int) ([]string, bool) {
+	if len(tags) <= max {
+		return tags, false
+	}
+	return tags[:max], true
+}
+
+// notifyMentions pushes a "mentioned you" to the users a live post mentions.
+// The excerpt is of the message as a reader would get it (p is a copy), a
+// post the word filter drops now sends nothing.
+func notifyMentions(p Post) {
+	if !moderatePost(&p) {
+		return
+	}
+	for _, name := range p.Mentions {
+		if name != p.User {
+			notify(Push{Username: name, Title: p.User + " mentioned you", Body: pushExcerpt(p.Message),
+				Data: map[string]string{"type": "mention", "user": p.User, "post_id": p.Id}})
+		}
+	}
+}
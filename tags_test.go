@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+// queuedPushes runs f with pushes on, and returns what it queued.
+func queuedPushes(t *testing.T, f func()) []Push {
+	oldQueue := pushQueue
+	t.Cleanup(func() { pushQueue = oldQueue })
+	pushQueue = make(chan Push, 10)
+	config.FCMProjectID = "test"
+
+	f()
+	close(pushQueue)
+	var pushes []Push
+	for p := range pushQueue {
+		pushes = append(pushes, p)
+	}
+	return pushes
+}
+
+func TestNotifyMentionsModerated(t *testing.T) {
+	setupMemBackends(t)
+
+	pushes := queuedPushes(t, func() {
+		notifyMentions(Post{Id: "p1", User: "alice", Message: "hi @bob @alice", Mentions: []string{"bob", "alice"}})
+	})
+	if len(pushes) != 1 || pushes[0].Username != "bob" || pushes[0].Body != "hi @bob @alice" {
+		t.Errorf("got %+v, want one push to bob", pushes)
+	}
+
+	// the built-in word is dropped (FILTER_MODE drop) --> no push at all
+	pushes = queuedPushes(t, func() {
+		notifyMentions(Post{Id: "p2", User: "alice", Message: "fuck @bob", Mentions: []string{"bob"}})
+	})
+	if len(pushes) != 0 {
+		t.Errorf("got %d pushes of a filtered post", len(pushes))
+	}
+
+	// mask mode --> the excerpt is masked
+	config.FilterMode = FILTER_MODE_MASK
+	if err := loadFilteredWords(""); err != nil {
+		t.Fatal(err)
+	}
+	pushes = queuedPushes(t, func() {
+		notifyMentions(Post{Id: "p3", User: "alice", Message: "fuck @bob", Mentions: []string{"bob"}})
+	})
+	if len(pushes) != 1 || pushes[0].Body != MASK+" @bob" {
+		t.Errorf("got %+v, want the masked excerpt", pushes)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// Purposes of the one-off tokens we send by email.
+	PURPOSE_VERIFY_EMAIL   = "verify_email"
+	PURPOSE_RESET_PASSWORD = "reset_password"
+)
+
+//***************  ONE-OFF TOKEN ***************************
+// signPurposeToken creates a signed token for one purpose (e.g. an email link).
+// It's signed with a key derived from the purpose, so it can never be used
+// as a login token with jwtMiddleware, nor for another purpose.
+// extra claims (can be nil) are added to the token as well.
+func signPurposeToken(purpose, username string, ttl time.Duration, extra jwt.MapClaims) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	for k, v := range extra {
+		claims[k] = v
+	}
+	claims["username"] = username
+	claims["purpose"] = purpose
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	return token.SignedString(purposeKey(purpose))
+}
+
+// parsePurposeToken checks the token and returns the username in it.
+func parsePurposeToken(purpose, tokenString string) (string, error) {
+	claims, err := parsePurposeClaims(purpose, tokenString)
+	if err != nil {
+		return "", err
+	}
+	return claims["username"].(string), nil
+}
+
+func parsePurposeClaims(purpose, tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return purposeKey(purpose), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["purpose"] != purpose {
+		return nil, fmt.Errorf("token is not for %s", purpose)
+	}
+	if _, ok := claims["username"].(string); !ok {
+		return nil, fmt.Errorf("token has no username")
+	}
+	return claims, nil
+}
+
+func purposeKey(purpose string) []byte {
+	return append(append([]byte{}, mySigningKey...), []byte(":"+purpose)...)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const (
+	// BigTable table of the deleted posts, for sync clients to purge them.
+	// row key: <deleted at, unix seconds, 19 digits>#<post id>, so a range
+	// scan from a time returns the posts deleted since then, oldest first.
+	// columns: tombstone:lat, tombstone:lon (where the post was, to scope
+	// the tombstones to the searched area). Nothing about the author.
+	TOMBSTONE_TABLE = "tombstone"
+)
+
+// Tombstone tells a sync client that a post it may have cached is gone.
+type Tombstone struct {
+	Id        string `json:"id"`
+	DeletedAt int64  `json:"deleted_at"`
+}
+
+//***************  TOMBSTONES ***************************
+// saveTombstone records that the post was deleted now.
+func saveTombstone(ctx context.Context, p *Post) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("tombstone", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
+	mut.Set("tombstone", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
+	return bt_client.Open(TOMBSTONE_TABLE).Apply(ctx, tombstoneRowKey(time.Now().Unix(), p.Id), mut)
+}
+
+// tombstonesSince returns the posts deleted since the unix time since, in
+// the area inArea accepts, oldest first.
+func tombstonesSince(ctx context.Context, since int64, inArea func(Location) bool) ([]Tombstone, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	tombstones := []Tombstone{}
+	rr := bigtable.NewRange(fmt.Sprintf("%019d#", since), "")
+	err = bt_client.Open(TOMBSTONE_TABLE).ReadRows(ctx, rr, func(row bigtable.Row) bool {
+		parts := strings.SplitN(row.Key(), "#", 2)
+		if len(parts) != 2 {
+			return true
+		}
+		var loc Location
+		for _, item := range row["tombstone"] {
+			switch item.Column {
+			case "tombstone:lat":
+				loc.Lat, _ = strconv.ParseFloat(string(item.Value), 64)
+			case "tombstone:lon":
+				loc.Lon, _ = strconv.ParseFloat(string(item.Value), 64)
+			}
+		}
+		if inArea(loc) {
+			deletedAt, _ := strconv.ParseInt(parts[0], 10, 64)
+			tombstones = append(tombstones, Tombstone{Id: parts[1], DeletedAt: deletedAt})
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return tombstones, err
+}
+
+// deleteTombstonesOf removes the tombstones of the posts ids and returns how
+// many were removed. The row keys start with the time, so the whole table
+// is scanned: only for an account deletion.
+func deleteTombstonesOf(ctx context.Context, ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	of := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		of[id] = true
+	}
+
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return 0, err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(TOMBSTONE_TABLE)
+	var keys []string
+	err = tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		if parts := strings.SplitN(row.Key(), "#", 2); len(parts) == 2 && of[parts[1]] {
+			keys = append(keys, row.Key())
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		mut := bigtable.NewMutation()
+		mut.DeleteRow()
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+func tombstoneRowKey(deletedAt int64, id string) string {
+	return fmt.Sprintf("%019d#%s", deletedAt, id)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// BigTable table of the engagement counters of posts.
+	// row key: <post id>, columns: count:likes, count:comments, count:views
+	// (8 bytes big-endian int64, as written by ReadModifyWrite Increment)
+	POST_STATS_TABLE = "post_stats"
+
+	COUNTER_LIKES    = "likes"
+	COUNTER_COMMENTS = "comments"
+	COUNTER_VIEWS    = "views"
+
+	// BigTable table of the last counted view of a user on a post.
+	// row key: <post id>#<username>, column: view:at
+	VIEW_TABLE = "post_view"
+
+	// Recent nearby posts read from ES and ranked, and how many are returned.
+	TRENDING_CANDIDATES = 200
+	TRENDING_SIZE       = 20
+)
+
+//***************  POST COUNTERS ***************************
+// PostStats are the engagement counters of a post.
+type PostStats struct {
+	Likes    int64 `json:"likes"`
+	Comments int64 `json:"comments"`
+	Views    int64 `json:"views"`
+	// count of each reaction type (Likes is their total)
+	Reactions map[string]int64 `json:"reactions"`
+}
+
+// incrementPostCounter adds delta (can be negative) to one counter of a post.
+// Increment is atomic in BigTable, no read-then-write race between requests.
+func incrementPostCounter(ctx context.Context, id, counter string, delta int64) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	rmw := bigtable.NewReadModifyWrite()
+	rmw.Increment("count", counter, delta)
+	_, err = bt_client.Open(POST_STATS_TABLE).ApplyReadModifyWrite(ctx, id, rmw)
+	return err
+}
+
+// getPostStats reads the counters of many posts in one batch. Posts without
+// any counter are missing from the map.
+func getPostStats(ctx context.Context, ids []string) (map[string]PostStats, error) {
+	if len(ids) == 0 {
+		return map[string]PostStats{}, nil
+	}
+	return postStore.Stats(ctx, ids)
+}
+
+// readPostStatsFromBigTable is bigtablePostStore.Stats.
+func readPostStatsFromBigTable(ctx context.Context, ids []string) (map[string]PostStats, error) {
+	stats := map[string]PostStats{}
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	err = bt_client.Open(POST_STATS_TABLE).ReadRows(ctx, bigtable.RowList(ids), func(row bigtable.Row) bool {
+		stats[row.Key()] = postStatsFromRow(row)
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return stats, err
+}
+
+func postStatsFromRow(row bigtable.Row) PostStats {
+	s := PostStats{Reactions: map[string]int64{}}
+	for _, item := range row["count"] {
+		if len(item.Value) != 8 {
+			continue
+		}
+		n := int64(binary.BigEndian.Uint64(item.Value))
+		switch item.Column {
+		case "count:" + COUNTER_LIKES:
+			s.Likes = n
+		case "count:" + COUNTER_COMMENTS:
+			s.Comments = n
+		case "count:" + COUNTER_VIEWS:
+			s.Views = n
+		default:
+			if t := strings.TrimPrefix(item.Column, "count:"+REACTION_COUNTER_PREFIX); t != item.Column {
+				s.Reactions[t] = n
+			}
+		}
+	}
+	return s
+}
+
+// viewPostHandler counts one view of a post. Clients call it when a post is
+// shown to the user (e.g. scrolled into view), it feeds the trending ranking.
+// The same user viewing it again within ViewDedupWindow doesn't count, and
+// the post has to exist, so views can't be farmed.
+func viewPostHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ctx := context.Background()
+	p, err := postStore.Read(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read post %s from BigTable %v\n", id, err)
+		http.Error(w, "Failed to count view", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if _, err := postStore.CountView(ctx, id, usernameFromToken(r)); err != nil {
+		fmt.Printf("Failed to count view of post %s %v\n", id, err)
+		http.Error(w, "Failed to count view", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func viewRowKey(id, viewer string) string { return id + "#" + viewer }
+
+// countViewInBigTable is bigtablePostStore.CountView. The view row is only
+// written if it has no cell within the window, checked and set in one
+// conditional mutation, so two views at once count once.
+func countViewInBigTable(ctx context.Context, id, viewer string) (bool, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return false, err
+	}
+	defer bt_client.Close()
+
+	recent := bigtable.ChainFilters(
+		bigtable.ColumnFilter("at"),
+		bigtable.TimestampRangeFilter(time.Now().Add(-config.ViewDedupWindow), time.Time{}),
+	)
+	mut := bigtable.NewMutation()
+	mut.Set("view", "at", bigtable.Now(), []byte{})
+	var matched bool
+	cond := bigtable.NewCondMutation(recent, nil, mut)
+	if err := bt_client.Open(VIEW_TABLE).Apply(ctx, viewRowKey(id, viewer), cond, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return false, err
+	}
+	if matched {
+		return false, nil
+	}
+	return true, incrementPostCounter(ctx, id, COUNTER_VIEWS, 1)
+}
+
+//***************  TRENDING ***************************
+// TrendingResult is a post of /trending with what it was ranked by.
+type TrendingResult struct {
+	PostResult
+	Stats PostStats `json:"stats"`
+	Score float64   `json:"score"`
+}
+
+// trendingHandler returns the hot posts around a location: posts of the last
+// TrendingWindow within range (ES), ranked by their likes, comments and views
+// (BigTable) weighted by config. Ties go to the newest post.
+//
+//	GET /trending?lat=37.5&lon=-122.3&range=20
+func trendingHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for trending")
+	center, radius, err := parseCircle(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	ps, err := recentPostsNear(center, radius, time.Now().Add(-config.TrendingWindow))
+	if err == nil {
+		ps, err = filterVisiblePosts(ctx, usernameFromToken(r), ps)
+	}
+	if err != nil {
+		fmt.Printf("Failed to search recent posts %v\n", err)
+		http.Error(w, "Failed to read trending posts", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]string, len(ps))
+	for i, p := range ps {
+		ids[i] = p.Id
+	}
+	stats, err := getPostStats(ctx, ids)
+	if err != nil {
+		fmt.Printf("Failed to read post stats %v\n", err)
+		http.Error(w, "Failed to read trending posts", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]TrendingResult, 0, len(ps))
+	for _, pr := range enrichPosts(ctx, ps, &center) {
+		s := stats[pr.Id]
+		results = append(results, TrendingResult{PostResult: pr, Stats: s, Score: trendingScore(s)})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Created > results[j].Created
+	})
+	if len(results) > TRENDING_SIZE {
+		results = results[:TRENDING_SIZE]
+	}
+
+	js, err := json.Marshal(results)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Write(js)
+}
+
+func trendingScore(s PostStats) float64 {
+	return config.TrendingLikeWeight*float64(s.Likes) +
+		config.TrendingCommentWeight*float64(s.Comments) +
+		config.TrendingViewWeight*float64(s.Views)
+}
+
+// recentPostsNear returns up to TRENDING_CANDIDATES posts created after since
+// within radiusKm of center, newest first. Filtered posts are dropped/masked.
+func recentPostsNear(center Location, radiusKm float64, since time.Time) ([]Post, error) {
+	es_client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ran := strconv.FormatFloat(radiusKm, 'f', -1, 64) + "km"
+	q := elastic.NewBoolQuery().Filter(
+		elastic.NewGeoDistanceQuery("location").Distance(ran).Lat(center.Lat).Lon(center.Lon),
+		elastic.NewRangeQuery("created").Gte(since.Unix()),
+	)
+	searchResult, err := es_client.Search().
+		Index(config.ESIndex).
+		Type(config.ESType).
+		Query(publishedOnly(q)).
+		Sort("created", false).
+		Size(TRENDING_CANDIDATES).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []Post
+	for _, hit := range searchResult.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			continue
+		}
+		p.Id = hit.Id
+		if moderatePost(&p) {
+			ps = append(ps, p)
+		}
+	}
+	return ps, nil
+}
+
+// deletePostStats drops the counters of a deleted post.
+func deletePostStats(ctx context.Context, id string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	return bt_client.Open(POST_STATS_TABLE).Apply(ctx, id, mut)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func viewPost(t *testing.T, viewer, id string) int {
+	r := httptest.NewRequest("POST", "/post/"+id+"/view", nil)
+	r = mux.SetURLVars(asUser(r, viewer), map[string]string{"id": id})
+	w := httptest.NewRecorder()
+	viewPostHandler(w, r)
+	return w.Code
+}
+
+func TestViewPostHandler(t *testing.T) {
+	b := setupMemBackends(t)
+	b.posts.Save(&Post{User: "alice", Message: "hi"}, "p1")
+
+	if code := viewPost(t, "bob", "nope"); code != http.StatusNotFound {
+		t.Errorf("missing post: got %d, want 404", code)
+	}
+	for _, viewer := range []string{"bob", "bob", "carol"} {
+		if code := viewPost(t, viewer, "p1"); code != http.StatusNoContent {
+			t.Fatalf("view of %s: got %d", viewer, code)
+		}
+	}
+	stats, _ := getPostStats(context.Background(), []string{"p1", "nope"})
+	if got := stats["p1"].Views; got != 2 {
+		t.Errorf("got %d views, want 2 (bob once within the window)", got)
+	}
+	if _, ok := stats["nope"]; ok {
+		t.Error("a missing post got a view")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Seconds a client is told to wait when all the upload slots are taken.
+const UPLOAD_RETRY_AFTER = "5"
+
+// errUploadsBusy is returned by saveImage when no upload slot got free in
+// time, the post is refused with a 503.
+var errUploadsBusy = errors.New("too many uploads in flight")
+
+//***************  UPLOAD CONCURRENCY ***************************
+// uploadSlots holds one token per image being stored, its size is
+// config.MaxConcurrentUploads (made in main once the config is loaded). A
+// burst of big posts waits for a slot instead of eating all the memory and
+// egress at once.
+var uploadSlots chan struct{}
+
+// the in-flight count, at /admin/metrics
+var uploadsInFlight = expvar.NewInt("upload_in_flight")
+
+// acquireUploadSlot waits up to config.UploadQueueTimeout for a free slot.
+func acquireUploadSlot(ctx context.Context) error {
+	timer := time.NewTimer(config.UploadQueueTimeout)
+	defer timer.Stop()
+	select {
+	case uploadSlots <- struct{}{}:
+		uploadsInFlight.Add(1)
+		return nil
+	case <-timer.C:
+		return errUploadsBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseUploadSlot() {
+	<-uploadSlots
+	uploadsInFlight.Add(-1)
+}
+
+//***************  ORIGINAL FILE INFO ***************************
+// Longest original file name kept, in characters.
+const MAX_ORIGINAL_NAME_LENGTH = 255
+
+// ImageInfo is what the client told about an uploaded image, kept for
+// downloads and moderation (the stored image may be re-encoded, see orientImage).
+type ImageInfo struct {
+	OriginalName string `json:"original_name,omitempty"`
+	// Size in bytes of the upload.
+	Size int64 `json:"size"`
+}
+
+// uploadedImageInfos returns the info of the "image" parts of a parsed post
+// form, in order (the order of Urls).
+func uploadedImageInfos(r *http.Request) []ImageInfo {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	var infos []ImageInfo
+	for _, fh := range r.MultipartForm.File["image"] {
+		infos = append(infos, ImageInfo{OriginalName: sanitizeFilename(fh.Filename), Size: fh.Size})
+	}
+	return infos
+}
+
+// sanitizeFilename keeps the base name of a client file name, without
+// control characters (no CR/LF to inject into a header), quotes or
+// backslashes, so it can go into a Content-Disposition as is.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, "/\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(c rune) rune {
+		if c == utf8.RuneError || c == '"' || c == ';' || !unicode.IsPrint(c) {
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > MAX_ORIGINAL_NAME_LENGTH {
+		name = string([]rune(name)[:MAX_ORIGINAL_NAME_LENGTH])
+	}
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
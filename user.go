@@ -3,30 +3,33 @@ package main
 import (
 	elastic "gopkg.in/olivere/elastic.v3"
 
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"reflect"
 	"regexp"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/bigtable"
 	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	TYPE_USER = "user"
+
+	// Roles of /me, from the claims of the token.
+	ROLE_USER  = "user"
+	ROLE_ADMIN = "admin"
 )
 
 var (
-	// Check username is correctly formated
-	/*
-		1. ^ --> begin of string
-		2. $ --> end of string
-				means : this rule valid in HOLE string
-		3. [a-z0-9_] --> You can use ('a' to  'z'), ('0' to '9') and ('_')
-		4. + --> one or more (* --> zero or more)
-	*/
-	usernamePattern = regexp.MustCompile(`^[a-z0-9_]+$`).MatchString
+	// Loose email check: something@domain.tld, no spaces
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`).MatchString
 )
 
 type User struct {
@@ -34,13 +37,18 @@ type User struct {
 	Password string `json:"password"`
 	Age      int    `json:"age"`
 	Gender   string `json:"gender"`
+	// Email is required at signup, and stays unverified until the link we sent is opened.
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	// CreatedAt is the signup time (unix seconds), 0 for older accounts.
+	CreatedAt int64 `json:"created_at,omitempty"`
 }
 
 //***************  CHECK USER (LOG IN) ***************************
 // checkUser checks whether user is valid
 func checkUser(username, password string) bool {
 	// create a es_clinet
-	es_client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+	es_client, err := getESClient()
 	if err != nil {
 		fmt.Printf("ES is not setup %v\n", err)
 		panic(err)
@@ -49,7 +57,7 @@ func checkUser(username, password string) bool {
 	// Search with a term query (geoQuery in searchHandler func)
 	termQuery := elastic.NewTermQuery("username", username)
 	queryResult, err := es_client.Search().
-		Index(INDEX).
+		Index(config.ESIndex).
 		Query(termQuery).
 		Pretty(true).
 		Do()
@@ -62,17 +70,43 @@ func checkUser(username, password string) bool {
 	var tyu User
 	for _, item := range queryResult.Each(reflect.TypeOf(tyu)) {
 		u := item.(User)
-		return u.Password == password && u.Username == username
+		return checkPassword(u.Password, password) && u.Username == username
 	}
 	// If no user exist, return false.
 	return false
 }
 
+//***************  GET USER ***************************
+// getUser reads a user by username (it's also the doc id in ES).
+func getUser(username string) (*User, error) {
+	es_client, err := getESClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := esContext(ES_OP_GET)
+	defer cancel()
+	result, err := es_client.Get().
+		Index(config.ESIndex).
+		Type(TYPE_USER).
+		Id(username).
+		DoC(ctx)
+	if err != nil {
+		return nil, esError(ctx, ES_OP_GET, err)
+	}
+
+	var u User
+	if err := json.Unmarshal(*result.Source, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
 //***************  ADD USER (SIGN UP) ***************************
 // Add a new user. Return true if successfully.
 func addUser(user User) bool {
 	// create a es_client
-	es_client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+	es_client, err := getESClient()
 	if err != nil {
 		fmt.Printf("ES is not setup %v\n", err)
 		return false
@@ -81,7 +115,7 @@ func addUser(user User) bool {
 	// CHECK if username exist --> search username first
 	termQuery := elastic.NewTermQuery("username", user.Username)
 	queryResult, err := es_client.Search().
-		Index(INDEX).
+		Index(config.ESIndex).
 		Query(termQuery).
 		Pretty(true).
 		Do()
@@ -97,9 +131,16 @@ func addUser(user User) bool {
 		return false
 	}
 
-	// username DON'T exist
+	// username DON'T exist --> never store the plain password
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		fmt.Printf("Failed to hash password %v\n", err)
+		return false
+	}
+	user.Password = hash
+	user.CreatedAt = time.Now().Unix()
 	_, err = es_client.Index().
-		Index(INDEX).
+		Index(config.ESIndex).
 		Type(TYPE_USER).
 		Id(user.Username).
 		BodyJson(user).
@@ -113,6 +154,22 @@ func addUser(user User) bool {
 	return true
 }
 
+//***************  PASSWORD HASH ***************************
+// hashPassword returns the bcrypt hash we store instead of the password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword compares a password with the stored value. Accounts created
+// before hashing was added still have the plain password stored.
+func checkPassword(stored, password string) bool {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return stored != "" && stored == password
+}
+
 //*************** SIGN_UP HANDLER ***************************
 // If signup is successful, a new session is created.
 func signupHandler(w http.ResponseWriter, r *http.Request) {
@@ -121,26 +178,42 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var u User
 	if err := decoder.Decode(&u); err != nil {
-		panic(err)
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+
+	// A new account always starts unverified, whatever the client sends.
+	u.EmailVerified = false
+
+	// CHECEK if INPUT of username, password and email is correct
+	var errs ValidationErrors
+	config.Policy.checkUsername(&errs, "username", u.Username)
+	if u.Password == "" {
+		errs.Add("password", "password is required")
+	}
+	if !emailPattern(u.Email) {
+		errs.Add("email", "email is invalid")
+	}
+	if errs != nil {
+		fmt.Printf("Invalid signup: %v\n", errs)
+		writeValidationErrors(w, errs)
+		return
 	}
 
-	// CHECEK if INPUT of username and password is correct
-	if u.Username != "" && u.Password != "" && usernamePattern(u.Username) {
-		// call addUser func --> return TRUE if sign up succss
-		if addUser(u) {
-			fmt.Println("User added successfully.")     // use for debug
-			w.Write([]byte("User added successfully.")) // use for notice client
-		} else {
-			fmt.Println("Failed to add a new user.")
-			http.Error(w, "Failed to add a new user", http.StatusInternalServerError)
+	// call addUser func --> return TRUE if sign up succss
+	if addUser(u) {
+		// the account is created anyway, a failed email is only logged
+		if err := sendVerificationEmail(u); err != nil {
+			fmt.Printf("Failed to send verification email to %s %v\n", u.Email, err)
 		}
+		fmt.Println("User added successfully.")     // use for debug
+		w.Write([]byte("User added successfully.")) // use for notice client
 	} else {
-		fmt.Println("Empty password or username.")
-		http.Error(w, "Empty password or username", http.StatusInternalServerError)
+		fmt.Println("Failed to add a new user.")
+		http.Error(w, "Failed to add a new user", http.StatusInternalServerError)
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 }
 
 //*************** LOIG_IN HANDLER ***************************
@@ -151,20 +224,30 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var u User
 	if err := decoder.Decode(&u); err != nil {
-		panic(err)
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
 	}
 
 	// call checkUser func --> return TRUE if log in succss
 	if checkUser(u.Username, u.Password) {
-		// creat TOKEN !!!!!!
-		token := jwt.New(jwt.SigningMethodHS256)
-		claims := token.Claims.(jwt.MapClaims)
-		/* Set token claims */
-		claims["username"] = u.Username
-		claims["exp"] = time.Now().Add(time.Hour * 24).Unix() // Unix: seconds from 01/01/1970
+		if config.RequireVerifiedEmail {
+			if profile, err := getUser(u.Username); err != nil || !profile.EmailVerified {
+				fmt.Printf("Email of %s is not verified.\n", u.Username)
+				http.Error(w, "Email is not verified", http.StatusForbidden)
+				return
+			}
+		}
 
-		/* Sign the token with our secret */
-		tokenString, _ := token.SignedString(mySigningKey)
+		bans, err := getBans(r.Context(), []string{u.Username})
+		if err != nil {
+			fmt.Printf("Failed to check ban of %s %v\n", u.Username, err)
+		}
+		if b := bans[u.Username]; b.active() {
+			http.Error(w, banMessage(b), http.StatusForbidden)
+			return
+		}
+
+		tokenString, _ := newSessionToken(u.Username)
 
 		/* Finally, write the token to the browser window */
 		w.Write([]byte(tokenString))
@@ -174,5 +257,389 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+// newSessionToken makes the JWT a logged in user sends with every request.
+func newSessionToken(username string) (string, error) {
+	// creat TOKEN !!!!!!
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	/* Set token claims */
+	claims["username"] = username
+	if config.isAdminUser(username) {
+		claims["admin"] = true
+	}
+	claims["exp"] = time.Now().Add(time.Hour * 24).Unix() // Unix: seconds from 01/01/1970
+
+	/* Sign the token with our newest secret, named by its kid */
+	key := signingKey()
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.Secret)
+}
+
+//*************** VERIFY EMAIL ***************************
+// sendVerificationEmail mails the user a link to GET /verify?token=...
+func sendVerificationEmail(u User) error {
+	token, err := signPurposeToken(PURPOSE_VERIFY_EMAIL, u.Username, VERIFY_EMAIL_TOKEN_TTL, nil)
+	if err != nil {
+		return err
+	}
+	link := config.PublicURL + "/verify?token=" + url.QueryEscape(token)
+	body := "Hi " + u.Username + ",\n\nPlease verify your email by opening this link:\n" + link + "\n"
+	return sendMail(u.Email, "Verify your email", body)
+}
+
+// Mark the email of the user in the token as verified.
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one verify email request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	username, err := parsePurposeToken(PURPOSE_VERIFY_EMAIL, r.URL.Query().Get("token"))
+	if err != nil {
+		fmt.Printf("Invalid verification token %v\n", err)
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	es_client, err := getESClient()
+	if err != nil {
+		http.Error(w, "ES is not setup", http.StatusInternalServerError)
+		return
+	}
+	_, err = es_client.Update().
+		Index(config.ESIndex).
+		Type(TYPE_USER).
+		Id(username).
+		Doc(map[string]interface{}{"email_verified": true}).
+		Refresh(true).
+		Do()
+	if err != nil {
+		fmt.Printf("Failed to verify email of %s %v\n", username, err)
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("Email of %s is verified.\n", username)
+	w.Write([]byte("Email verified."))
+}
+
+//***************  TOKEN USER ***************************
+// usernameFromToken returns the username in the JWT checked by jwtMiddleware.
+func usernameFromToken(r *http.Request) string {
+	user := r.Context().Value("user")
+	claims := user.(*jwt.Token).Claims
+	return claims.(jwt.MapClaims)["username"].(string)
+}
+
+// isAdmin tells whether the caller's token has the admin claim.
+func isAdmin(r *http.Request) bool {
+	user := r.Context().Value("user")
+	claims := user.(*jwt.Token).Claims
+	admin, _ := claims.(jwt.MapClaims)["admin"].(bool)
+	return admin
+}
+
+//***************  ACCOUNT AGE ***************************
+// accountWait returns how long the caller must still wait before posting
+// (config.MinAccountAge after signup), 0 if they can post. Admins and
+// services don't wait, neither do accounts older than CreatedAt itself.
+func accountWait(r *http.Request) (time.Duration, error) {
+	if config.MinAccountAge <= 0 || isAdmin(r) || isService(r) {
+		return 0, nil
+	}
+	u, err := getUser(usernameFromToken(r))
+	if err != nil || u.CreatedAt == 0 {
+		return 0, err
+	}
+	return time.Until(time.Unix(u.CreatedAt, 0).Add(config.MinAccountAge)), nil
+}
+
+//***************  WHO AM I ***************************
+// Me is the response of /me: what the caller's token says, and their profile.
+type Me struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+	// when the token expires (unix seconds), time to log in again
+	ExpiresAt int64    `json:"expires_at"`
+	Profile   *Profile `json:"profile"`
+}
+
+// meHandler tells clients who they are logged in as, without decoding the
+// JWT themselves. No token --> 401 from jwtMiddleware.
+//
+//	GET /me
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fmt.Printf("Received one me request from %s\n", username)
+
+	me := Me{Username: username, Roles: []string{ROLE_USER}, ExpiresAt: tokenExpiry(r)}
+	if isAdmin(r) {
+		me.Roles = append(me.Roles, ROLE_ADMIN)
+	}
+
+	var err error
+	if me.Profile, err = getProfile(context.Background(), username); err != nil {
+		fmt.Printf("Failed to read profile %s %v\n", username, err)
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+	if me.Profile == nil {
+		me.Profile = &Profile{Username: username, DisplayName: username}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(me)
+}
+
+// validateTokenHandler answers 200 with the time left if the token is valid,
+// so clients can refresh it before it expires. An invalid (or expired, or
+// banned user's) token never gets here, jwtMiddleware answers 401.
+//
+//	GET /auth/validate
+func validateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	exp := tokenExpiry(r)
+	left := exp - time.Now().Unix()
+	if left < 0 {
+		left = 0
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":      true,
+		"expires_at": exp,
+		"expires_in": left,
+	})
+}
+
+// tokenExpiry returns the exp claim (unix seconds) of the caller's token.
+func tokenExpiry(r *http.Request) int64 {
+	claims := r.Context().Value("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	// numbers of a decoded token are float64
+	exp, _ := claims["exp"].(float64)
+	return int64(exp)
+}
+
+//*************** DELETE ACCOUNT HANDLER ***************************
+// What was removed by a DELETE /user/me, returned to the client.
+type DeletionSummary struct {
+	Username        string `json:"username"`
+	Posts           int    `json:"posts"`
+	Views           int    `json:"views"`
+	Tombstones      int    `json:"tombstones"`
+	IdempotencyKeys int    `json:"idempotency_keys"`
+	Reactions       int    `json:"reactions"`
+	Comments        int    `json:"comments"`
+	Follows         int    `json:"follows"`
+	Devices         int    `json:"devices"`
+	Profile         bool   `json:"profile"`
+	Presence        bool   `json:"presence"`
+	Account         bool   `json:"account"`
+}
+
+// Delete the caller's account and everything the service stored for it.
+// The password must be sent again in the body: {"password": "..."}, or for
+// an account linked to Google a fresh ID token of it: {"id_token": "..."}
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one delete account request")
+	w.Header().Set("Content-Type", "application/json")
+
+	username := usernameFromToken(r)
+	ctx := context.Background()
+
+	var body struct {
+		Password string `json:"password"`
+		IdToken  string `json:"id_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	if body.IdToken != "" {
+		if !googleConfirms(ctx, username, body.IdToken) {
+			http.Error(w, "Invalid Google ID token", http.StatusForbidden)
+			return
+		}
+	} else if !checkUser(username, body.Password) {
+		http.Error(w, "Invalid password", http.StatusForbidden)
+		return
+	}
+
+	summary, err := deleteAccount(ctx, username)
+	if err != nil {
+		fmt.Printf("Failed to delete account %s %v\n", username, err)
+		http.Error(w, "Failed to delete account, please retry", http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(summary)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(js)
+}
+
+// deleteAccount removes the user's posts (ES + BigTable + GCS), idempotency keys
+// and finally the user itself. The user is removed last, so a failed run can
+// be retried by calling it again with the same password.
+func deleteAccount(ctx context.Context, username string) (*DeletionSummary, error) {
+	summary := &DeletionSummary{Username: username}
+
+	// ES may not have refreshed the newest posts yet, the user index of
+	// BigTable has them. It is only deleted once the posts are gone.
+	ids, err := listPostIDsByUser(username)
+	if err != nil {
+		return summary, err
+	}
+	indexed, err := userPostIDsFromBigTable(ctx, username)
+	if err != nil {
+		return summary, err
+	}
+	ids = mergeIDs(ids, indexed)
+	for _, id := range ids {
+		if err := deletePost(ctx, id); err != nil {
+			return summary, err
+		}
+		summary.Posts++
+		n, err := deleteRowsWithPrefix(ctx, VIEW_TABLE, viewRowKey(id, ""))
+		if err != nil {
+			return summary, err
+		}
+		summary.Views += n
+	}
+	// deletePost left one, nothing of the user may stay
+	if summary.Tombstones, err = deleteTombstonesOf(ctx, ids); err != nil {
+		return summary, err
+	}
+
+	// the user index of posts (read-your-writes)
+	if _, err := deleteRowsWithPrefix(ctx, USER_POST_TABLE, username+"#"); err != nil {
+		return summary, err
+	}
+	if summary.IdempotencyKeys, err = deleteIdempotencyKeys(ctx, username); err != nil {
+		return summary, err
+	}
+	if summary.Reactions, err = deleteReactionsOfUser(ctx, username); err != nil {
+		return summary, err
+	}
+	if summary.Comments, err = deleteCommentsOfUser(ctx, username); err != nil {
+		return summary, err
+	}
+	if summary.Follows, err = deleteFollowsOfUser(ctx, username); err != nil {
+		return summary, err
+	}
+	if summary.Devices, err = deleteRowsWithPrefix(ctx, DEVICE_TABLE, deviceKey(username, "")); err != nil {
+		return summary, err
+	}
+	if err := deleteProfile(ctx, username); err != nil {
+		return summary, err
+	}
+	summary.Profile = true
+	if err := deletePresence(ctx, username); err != nil {
+		return summary, err
+	}
+	summary.Presence = true
+
+	es_client, err := getESClient()
+	if err != nil {
+		return summary, err
+	}
+	_, err = es_client.Delete().
+		Index(config.ESIndex).
+		Type(TYPE_USER).
+		Id(username).
+		Refresh(true).
+		Do()
+	if err != nil && !elastic.IsNotFound(err) {
+		return summary, err
+	}
+	summary.Account = true
+
+	fmt.Printf("Account %s is deleted: %d posts\n", username, summary.Posts)
+	return summary, nil
+}
+
+// listPostIDsByUser returns the ids of all posts of a user.
+func listPostIDsByUser(username string) ([]string, error) {
+	var ids []string
+	err := scrollPostsByUser(username, func(hit *elastic.SearchHit) error {
+		ids = append(ids, hit.Id)
+		return nil
+	})
+	return ids, err
+}
+
+// mergeIDs returns ids followed by the ones of more not in it yet.
+func mergeIDs(ids, more []string) []string {
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range more {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// scrollPostsByUser calls fn for every post of a user, scrolling ES page by page
+// so we never hold all of them in memory.
+func scrollPostsByUser(username string, fn func(hit *elastic.SearchHit) error) error {
+	es_client, err := getESClient()
+	if err != nil {
+		return err
+	}
+
+	scroll := es_client.Scroll(config.ESIndex).
+		Type(config.ESType).
+		Query(elastic.NewTermQuery("user", username)).
+		Size(100)
+	for {
+		result, err := scroll.Do()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, hit := range result.Hits.Hits {
+			if err := fn(hit); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deleteIdempotencyKeys removes all Idempotency-Key rows of a user.
+func deleteIdempotencyKeys(ctx context.Context, username string) (int, error) {
+	return deleteRowsWithPrefix(ctx, IDEMPOTENCY_TABLE, idempotencyRowKey(username, ""))
+}
+
+// deleteRowsWithPrefix removes every row of table whose key starts with prefix,
+// and returns how many were removed.
+func deleteRowsWithPrefix(ctx context.Context, table, prefix string) (int, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return 0, err
+	}
+	defer bt_client.Close()
+
+	tbl := bt_client.Open(table)
+	var keys []string
+	err = tbl.ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		keys = append(keys, row.Key())
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		mut := bigtable.NewMutation()
+		mut.DeleteRow()
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
 }
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeIDs(t *testing.T) {
+	// p3 is in the user index only, ES has not refreshed it yet
+	got := mergeIDs([]string{"p1", "p2"}, []string{"p3", "p2", "p1"})
+	if want := []string{"p1", "p2", "p3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := mergeIDs(nil, []string{"p1", "p1"}); !reflect.DeepEqual(got, []string{"p1"}) {
+		t.Errorf("got %v, want [p1]", got)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Image types a post can upload, sniffed from the file content
+// (the Content-Type sent by the client can't be trusted).
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+//***************  VALIDATION ERROR ***************************
+// FieldError tells why one field of a request is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects all the invalid fields of a request, so the client
+// can fix everything at once instead of one field per request.
+type ValidationErrors []FieldError
+
+// Add records that field is invalid.
+func (v *ValidationErrors) Add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// writeValidationErrors responds 400 with {"errors":[{"field":...,"message":...}]}.
+func writeValidationErrors(w http.ResponseWriter, v ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": v})
+}
+
+//***************  POST VALIDATION ***************************
+// validatePostFields checks the text fields of a new post form (everything
+// but the images), see validatePost.
+func validatePostFields(r *http.Request) (Location, ValidationErrors) {
+	var errs ValidationErrors
+	var location Location
+	var err error
+
+	if val := r.FormValue("lat"); val == "" {
+		errs.Add("lat", "lat is required")
+	} else if location.Lat, err = parseLat(val); err != nil {
+		errs.Add("lat", "%s", err)
+	}
+	if val := r.FormValue("lon"); val == "" {
+		errs.Add("lon", "lon is required")
+	} else if location.Lon, err = parseLon(val); err != nil {
+		errs.Add("lon", "%s", err)
+	}
+
+	config.Policy.checkMessage(&errs, "message", r.FormValue("message"))
+	if _, err := parsePublishAt(r.FormValue("publish_at"), time.Now()); err != nil {
+		errs.Add("publish_at", "%s", err)
+	}
+	return location, errs
+}
+
+// validatePost checks every field of a new post form in one pass. On success
+// it returns the location and the image files (to be closed by the caller).
+func validatePost(r *http.Request) (Location, []multipart.File, ValidationErrors) {
+	location, errs := validatePostFields(r)
+
+	// several "image" parts make a post with several images. Only the
+	// headers are looked at here, nothing is uploaded before all checks pass.
+	var headers []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		headers = r.MultipartForm.File["image"]
+	}
+	if len(headers) == 0 {
+		errs.Add("image", "image is required")
+		return location, nil, errs
+	}
+	if len(headers) > config.MaxImagesPerPost {
+		errs.Add("image", "%d images sent, the limit is %d per post", len(headers), config.MaxImagesPerPost)
+		return location, nil, errs
+	}
+
+	var files []multipart.File
+	for i, fh := range headers {
+		file, err := fh.Open()
+		if err != nil {
+			errs.Add("image", "image %d can't be read", i+1)
+			continue
+		}
+		files = append(files, file)
+		if fh.Size > config.MaxImageBytes {
+			errs.Add("image", "image %d is over the limit of %d MB", i+1, config.MaxImageBytes>>20)
+		} else if contentType, err := sniffContentType(file); err != nil {
+			errs.Add("image", "image %d can't be read", i+1)
+		} else if !allowedImageTypes[contentType] {
+			errs.Add("image", "image %d type %s is not supported, use jpeg, png or gif", i+1, contentType)
+		}
+	}
+
+	if len(errs) > 0 {
+		closeFiles(files)
+		return location, nil, errs
+	}
+	return location, files, nil
+}
+
+func closeFiles(files []multipart.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// sniffContentType detects the type from the first 512 bytes, then rewinds the file.
+func sniffContentType(file multipart.File) (string, error) {
+	buf := make([]byte, 512)
+	n, err := file.Read(buf)
+	if err != nil && n == 0 {
+		return "", err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// validateImportedPost checks a post of an admin import (see importHandler).
+// The images are urls already stored somewhere, they are optional.
+func validateImportedPost(p *Post) ValidationErrors {
+	var errs ValidationErrors
+	config.Policy.checkExistingUsername(&errs, "user", p.User)
+	if strings.TrimSpace(p.Message) == "" {
+		errs.Add("message", "message is required")
+	} else {
+		config.Policy.checkMessage(&errs, "message", p.Message)
+	}
+	if p.Location.Lat < -90 || p.Location.Lat > 90 {
+		errs.Add("location.lat", "lat must be between -90 and 90")
+	}
+	if p.Location.Lon < -180 || p.Location.Lon > 180 {
+		errs.Add("location.lon", "lon must be between -180 and 180")
+	}
+	if len(p.Urls) > config.MaxImagesPerPost {
+		errs.Add("urls", "%d images, the limit is %d per post", len(p.Urls), config.MaxImagesPerPost)
+	}
+	for _, u := range append([]string{p.Url}, p.Urls...) {
+		if u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			errs.Add("url", "%q is not an http(s) url", u)
+		}
+	}
+	if p.Created < 0 || p.Created > time.Now().Unix() {
+		errs.Add("created", "created must be a unix time in the past")
+	}
+	return errs
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postForm is a POST /post of alice with the fields and that many copies
+// of image.
+func postForm(t *testing.T, fields map[string]string, image []byte, images int) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for i := 0; i < images; i++ {
+		fw, err := mw.CreateFormFile("image", "pic.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(image)
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/post", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return asUser(r, "alice")
+}
+
+// fieldsOf decodes the {"errors": [...]} of a 400 into the fields in error.
+func fieldsOf(t *testing.T, w *httptest.ResponseRecorder) []string {
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want 400", w.Code, w.Body.String())
+	}
+	var res struct {
+		Errors ValidationErrors `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, fe := range res.Errors {
+		fields = append(fields, fe.Field)
+	}
+	return fields
+}
+
+func TestHandlerPostAllValidationErrors(t *testing.T) {
+	setupMemBackends(t)
+
+	// everything wrong at once --> every field reported in one response
+	r := postForm(t, map[string]string{
+		"lat":        "91",
+		"lon":        "abc",
+		"message":    strings.Repeat("a", config.Policy.MaxMessageLength+1),
+		"publish_at": "tomorrow",
+	}, nil, 0)
+	got := strings.Join(fieldsOf(t, createPost(t, r)), ",")
+	if got != "lat,lon,message,publish_at,image" {
+		t.Errorf("got errors on %s, want lat,lon,message,publish_at,image", got)
+	}
+}
+
+func TestHandlerPostMaxImages(t *testing.T) {
+	b := setupMemBackends(t)
+	fields := map[string]string{"lat": "37.5", "lon": "-122.3", "message": "pics"}
+
+	// at the limit --> one post with every image
+	w := createPost(t, postForm(t, fields, smallPNG(t), config.MaxImagesPerPost))
+	p, _ := b.posts.Read(context.Background(), createdID(t, w))
+	if p == nil || len(p.Urls) != config.MaxImagesPerPost {
+		t.Fatalf("stored post %+v, want %d images", p, config.MaxImagesPerPost)
+	}
+
+	// one more --> nothing stored
+	fields["message"] = "too many pics"
+	w = createPost(t, postForm(t, fields, smallPNG(t), config.MaxImagesPerPost+1))
+	if got := strings.Join(fieldsOf(t, w), ","); got != "image" {
+		t.Errorf("got errors on %s, want image", got)
+	}
+	if len(b.posts.posts) != 1 {
+		t.Errorf("%d posts stored, want 1", len(b.posts.posts))
+	}
+}
+
+func TestValidateImportedPostMaxImages(t *testing.T) {
+	setupMemBackends(t)
+	p := &Post{User: "alice", Message: "pics", Created: 1}
+	for i := 0; i < config.MaxImagesPerPost; i++ {
+		p.Urls = append(p.Urls, "https://example.com/pic.png")
+	}
+	if errs := validateImportedPost(p); len(errs) != 0 {
+		t.Errorf("at the limit: got %v", errs)
+	}
+
+	p.Urls = append(p.Urls, "https://example.com/pic.png")
+	errs := validateImportedPost(p)
+	if len(errs) != 1 || errs[0].Field != "urls" {
+		t.Errorf("over the limit: got %v, want an error on urls", errs)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// BigTable table of the webhooks, row key: <webhook id>
+	// columns: webhook:url, webhook:secret, webhook:bbox ("top,left,bottom,right"),
+	// webhook:created, webhook:disabled ("1" once disabled), webhook:failures (counter),
+	// webhook:owner (id of the API key which created it, missing if an admin did)
+	WEBHOOK_TABLE = "webhook"
+
+	// Header with the HMAC-SHA256 of the body (hex), keyed with the webhook
+	// secret, so the receiver can check the call comes from us.
+	WEBHOOK_SIGNATURE_HEADER = "X-Webhook-Signature"
+
+	// One delivery is tried this many times, waiting 1s, 2s, 4s ... in between.
+	WEBHOOK_ATTEMPTS = 3
+	WEBHOOK_TIMEOUT  = 10 * time.Second
+	// A webhook is disabled after this many deliveries failed in a row.
+	WEBHOOK_MAX_FAILURES = 5
+	// Time to resolve the host of a new webhook.
+	WEBHOOK_RESOLVE_TIMEOUT = 5 * time.Second
+
+	AUDIT_CREATE_WEBHOOK = "create_webhook"
+	AUDIT_DELETE_WEBHOOK = "delete_webhook"
+)
+
+type Webhook struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// only returned when the webhook is created, keep it then
+	Secret   string      `json:"secret,omitempty"`
+	Bbox     BoundingBox `json:"bbox"`
+	Created  int64       `json:"created"`
+	Disabled bool        `json:"disabled"`
+	Failures int64       `json:"failures"`
+	// the API key which created the webhook, empty when an admin did
+	Owner string `json:"owner,omitempty"`
+}
+
+// WebhookEvent is the body POSTed to the webhooks.
+type WebhookEvent struct {
+	Event string `json:"event"`
+	Post  Post   `json:"post"`
+}
+
+//***************  WEBHOOK HANDLERS ***************************
+// createWebhookHandler registers a webhook for the new posts in a box:
+// {"url": "https://...", "bbox": "top,left,bottom,right"}.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one create webhook request")
+
+	var body struct {
+		Url  string `json:"url"`
+		Bbox string `json:"bbox"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err, "Cannot decode request body")
+		return
+	}
+	var errs ValidationErrors
+	if err := checkWebhookURL(body.Url); err != nil {
+		errs.Add("url", "%s", err.Error())
+	}
+	box, err := parseBBox(body.Bbox)
+	if err != nil {
+		errs.Add("bbox", "%s", err.Error())
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	secret, err := randomBase62(32)
+	if err != nil {
+		panic(err)
+	}
+	hook := &Webhook{
+		Id:      uuid.New(),
+		Url:     body.Url,
+		Secret:  secret,
+		Bbox:    box,
+		Created: time.Now().Unix(),
+		Owner:   apiKeyID(r),
+	}
+	if err := saveWebhook(context.Background(), hook, body.Bbox); err != nil {
+		fmt.Printf("Failed to save webhook %v\n", err)
+		http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_CREATE_WEBHOOK, hook.Id, hook.Url)
+
+	js, err := json.Marshal(hook)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// listWebhooksHandler lists the webhooks of the caller's API key, every
+// webhook for an admin (without secrets).
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := listWebhooks(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to read webhooks %v\n", err)
+		http.Error(w, "Failed to read webhooks", http.StatusInternalServerError)
+		return
+	}
+	hooks := []*Webhook{}
+	for _, hook := range all {
+		if ownsWebhook(r, hook) {
+			hook.Secret = ""
+			hooks = append(hooks, hook)
+		}
+	}
+	js, err := json.Marshal(hooks)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	fmt.Printf("Received one delete webhook request %s\n", id)
+
+	ctx := context.Background()
+	hook, err := getWebhook(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to read webhook %s %v\n", id, err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	// someone else's webhook is as good as missing
+	if hook == nil || !ownsWebhook(r, hook) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err := deleteWebhook(ctx, id); err != nil {
+		fmt.Printf("Failed to delete webhook %s %v\n", id, err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AUDIT_DELETE_WEBHOOK, id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownsWebhook tells whether the caller may see and delete hook: admins can
+// for all of them, a service for those its API key created.
+func ownsWebhook(r *http.Request, hook *Webhook) bool {
+	if isAdmin(r) {
+		return true
+	}
+	id := apiKeyID(r)
+	return id != "" && hook.Owner == id
+}
+
+// checkWebhookURL refuses what a webhook must not be: anything but https, or
+// a host inside our network (loopback, private, link-local like the metadata
+// server), we would POST to it from there. The delivery checks the address
+// again when it connects, the DNS may have changed since.
+func checkWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return errors.New("url must be an https URL")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_RESOLVE_TIMEOUT)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s", u.Hostname())
+	}
+	for _, ip := range ips {
+		if internalIP(ip.IP) {
+			return fmt.Errorf("%s is not a public address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// internalIP tells whether ip is one of ours rather than on the internet.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// webhookClient only connects to public addresses, whatever the host
+// resolves to now (redirects included), and never through a proxy.
+var webhookClient = &http.Client{
+	Timeout: WEBHOOK_TIMEOUT,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: WEBHOOK_TIMEOUT,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+					return fmt.Errorf("webhook address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: WEBHOOK_TIMEOUT,
+	},
+}
+
+//***************  WEBHOOK DELIVERY ***************************
+// the deliverNewPost goroutines still checking or listing, waited for at
+// shutdown (and by the tests, before they put the stores back)
+var webhookFanouts sync.WaitGroup
+
+// deliverNewPost calls, in the background, the webhooks whose box has the post.
+// The webhooks get only what an anonymous search would return: no post of a
+// private or banned user, and the post as the moderator leaves it.
+func deliverNewPost(p Post) {
+	webhookFanouts.Add(1)
+	go func() {
+		defer webhookFanouts.Done()
+		ctx := context.Background()
+		visible, err := filterVisiblePosts(ctx, "", []Post{p})
+		if err != nil {
+			fmt.Printf("Failed to check visibility of post %s for webhooks %v\n", p.Id, err)
+			return
+		}
+		if len(visible) == 0 || !moderatePost(&p) {
+			return
+		}
+		hooks, err := listWebhooks(ctx)
+		if err != nil {
+			fmt.Printf("Failed to read webhooks for post %s %v\n", p.Id, err)
+			return
+		}
+		js, err := json.Marshal(WebhookEvent{Event: "post.created", Post: p})
+		if err != nil {
+			fmt.Printf("Failed to encode webhook event %v\n", err)
+			return
+		}
+		for _, hook := range hooks {
+			if !hook.Disabled && hook.Url != "" && hook.Bbox.contains(p.Location) {
+				go deliverWebhook(ctx, hook, js)
+			}
+		}
+	}()
+}
+
+// deliverWebhook POSTs body to the webhook with retries, and keeps count of
+// the deliveries failed in a row to disable a webhook which keeps failing.
+func deliverWebhook(ctx context.Context, hook *Webhook, body []byte) {
+	var err error
+	for attempt := 0; attempt < WEBHOOK_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << uint(attempt-1))
+		}
+		if err = postWebhook(hook, body); err == nil {
+			break
+		}
+	}
+	if err == nil {
+		if hook.Failures > 0 {
+			if err := resetWebhookFailures(ctx, hook.Id); err != nil {
+				fmt.Printf("Failed to reset failures of webhook %s %v\n", hook.Id, err)
+			}
+		}
+		return
+	}
+
+	fmt.Printf("Failed to deliver webhook %s to %s %v\n", hook.Id, hook.Url, err)
+	failures, err := incrementWebhookFailures(ctx, hook.Id)
+	if err != nil {
+		fmt.Printf("Failed to count failure of webhook %s %v\n", hook.Id, err)
+		return
+	}
+	if failures >= WEBHOOK_MAX_FAILURES {
+		fmt.Printf("Disabling webhook %s after %d failures in a row\n", hook.Id, failures)
+		if err := disableWebhook(ctx, hook.Id); err != nil {
+			fmt.Printf("Failed to disable webhook %s %v\n", hook.Id, err)
+		}
+	}
+}
+
+func postWebhook(hook *Webhook, body []byte) error {
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+signWebhook(hook.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//***************  WEBHOOK STORE ***************************
+func saveWebhook(ctx context.Context, hook *Webhook, bbox string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("webhook", "url", t, []byte(hook.Url))
+	mut.Set("webhook", "secret", t, []byte(hook.Secret))
+	mut.Set("webhook", "bbox", t, []byte(bbox))
+	mut.Set("webhook", "created", t, []byte(strconv.FormatInt(hook.Created, 10)))
+	if hook.Owner != "" {
+		mut.Set("webhook", "owner", t, []byte(hook.Owner))
+	}
+	return bt_client.Open(WEBHOOK_TABLE).Apply(ctx, hook.Id, mut)
+}
+
+// listWebhooks reads all the webhooks, there are few of them.
+func listWebhooks(ctx context.Context) ([]*Webhook, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	hooks := []*Webhook{}
+	err = bt_client.Open(WEBHOOK_TABLE).ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		hooks = append(hooks, webhookFromRow(row))
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return hooks, err
+}
+
+// getWebhook returns the webhook id, nil if there is none.
+func getWebhook(ctx context.Context, id string) (*Webhook, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	defer bt_client.Close()
+
+	row, err := bt_client.Open(WEBHOOK_TABLE).ReadRow(ctx, id, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil || len(row) == 0 {
+		return nil, err
+	}
+	return webhookFromRow(row), nil
+}
+
+func webhookFromRow(row bigtable.Row) *Webhook {
+	hook := &Webhook{Id: row.Key()}
+	for _, item := range row["webhook"] {
+		val := string(item.Value)
+		switch item.Column {
+		case "webhook:url":
+			hook.Url = val
+		case "webhook:secret":
+			hook.Secret = val
+		case "webhook:bbox":
+			hook.Bbox, _ = parseBBox(val)
+		case "webhook:created":
+			hook.Created, _ = strconv.ParseInt(val, 10, 64)
+		case "webhook:owner":
+			hook.Owner = val
+		case "webhook:disabled":
+			hook.Disabled = val == "1"
+		case "webhook:failures":
+			if len(item.Value) == 8 {
+				hook.Failures = int64(binary.BigEndian.Uint64(item.Value))
+			}
+		}
+	}
+	return hook
+}
+
+// incrementWebhookFailures counts one more failed delivery and returns the count.
+func incrementWebhookFailures(ctx context.Context, id string) (int64, error) {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return 0, err
+	}
+	defer bt_client.Close()
+
+	rmw := bigtable.NewReadModifyWrite()
+	rmw.Increment("webhook", "failures", 1)
+	row, err := bt_client.Open(WEBHOOK_TABLE).ApplyReadModifyWrite(ctx, id, rmw)
+	if err != nil {
+		return 0, err
+	}
+	return webhookFromRow(row).Failures, nil
+}
+
+func resetWebhookFailures(ctx context.Context, id string) error {
+	return setWebhookColumn(ctx, id, "failures", make([]byte, 8))
+}
+
+func disableWebhook(ctx context.Context, id string) error {
+	return setWebhookColumn(ctx, id, "disabled", []byte("1"))
+}
+
+func setWebhookColumn(ctx context.Context, id, column string, val []byte) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.Set("webhook", column, bigtable.Now(), val)
+	return bt_client.Open(WEBHOOK_TABLE).Apply(ctx, id, mut)
+}
+
+func deleteWebhook(ctx context.Context, id string) error {
+	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
+	if err != nil {
+		return err
+	}
+	defer bt_client.Close()
+
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	return bt_client.Open(WEBHOOK_TABLE).Apply(ctx, id, mut)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckWebhookURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"http://93.184.216.34/hook", false}, // https only
+		{"https://169.254.169.254/computeMetadata/v1/", false},
+		{"https://localhost/hook", false},
+		{"https://127.0.0.1:8080/hook", false},
+		{"https://10.0.0.5/hook", false},
+		{"https://192.168.1.1/hook", false},
+		{"https://[::1]/hook", false},
+		{"https://[fe80::1]/hook", false},
+		{"https://0.0.0.0/hook", false},
+		{"not a url", false},
+	}
+	for _, tt := range tests {
+		if err := checkWebhookURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.url, err)
+		}
+	}
+}
+
+func TestWebhookClientRefusesInternal(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	// registered when it resolved elsewhere, loopback now
+	if err := postWebhook(&Webhook{Url: srv.URL, Secret: "s"}, []byte("{}")); err == nil {
+		t.Error("delivered to a loopback address")
+	}
+	if called {
+		t.Error("the loopback server was called")
+	}
+}